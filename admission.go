@@ -0,0 +1,96 @@
+package ckit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+	"github.com/rfratto/ckit/peer"
+)
+
+// NotifyAlive implements memberlist.AliveDelegate, rejecting peers which are
+// denied, belong to a different cluster, or aren't admitted by
+// cfg.VersionPolicy or cfg.OnPeerAdmission.
+func (nd *nodeDelegate) NotifyAlive(node *memberlist.Node) error {
+	if node.Name == nd.cfg.Name {
+		return nil
+	}
+	if nd.isDenied(node) {
+		nd.admissionMut.Lock()
+		defer nd.admissionMut.Unlock()
+		return nd.rejectPeer(node.Name, node.Address(), errDenied)
+	}
+	if err := nd.checkClusterName(node); err != nil {
+		nd.admissionMut.Lock()
+		defer nd.admissionMut.Unlock()
+		return nd.rejectPeer(node.Name, node.Address(), err)
+	}
+	if nd.cfg.OnPeerAdmission == nil && nd.cfg.VersionPolicy == nil {
+		return nil
+	}
+
+	nd.peerMut.RLock()
+	existing, known := nd.peers[node.Name]
+	p := nd.nodeToPeer(node)
+	nd.peerMut.RUnlock()
+
+	if known && existing.Addr == p.Addr {
+		// Peer has already been admitted.
+		return nil
+	}
+
+	nd.admissionMut.Lock()
+	defer nd.admissionMut.Unlock()
+
+	if err := nd.admitPeer(p); err != nil {
+		return nd.rejectPeer(p.Name, p.Addr, err)
+	}
+
+	delete(nd.rejectedPeers, p.Name)
+	return nil
+}
+
+// errDenied is used for rejecting peers which are denied.
+var errDenied = errors.New("peer is denied")
+
+// maxClusterNameSize is the maximum length of Config.ClusterName.
+const maxClusterNameSize = 128
+
+// checkClusterName returns an error if node belongs to a different cluster
+// than the local node.
+func (nd *nodeDelegate) checkClusterName(node *memberlist.Node) error {
+	remote := decodeMeta(node.Meta).ClusterName
+	if remote == nd.cfg.ClusterName {
+		return nil
+	}
+	nd.m.clusterNameMismatchesTotal.Inc()
+	return fmt.Errorf("cluster name mismatch: local cluster is %q, peer is in cluster %q", nd.cfg.ClusterName, remote)
+}
+
+// rejectPeer records that the peer with the given name and address was
+// rejected for the provided reason and returns an error to pass to
+// memberlist. Must be called with admissionMut held.
+func (nd *nodeDelegate) rejectPeer(name, addr string, reason error) error {
+	// Only report a rejection the first time we see it; memberlist will
+	// continue to tell us about the peer as it gossips.
+	if nd.rejectedPeers[name] != addr {
+		nd.rejectedPeers[name] = addr
+		nd.m.peersRejectedTotal.Inc()
+		level.Warn(nd.log).Log("msg", "rejected peer", "peer", name, "addr", addr, "err", reason)
+	}
+	return fmt.Errorf("peer %s rejected: %w", name, reason)
+}
+
+// admitPeer returns an error if p should be rejected.
+func (nd *nodeDelegate) admitPeer(p peer.Peer) error {
+	if policy := nd.cfg.VersionPolicy; policy != nil {
+		if err := policy(nd.cfg.Version, p.Version); err != nil {
+			return err
+		}
+	}
+	if admit := nd.cfg.OnPeerAdmission; admit != nil {
+		return admit(p)
+	}
+	return nil
+}
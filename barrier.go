@@ -0,0 +1,105 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/peer"
+)
+
+// barrierLabelPrefix prefixes the label used to announce that a Node has
+// entered a barrier.
+const barrierLabelPrefix = "ckit.barrier/"
+
+// Barrier blocks until at least count peers, including n, have entered the
+// barrier with the given name, or until ctx is canceled. Barriers can be
+// used to align phase changes across the cluster, such as waiting for every
+// node to be ready before starting a schema migration.
+//
+// Entering a barrier is announced to peers with a label, so peers which
+// join late still observe that n entered. n remains in the barrier after
+// Barrier returns so that peers which are still waiting can proceed; call
+// LeaveBarrier once the barrier is no longer needed. Barrier names should be
+// unique for each phase being coordinated, since a name can only be passed
+// once. Calling SetLabels while in a barrier removes n from it.
+//
+// If ctx is canceled before count peers enter the barrier, n leaves the
+// barrier and ctx.Err() is returned.
+func (n *Node) Barrier(ctx context.Context, name string, count int) error {
+	if name == "" {
+		return fmt.Errorf("barrier name must not be empty")
+	} else if count < 1 {
+		return fmt.Errorf("barrier count must be at least 1")
+	}
+	key := barrierLabelPrefix + name
+
+	// withdraw leaves the barrier so peers don't count n as having entered.
+	// We use a new context since ctx may already be canceled.
+	withdraw := func() {
+		leaveCtx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+		defer cancel()
+		if err := n.LeaveBarrier(leaveCtx, name); err != nil {
+			level.Warn(n.log).Log("msg", "failed to leave barrier", "barrier", name, "err", err)
+		}
+	}
+
+	if err := n.ModifyLabels(ctx, func(labels map[string]string) { labels[key] = "entered" }); err != nil {
+		// The label is changed even if waiting for the broadcast failed.
+		withdraw()
+		return fmt.Errorf("failed to enter barrier %q: %w", name, err)
+	}
+
+	reached := make(chan struct{})
+	var once sync.Once
+
+	check := func(peers []peer.Peer) (reregister bool) {
+		var entered int
+		for _, p := range peers {
+			if _, ok := p.Labels[key]; ok {
+				entered++
+			}
+		}
+		if entered < count {
+			return true
+		}
+		once.Do(func() { close(reached) })
+		return false
+	}
+
+	unsubscribe := n.Observe(FuncObserver(check))
+	defer unsubscribe()
+
+	if check(n.Peers()) {
+		level.Debug(n.log).Log("msg", "waiting for peers to enter barrier", "barrier", name, "count", count)
+	}
+
+	select {
+	case <-ctx.Done():
+		withdraw()
+		return fmt.Errorf("waiting for %d peers to enter barrier %q: %w", count, name, ctx.Err())
+	case <-reached:
+		return nil
+	}
+}
+
+// LeaveBarrier removes n from the barrier with the given name. Peers which
+// are still waiting on the barrier will no longer count n as having entered
+// it. Leaving a barrier which n never entered is a no-op.
+func (n *Node) LeaveBarrier(ctx context.Context, name string) error {
+	key := barrierLabelPrefix + name
+	return n.ModifyLabels(ctx, func(labels map[string]string) { delete(labels, key) })
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package ckit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_Barrier(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+		c, _     = newTestNode(t, l, "node-c")
+	)
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	t.Run("blocks until count peers entered", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		done := make(chan error, 2)
+		go func() { done <- a.Barrier(ctx, "phase-1", 3) }()
+		go func() { done <- b.Barrier(ctx, "phase-1", 3) }()
+
+		select {
+		case err := <-done:
+			require.FailNow(t, "barrier returned before every peer entered", "err: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		require.NoError(t, c.Barrier(ctx, "phase-1", 3))
+		require.NoError(t, <-done)
+		require.NoError(t, <-done)
+
+		require.NoError(t, c.LeaveBarrier(ctx, "phase-1"))
+		require.NotContains(t, c.Labels(), barrierLabelPrefix+"phase-1")
+	})
+
+	t.Run("leaves barrier when canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+
+		err := a.Barrier(ctx, "phase-2", 3)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotContains(t, a.Labels(), barrierLabelPrefix+"phase-2")
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		require.EqualError(t, a.Barrier(context.Background(), "", 1), "barrier name must not be empty")
+		require.EqualError(t, a.Barrier(context.Background(), "phase-3", 0), "barrier count must be at least 1")
+	})
+}
@@ -0,0 +1,112 @@
+package ckit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/internal/lamport"
+	"github.com/rfratto/ckit/internal/messages"
+)
+
+// MaxBroadcastSize is the maximum size of a payload passed to Node.Broadcast.
+// Broadcasts are sent over gossip alongside other messages, so payloads
+// should be kept as small as possible.
+const MaxBroadcastSize = 512
+
+// broadcastSeenTTL is how long a received broadcast is remembered for
+// deduplication. It must be longer than the time it takes for a broadcast to
+// finish retransmitting through the cluster.
+const broadcastSeenTTL = time.Minute
+
+// A BroadcastHandler is invoked when a broadcast from a peer is received.
+// from is the name of the peer which sent the broadcast.
+//
+// BroadcastHandlers are invoked while gossip messages are being processed and
+// must not block. payload must not be retained after the handler returns.
+type BroadcastHandler func(from string, payload []byte)
+
+// broadcastID uniquely identifies a user broadcast.
+type broadcastID struct {
+	node string
+	time lamport.Time
+}
+
+// Broadcast sends payload to every peer in the cluster. Peers receive the
+// payload through handlers registered with OnBroadcast. The local node does
+// not receive its own broadcasts.
+//
+// Broadcast returns once the payload has been queued for delivery. Delivery
+// is best-effort: peers which are unreachable while the payload is gossiped
+// will not receive it. payload must be no larger than MaxBroadcastSize.
+func (n *Node) Broadcast(payload []byte) error {
+	if len(payload) > MaxBroadcastSize {
+		return fmt.Errorf("broadcast payload of %d bytes exceeds limit of %d bytes", len(payload), MaxBroadcastSize)
+	}
+
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+	if n.stopped {
+		return ErrStopped
+	}
+
+	msg := messages.User{
+		NodeName: n.cfg.Name,
+		Time:     n.clock.Tick(),
+		Payload:  append([]byte(nil), payload...),
+	}
+	bcast, err := messages.Broadcast(&msg, nil)
+	if err != nil {
+		return err
+	}
+	n.broadcasts.QueueBroadcast(bcast)
+	return nil
+}
+
+// OnBroadcast registers h to be invoked for every broadcast received from a
+// peer. Multiple handlers may be registered; they are invoked in the order
+// they were registered.
+func (n *Node) OnBroadcast(h BroadcastHandler) {
+	n.broadcastMut.Lock()
+	defer n.broadcastMut.Unlock()
+	n.broadcastHandlers = append(n.broadcastHandlers, h)
+}
+
+// handleUserMessage handles a user broadcast received from a peer. Returns
+// true if the message hasn't been seen before.
+func (n *Node) handleUserMessage(msg messages.User) (newMessage bool) {
+	n.clock.Observe(msg.Time)
+
+	if msg.NodeName == n.cfg.Name {
+		// Ignore our own broadcasts being gossiped back to us.
+		return false
+	}
+	if n.isDeniedName(msg.NodeName) {
+		return false
+	}
+
+	n.broadcastMut.Lock()
+	now := time.Now()
+	for id, seen := range n.broadcastsSeen {
+		if now.Sub(seen) > broadcastSeenTTL {
+			delete(n.broadcastsSeen, id)
+		}
+	}
+
+	id := broadcastID{node: msg.NodeName, time: msg.Time}
+	if _, seen := n.broadcastsSeen[id]; seen {
+		n.broadcastMut.Unlock()
+		return false
+	}
+	n.broadcastsSeen[id] = now
+
+	handlers := make([]BroadcastHandler, len(n.broadcastHandlers))
+	copy(handlers, n.broadcastHandlers)
+	n.broadcastMut.Unlock()
+
+	level.Debug(n.log).Log("msg", "received broadcast", "broadcast", msg)
+	for _, h := range handlers {
+		h(msg.NodeName, msg.Payload)
+	}
+	return true
+}
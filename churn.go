@@ -0,0 +1,69 @@
+package ckit
+
+import (
+	"sort"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+)
+
+// KeyspaceChurn reports how ownership of the keyspace changed across a
+// sequence of membership changes, such as to review how much data moved
+// during a rollout. initial is the set of peers before the first change.
+// Each element of changes is a batch of events which happened together,
+// such as the events passed to an EventObserver or a group of entries
+// returned by GroupHistory. Ownership is compared after each batch.
+//
+// newSharder must return a new, empty Sharder configured the same way as the
+// Sharder being analyzed. See shard.Churn for how ownership is determined.
+func KeyspaceChurn(newSharder func() shard.Sharder, initial []peer.Peer, changes [][]Event, sampler shard.KeySampler) shard.ChurnReport {
+	var (
+		peers    = make(map[string]peer.Peer, len(initial))
+		peerSets = make([][]peer.Peer, 0, len(changes)+1)
+	)
+	for _, p := range initial {
+		peers[p.Name] = p
+	}
+	peerSets = append(peerSets, sortedPeers(peers))
+
+	for _, events := range changes {
+		for _, e := range events {
+			switch e := e.(type) {
+			case PeerJoined:
+				peers[e.Peer.Name] = e.Peer
+			case PeerLeft:
+				delete(peers, e.Peer.Name)
+			case PeerStateChanged:
+				peers[e.Peer.Name] = e.Peer
+			case PeerUpdated:
+				peers[e.New.Name] = e.New
+			}
+		}
+		peerSets = append(peerSets, sortedPeers(peers))
+	}
+
+	return shard.Churn(newSharder, peerSets, sampler)
+}
+
+// GroupHistory groups consecutive history entries which were observed
+// together into batches of events for KeyspaceChurn.
+func GroupHistory(entries []HistoryEntry) [][]Event {
+	var res [][]Event
+	for i, e := range entries {
+		if i > 0 && entries[i-1].LamportTime == e.LamportTime && entries[i-1].Time.Equal(e.Time) {
+			res[len(res)-1] = append(res[len(res)-1], e.Event)
+			continue
+		}
+		res = append(res, []Event{e.Event})
+	}
+	return res
+}
+
+func sortedPeers(peers map[string]peer.Peer) []peer.Peer {
+	res := make([]peer.Peer, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
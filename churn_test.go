@@ -0,0 +1,51 @@
+package ckit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspaceChurn(t *testing.T) {
+	var (
+		a = peer.Peer{Name: "node-a", State: peer.StateParticipant}
+		b = peer.Peer{Name: "node-b", State: peer.StateParticipant}
+
+		now     = time.Now()
+		history = []HistoryEntry{
+			{Time: now, LamportTime: 1, Event: PeerJoined{Peer: b}},
+			{Time: now.Add(time.Second), LamportTime: 2, Event: PeerStateChanged{Peer: peer.Peer{Name: "node-a", State: peer.StateTerminating}, Old: peer.StateParticipant, New: peer.StateTerminating}},
+			{Time: now.Add(2 * time.Second), LamportTime: 3, Event: PeerLeft{Peer: b}},
+			{Time: now.Add(2 * time.Second), LamportTime: 3, Event: PeerJoined{Peer: peer.Peer{Name: "node-c", State: peer.StateParticipant}}},
+		}
+	)
+
+	changes := GroupHistory(history)
+	require.Len(t, changes, 3)
+	require.Len(t, changes[2], 2)
+
+	report := KeyspaceChurn(
+		func() shard.Sharder { return shard.Rendezvous() },
+		[]peer.Peer{a},
+		changes,
+		shard.UniformKeys(1_000),
+	)
+	require.Len(t, report.Steps, 3)
+
+	byName := make(map[string]shard.PeerChurn)
+	for _, pc := range report.Peers {
+		byName[pc.Name] = pc
+	}
+
+	// node-b takes part of the keyspace from node-a, then every key when
+	// node-a is no longer a Participant.
+	require.Greater(t, byName["node-b"].Gained[0], 0.0)
+	require.InDelta(t, byName["node-a"].Lost[0]+byName["node-a"].Lost[1], 1, 1e-9)
+
+	// Every key moves from node-b to node-c.
+	require.InDelta(t, 1, byName["node-b"].Lost[2], 1e-9)
+	require.InDelta(t, 1, byName["node-c"].Gained[2], 1e-9)
+}
@@ -0,0 +1,167 @@
+package clientpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ErrDialBackoff is returned by Get when a previous dial to an address failed
+// and its backoff hasn't elapsed yet.
+var ErrDialBackoff = errors.New("waiting to retry failed dial")
+
+// errConnectFailed is recorded as the dial error of a connection which was
+// dialed but failed to connect.
+var errConnectFailed = errors.New("failed to connect")
+
+// defaultDialMaxBackoff is the default value of Options.DialMaxBackoff.
+const defaultDialMaxBackoff = time.Minute
+
+// dialBackoff is the backoff of a single address.
+type dialBackoff struct {
+	failures int       // Consecutive failed dials
+	retryAt  time.Time // Time after which dialing may be retried
+	lastErr  error     // Error from the most recent dial
+}
+
+// dialBackoffs tracks addresses which recently failed to dial. Addresses
+// whose most recent dial succeeded have no entry. A nil *dialBackoffs never
+// delays dialing.
+type dialBackoffs struct {
+	min, max time.Duration
+	now      func() time.Time
+	jitter   func(time.Duration) time.Duration
+
+	mut   sync.Mutex
+	peers map[string]*dialBackoff
+}
+
+func newDialBackoffs(o Options) *dialBackoffs {
+	if o.DialMinBackoff == 0 {
+		return nil
+	}
+	return &dialBackoffs{
+		min:    o.DialMinBackoff,
+		max:    o.DialMaxBackoff,
+		now:    time.Now,
+		jitter: halfJitter,
+
+		peers: make(map[string]*dialBackoff),
+	}
+}
+
+// halfJitter returns a random duration in the range [d/2, d).
+func halfJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// wait returns an error wrapping ErrDialBackoff if addr may not be dialed
+// yet.
+func (b *dialBackoffs) wait(addr string) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	bo, ok := b.peers[addr]
+	if !ok || !b.now().Before(bo.retryAt) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w (last error: %s)", addr, ErrDialBackoff, bo.lastErr)
+}
+
+// report records the result of dialing addr. A failed dial doubles the
+// backoff of addr, from the minimum up to the maximum backoff. A successful
+// dial resets it.
+func (b *dialBackoffs) report(addr string, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	bo, ok := b.peers[addr]
+	if err == nil {
+		delete(b.peers, addr)
+		return
+	}
+	if !ok {
+		bo = &dialBackoff{}
+		b.peers[addr] = bo
+	}
+
+	backoff := b.min
+	for i := 0; i < bo.failures && backoff < b.max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.max {
+		backoff = b.max
+	}
+
+	bo.failures++
+	bo.retryAt = b.now().Add(b.jitter(backoff))
+	bo.lastErr = err
+}
+
+// watch reports the result of dialing addr once cc either connects or fails
+// to connect. Unless grpc.WithBlock is used, dialing returns before the
+// connection is established, so connection failures are only visible in the
+// state of cc.
+//
+// If cc fails to connect, it is closed so that the next Get for addr dials
+// again, waiting for the backoff, rather than reusing cc.
+func (b *dialBackoffs) watch(addr string, cc *grpc.ClientConn) {
+	if b == nil {
+		return
+	}
+
+	go func() {
+		for {
+			state := cc.GetState()
+			switch state {
+			case connectivity.Ready:
+				b.report(addr, nil)
+				return
+			case connectivity.TransientFailure:
+				b.report(addr, errConnectFailed)
+				_ = cc.Close()
+				return
+			case connectivity.Shutdown:
+				return
+			}
+			cc.WaitForStateChange(context.Background(), state)
+		}
+	}()
+}
+
+// active returns the number of addresses which may not be dialed yet.
+func (b *dialBackoffs) active() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	var n int
+	now := b.now()
+	for _, bo := range b.peers {
+		if now.Before(bo.retryAt) {
+			n++
+		}
+	}
+	return n
+}
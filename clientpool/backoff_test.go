@@ -0,0 +1,100 @@
+package clientpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func Test_dialBackoffs(t *testing.T) {
+	var (
+		now = time.Now()
+		b   = newDialBackoffs(Options{DialMinBackoff: time.Second, DialMaxBackoff: 3 * time.Second})
+
+		dialErr = fmt.Errorf("dial failed")
+	)
+	b.now = func() time.Time { return now }
+	b.jitter = func(d time.Duration) time.Duration { return d }
+
+	require.NoError(t, b.wait("a"))
+
+	// The backoff doubles for every failed dial, up to the maximum.
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		b.report("a", dialErr)
+		require.True(t, errors.Is(b.wait("a"), ErrDialBackoff))
+		require.NoError(t, b.wait("b"), "unrelated address should be allowed")
+		require.Equal(t, 1, b.active())
+
+		now = now.Add(backoff - time.Millisecond)
+		require.True(t, errors.Is(b.wait("a"), ErrDialBackoff))
+
+		now = now.Add(time.Millisecond)
+		require.NoError(t, b.wait("a"))
+		require.Equal(t, 0, b.active())
+	}
+
+	// A successful dial resets the backoff.
+	b.report("a", nil)
+	require.Empty(t, b.peers)
+	b.report("a", dialErr)
+	now = now.Add(time.Second)
+	require.NoError(t, b.wait("a"))
+}
+
+func Test_halfJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := halfJitter(time.Second)
+		require.True(t, d >= 500*time.Millisecond && d < time.Second, "unexpected jitter %s", d)
+	}
+}
+
+func TestPool_DialBackoff(t *testing.T) {
+	opts := DefaultOptions
+	opts.DialMinBackoff = time.Hour
+
+	p, err := New(opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	// Find an address which refuses connections.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	// Dialing doesn't block, so the first Get succeeds and the connection
+	// fails in the background.
+	cc, err := p.Get(context.Background(), addr, grpc.WithInsecure())
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return cc.GetState() == connectivity.Shutdown
+	}, 5*time.Second, 10*time.Millisecond, "failed connection should be closed")
+
+	_, err = p.Get(context.Background(), addr, grpc.WithInsecure())
+	require.True(t, errors.Is(err, ErrDialBackoff), "unexpected error %v", err)
+}
+
+func TestPool_DialBackoff_DialError(t *testing.T) {
+	opts := DefaultOptions
+	opts.DialMinBackoff = time.Hour
+
+	// Dialing fails without any transport security configured.
+	p, err := New(opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	_, err = p.Get(context.Background(), "127.0.0.1:12345")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrDialBackoff))
+
+	_, err = p.Get(context.Background(), "127.0.0.1:12345")
+	require.True(t, errors.Is(err, ErrDialBackoff))
+}
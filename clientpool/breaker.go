@@ -0,0 +1,216 @@
+package clientpool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned by Get when the circuit breaker for an address
+// is open. RPCs made through pooled connections fail with the Unavailable
+// code instead.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// defaultBreakerCooldown is the default value of Options.BreakerCooldown.
+const defaultBreakerCooldown = 10 * time.Second
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Requests are allowed.
+	breakerOpen                         // Requests fail fast until the cooldown ends.
+	breakerHalfOpen                     // A single trial request is allowed.
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return fmt.Sprintf("<unknown state %d>", s)
+	}
+}
+
+// breaker is the circuit breaker of a single address.
+type breaker struct {
+	state    breakerState
+	failures int       // Consecutive failures
+	openedAt time.Time // When the breaker last opened
+	trial    bool      // True if a trial request is in flight while half-open
+}
+
+// breakers tracks the circuit breaker of every address with recent
+// failures. Addresses without failures have no entry. A nil *breakers
+// allows every request.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+	m         *metrics
+	now       func() time.Time
+
+	mut   sync.Mutex
+	peers map[string]*breaker
+}
+
+func newBreakers(o Options, m *metrics) *breakers {
+	if o.BreakerThreshold == 0 {
+		return nil
+	}
+	return &breakers{
+		threshold: o.BreakerThreshold,
+		cooldown:  o.BreakerCooldown,
+		m:         m,
+		now:       time.Now,
+
+		peers: make(map[string]*breaker),
+	}
+}
+
+// open returns an error wrapping ErrCircuitOpen if the breaker of addr is
+// open and its cooldown hasn't ended.
+func (b *breakers) open(addr string) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	br, ok := b.peers[addr]
+	if ok && br.state == breakerOpen && b.now().Sub(br.openedAt) < b.cooldown {
+		b.m.breakerRejectionsTotal.WithLabelValues(b.m.peer(addr)).Inc()
+		return fmt.Errorf("%s: %w", addr, ErrCircuitOpen)
+	}
+	return nil
+}
+
+// allow returns an error wrapping ErrCircuitOpen if a request to addr should
+// fail fast. Once the cooldown of an open breaker ends, allow lets a single
+// trial request through, for which probe is true. The result of every
+// allowed request must be passed to reportRPC along with probe.
+func (b *breakers) allow(addr string) (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	br, ok := b.peers[addr]
+	if !ok {
+		return false, nil
+	}
+
+	switch {
+	case br.state == breakerOpen && b.now().Sub(br.openedAt) >= b.cooldown:
+		b.setState(br, breakerHalfOpen)
+		br.trial = true
+		return true, nil
+	case br.state == breakerHalfOpen && !br.trial:
+		br.trial = true
+		return true, nil
+	case br.state == breakerClosed:
+		return false, nil
+	default:
+		b.m.breakerRejectionsTotal.WithLabelValues(b.m.peer(addr)).Inc()
+		return false, fmt.Errorf("%s: %w", addr, ErrCircuitOpen)
+	}
+}
+
+// reportRPC records the result of an RPC to addr. Only errors which
+// indicate that addr is unreachable count as failures; other errors mean the
+// server responded.
+func (b *breakers) reportRPC(addr string, probe bool, err error) {
+	switch status.Code(err) {
+	case codes.Canceled:
+		// The caller gave up, which says nothing about addr.
+		b.release(addr, probe)
+	case codes.Unavailable, codes.DeadlineExceeded:
+		b.report(addr, probe, true)
+	default:
+		b.report(addr, probe, false)
+	}
+}
+
+// report records whether a request to addr failed. probe must be true if
+// the request was the trial request of a half-open breaker.
+//
+// Only the result of the trial request changes the state of a breaker which
+// isn't closed; requests which started before the breaker opened are
+// ignored.
+func (b *breakers) report(addr string, probe, failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	br, ok := b.peers[addr]
+	if !failed {
+		switch {
+		case !ok:
+		case br.state == breakerClosed:
+			// Reset the consecutive failures.
+			delete(b.peers, addr)
+		case br.state == breakerHalfOpen && probe:
+			b.setState(br, breakerClosed)
+			delete(b.peers, addr)
+		}
+		return
+	}
+
+	if !ok {
+		br = &breaker{}
+		b.peers[addr] = br
+	}
+
+	switch {
+	case br.state == breakerClosed:
+		br.failures++
+		if br.failures >= b.threshold {
+			b.setState(br, breakerOpen)
+			br.openedAt = b.now()
+		}
+	case br.state == breakerHalfOpen && probe:
+		br.trial = false
+		b.setState(br, breakerOpen)
+		br.openedAt = b.now()
+	}
+}
+
+// release allows another trial request to addr without recording a result.
+// release does nothing unless probe is true.
+func (b *breakers) release(addr string, probe bool) {
+	if b == nil || !probe {
+		return
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if br, ok := b.peers[addr]; ok {
+		br.trial = false
+	}
+}
+
+// setState transitions br to state. b.mut must be held.
+func (b *breakers) setState(br *breaker, state breakerState) {
+	if br.state == state {
+		return
+	}
+	if br.state != breakerClosed {
+		b.m.breakerStates.WithLabelValues(br.state.String()).Dec()
+	}
+	if state != breakerClosed {
+		b.m.breakerStates.WithLabelValues(state.String()).Inc()
+	}
+	br.state = state
+}
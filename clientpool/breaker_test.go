@@ -0,0 +1,114 @@
+package clientpool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func Test_breakers(t *testing.T) {
+	var (
+		now = time.Now()
+		b   = newBreakers(Options{BreakerThreshold: 2, BreakerCooldown: time.Minute}, newMetrics(Options{}))
+
+		unavailable = status.Error(codes.Unavailable, "unavailable")
+		notFound    = status.Error(codes.NotFound, "not found")
+	)
+	b.now = func() time.Time { return now }
+
+	allow := func(addr string) bool {
+		t.Helper()
+		probe, err := b.allow(addr)
+		require.NoError(t, err)
+		return probe
+	}
+	rejected := func(addr string) bool {
+		_, err := b.allow(addr)
+		return errors.Is(err, ErrCircuitOpen)
+	}
+
+	// Consecutive failures open the breaker.
+	require.False(t, allow("a"))
+	b.reportRPC("a", false, unavailable)
+	b.reportRPC("a", false, nil)
+	b.reportRPC("a", false, unavailable)
+	require.False(t, allow("a"))
+	b.reportRPC("a", false, unavailable)
+
+	require.True(t, rejected("a"))
+	require.True(t, errors.Is(b.open("a"), ErrCircuitOpen))
+	require.False(t, allow("b"), "unrelated address should be allowed")
+
+	// Requests which were in flight before the breaker opened don't close it.
+	b.reportRPC("a", false, nil)
+	require.True(t, rejected("a"))
+
+	// After the cooldown, a single trial request is allowed. A failed trial
+	// opens the breaker again.
+	now = now.Add(time.Minute)
+	require.NoError(t, b.open("a"))
+	require.True(t, allow("a"))
+	require.True(t, rejected("a"), "only one trial should be allowed")
+	b.reportRPC("a", true, unavailable)
+	require.True(t, rejected("a"))
+
+	// A canceled trial allows another trial.
+	now = now.Add(time.Minute)
+	require.True(t, allow("a"))
+	b.reportRPC("a", true, status.Error(codes.Canceled, "canceled"))
+	require.True(t, allow("a"))
+
+	// Only the trial closes a half-open breaker.
+	b.reportRPC("a", false, nil)
+	require.True(t, rejected("a"))
+
+	// A response from the server closes the breaker, even if it's an error.
+	b.reportRPC("a", true, notFound)
+	require.False(t, allow("a"))
+	require.False(t, allow("a"))
+	require.Empty(t, b.peers)
+}
+
+func TestPool_CircuitBreaker(t *testing.T) {
+	// Get an address which nothing listens on.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	opts := DefaultOptions
+	opts.BreakerThreshold = 2
+	opts.BreakerCooldown = time.Hour
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer p.Close()
+
+	cc, err := p.Get(context.Background(), addr)
+	require.NoError(t, err)
+
+	check := func() error {
+		_, err := grpc_health_v1.NewHealthClient(cc).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		err := check()
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.False(t, strings.Contains(err.Error(), ErrCircuitOpen.Error()), "breaker opened too early")
+	}
+
+	err = check()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Contains(t, err.Error(), ErrCircuitOpen.Error())
+
+	_, err = p.Get(context.Background(), addr)
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+}
@@ -7,6 +7,7 @@ import (
 
 type metrics struct {
 	container metricsutil.Container
+	peers     *metricsutil.PeerLabeler
 
 	currentConns prometheus.Gauge
 	gcActive     prometheus.Gauge
@@ -14,6 +15,11 @@ type metrics struct {
 	eventsTotal  *prometheus.CounterVec
 	lookupsTotal *prometheus.CounterVec
 
+	healthChecksTotal *prometheus.CounterVec
+
+	breakerStates          *prometheus.GaugeVec
+	breakerRejectionsTotal *prometheus.CounterVec
+
 	maxConns  prometheus.Gauge
 	autoClose prometheus.Gauge
 }
@@ -21,7 +27,7 @@ type metrics struct {
 var _ prometheus.Collector = (*metrics)(nil)
 
 func newMetrics(o Options) *metrics {
-	var m metrics
+	m := metrics{peers: metricsutil.NewPeerLabeler(o.PeerLabelLimit)}
 
 	m.currentConns = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "clientpool_conns",
@@ -39,11 +45,25 @@ func newMetrics(o Options) *metrics {
 	m.eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "clientpool_events_total",
 		Help: "Total number of times connections were opened or closed.",
-	}, []string{"event"})
+	}, []string{"peer", "event"})
 	m.lookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "clientpool_lookups_total",
-		Help: "Total number of lookups for a connection. result will be one of: success, error_dial, error_max_conns, or error_other.",
-	}, []string{"result"})
+		Help: "Total number of lookups for a connection. result will be one of: success, error_dial, error_max_conns, error_circuit_open, error_dial_backoff, or error_other.",
+	}, []string{"peer", "result"})
+
+	m.healthChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clientpool_health_checks_total",
+		Help: "Total number of health checks run against connections. result will be one of: serving, not_serving, unimplemented, or error.",
+	}, []string{"peer", "result"})
+
+	m.breakerStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clientpool_circuit_breakers",
+		Help: "Current number of addresses whose circuit breaker is not closed. state will be one of: open or half_open.",
+	}, []string{"state"})
+	m.breakerRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clientpool_circuit_breaker_rejections_total",
+		Help: "Total number of lookups and RPCs which failed fast because a circuit breaker was open.",
+	}, []string{"peer"})
 
 	m.maxConns = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "clientpool_max_conns",
@@ -65,6 +85,9 @@ func newMetrics(o Options) *metrics {
 		m.gcTotal,
 		m.eventsTotal,
 		m.lookupsTotal,
+		m.healthChecksTotal,
+		m.breakerStates,
+		m.breakerRejectionsTotal,
 		m.maxConns,
 		m.autoClose,
 	)
@@ -72,6 +95,12 @@ func newMetrics(o Options) *metrics {
 	return &m
 }
 
+// peer returns the value of the peer label for addr. The peer label is empty
+// unless Options.PeerLabelLimit is set.
+func (m *metrics) peer(addr string) string {
+	return m.peers.Label(addr)
+}
+
 func boolToFloat64(b bool) float64 {
 	if b {
 		return 1
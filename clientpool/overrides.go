@@ -0,0 +1,81 @@
+package clientpool
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// DialOverride configures dial options for connections to specific
+// addresses.
+type DialOverride struct {
+	// Match is the set of addresses the override applies to. Match may be an
+	// exact address passed to Get (such as "localhost:12946"), a host which
+	// matches addresses with any port (such as "localhost"), or a CIDR which
+	// matches addresses with an IP in the range (such as "10.0.0.0/8").
+	Match string
+
+	// DialOptions are appended to the default dial options of the pool when
+	// dialing a matching address. Options which configure the same setting,
+	// such as transport credentials, take precedence over the default dial
+	// options.
+	DialOptions []grpc.DialOption
+}
+
+// dialOverride is a parsed DialOverride.
+type dialOverride struct {
+	match   string
+	network *net.IPNet // Set if match is a CIDR
+	opts    []grpc.DialOption
+}
+
+func parseDialOverrides(overrides []DialOverride) ([]dialOverride, error) {
+	res := make([]dialOverride, 0, len(overrides))
+	for _, o := range overrides {
+		do := dialOverride{match: o.Match, opts: o.DialOptions}
+		switch {
+		case o.Match == "":
+			return nil, fmt.Errorf("DialOverride must have a non-empty Match")
+		case strings.Contains(o.Match, "/"):
+			_, network, err := net.ParseCIDR(o.Match)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DialOverride %q: %w", o.Match, err)
+			}
+			do.network = network
+		}
+		res = append(res, do)
+	}
+	return res, nil
+}
+
+// matches returns true if o applies to addr.
+func (o dialOverride) matches(addr string) bool {
+	if addr == o.match {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// addr doesn't have a port.
+		host = addr
+	}
+	if o.network == nil {
+		return host == o.match
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && o.network.Contains(ip)
+}
+
+// overrideDialOpts returns the dial options of every override which applies
+// to addr, in the order the overrides were given.
+func (p *Pool) overrideDialOpts(addr string) []grpc.DialOption {
+	var res []grpc.DialOption
+	for _, o := range p.overrides {
+		if o.matches(addr) {
+			res = append(res, o.opts...)
+		}
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+package clientpool
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func Test_dialOverride_matches(t *testing.T) {
+	tt := []struct {
+		match  string
+		addr   string
+		expect bool
+	}{
+		{match: "localhost:80", addr: "localhost:80", expect: true},
+		{match: "localhost:80", addr: "localhost:81", expect: false},
+		{match: "localhost", addr: "localhost:80", expect: true},
+		{match: "localhost", addr: "localhost", expect: true},
+		{match: "localhost", addr: "remote:80", expect: false},
+		{match: "10.0.0.0/8", addr: "10.1.2.3:80", expect: true},
+		{match: "10.0.0.0/8", addr: "10.1.2.3", expect: true},
+		{match: "10.0.0.0/8", addr: "11.1.2.3:80", expect: false},
+		{match: "10.0.0.0/8", addr: "localhost:80", expect: false},
+		{match: "::1/128", addr: "[::1]:80", expect: true},
+	}
+
+	for _, tc := range tt {
+		overrides, err := parseDialOverrides([]DialOverride{{Match: tc.match}})
+		require.NoError(t, err)
+		require.Equal(t, tc.expect, overrides[0].matches(tc.addr), "match %q, addr %q", tc.match, tc.addr)
+	}
+}
+
+func Test_parseDialOverrides_Invalid(t *testing.T) {
+	_, err := parseDialOverrides([]DialOverride{{Match: "10.0.0.0/99"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid DialOverride "10.0.0.0/99"`)
+
+	_, err = parseDialOverrides([]DialOverride{{Match: ""}})
+	require.Error(t, err)
+}
+
+func TestPool_DialOverrides(t *testing.T) {
+	server := newTestServer(t)
+	_, port, err := net.SplitHostPort(server)
+	require.NoError(t, err)
+
+	opts := DefaultOptions
+	opts.DialOverrides = []DialOverride{{
+		Match:       "127.0.0.0/8",
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+	}}
+
+	// The pool has no default transport credentials, so only addresses which
+	// match the override can be dialed.
+	p, err := New(opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	_, err = p.Get(context.Background(), server)
+	require.NoError(t, err)
+
+	_, err = p.Get(context.Background(), net.JoinHostPort("localhost", port))
+	require.Error(t, err)
+}
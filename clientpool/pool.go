@@ -7,25 +7,36 @@ package clientpool
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sort"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/hashicorp/go-multierror"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // Options configures options for the client pool.
 type Options struct {
-	// Optional logging interface.
+	// Optional logging interface. Use ckit.NewSlogLogger to log to a
+	// *slog.Logger.
 	Log log.Logger
 
 	// Time a connection must be unused for before it's considered stale.
+	// Stale connections are closed every StaleCleanupFrequency, regardless
+	// of whether MaxClients has been reached. A connection is used by any
+	// RPC or stream message sent through it.
 	StaleTime time.Duration
 
 	// Frequency at which stale connections should be removed.
@@ -40,8 +51,115 @@ type Options struct {
 	//
 	// If this is false, no new clients can be generated past MaxClients.
 	CleanupLRU bool
+
+	// HealthCheckFrequency, if non-zero, is how often the standard gRPC
+	// health checking protocol is run against every connection in the pool.
+	// Connections whose server reports that it isn't serving or doesn't
+	// respond within HealthCheckTimeout are closed, so the next call to Get
+	// for the address dials a new connection. Servers which don't implement
+	// the health service are treated as healthy.
+	//
+	// Health checks don't count as using a connection for StaleTime.
+	HealthCheckFrequency time.Duration
+
+	// HealthCheckTimeout is the maximum time to wait for a health check
+	// response. Defaults to 5 seconds.
+	HealthCheckTimeout time.Duration
+
+	// DialOverrides configures additional dial options for specific
+	// addresses, such as to use plaintext for localhost and TLS for everything
+	// else. The dial options of every matching override are applied in order
+	// after the default dial options and before the dial options passed to
+	// Get.
+	DialOverrides []DialOverride
+
+	// Dialer, if set, is used to create the network connections for new
+	// clients, such as to connect over unix sockets or to in-memory listeners
+	// in tests. addr is the address passed to Get. Dial options passed to New
+	// or Get which set a dialer take precedence.
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// BreakerThreshold, if non-zero, enables a circuit breaker for each
+	// address which opens after BreakerThreshold consecutive failures. A
+	// failure is a failed dial or an RPC which failed with the Unavailable or
+	// DeadlineExceeded codes.
+	//
+	// While the breaker of an address is open, Get returns ErrCircuitOpen
+	// and RPCs made through its connection fail immediately with the
+	// Unavailable code. Once BreakerCooldown elapses, a single trial RPC is
+	// allowed: the breaker closes if it succeeds, and opens again otherwise.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long a circuit breaker stays open before a trial
+	// RPC is allowed. Defaults to 10 seconds.
+	BreakerCooldown time.Duration
+
+	// DialMinBackoff, if non-zero, delays dialing an address again after a
+	// dial to it failed. Until the backoff elapses, Get returns
+	// ErrDialBackoff for the address instead of dialing it. The backoff
+	// doubles from DialMinBackoff up to DialMaxBackoff for every consecutive
+	// failed dial, with random jitter applied so that callers don't retry in
+	// lockstep.
+	//
+	// A dial fails if it returns an error or if the new connection fails to
+	// connect before becoming ready. Connections which fail to connect are
+	// closed, so Get may return a connection which is closed shortly
+	// afterwards.
+	DialMinBackoff time.Duration
+
+	// DialMaxBackoff is the maximum backoff after a failed dial. Defaults to
+	// 1 minute. Ignored if DialMinBackoff is 0.
+	DialMaxBackoff time.Duration
+
+	// TransportCredentials, if set, is called every time a new connection is
+	// dialed to get the transport credentials to use for it. This allows
+	// rotated certificates to be used for new connections without
+	// recreating the pool; call Redial after rotating certificates to replace
+	// existing connections. Dial options passed to New or Get which set
+	// transport credentials take precedence, and must not include
+	// grpc.WithInsecure.
+	//
+	// Alternatively, credentials created with credentials.NewTLS from a
+	// tls.Config which sets GetClientCertificate evaluate the client
+	// certificate for every handshake.
+	TransportCredentials func() credentials.TransportCredentials
+
+	// OnConnClosed, if set, is called whenever a connection is removed from
+	// the pool, so that applications holding clients derived from the
+	// connection can discard them. reason describes why the connection was
+	// removed.
+	//
+	// OnConnClosed is called while the pool is locked; it must not block or
+	// call methods of the Pool.
+	OnConnClosed func(addr string, reason CloseReason)
+
+	// MaxConnAge, if non-zero, is the maximum age of a connection. Once a
+	// connection is older than MaxConnAge, the next call to Get for its
+	// address dials a replacement connection, such as to rebalance across
+	// load balancers or to pick up new credentials. The old connection is
+	// removed from the pool but only closed after MaxConnAgeGrace, allowing
+	// RPCs in progress to finish. If the replacement can't be dialed, the old
+	// connection continues to be used.
+	MaxConnAge time.Duration
+
+	// MaxConnAgeGrace is how long connections replaced because of MaxConnAge
+	// are kept open before being closed. Defaults to 30 seconds.
+	MaxConnAgeGrace time.Duration
+
+	// PeerLabelLimit, if non-zero, labels the clientpool_*_total metrics by
+	// the address of the peer with the peer label. At most PeerLabelLimit
+	// distinct addresses are used as label values; lookups for any other
+	// address are labeled as "other".
+	PeerLabelLimit int
 }
 
+// defaultHealthCheckTimeout is the default value of
+// Options.HealthCheckTimeout.
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// defaultMaxConnAgeGrace is the default value of Options.MaxConnAgeGrace.
+const defaultMaxConnAgeGrace = 30 * time.Second
+
 // DefaultOptions holds default options for creating client pools.
 var DefaultOptions = Options{
 	StaleTime:             30 * time.Second,
@@ -50,25 +168,94 @@ var DefaultOptions = Options{
 	CleanupLRU:            true,
 }
 
+// CloseReason describes why a connection was removed from a Pool.
+type CloseReason int
+
+const (
+	// CloseReasonStale is used for connections which went unused for longer
+	// than Options.StaleTime.
+	CloseReasonStale CloseReason = iota
+
+	// CloseReasonEvicted is used for the least recently used connection when
+	// it was closed to make room for a new connection.
+	CloseReasonEvicted
+
+	// CloseReasonUnhealthy is used for connections which failed a health
+	// check.
+	CloseReasonUnhealthy
+
+	// CloseReasonShutdown is used for connections which were found to be
+	// closed outside of the pool.
+	CloseReasonShutdown
+
+	// CloseReasonMaxAge is used for connections which were replaced because
+	// they were older than Options.MaxConnAge. The connection is closed after
+	// Options.MaxConnAgeGrace.
+	CloseReasonMaxAge
+
+	// CloseReasonRedial is used for connections closed by Pool.Redial.
+	CloseReasonRedial
+
+	// CloseReasonPoolClosed is used for connections closed by Pool.Close.
+	CloseReasonPoolClosed
+)
+
+// String returns the string representation of r.
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonStale:
+		return "stale"
+	case CloseReasonEvicted:
+		return "evicted"
+	case CloseReasonUnhealthy:
+		return "unhealthy"
+	case CloseReasonShutdown:
+		return "shutdown"
+	case CloseReasonMaxAge:
+		return "max_age"
+	case CloseReasonRedial:
+		return "redial"
+	case CloseReasonPoolClosed:
+		return "pool_closed"
+	default:
+		return fmt.Sprintf("<unknown reason %d>", r)
+	}
+}
+
 // Pool manages a set of clients.
 type Pool struct {
-	log      log.Logger
-	dialOpts []grpc.DialOption
-	opts     Options
-	m        *metrics
+	log       log.Logger
+	dialOpts  []grpc.DialOption
+	overrides []dialOverride
+	opts      Options
+	m         *metrics
+	breakers  *breakers
+	backoffs  *dialBackoffs
+
+	// Connections are split across shards by address. No goroutine may hold
+	// more than one shard lock at a time, and shard locks are never held
+	// while dialing.
+	shards   []*shard
+	numConns atomic.Int64 // Connections in the pool
+	slots    atomic.Int64 // Connections in the pool plus in-flight dials
+	closed   atomic.Bool
 
-	clientsMut    sync.RWMutex
-	clients       map[string]*client
-	reverseLookup map[*grpc.ClientConn]*client
-	closed        bool
+	// dialMut serializes operations on the whole pool (Redial and Close).
+	dialMut sync.Mutex
+
+	// Connections replaced because of MaxConnAge which haven't been closed
+	// yet.
+	retiredMut sync.Mutex
+	retired    map[*client]*time.Timer
 
 	exited    chan struct{}
 	cancelRun context.CancelFunc
 }
 
 type client struct {
-	Addr string
-	Conn *grpc.ClientConn
+	Addr    string
+	Conn    *grpc.ClientConn
+	Created time.Time
 
 	Mutex    sync.Mutex
 	LastUsed time.Time
@@ -80,10 +267,15 @@ func (c *client) updateLastUsed() {
 	c.LastUsed = time.Now()
 }
 
+func (c *client) lastUsed() time.Time {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.LastUsed
+}
+
 // New creats a new Pool. An error will be returned if the options are invalid.
 // The set of defaultDialOpts will be used when opening new connections.
 //
-//
 // Call Close to close the pool.
 func New(opts Options, defaultDialOpts ...grpc.DialOption) (*Pool, error) {
 	// Validations
@@ -94,6 +286,37 @@ func New(opts Options, defaultDialOpts ...grpc.DialOption) (*Pool, error) {
 		return nil, fmt.Errorf("StaleCleanupFrequency must be greater than 0")
 	case opts.MaxClients < 0:
 		return nil, fmt.Errorf("MaxClients must be greater or equal to 0")
+	case opts.HealthCheckFrequency < 0 || opts.HealthCheckTimeout < 0:
+		return nil, fmt.Errorf("HealthCheckFrequency and HealthCheckTimeout must be greater or equal to 0")
+	case opts.BreakerThreshold < 0 || opts.BreakerCooldown < 0:
+		return nil, fmt.Errorf("BreakerThreshold and BreakerCooldown must be greater or equal to 0")
+	case opts.DialMinBackoff < 0 || opts.DialMaxBackoff < 0:
+		return nil, fmt.Errorf("DialMinBackoff and DialMaxBackoff must be greater or equal to 0")
+	case opts.MaxConnAge < 0 || opts.MaxConnAgeGrace < 0:
+		return nil, fmt.Errorf("MaxConnAge and MaxConnAgeGrace must be greater or equal to 0")
+	case opts.PeerLabelLimit < 0:
+		return nil, fmt.Errorf("PeerLabelLimit must be greater or equal to 0")
+	}
+	if opts.DialMinBackoff > 0 {
+		if opts.DialMaxBackoff == 0 {
+			opts.DialMaxBackoff = defaultDialMaxBackoff
+		}
+		if opts.DialMaxBackoff < opts.DialMinBackoff {
+			opts.DialMaxBackoff = opts.DialMinBackoff
+		}
+	}
+	if opts.MaxConnAgeGrace == 0 {
+		opts.MaxConnAgeGrace = defaultMaxConnAgeGrace
+	}
+	if opts.BreakerCooldown == 0 {
+		opts.BreakerCooldown = defaultBreakerCooldown
+	}
+	if opts.HealthCheckTimeout == 0 {
+		opts.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	overrides, err := parseDialOverrides(opts.DialOverrides)
+	if err != nil {
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -104,22 +327,35 @@ func New(opts Options, defaultDialOpts ...grpc.DialOption) (*Pool, error) {
 	}
 
 	p := &Pool{
-		log:  l,
-		opts: opts,
-		m:    newMetrics(opts),
+		log:       l,
+		overrides: overrides,
+		opts:      opts,
+		m:         newMetrics(opts),
 
-		clients:       make(map[string]*client, opts.MaxClients),
-		reverseLookup: make(map[*grpc.ClientConn]*client),
+		shards:  newShards(),
+		retired: make(map[*client]*time.Timer),
 
 		exited:    make(chan struct{}),
 		cancelRun: cancel,
 	}
+	p.breakers = newBreakers(opts, p.m)
+	p.backoffs = newDialBackoffs(opts)
+
+	p.m.container.Add(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clientpool_dial_backoffs",
+		Help: "Current number of addresses which won't be dialed until their backoff after a failed dial elapses.",
+	}, func() float64 {
+		return float64(p.backoffs.active())
+	}))
 
 	// Create the full set of dial options by prepending our interceptors before
 	// the user-supplied options.
 	var fullDialOptions []grpc.DialOption
 	fullDialOptions = append(fullDialOptions, grpc.WithUnaryInterceptor(unaryLastUsedInterceptor(p)))
 	fullDialOptions = append(fullDialOptions, grpc.WithStreamInterceptor(streamLastUsedInterceptor(p)))
+	if opts.Dialer != nil {
+		fullDialOptions = append(fullDialOptions, grpc.WithContextDialer(opts.Dialer))
+	}
 	fullDialOptions = append(fullDialOptions, defaultDialOpts...)
 	p.dialOpts = fullDialOptions
 
@@ -140,192 +376,645 @@ func (p *Pool) run(ctx context.Context) {
 		cleanupTick = t.C
 	}
 
+	var healthTick <-chan time.Time
+	if p.opts.HealthCheckFrequency != 0 {
+		t := time.NewTicker(p.opts.HealthCheckFrequency)
+		defer t.Stop()
+		healthTick = t.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-cleanupTick:
 			p.removeStaleClients()
+		case <-healthTick:
+			p.removeUnhealthyClients(ctx)
 		}
 	}
 }
 
+// removeUnhealthyClients runs a health check against every client and
+// removes the clients which failed.
+func (p *Pool) removeUnhealthyClients(ctx context.Context) {
+	clients := p.conns()
+
+	var (
+		wg        sync.WaitGroup
+		resultMut sync.Mutex
+		unhealthy []*client
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+
+			err := p.checkHealth(ctx, c)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			level.Warn(p.log).Log("msg", "closing unhealthy client", "addr", c.Addr, "err", err)
+
+			resultMut.Lock()
+			defer resultMut.Unlock()
+			unhealthy = append(unhealthy, c)
+		}(c)
+	}
+	wg.Wait()
+
+	for _, c := range unhealthy {
+		s := p.shardFor(c.Addr)
+		s.mut.Lock()
+		// The client may have been replaced while its health was checked.
+		if s.clients[c.Addr] == c {
+			if err := p.closeConn(s, c.Addr, c, CloseReasonUnhealthy); err != nil {
+				level.Error(p.log).Log("msg", "failed to close unhealthy client", "err", err)
+			}
+		}
+		s.mut.Unlock()
+	}
+}
+
+// checkHealth runs a health check against c, returning an error if c is
+// unhealthy.
+func (p *Pool) checkHealth(ctx context.Context, c *client) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, healthCheckKey{}, true), p.opts.HealthCheckTimeout)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(c.Conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		p.m.healthChecksTotal.WithLabelValues(p.m.peer(c.Addr), "unimplemented").Inc()
+		return nil
+	case err != nil:
+		p.m.healthChecksTotal.WithLabelValues(p.m.peer(c.Addr), "error").Inc()
+		return err
+	case resp.Status != grpc_health_v1.HealthCheckResponse_SERVING:
+		p.m.healthChecksTotal.WithLabelValues(p.m.peer(c.Addr), "not_serving").Inc()
+		return fmt.Errorf("server reported status %s", resp.Status)
+	default:
+		p.m.healthChecksTotal.WithLabelValues(p.m.peer(c.Addr), "serving").Inc()
+		return nil
+	}
+}
+
+// healthCheckKey marks the context of health checks so they don't update
+// when a client was last used.
+type healthCheckKey struct{}
+
 // removeStaleClient removes all clients which are stale or shut down.
 func (p *Pool) removeStaleClients() {
-	p.clientsMut.Lock()
-	defer p.clientsMut.Unlock()
-
 	p.m.gcActive.Set(1)
 	defer p.m.gcActive.Set(0)
 
 	timer := prometheus.NewTimer(p.m.gcTotal)
 	defer timer.ObserveDuration()
 
-	for addr, client := range p.clients {
-		stale := time.Since(client.LastUsed) > p.opts.StaleTime
-		if !stale && client.Conn.GetState() != connectivity.Shutdown {
-			continue
-		}
-		if err := p.closeConn(addr, client); err != nil {
-			level.Error(p.log).Log("msg", "failed to close stale client", "err", err)
+	for _, s := range p.shards {
+		s.mut.Lock()
+		for addr, client := range s.clients {
+			reason := CloseReasonStale
+			if client.Conn.GetState() == connectivity.Shutdown {
+				reason = CloseReasonShutdown
+			} else if time.Since(client.lastUsed()) <= p.opts.StaleTime {
+				continue
+			}
+			if err := p.closeConn(s, addr, client, reason); err != nil {
+				level.Error(p.log).Log("msg", "failed to close stale client", "err", err)
+			}
 		}
+		s.mut.Unlock()
 	}
 }
 
-// closeConn closes a connection. clientsMut must be held.
-func (p *Pool) closeConn(addr string, client *client) error {
+// closeConn closes a connection. The lock of s must be held.
+func (p *Pool) closeConn(s *shard, addr string, client *client, reason CloseReason) error {
 	err := client.Conn.Close()
 
 	// Clean up the pool regardless of whether the connection closed
 	// successfully.
-	delete(p.clients, addr)
-	delete(p.reverseLookup, client.Conn)
-	p.m.eventsTotal.WithLabelValues("closed").Inc()
-	p.m.currentConns.Set(float64(len(p.clients)))
+	p.removeConn(s, addr, client, reason)
+	p.m.eventsTotal.WithLabelValues(p.m.peer(addr), "closed").Inc()
 
 	return err
 }
 
+// removeConn removes a connection from the pool without closing it. The
+// lock of s must be held.
+func (p *Pool) removeConn(s *shard, addr string, client *client, reason CloseReason) {
+	delete(s.clients, addr)
+	delete(s.reverseLookup, client.Conn)
+	p.slots.Dec()
+	p.m.currentConns.Set(float64(p.numConns.Dec()))
+
+	if p.opts.OnConnClosed != nil {
+		p.opts.OnConnClosed(addr, reason)
+	}
+}
+
 // Get retrieves a new or existing *grpc.ClientConn for the given address. The
 // provided context will is only used for creating the new connection, and will
 // not close the returned client.
 //
 // A new connection will be created if there is no existing connection or the
 // existing connection was closed. The provided extraDialOpts will be appended
-// to defaultDialOpts to create the new connection, but are ignored if an
-// existing connection is retrieved.
+// to defaultDialOpts and the dial options of matching Options.DialOverrides to
+// create the new connection, but are ignored if an existing connection is
+// retrieved.
 //
 // It is not recommended to manually close clients; let the pool close stale
 // clients instead.
 func (p *Pool) Get(ctx context.Context, addr string, extraDialOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
-	p.clientsMut.Lock()
-	defer p.clientsMut.Unlock()
-
-	defer func() {
-		p.m.currentConns.Set(float64(len(p.clients)))
-	}()
-
-	if p.closed {
-		p.m.lookupsTotal.WithLabelValues("error_other").Inc()
+	if p.closed.Load() {
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_other").Inc()
 		return nil, fmt.Errorf("clientpool has closed")
 	}
+	if err := p.breakers.open(addr); err != nil {
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_circuit_open").Inc()
+		return nil, err
+	}
 
-	// If an existing entry exists and isn't shut down, we can return early.
-	// Otherwise we either need to create a new entry or replace the terminated
-	// one.
-	entry, ok := p.clients[addr]
-	if ok && entry.Conn.GetState() != connectivity.Shutdown {
+	// If an existing entry exists and isn't shut down, we can return early
+	// without serializing with other calls to Get.
+	s := p.shardFor(addr)
+	s.mut.RLock()
+	entry, ok := s.clients[addr]
+	s.mut.RUnlock()
+	if ok && entry.Conn.GetState() != connectivity.Shutdown && !p.expired(entry) {
 		entry.updateLastUsed()
 
-		p.m.lookupsTotal.WithLabelValues("success").Inc()
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "success").Inc()
 		return entry.Conn, nil
 	}
-	if entry != nil {
+
+	return p.dial(ctx, s, addr, extraDialOpts)
+}
+
+// errMaxConns is returned when the pool is full.
+var errMaxConns = fmt.Errorf("maxium number of clients reached")
+
+// dial creates a new connection for addr in s, or returns the existing one
+// if another goroutine created it first. Concurrent calls to dial for the
+// same address wait for a single dial.
+func (p *Pool) dial(ctx context.Context, s *shard, addr string, extraDialOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	s.mut.Lock()
+
+	// Check for an existing entry again now that we hold the lock. Otherwise
+	// we either need to create a new entry or replace the terminated or
+	// expired one.
+	var old *client
+	entry, ok := s.clients[addr]
+	switch {
+	case ok && entry.Conn.GetState() != connectivity.Shutdown && !p.expired(entry):
+		s.mut.Unlock()
+		entry.updateLastUsed()
+
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "success").Inc()
+		return entry.Conn, nil
+	case ok && entry.Conn.GetState() != connectivity.Shutdown:
+		// The entry is expired; keep it until its replacement is dialed.
+		old = entry
+	case ok:
 		// Delete the existing client
-		delete(p.clients, addr)
-		delete(p.reverseLookup, entry.Conn)
+		p.removeConn(s, addr, entry, CloseReasonShutdown)
 	}
 
-	if p.opts.MaxClients > 0 && len(p.clients)+1 > p.opts.MaxClients {
-		if !p.opts.CleanupLRU {
-			p.m.lookupsTotal.WithLabelValues("error_max_conns").Inc()
-			return nil, fmt.Errorf("maxium number of clients reached")
+	if pd, ok := s.dialing[addr]; ok {
+		s.mut.Unlock()
+		return p.waitDial(ctx, addr, pd)
+	}
+	pd := &pendingDial{done: make(chan struct{})}
+	s.dialing[addr] = pd
+	s.mut.Unlock()
+
+	// Dial without holding any locks so that dials to other addresses can
+	// proceed concurrently.
+	cc, err := p.dialConn(ctx, addr, old != nil, extraDialOpts)
+
+	s.mut.Lock()
+	delete(s.dialing, addr)
+	switch {
+	case err != nil && old != nil:
+		level.Warn(p.log).Log("msg", "failed to replace expired client; continuing to use it", "addr", addr, "err", err)
+		old.updateLastUsed()
+		cc, err = old.Conn, nil
+
+	case err != nil:
+		// Metrics were recorded by dialConn.
+
+	case p.closed.Load():
+		// The pool was closed while dialing.
+		_ = cc.Close()
+		if old == nil {
+			p.slots.Dec()
 		}
-		if err := p.removeLRU(); err != nil {
-			p.m.lookupsTotal.WithLabelValues("error_other").Inc()
+		cc, err = nil, fmt.Errorf("clientpool has closed")
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_other").Inc()
+
+	default:
+		if old != nil {
+			p.slots.Inc()
+			if s.clients[addr] == old {
+				p.removeConn(s, addr, old, CloseReasonMaxAge)
+				p.retire(old)
+			}
+		}
+
+		now := time.Now()
+		entry = &client{
+			Addr:     addr,
+			Conn:     cc,
+			Created:  now,
+			LastUsed: now,
+		}
+		s.clients[addr] = entry
+		s.reverseLookup[cc] = entry
+		p.m.currentConns.Set(float64(p.numConns.Inc()))
+		p.m.eventsTotal.WithLabelValues(p.m.peer(addr), "opened").Inc()
+	}
+	s.mut.Unlock()
+
+	pd.cc, pd.err = cc, err
+	close(pd.done)
+
+	if err == nil {
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "success").Inc()
+	}
+	return cc, err
+}
+
+// waitDial waits for another goroutine to finish dialing addr.
+func (p *Pool) waitDial(ctx context.Context, addr string, pd *pendingDial) (*grpc.ClientConn, error) {
+	select {
+	case <-ctx.Done():
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_other").Inc()
+		return nil, ctx.Err()
+	case <-pd.done:
+	}
+
+	if pd.err != nil {
+		p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_dial").Inc()
+		return nil, pd.err
+	}
+	p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "success").Inc()
+	return pd.cc, nil
+}
+
+// dialConn dials a new connection to addr. If replace is false, dialConn
+// waits for the dial backoff of addr and reserves room for the connection
+// in the pool, which must be released if the connection isn't added to the
+// pool. No locks may be held.
+func (p *Pool) dialConn(ctx context.Context, addr string, replace bool, extraDialOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	// Replacing an expired connection doesn't change the number of
+	// connections, so limits only apply to new connections.
+	if !replace {
+		if err := p.backoffs.wait(addr); err != nil {
+			p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_dial_backoff").Inc()
+			return nil, err
+		}
+
+		if err := p.reserveSlot(); errors.Is(err, errMaxConns) {
+			p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_max_conns").Inc()
+			return nil, err
+		} else if err != nil {
+			p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_other").Inc()
 			return nil, err
 		}
 	}
 
-	dialOpts := make([]grpc.DialOption, len(p.dialOpts)+len(extraDialOpts))
-	copy(dialOpts[0:], p.dialOpts)
-	copy(dialOpts[len(p.dialOpts):], extraDialOpts)
+	overrideOpts := p.overrideDialOpts(addr)
+	dialOpts := make([]grpc.DialOption, 0, len(p.dialOpts)+len(overrideOpts)+len(extraDialOpts)+1)
+	if p.opts.TransportCredentials != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(p.opts.TransportCredentials()))
+	}
+	dialOpts = append(dialOpts, p.dialOpts...)
+	dialOpts = append(dialOpts, overrideOpts...)
+	dialOpts = append(dialOpts, extraDialOpts...)
 
 	cc, err := grpc.DialContext(ctx, addr, dialOpts...)
 	if err != nil {
-		p.m.lookupsTotal.WithLabelValues("error_dial").Inc()
+		p.backoffs.report(addr, err)
+		p.breakers.report(addr, false, true)
+		if !replace {
+			p.slots.Dec()
+			p.m.lookupsTotal.WithLabelValues(p.m.peer(addr), "error_dial").Inc()
+		}
 		return nil, err
 	}
-	entry = &client{
-		Addr:     addr,
-		Conn:     cc,
-		LastUsed: time.Now(),
-	}
-	p.clients[addr] = entry
-	p.reverseLookup[cc] = entry
-
-	p.m.lookupsTotal.WithLabelValues("success").Inc()
-	p.m.eventsTotal.WithLabelValues("opened").Inc()
+	p.backoffs.watch(addr, cc)
 	return cc, nil
 }
 
-// removeLRU removes the least recently used client. Must only be called with
-// the client mut held.
-func (p *Pool) removeLRU() error {
-	clients := make([]*client, 0, len(p.clients))
-	for _, c := range p.clients {
-		clients = append(clients, c)
+// reserveSlot reserves room for a new connection. If the pool is full, the
+// least recently used connection is closed when Options.CleanupLRU is set;
+// otherwise errMaxConns is returned. No locks may be held.
+func (p *Pool) reserveSlot() error {
+	for {
+		n := p.slots.Load()
+		if p.opts.MaxClients == 0 || n < int64(p.opts.MaxClients) {
+			if p.slots.CAS(n, n+1) {
+				return nil
+			}
+			continue
+		}
+
+		if !p.opts.CleanupLRU {
+			return errMaxConns
+		}
+		if err := p.removeLRU(); err != nil {
+			return err
+		}
 	}
-	sort.Slice(clients, func(i, j int) bool {
-		return clients[i].LastUsed.Before(clients[j].LastUsed)
+}
+
+// expired returns true if c is older than Options.MaxConnAge.
+func (p *Pool) expired(c *client) bool {
+	return p.opts.MaxConnAge > 0 && time.Since(c.Created) > p.opts.MaxConnAge
+}
+
+// retire closes c after Options.MaxConnAgeGrace, allowing RPCs in progress
+// on c to finish. c must already be removed from the pool.
+func (p *Pool) retire(c *client) {
+	p.retiredMut.Lock()
+	defer p.retiredMut.Unlock()
+
+	p.retired[c] = time.AfterFunc(p.opts.MaxConnAgeGrace, func() {
+		p.retiredMut.Lock()
+		_, ok := p.retired[c]
+		delete(p.retired, c)
+		p.retiredMut.Unlock()
+
+		if ok {
+			p.closeRetired(c)
+		}
 	})
+}
+
+// closeRetired closes a connection passed to retire.
+func (p *Pool) closeRetired(c *client) {
+	if err := c.Conn.Close(); err != nil {
+		level.Warn(p.log).Log("msg", "failed to close expired client", "addr", c.Addr, "err", err)
+	}
+	p.m.eventsTotal.WithLabelValues(p.m.peer(c.Addr), "closed").Inc()
+}
+
+// Prewarm opens connections to addrs in parallel ahead of time, such as to
+// all current participants of a cluster, so the first RPC to each address
+// doesn't wait for the connection to be established. Prewarm blocks until
+// every connection is ready or ctx is canceled.
+//
+// Addresses which already have a connection in the pool are not dialed
+// again. An error is returned for each address whose connection couldn't be
+// established.
+func (p *Pool) Prewarm(ctx context.Context, addrs []string) error {
+	_, err := p.GetMulti(ctx, addrs)
+	return err
+}
+
+// GetMulti retrieves connections to addrs concurrently, such as to fan out
+// a request to every owner of a key. Like GetAny, GetMulti waits for each
+// connection to be ready; all connections share the deadline of ctx.
+//
+// The returned map holds the connection of every address which could be
+// connected to, even if an error is returned for the other addresses.
+func (p *Pool) GetMulti(ctx context.Context, addrs []string) (map[string]*grpc.ClientConn, error) {
+	var (
+		wg     sync.WaitGroup
+		resMut sync.Mutex
+		conns  = make(map[string]*grpc.ClientConn, len(addrs))
+		errs   *multierror.Error
+	)
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			cc, err := p.getReady(ctx, addr)
+
+			resMut.Lock()
+			defer resMut.Unlock()
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%s: %w", addr, err))
+				return
+			}
+			conns[addr] = cc
+		}(addr)
+	}
+	wg.Wait()
+
+	return conns, errs.ErrorOrNil()
+}
+
+// GetAny retrieves a connection to the first of addrs which can be
+// connected to, such as when a peer advertises multiple addresses or when any
+// replica can serve a request. Use the Target method of the returned
+// connection to find which address was chosen.
+//
+// Addresses with an existing ready connection in the pool are preferred.
+// Otherwise, addrs are tried in order until a connection is established;
+// unlike Get, GetAny waits for each new connection to be ready before
+// returning it. An error is returned if no address could be connected to
+// before ctx is canceled.
+func (p *Pool) GetAny(ctx context.Context, addrs []string) (*grpc.ClientConn, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses provided")
+	}
+
+	for _, addr := range addrs {
+		s := p.shardFor(addr)
+		s.mut.RLock()
+		entry, ok := s.clients[addr]
+		s.mut.RUnlock()
+
+		if ok && entry.Conn.GetState() == connectivity.Ready {
+			return p.Get(ctx, addr)
+		}
+	}
+
+	var errs *multierror.Error
+	for _, addr := range addrs {
+		cc, err := p.getReady(ctx, addr)
+		if err == nil {
+			return cc, nil
+		}
+		errs = multierror.Append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errs.ErrorOrNil()
+}
 
-	if len(clients) == 0 {
-		// Shoudln't be possible to get here, but let's be defensive.
-		return fmt.Errorf("no clients to remove")
+// getReady gets the connection for addr and waits for it to be ready.
+func (p *Pool) getReady(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	cc, err := p.Get(ctx, addr)
+	if err != nil {
+		return nil, err
 	}
 
-	return p.closeConn(clients[0].Addr, clients[0])
+	cc.Connect()
+	for {
+		switch state := cc.GetState(); state {
+		case connectivity.Ready:
+			return cc, nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return nil, fmt.Errorf("connection is %s", state)
+		default:
+			if !cc.WaitForStateChange(ctx, state) {
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// removeLRU removes the least recently used client across all shards. No
+// locks may be held.
+func (p *Pool) removeLRU() error {
+	for {
+		var (
+			lru     *client
+			lruUsed time.Time
+			clients = p.conns()
+		)
+		if len(clients) == 0 {
+			// Every slot is reserved by an in-flight dial.
+			return fmt.Errorf("no clients to remove")
+		}
+		for _, c := range clients {
+			if used := c.lastUsed(); lru == nil || used.Before(lruUsed) {
+				lru, lruUsed = c, used
+			}
+		}
+
+		s := p.shardFor(lru.Addr)
+		s.mut.Lock()
+		// The client may have been removed since it was found; try again if
+		// so.
+		removed := s.clients[lru.Addr] == lru
+		if removed {
+			if err := p.closeConn(s, lru.Addr, lru, CloseReasonEvicted); err != nil {
+				level.Warn(p.log).Log("msg", "failed to close evicted client", "addr", lru.Addr, "err", err)
+			}
+		}
+		s.mut.Unlock()
+
+		if removed {
+			return nil
+		}
+	}
+}
+
+// Redial closes every connection in the pool so that the next call to Get
+// for each address dials a new connection, such as after rotating the
+// certificates returned by Options.TransportCredentials. RPCs in progress
+// on the closed connections fail, and callers must call Get again rather
+// than reuse connections retrieved before Redial.
+func (p *Pool) Redial() error {
+	p.dialMut.Lock()
+	defer p.dialMut.Unlock()
+
+	var errs *multierror.Error
+	for _, s := range p.shards {
+		s.mut.Lock()
+		for addr, client := range s.clients {
+			if err := p.closeConn(s, addr, client, CloseReasonRedial); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%s: %w", addr, err))
+			}
+		}
+		s.mut.Unlock()
+	}
+	return errs.ErrorOrNil()
 }
 
 // Close closes the client pool. Once the pool is closed, all existing
 // connections will be shut down and no new connections may be opened.
 func (p *Pool) Close() error {
-	p.clientsMut.Lock()
-	defer p.clientsMut.Unlock()
-
+	// Stop the GC before taking the lock, since the GC needs the lock to
+	// finish.
 	p.cancelRun()
 	<-p.exited
 
+	p.dialMut.Lock()
+	defer p.dialMut.Unlock()
+
+	// In-flight dials check closed before adding their connection to the
+	// pool, so closed must be set before closing existing connections.
+	p.closed.Store(true)
+
 	// Close existing connections.
-	for addr, client := range p.clients {
-		err := p.closeConn(addr, client)
-		if err != nil {
-			level.Warn(p.log).Log("msg", "failed to close client on shutdown", "err", err)
+	for _, s := range p.shards {
+		s.mut.Lock()
+		for addr, client := range s.clients {
+			err := p.closeConn(s, addr, client, CloseReasonPoolClosed)
+			if err != nil {
+				level.Warn(p.log).Log("msg", "failed to close client on shutdown", "err", err)
+			}
 		}
+		s.mut.Unlock()
+	}
+
+	// Close connections replaced because of MaxConnAge without waiting for
+	// their grace period.
+	p.retiredMut.Lock()
+	defer p.retiredMut.Unlock()
+	for c, t := range p.retired {
+		if t.Stop() {
+			p.closeRetired(c)
+		}
+		delete(p.retired, c)
 	}
 
-	p.closed = true
 	return nil
 }
 
 func unaryLastUsedInterceptor(p *Pool) grpc.UnaryClientInterceptor {
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		p.clientsMut.RLock()
-		cli, ok := p.reverseLookup[cc]
-		p.clientsMut.RUnlock()
-		if ok {
-			cli.Mutex.Lock()
-			cli.LastUsed = time.Now()
-			cli.Mutex.Unlock()
+		cli, ok := p.lookup(cc)
+		if !ok || ctx.Value(healthCheckKey{}) != nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
 		}
 
-		return invoker(ctx, method, req, reply, cc, opts...)
+		cli.Mutex.Lock()
+		cli.LastUsed = time.Now()
+		cli.Mutex.Unlock()
+
+		probe, err := p.breakers.allow(cli.Addr)
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		p.breakers.reportRPC(cli.Addr, probe, err)
+		return err
 	}
 }
 
 func streamLastUsedInterceptor(p *Pool) grpc.StreamClientInterceptor {
 	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-		p.clientsMut.RLock()
-		cli, ok := p.reverseLookup[cc]
-		p.clientsMut.RUnlock()
+		cli, ok := p.lookup(cc)
+		var probe bool
 		if ok {
 			cli.Mutex.Lock()
 			cli.LastUsed = time.Now()
 			cli.Mutex.Unlock()
+
+			var err error
+			probe, err = p.breakers.allow(cli.Addr)
+			if err != nil {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
 		}
 
 		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if ok {
+			p.breakers.reportRPC(cli.Addr, probe, err)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -2,14 +2,21 @@ package clientpool
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func TestClientPool(t *testing.T) {
@@ -31,7 +38,7 @@ func TestClientPool(t *testing.T) {
 		cc, err := p.Get(context.Background(), server)
 		require.NoError(t, err)
 
-		ent, ok := p.reverseLookup[cc]
+		ent, ok := p.lookup(cc)
 		require.True(t, ok)
 		firstUsed := ent.LastUsed
 
@@ -48,7 +55,7 @@ func TestClientPool(t *testing.T) {
 		require.NoError(t, err)
 
 		p.removeStaleClients()
-		require.Len(t, p.clients, 1)
+		require.Len(t, p.conns(), 1)
 	})
 
 	t.Run("Stale clients get removed", func(t *testing.T) {
@@ -56,31 +63,461 @@ func TestClientPool(t *testing.T) {
 		cc, err := p.Get(context.Background(), server)
 		require.NoError(t, err)
 
-		ent, ok := p.reverseLookup[cc]
+		ent, ok := p.lookup(cc)
 		require.True(t, ok)
 		ent.LastUsed = time.Now().Add(-24 * time.Hour)
 
 		p.removeStaleClients()
-		require.Len(t, p.clients, 0)
+		require.Len(t, p.conns(), 0)
 	})
 }
 
+func TestClientPool_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	opts.MaxClients = 5
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				// Nothing needs to listen on the addresses since dialing is
+				// non-blocking.
+				addr := fmt.Sprintf("127.0.0.1:%d", 10000+(i*j)%10)
+				_, err := p.Get(context.Background(), addr)
+				require.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Len(t, p.conns(), opts.MaxClients)
+	require.Equal(t, int64(opts.MaxClients), p.numConns.Load())
+	require.Equal(t, p.numConns.Load(), p.slots.Load(), "slots leaked")
+}
+
+func TestClientPool_SlowDial(t *testing.T) {
+	var (
+		fast    = newTestServer(t)
+		slow    = "slow:80"
+		release = make(chan struct{})
+	)
+
+	opts := DefaultOptions
+	opts.Dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr == slow {
+			<-release
+			return nil, fmt.Errorf("slow address is unreachable")
+		}
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	p, err := New(opts, grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		_, _ = p.Get(ctx, slow)
+	}()
+
+	// Dialing a slow address must not block dialing other addresses.
+	_, err = p.Get(context.Background(), fast)
+	require.NoError(t, err)
+
+	close(release)
+	cancel()
+	<-slowDone
+}
+
+func TestClientPool_HealthChecks(t *testing.T) {
+	t.Run("Healthy clients stay", func(t *testing.T) {
+		p := newTestPool(t)
+		cc, err := p.Get(context.Background(), newTestServer(t))
+		require.NoError(t, err)
+
+		ent, ok := p.lookup(cc)
+		require.True(t, ok)
+		lastUsed := ent.LastUsed
+
+		p.removeUnhealthyClients(context.Background())
+		require.Len(t, p.conns(), 1)
+		require.Equal(t, lastUsed, ent.LastUsed, "health check updated LastUsed")
+	})
+
+	t.Run("Clients without health service stay", func(t *testing.T) {
+		p := newTestPool(t)
+		_, err := p.Get(context.Background(), newTestServerWithHealth(t, nil))
+		require.NoError(t, err)
+
+		p.removeUnhealthyClients(context.Background())
+		require.Len(t, p.conns(), 1)
+	})
+
+	t.Run("Not serving clients get removed", func(t *testing.T) {
+		hs := health.NewServer()
+		server := newTestServerWithHealth(t, hs)
+
+		p := newTestPool(t)
+		cc, err := p.Get(context.Background(), server)
+		require.NoError(t, err)
+
+		hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		p.removeUnhealthyClients(context.Background())
+		require.Len(t, p.conns(), 0)
+
+		// The next Get should dial a new client.
+		cc2, err := p.Get(context.Background(), server)
+		require.NoError(t, err)
+		require.False(t, cc == cc2, "connpool returned evicted client")
+	})
+
+	t.Run("Unresponsive clients get removed", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer lis.Close()
+
+		opts := DefaultOptions
+		opts.HealthCheckTimeout = 100 * time.Millisecond
+		p, err := New(opts, grpc.WithInsecure())
+		require.NoError(t, err)
+		defer p.Close()
+
+		// Nothing accepts connections from lis, so the health check times out.
+		_, err = p.Get(context.Background(), lis.Addr().String())
+		require.NoError(t, err)
+
+		p.removeUnhealthyClients(context.Background())
+		require.Len(t, p.conns(), 0)
+	})
+
+	t.Run("Health checks run periodically", func(t *testing.T) {
+		hs := health.NewServer()
+		server := newTestServerWithHealth(t, hs)
+
+		opts := DefaultOptions
+		opts.HealthCheckFrequency = 10 * time.Millisecond
+		p, err := New(opts, grpc.WithInsecure())
+		require.NoError(t, err)
+		defer p.Close()
+
+		_, err = p.Get(context.Background(), server)
+		require.NoError(t, err)
+
+		hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		require.Eventually(t, func() bool {
+			return len(p.conns()) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestClientPool_Dialer(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	grpcSrv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcSrv, health.NewServer())
+	go func() {
+		require.NoError(t, grpcSrv.Serve(lis))
+	}()
+	defer grpcSrv.GracefulStop()
+
+	var dialed []string
+
+	opts := DefaultOptions
+	opts.Dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return lis.DialContext(ctx)
+	}
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer p.Close()
+
+	cc, err := p.Get(context.Background(), "in-memory")
+	require.NoError(t, err)
+
+	_, err = grpc_health_v1.NewHealthClient(cc).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"in-memory"}, dialed)
+}
+
+func TestClientPool_Prewarm(t *testing.T) {
+	t.Run("Connections become ready", func(t *testing.T) {
+		servers := []string{newTestServer(t), newTestServer(t)}
+
+		p := newTestPool(t)
+		require.NoError(t, p.Prewarm(context.Background(), servers))
+		require.Len(t, p.conns(), 2)
+
+		for _, server := range servers {
+			require.Equal(t, connectivity.Ready, findClient(t, p, server).Conn.GetState())
+		}
+	})
+
+	t.Run("Dials concurrently", func(t *testing.T) {
+		servers := []string{newTestServer(t), newTestServer(t), newTestServer(t)}
+
+		p := newBarrierPool(t, len(servers))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		require.NoError(t, p.Prewarm(ctx, servers))
+		require.Len(t, p.conns(), len(servers))
+	})
+
+	t.Run("Unreachable addresses fail", func(t *testing.T) {
+		// Get an address which nothing listens on.
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := lis.Addr().String()
+		require.NoError(t, lis.Close())
+
+		p := newTestPool(t)
+		err = p.Prewarm(context.Background(), []string{newTestServer(t), addr})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), addr)
+	})
+}
+
+func TestClientPool_GetMulti(t *testing.T) {
+	t.Run("Returns reachable connections", func(t *testing.T) {
+		// Get an address which nothing listens on.
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		unreachable := lis.Addr().String()
+		require.NoError(t, lis.Close())
+
+		servers := []string{newTestServer(t), newTestServer(t)}
+
+		p := newTestPool(t)
+		conns, err := p.GetMulti(context.Background(), []string{servers[0], unreachable, servers[1], servers[0]})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), unreachable)
+
+		require.Len(t, conns, 2)
+		for _, server := range servers {
+			require.Equal(t, server, conns[server].Target())
+			require.Equal(t, connectivity.Ready, conns[server].GetState())
+		}
+	})
+
+	t.Run("Dials concurrently", func(t *testing.T) {
+		servers := []string{newTestServer(t), newTestServer(t), newTestServer(t)}
+
+		p := newBarrierPool(t, len(servers))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		conns, err := p.GetMulti(ctx, servers)
+		require.NoError(t, err)
+		require.Len(t, conns, len(servers))
+	})
+}
+
+func TestClientPool_GetAny(t *testing.T) {
+	// Get an address which nothing listens on.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	t.Run("Skips unreachable addresses", func(t *testing.T) {
+		server := newTestServer(t)
+
+		p := newTestPool(t)
+		cc, err := p.GetAny(context.Background(), []string{unreachable, server})
+		require.NoError(t, err)
+		require.Equal(t, server, cc.Target())
+	})
+
+	t.Run("Prefers open connections", func(t *testing.T) {
+		servers := []string{newTestServer(t), newTestServer(t)}
+
+		p := newTestPool(t)
+		require.NoError(t, p.Prewarm(context.Background(), servers[1:]))
+
+		cc, err := p.GetAny(context.Background(), servers)
+		require.NoError(t, err)
+		require.Equal(t, servers[1], cc.Target())
+		require.Len(t, p.conns(), 1)
+	})
+
+	t.Run("Fails if no address is reachable", func(t *testing.T) {
+		p := newTestPool(t)
+		_, err := p.GetAny(context.Background(), []string{unreachable})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), unreachable)
+	})
+}
+
+func TestClientPool_MaxConnAge(t *testing.T) {
+	server := newTestServer(t)
+
+	var reasons []CloseReason
+
+	opts := DefaultOptions
+	opts.MaxConnAge = 50 * time.Millisecond
+	opts.MaxConnAgeGrace = 100 * time.Millisecond
+	opts.OnConnClosed = func(_ string, reason CloseReason) { reasons = append(reasons, reason) }
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer p.Close()
+
+	cc, err := p.Get(context.Background(), server)
+	require.NoError(t, err)
+	time.Sleep(opts.MaxConnAge)
+
+	cc2, err := p.Get(context.Background(), server)
+	require.NoError(t, err)
+	require.False(t, cc == cc2, "expired connection wasn't replaced")
+	require.Equal(t, []CloseReason{CloseReasonMaxAge}, reasons)
+	require.Len(t, p.conns(), 1)
+
+	// The old connection should stay open for the grace period.
+	require.NotEqual(t, connectivity.Shutdown, cc.GetState())
+	require.Eventually(t, func() bool {
+		return cc.GetState() == connectivity.Shutdown
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Close shouldn't wait for the grace period of replaced connections.
+	time.Sleep(opts.MaxConnAge)
+	_, err = p.Get(context.Background(), server)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.Equal(t, connectivity.Shutdown, cc2.GetState())
+}
+
+func TestClientPool_TransportCredentials(t *testing.T) {
+	server := newTestServer(t)
+
+	var calls int
+
+	opts := DefaultOptions
+	opts.TransportCredentials = func() credentials.TransportCredentials {
+		calls++
+		return insecure.NewCredentials()
+	}
+	p, err := New(opts)
+	require.NoError(t, err)
+	defer p.Close()
+
+	cc, err := p.Get(context.Background(), server)
+	require.NoError(t, err)
+	_, err = grpc_health_v1.NewHealthClient(cc).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = p.Get(context.Background(), server)
+	require.NoError(t, err)
+	require.Equal(t, 1, calls, "credentials should only be retrieved for new connections")
+
+	// Redial should close the existing connection so new credentials are used.
+	require.NoError(t, p.Redial())
+	require.Equal(t, connectivity.Shutdown, cc.GetState())
+
+	cc2, err := p.Get(context.Background(), server)
+	require.NoError(t, err)
+	require.False(t, cc == cc2, "connpool returned closed client")
+	require.Equal(t, 2, calls)
+}
+
+func TestClientPool_OnConnClosed(t *testing.T) {
+	servers := []string{newTestServer(t), newTestServer(t), newTestServer(t)}
+
+	type closeEvent struct {
+		Addr   string
+		Reason CloseReason
+	}
+	var events []closeEvent
+
+	opts := DefaultOptions
+	opts.MaxClients = 2
+	opts.OnConnClosed = func(addr string, reason CloseReason) {
+		events = append(events, closeEvent{Addr: addr, Reason: reason})
+	}
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+
+	// Opening a third connection evicts the least recently used one.
+	for _, server := range servers {
+		_, err := p.Get(context.Background(), server)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []closeEvent{{servers[0], CloseReasonEvicted}}, events)
+
+	findClient(t, p, servers[1]).LastUsed = time.Now().Add(-24 * time.Hour)
+	p.removeStaleClients()
+	require.Equal(t, closeEvent{servers[1], CloseReasonStale}, events[1])
+
+	require.NoError(t, p.Close())
+	require.Equal(t, closeEvent{servers[2], CloseReasonPoolClosed}, events[2])
+	require.Len(t, events, 3)
+}
+
+func TestClientPool_PeerLabels(t *testing.T) {
+	servers := []string{newTestServer(t), newTestServer(t)}
+
+	opts := DefaultOptions
+	opts.PeerLabelLimit = 1
+	p, err := New(opts, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer p.Close()
+
+	for _, server := range servers {
+		_, err := p.Get(context.Background(), server)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 1.0, testutil.ToFloat64(p.m.lookupsTotal.WithLabelValues(servers[0], "success")))
+	require.Equal(t, 1.0, testutil.ToFloat64(p.m.lookupsTotal.WithLabelValues("other", "success")))
+	require.Equal(t, 2, testutil.CollectAndCount(p.m.lookupsTotal))
+}
+
 func newTestServer(t *testing.T) (serverAddr string) {
 	t.Helper()
+	return newTestServerWithHealth(t, health.NewServer())
+}
+
+// newTestServerWithHealth creates a server which serves hs. If hs is nil, the
+// server doesn't implement the health service.
+func newTestServerWithHealth(t *testing.T, hs *health.Server) (serverAddr string) {
+	t.Helper()
 
 	lis, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
 	grpcSrv := grpc.NewServer()
-	grpc_health_v1.RegisterHealthServer(grpcSrv, health.NewServer())
+	if hs != nil {
+		grpc_health_v1.RegisterHealthServer(grpcSrv, hs)
+	}
 	go func() {
-		require.NoError(t, grpcSrv.Serve(lis))
+		// Serve fails with ErrServerStopped if the test finishes before it
+		// starts serving.
+		if err := grpcSrv.Serve(lis); err != grpc.ErrServerStopped {
+			require.NoError(t, err)
+		}
 	}()
 	t.Cleanup(grpcSrv.GracefulStop)
 
 	return lis.Addr().String()
 }
 
+// findClient returns the pooled client for addr.
+func findClient(t *testing.T, p *Pool, addr string) *client {
+	t.Helper()
+
+	for _, c := range p.conns() {
+		if c.Addr == addr {
+			return c
+		}
+	}
+	require.FailNow(t, "no pooled client", "addr %s", addr)
+	return nil
+}
+
 func newTestPool(t *testing.T) *Pool {
 	t.Helper()
 
@@ -91,3 +528,41 @@ func newTestPool(t *testing.T) *Pool {
 	})
 	return p
 }
+
+// newBarrierPool returns a pool which blocks on dialing until n dials are in
+// flight at once. Dials fail if n dials don't overlap within a few seconds.
+func newBarrierPool(t *testing.T, n int) *Pool {
+	t.Helper()
+
+	var (
+		mut     sync.Mutex
+		pending int
+		ready   = make(chan struct{})
+	)
+
+	opts := DefaultOptions
+	opts.Dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		mut.Lock()
+		pending++
+		if pending == n {
+			close(ready)
+		}
+		mut.Unlock()
+
+		select {
+		case <-ready:
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("dial of %s did not overlap with %d other dials", addr, n-1)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p, err := New(opts, grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+	return p
+}
@@ -0,0 +1,72 @@
+package clientpool
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"google.golang.org/grpc"
+)
+
+// numShards is the number of shards the connections of a Pool are split
+// across.
+const numShards = 32
+
+// shard holds the connections for a subset of addresses. Splitting
+// connections across shards allows lookups of existing connections for
+// different addresses to proceed without contending on a single lock.
+type shard struct {
+	mut           sync.RWMutex
+	clients       map[string]*client
+	reverseLookup map[*grpc.ClientConn]*client
+	dialing       map[string]*pendingDial
+}
+
+// pendingDial is an in-flight dial for an address. Concurrent calls to Get
+// for the address wait for the pending dial rather than dialing again.
+type pendingDial struct {
+	done chan struct{} // Closed once the dial completes
+	cc   *grpc.ClientConn
+	err  error
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, numShards)
+	for i := range shards {
+		shards[i] = &shard{
+			clients:       make(map[string]*client),
+			reverseLookup: make(map[*grpc.ClientConn]*client),
+			dialing:       make(map[string]*pendingDial),
+		}
+	}
+	return shards
+}
+
+// shardFor returns the shard which holds the connection for addr.
+func (p *Pool) shardFor(addr string) *shard {
+	return p.shards[xxhash.Sum64String(addr)%numShards]
+}
+
+// lookup returns the pooled client for cc. The target of pooled connections
+// is always the address passed to Get, which is used to find the shard of
+// cc.
+func (p *Pool) lookup(cc *grpc.ClientConn) (*client, bool) {
+	s := p.shardFor(cc.Target())
+
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	cli, ok := s.reverseLookup[cc]
+	return cli, ok
+}
+
+// conns returns all clients in the pool.
+func (p *Pool) conns() []*client {
+	var clients []*client
+	for _, s := range p.shards {
+		s.mut.RLock()
+		for _, c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.mut.RUnlock()
+	}
+	return clients
+}
@@ -0,0 +1,26 @@
+package ckit
+
+import (
+	"context"
+
+	"github.com/rfratto/ckit/peer"
+)
+
+// Cluster is the subset of methods from *Node used to participate in a
+// cluster. Code which depends on Cluster rather than *Node can be tested
+// against a fake, such as the one in the testutil package.
+type Cluster interface {
+	// Start starts the cluster, joining the provided peers. See Node.Start.
+	Start(peers []string) error
+	// Stop leaves the cluster. See Node.Stop.
+	Stop() error
+	// ChangeState changes the state of the local node. See Node.ChangeState.
+	ChangeState(ctx context.Context, to peer.State, opts ...ChangeStateOption) error
+	// Peers returns the current set of peers. See Node.Peers.
+	Peers(opts ...PeersOption) []peer.Peer
+	// Observe registers o to be informed when the cluster changes. See
+	// Node.Observe.
+	Observe(o Observer) (unsubscribe func())
+}
+
+var _ Cluster = (*Node)(nil)
@@ -0,0 +1,40 @@
+package ckit
+
+import (
+	"context"
+	"time"
+)
+
+// WaitConverged blocks until no membership changes have been observed by n
+// for at least window, or until ctx is canceled. A membership change is any
+// change to the list returned by Peers, such as a peer joining, leaving, or
+// changing state.
+//
+// WaitConverged only reflects the local view of the cluster; other Nodes may
+// not have converged yet. The time spent waiting is recorded in the
+// cluster_node_converge_duration_seconds metric when WaitConverged returns
+// successfully.
+func (n *Node) WaitConverged(ctx context.Context, window time.Duration) error {
+	start := time.Now()
+
+	for {
+		n.peerMut.RLock()
+		lastChange := n.peersTime
+		n.peerMut.RUnlock()
+
+		remaining := window - time.Since(lastChange)
+		if remaining <= 0 {
+			n.m.convergeDuration.Observe(time.Since(start).Seconds())
+			return nil
+		}
+
+		t := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+			// Check again in case a change happened while we were waiting.
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package ckit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_WaitConverged(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	t.Run("returns after quiet window", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		require.NoError(t, a.WaitConverged(ctx, 250*time.Millisecond))
+		require.Len(t, a.Peers(), 2)
+
+		a.peerMut.RLock()
+		quietFor := time.Since(a.peersTime)
+		a.peerMut.RUnlock()
+		require.GreaterOrEqual(t, quietFor, 250*time.Millisecond)
+	})
+
+	t.Run("context canceled before convergence", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := a.WaitConverged(ctx, time.Hour)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,102 @@
+package ckit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+)
+
+// denylist is a set of peers which are refused membership.
+type denylist struct {
+	names map[string]struct{}
+	nets  []*net.IPNet
+}
+
+// parseDenylist parses entries from Config.DeniedPeers. Entries containing a
+// slash are parsed as CIDRs; all other entries are peer names.
+func parseDenylist(entries []string) (denylist, error) {
+	dl := denylist{names: make(map[string]struct{})}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if entry == "" {
+				return dl, fmt.Errorf("denied peer names must not be empty")
+			}
+			dl.names[entry] = struct{}{}
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return dl, fmt.Errorf("invalid denied peer %q: %w", entry, err)
+		}
+		dl.nets = append(dl.nets, ipnet)
+	}
+	return dl, nil
+}
+
+// match returns true if a peer with the given name or IP is denied. ip may be
+// nil.
+func (dl denylist) match(name string, ip net.IP) bool {
+	if _, ok := dl.names[name]; ok {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range dl.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDenied returns true if node is denied.
+func (n *Node) isDenied(node *memberlist.Node) bool {
+	n.denyMut.RLock()
+	defer n.denyMut.RUnlock()
+	return n.denied.match(node.Name, node.Addr)
+}
+
+// isDeniedName returns true if the peer with the given name is denied. Peers
+// denied by CIDR can't be matched by name alone, but they're never admitted
+// as peers in the first place.
+func (n *Node) isDeniedName(name string) bool {
+	n.denyMut.RLock()
+	defer n.denyMut.RUnlock()
+	return n.denied.match(name, nil)
+}
+
+// DenyPeer denies the peer with the given name, evicting it from the local
+// view of the cluster and refusing any further gossip about it. The evicted
+// peer is removed from Peers and Observers are notified.
+//
+// DenyPeer only affects n. To remove a peer from the entire cluster, call
+// DenyPeer on every Node or add the peer to Config.DeniedPeers when Nodes are
+// restarted. An error is returned if name is the local Node.
+func (n *Node) DenyPeer(name string) error {
+	if name == n.cfg.Name {
+		return fmt.Errorf("cannot deny the local node")
+	}
+
+	n.denyMut.Lock()
+	n.denied.names[name] = struct{}{}
+	n.denyMut.Unlock()
+
+	n.peerMut.Lock()
+	defer n.peerMut.Unlock()
+
+	delete(n.peerStates, name)
+	if _, ok := n.peers[name]; ok {
+		level.Info(n.log).Log("msg", "evicting denied peer", "peer", name)
+		delete(n.peers, name)
+		n.forgetHealth(name)
+		n.forgetMetadata(name)
+		n.forgetFingerprint(name)
+		n.handlePeersChanged()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package ckit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestDenylist(t *testing.T) {
+	dl, err := parseDenylist([]string{"node-a", "10.0.0.0/24", "fd00::/8"})
+	require.NoError(t, err)
+
+	tt := []struct {
+		name   string
+		ip     string
+		expect bool
+	}{
+		{name: "node-a", expect: true},
+		{name: "node-a", ip: "192.168.0.1", expect: true},
+		{name: "node-b", ip: "10.0.0.15", expect: true},
+		{name: "node-b", ip: "fd00::1", expect: true},
+		{name: "node-b", ip: "10.0.1.15", expect: false},
+		{name: "node-b", expect: false},
+	}
+	for _, tc := range tt {
+		require.Equal(t, tc.expect, dl.match(tc.name, net.ParseIP(tc.ip)), "name=%s ip=%s", tc.name, tc.ip)
+	}
+
+	_, err = parseDenylist([]string{"10.0.0.0/33"})
+	require.EqualError(t, err, `invalid denied peer "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33`)
+
+	_, err = parseDenylist([]string{""})
+	require.EqualError(t, err, "denied peer names must not be empty")
+}
+
+func TestNode_DenyPeer(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", DeniedPeers: []string{"node-c"}})
+		b, _     = newTestNode(t, l, "node-b")
+		c, _     = newTestNode(t, l, "node-c")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	t.Run("config denied peers are rejected", func(t *testing.T) {
+		time.Sleep(500 * time.Millisecond)
+		for _, p := range a.Peers() {
+			require.NotEqual(t, "node-c", p.Name, "denied peer should not be in the peer list")
+		}
+	})
+
+	t.Run("denied peers are evicted", func(t *testing.T) {
+		var received atomic.Bool
+		a.OnBroadcast(func(from string, _ []byte) {
+			if from == "node-b" {
+				received.Store(true)
+			}
+		})
+
+		require.NoError(t, a.DenyPeer("node-b"))
+		require.Len(t, a.Peers(), 1)
+
+		require.NoError(t, b.Broadcast([]byte("hello")))
+		time.Sleep(500 * time.Millisecond)
+		require.False(t, received.Load(), "broadcasts from denied peers should be ignored")
+		require.Len(t, a.Peers(), 1)
+	})
+
+	t.Run("local node can't be denied", func(t *testing.T) {
+		require.EqualError(t, a.DenyPeer("node-a"), "cannot deny the local node")
+	})
+}
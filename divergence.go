@@ -0,0 +1,156 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+	"github.com/rfratto/ckit/shard"
+)
+
+// DivergentPeers returns the names of remote peers whose Sharder would
+// compute different owners for the same key than Config.Sharder, sorted by
+// name. A peer is divergent when the fingerprint it gossips differs from the
+// local fingerprint for two consecutive checks, so brief differences while a
+// change propagates through the cluster aren't reported.
+//
+// Peers running a version of ckit which doesn't gossip fingerprints, or
+// which don't set Config.DivergenceCheckInterval, are never divergent.
+// DivergentPeers always returns no names unless
+// Config.DivergenceCheckInterval is set.
+func (n *Node) DivergentPeers() []string {
+	n.divergenceMut.Lock()
+	defer n.divergenceMut.Unlock()
+	return append([]string(nil), n.divergent...)
+}
+
+// runDivergenceCheck publishes the fingerprint of cfg.Sharder and compares
+// it with the fingerprints of peers every cfg.DivergenceCheckInterval.
+//
+// runDivergenceCheck exits when ctx is canceled.
+func (n *Node) runDivergenceCheck(ctx context.Context) {
+	t := time.NewTicker(n.cfg.DivergenceCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := n.checkDivergence(ctx); err != nil && ctx.Err() == nil {
+			level.Warn(n.log).Log("msg", "failed to check for sharder divergence", "err", err)
+		}
+	}
+}
+
+// checkDivergence publishes the fingerprint of cfg.Sharder if it changed and
+// updates the set of divergent peers.
+func (n *Node) checkDivergence(ctx context.Context) error {
+	fp, err := shard.Fingerprint(n.cfg.Sharder)
+	if err != nil {
+		return fmt.Errorf("failed to compute sharder fingerprint: %w", err)
+	}
+	if err := n.publishFingerprint(ctx, fp); err != nil {
+		return err
+	}
+
+	peers := make(map[string]struct{})
+	for _, p := range n.Peers() {
+		if !p.Self {
+			peers[p.Name] = struct{}{}
+		}
+	}
+
+	mismatched := make(map[string]struct{})
+	n.fingerprintsMut.Lock()
+	for name, other := range n.peerFingerprints {
+		if _, ok := peers[name]; ok && other != fp {
+			mismatched[name] = struct{}{}
+		}
+	}
+	n.fingerprintsMut.Unlock()
+
+	n.divergenceMut.Lock()
+	var divergent []string
+	for name := range mismatched {
+		if _, ok := n.mismatched[name]; ok {
+			divergent = append(divergent, name)
+		}
+	}
+	sort.Strings(divergent)
+	n.mismatched = mismatched
+
+	if stringSlicesEqual(n.divergent, divergent) {
+		n.divergenceMut.Unlock()
+		return nil
+	}
+	n.divergent = divergent
+	n.divergenceMut.Unlock()
+
+	n.m.sharderDivergentPeers.Set(float64(len(divergent)))
+	if len(divergent) > 0 {
+		level.Warn(n.log).Log("msg", "peers would compute different owners for the same key", "divergent", fmt.Sprint(divergent))
+	} else {
+		level.Info(n.log).Log("msg", "sharder divergence resolved")
+	}
+	if n.cfg.OnSharderDivergence != nil {
+		n.cfg.OnSharderDivergence(divergent)
+	}
+	return nil
+}
+
+// recordFingerprint records the sharder fingerprint gossiped by node. It is
+// called from memberlist event callbacks, which are the only places node.Meta
+// may be safely read.
+func (n *Node) recordFingerprint(node *memberlist.Node) {
+	if node.Name == n.cfg.Name {
+		return
+	}
+	fp := decodeMeta(node.Meta).SharderFingerprint
+
+	n.fingerprintsMut.Lock()
+	defer n.fingerprintsMut.Unlock()
+	if fp == 0 {
+		// The peer doesn't gossip fingerprints.
+		delete(n.peerFingerprints, node.Name)
+		return
+	}
+	n.peerFingerprints[node.Name] = fp
+}
+
+// forgetFingerprint removes the sharder fingerprint of a peer which left the
+// cluster.
+func (n *Node) forgetFingerprint(name string) {
+	n.fingerprintsMut.Lock()
+	defer n.fingerprintsMut.Unlock()
+	delete(n.peerFingerprints, name)
+}
+
+// publishFingerprint gossips fp to peers if it changed.
+func (n *Node) publishFingerprint(ctx context.Context, fp uint64) error {
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+	if n.stopped {
+		return ErrStopped
+	}
+
+	n.metaMut.Lock()
+	if n.fingerprint == fp {
+		n.metaMut.Unlock()
+		return nil
+	}
+	prev := n.fingerprint
+	n.fingerprint = fp
+	if err := n.encodeMetaLocked(); err != nil {
+		n.fingerprint = prev
+		n.metaMut.Unlock()
+		return err
+	}
+	n.metaMut.Unlock()
+
+	return n.memberlist().UpdateNode(leaveTimeout(ctx))
+}
@@ -0,0 +1,72 @@
+package ckit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_DivergentPeers(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		mut       sync.Mutex
+		reported  []string
+		onDiverge = func(divergent []string) {
+			mut.Lock()
+			defer mut.Unlock()
+			reported = divergent
+		}
+		lastReported = func() []string {
+			mut.Lock()
+			defer mut.Unlock()
+			return reported
+		}
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name:                    "node-a",
+			Sharder:                 shard.Ring(16),
+			DivergenceCheckInterval: 50 * time.Millisecond,
+			OnSharderDivergence:     onDiverge,
+		})
+		b, _ = newTestNodeWithConfig(t, l, Config{
+			Name:                    "node-b",
+			Sharder:                 shard.Ring(16),
+			DivergenceCheckInterval: 50 * time.Millisecond,
+		})
+		c, _ = newTestNodeWithConfig(t, l, Config{
+			Name:                    "node-c",
+			Sharder:                 shard.Ring(32),
+			DivergenceCheckInterval: 50 * time.Millisecond,
+		})
+	)
+
+	ctx := context.Background()
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+	for _, n := range []*Node{a, b, c} {
+		require.NoError(t, n.ChangeState(ctx, peer.StateParticipant))
+	}
+
+	// node-c uses different sharder parameters, so it diverges from every
+	// other node.
+	require.Eventually(t, func() bool {
+		return stringSlicesEqual(a.DivergentPeers(), []string{"node-c"}) &&
+			stringSlicesEqual(b.DivergentPeers(), []string{"node-c"}) &&
+			stringSlicesEqual(c.DivergentPeers(), []string{"node-a", "node-b"}) &&
+			stringSlicesEqual(lastReported(), []string{"node-c"})
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Divergence is resolved once node-c leaves.
+	require.NoError(t, c.Stop())
+	require.Eventually(t, func() bool {
+		return len(a.DivergentPeers()) == 0 && len(lastReported()) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
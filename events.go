@@ -0,0 +1,188 @@
+package ckit
+
+import (
+	"context"
+	"sort"
+
+	"github.com/rfratto/ckit/internal/queue"
+	"github.com/rfratto/ckit/peer"
+)
+
+// An Event describes a change to a single peer. Event is implemented by
+// PeerJoined, PeerLeft, PeerStateChanged, and PeerUpdated.
+type Event interface {
+	// PeerName returns the name of the peer the event is for.
+	PeerName() string
+}
+
+// PeerJoined is emitted when a new peer is discovered.
+type PeerJoined struct {
+	Peer peer.Peer
+}
+
+// PeerLeft is emitted when a peer is removed from the cluster.
+type PeerLeft struct {
+	Peer peer.Peer // Last known value of the peer.
+}
+
+// PeerStateChanged is emitted when the state of an existing peer changes.
+type PeerStateChanged struct {
+	Peer     peer.Peer  // Current value of the peer.
+	Old, New peer.State // Old and new states of the peer.
+}
+
+// PeerUpdated is emitted when an existing peer changes in a way other than
+// its state, such as its address or labels.
+type PeerUpdated struct {
+	Old, New peer.Peer
+}
+
+// PeerName implements Event.
+func (e PeerJoined) PeerName() string { return e.Peer.Name }
+
+// PeerName implements Event.
+func (e PeerLeft) PeerName() string { return e.Peer.Name }
+
+// PeerName implements Event.
+func (e PeerStateChanged) PeerName() string { return e.Peer.Name }
+
+// PeerName implements Event.
+func (e PeerUpdated) PeerName() string { return e.New.Name }
+
+// An EventObserver watches a Node, receiving structured events when its peers
+// change.
+type EventObserver interface {
+	// NotifyEvents is invoked any time the set of Peers for a node changes.
+	// events describes every change since the previous notification, ordered
+	// by peer name.
+	//
+	// If NotifyEvents returns false, the EventObserver will no longer receive
+	// any notifications.
+	NotifyEvents(events []Event) (reregister bool)
+}
+
+// FuncEventObserver implements EventObserver.
+type FuncEventObserver func(events []Event) (reregister bool)
+
+// NotifyEvents implements EventObserver.
+func (f FuncEventObserver) NotifyEvents(events []Event) (reregister bool) { return f(events) }
+
+// EventsObserver wraps an EventObserver and converts it into an Observer.
+// The returned Observer tracks the last set of peers it was notified about
+// and invokes next with the difference.
+//
+// The first notification will include a PeerJoined event for every peer that
+// already exists.
+func EventsObserver(next EventObserver) Observer {
+	return &eventsObserver{next: next}
+}
+
+type eventsObserver struct {
+	lastPeers []peer.Peer
+	next      EventObserver
+}
+
+func (eo *eventsObserver) NotifyPeersChanged(peers []peer.Peer) (reregister bool) {
+	events := DiffPeers(eo.lastPeers, peers)
+	eo.lastPeers = peers
+
+	if len(events) == 0 {
+		return true
+	}
+	return eo.next.NotifyEvents(events)
+}
+
+// DiffPeers returns the set of events that describe the change from before
+// to after, ordered by peer name.
+func DiffPeers(before, after []peer.Peer) []Event {
+	var (
+		events = make([]Event, 0)
+
+		beforeLookup = make(map[string]peer.Peer, len(before))
+		afterLookup  = make(map[string]struct{}, len(after))
+	)
+	for _, p := range before {
+		beforeLookup[p.Name] = p
+	}
+
+	for _, p := range after {
+		afterLookup[p.Name] = struct{}{}
+
+		old, existed := beforeLookup[p.Name]
+		if !existed {
+			events = append(events, PeerJoined{Peer: p})
+			continue
+		}
+
+		if old.State != p.State {
+			events = append(events, PeerStateChanged{Peer: p, Old: old.State, New: p.State})
+		}
+
+		// Check for changes other than state.
+		compare := old
+		compare.State = p.State
+		if !compare.Equal(p) {
+			events = append(events, PeerUpdated{Old: old, New: p})
+		}
+	}
+
+	for _, p := range before {
+		if _, exists := afterLookup[p.Name]; !exists {
+			events = append(events, PeerLeft{Peer: p})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].PeerName() < events[j].PeerName()
+	})
+	return events
+}
+
+// ObserveEvents registers o to be informed with structured events when the
+// cluster changes. It is equivalent to calling Observe with an
+// EventsObserver.
+func (n *Node) ObserveEvents(o EventObserver) (unsubscribe func()) {
+	return n.Observe(EventsObserver(o))
+}
+
+// Events returns a channel which receives an Event any time the cluster
+// changes. As with EventsObserver, the first change will be preceded by a
+// PeerJoined event for every peer that already exists. The channel is closed
+// once ctx is canceled.
+//
+// Events are buffered in the background until they are received, so a slow
+// consumer will never delay notifications to Observers. Consumers must keep
+// up with the rate of events to avoid the buffer growing without bound.
+func (n *Node) Events(ctx context.Context) <-chan Event {
+	var (
+		ch      = make(chan Event)
+		pending = queue.New(queue.Unbounded)
+	)
+
+	n.ObserveContext(ctx, EventsObserver(FuncEventObserver(func(events []Event) (reregister bool) {
+		for _, e := range events {
+			pending.Enqueue(e)
+		}
+		return true
+	})))
+
+	go func() {
+		defer close(ch)
+		defer pending.Close()
+
+		for {
+			v, err := pending.Dequeue(ctx)
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- v.(Event):
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,57 @@
+package ckit
+
+import (
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffPeers(t *testing.T) {
+	var (
+		a = peer.Peer{Name: "a", State: peer.StateViewer}
+		b = peer.Peer{Name: "b", State: peer.StateParticipant}
+		c = peer.Peer{Name: "c", State: peer.StateParticipant}
+
+		bTerminating = peer.Peer{Name: "b", State: peer.StateTerminating}
+		cMoved       = peer.Peer{Name: "c", Addr: "new-addr", State: peer.StateParticipant}
+	)
+
+	t.Run("no changes", func(t *testing.T) {
+		require.Empty(t, DiffPeers([]peer.Peer{a, b}, []peer.Peer{a, b}))
+	})
+
+	t.Run("all changes", func(t *testing.T) {
+		events := DiffPeers(
+			[]peer.Peer{a, b, c},
+			[]peer.Peer{bTerminating, cMoved, {Name: "d"}},
+		)
+
+		expect := []Event{
+			PeerLeft{Peer: a},
+			PeerStateChanged{Peer: bTerminating, Old: peer.StateParticipant, New: peer.StateTerminating},
+			PeerUpdated{Old: c, New: cMoved},
+			PeerJoined{Peer: peer.Peer{Name: "d"}},
+		}
+		require.Equal(t, expect, events)
+	})
+}
+
+func TestEventsObserver(t *testing.T) {
+	var received [][]Event
+
+	obs := EventsObserver(FuncEventObserver(func(events []Event) bool {
+		received = append(received, events)
+		return true
+	}))
+
+	a := peer.Peer{Name: "a"}
+	obs.NotifyPeersChanged([]peer.Peer{a})
+	obs.NotifyPeersChanged([]peer.Peer{a})
+	obs.NotifyPeersChanged(nil)
+
+	require.Equal(t, [][]Event{
+		{PeerJoined{Peer: a}},
+		{PeerLeft{Peer: a}},
+	}, received)
+}
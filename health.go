@@ -0,0 +1,239 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/internal/phi"
+	"github.com/rfratto/ckit/shard"
+)
+
+const (
+	// healthWindowSize is the number of ping intervals used for calculating
+	// the health of a peer.
+	healthWindowSize = 100
+
+	// healthMinStdDev is the minimum standard deviation of ping intervals used
+	// for calculating the health of a peer.
+	healthMinStdDev = 500 * time.Millisecond
+)
+
+// PeerHealth describes the health of a peer as observed by the local Node.
+// Health is calculated from the history of successful pings sent to the
+// peer.
+type PeerHealth struct {
+	// Phi is the suspicion level that the peer has failed, determined by a
+	// phi accrual failure detector. Higher values indicate a greater
+	// likelihood of failure: a phi of 1 means there is a roughly 10% chance
+	// of being wrong about the peer having failed, a phi of 2 roughly 1%, and
+	// so on. Phi is 0 until enough pings have completed to make an estimate.
+	Phi float64
+
+	// RTT is the round trip time of the most recent successful ping.
+	RTT time.Duration
+
+	// LastContact is the time of the most recent successful ping.
+	LastContact time.Time
+}
+
+// peerHealth tracks the health of an individual peer.
+type peerHealth struct {
+	detector *phi.Detector
+	rtt      time.Duration
+
+	// sendFailed is the time of the most recent call to Send which failed to
+	// reach the peer. It's reset when Send reaches the peer.
+	sendFailed time.Time
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{detector: phi.New(healthWindowSize, healthMinStdDev)}
+}
+
+// PeerHealth returns the health of the peer with the given name. ok will be
+// false if no pings to the peer have completed yet. The local node never has
+// health information.
+func (n *Node) PeerHealth(name string) (health PeerHealth, ok bool) {
+	n.healthMut.Lock()
+	defer n.healthMut.Unlock()
+
+	h, ok := n.health[name]
+	if !ok {
+		return PeerHealth{}, false
+	}
+	return h.get(time.Now()), true
+}
+
+func (h *peerHealth) get(now time.Time) PeerHealth {
+	return PeerHealth{
+		Phi:         h.detector.Phi(now),
+		RTT:         h.rtt,
+		LastContact: h.detector.Last(),
+	}
+}
+
+// AckPayload implements memberlist.PingDelegate. No payload is sent.
+func (nd *nodeDelegate) AckPayload() []byte { return nil }
+
+// NotifyPingComplete implements memberlist.PingDelegate, recording a
+// heartbeat for other.
+func (nd *nodeDelegate) NotifyPingComplete(other *memberlist.Node, rtt time.Duration, payload []byte) {
+	nd.healthMut.Lock()
+	defer nd.healthMut.Unlock()
+
+	h, ok := nd.health[other.Name]
+	if !ok {
+		h = newPeerHealth()
+		nd.health[other.Name] = h
+	}
+	h.detector.Heartbeat(time.Now())
+	h.rtt = rtt
+}
+
+// recordSend records whether a call to Send reached the peer with the given
+// name.
+func (n *Node) recordSend(name string, reached bool) {
+	n.healthMut.Lock()
+	defer n.healthMut.Unlock()
+
+	h, ok := n.health[name]
+	switch {
+	case !ok && reached:
+		return
+	case !ok:
+		h = newPeerHealth()
+		n.health[name] = h
+	}
+
+	if reached {
+		h.sendFailed = time.Time{}
+	} else {
+		h.sendFailed = time.Now()
+	}
+}
+
+// UnhealthyPeers returns the names of remote peers which are suspected to be
+// unhealthy, sorted by name. A peer is unhealthy if PeerStatus reports it as
+// LivenessSuspect, or if the most recent call to Send failed to reach the
+// peer and no pings to the peer have succeeded since.
+//
+// Unhealthy peers are still members of the cluster, and may recover without
+// leaving it. See Config.HealthCheckInterval for marking unhealthy peers in
+// a Sharder.
+func (n *Node) UnhealthyPeers() []string {
+	n.healthMut.Lock()
+	defer n.healthMut.Unlock()
+
+	var (
+		now       = time.Now()
+		unhealthy []string
+	)
+	for name, h := range n.health {
+		health := h.get(now)
+		if health.Phi >= livenessSuspectPhi || (!h.sendFailed.IsZero() && h.sendFailed.After(health.LastContact)) {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy
+}
+
+// runHealthCheck marks unhealthy peers in cfg.Sharder every
+// cfg.HealthCheckInterval.
+//
+// runHealthCheck exits when ctx is canceled.
+func (n *Node) runHealthCheck(ctx context.Context) {
+	t := time.NewTicker(n.cfg.HealthCheckInterval)
+	defer t.Stop()
+
+	var last []string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		last = n.checkHealth(last)
+	}
+}
+
+// checkHealth marks unhealthy peers in cfg.Sharder if they changed from
+// last, returning the current set of unhealthy peers.
+func (n *Node) checkHealth(last []string) []string {
+	unhealthy := n.UnhealthyPeers()
+	if stringSlicesEqual(last, unhealthy) {
+		return last
+	}
+
+	level.Debug(n.log).Log("msg", "unhealthy peers changed", "unhealthy", fmt.Sprint(unhealthy))
+	shard.SetUnhealthy(n.cfg.Sharder, unhealthy...)
+	return unhealthy
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// forgetHealth removes health information for a peer which left the cluster.
+func (n *Node) forgetHealth(name string) {
+	n.healthMut.Lock()
+	defer n.healthMut.Unlock()
+	delete(n.health, name)
+}
+
+// healthCollector exposes the health of every peer as metrics.
+type healthCollector struct {
+	n *Node
+
+	phiDesc *prometheus.Desc
+	rttDesc *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*healthCollector)(nil)
+
+func newHealthCollector(n *Node) *healthCollector {
+	return &healthCollector{
+		n: n,
+
+		phiDesc: prometheus.NewDesc(
+			"cluster_node_peer_phi",
+			"Phi accrual suspicion level that a peer has failed. Higher values are less healthy.",
+			[]string{"peer"}, nil,
+		),
+		rttDesc: prometheus.NewDesc(
+			"cluster_node_peer_rtt_seconds",
+			"Round trip time of the most recent successful ping to a peer.",
+			[]string{"peer"}, nil,
+		),
+	}
+}
+
+func (hc *healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hc.phiDesc
+	ch <- hc.rttDesc
+}
+
+func (hc *healthCollector) Collect(ch chan<- prometheus.Metric) {
+	hc.n.healthMut.Lock()
+	defer hc.n.healthMut.Unlock()
+
+	now := time.Now()
+	for name, h := range hc.n.health {
+		health := h.get(now)
+		ch <- prometheus.MustNewConstMetric(hc.phiDesc, prometheus.GaugeValue, health.Phi, name)
+		ch <- prometheus.MustNewConstMetric(hc.rttDesc, prometheus.GaugeValue, health.RTT.Seconds(), name)
+	}
+}
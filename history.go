@@ -0,0 +1,128 @@
+package ckit
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rfratto/ckit/internal/lamport"
+	"github.com/rfratto/ckit/peer"
+)
+
+// defaultHistorySize is the default value of Config.HistorySize.
+const defaultHistorySize = 256
+
+// HistoryEntry is an Event recorded in the membership history of a Node.
+type HistoryEntry struct {
+	Time        time.Time // Wall clock time the event was observed.
+	LamportTime uint64    // Lamport time of the local Node when the event was observed.
+	Event       Event     // PeerJoined, PeerLeft, PeerStateChanged, or PeerUpdated.
+}
+
+// history is a fixed-size ring buffer of HistoryEntry.
+type history struct {
+	mut     sync.RWMutex
+	entries []HistoryEntry
+	next    int  // Index to write the next entry to.
+	full    bool // True once entries has wrapped around.
+}
+
+func newHistory(size int) *history {
+	return &history{entries: make([]HistoryEntry, size)}
+}
+
+// record records events which happened at the given time. record is a no-op
+// for a nil history.
+func (h *history) record(now time.Time, lt lamport.Time, events []Event) {
+	if h == nil || len(h.entries) == 0 {
+		return
+	}
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	for _, e := range events {
+		h.entries[h.next] = HistoryEntry{Time: now, LamportTime: uint64(lt), Event: e}
+		h.next = (h.next + 1) % len(h.entries)
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+}
+
+// list returns recorded entries from oldest to newest.
+func (h *history) list() []HistoryEntry {
+	if h == nil {
+		return nil
+	}
+
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+
+	if !h.full {
+		return append([]HistoryEntry(nil), h.entries[:h.next]...)
+	}
+	res := make([]HistoryEntry, 0, len(h.entries))
+	res = append(res, h.entries[h.next:]...)
+	return append(res, h.entries[:h.next]...)
+}
+
+// History returns the most recent membership events observed by n, ordered
+// from oldest to newest. Up to Config.HistorySize events are retained.
+// History returns nil if history is disabled.
+func (n *Node) History() []HistoryEntry {
+	return n.history.list()
+}
+
+// HistoryHandler returns an http.Handler which responds with the membership
+// history of n encoded as JSON. HistoryHandler is intended for debugging.
+func (n *Node) HistoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := n.History()
+
+		resp := make([]historyEntryJSON, 0, len(entries))
+		for _, e := range entries {
+			resp = append(resp, newHistoryEntryJSON(e))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	})
+}
+
+type historyEntryJSON struct {
+	Time        time.Time `json:"time"`
+	LamportTime uint64    `json:"lamport_time"`
+	Type        string    `json:"type"`
+	Peer        string    `json:"peer"`
+	Addr        string    `json:"addr,omitempty"`
+	State       string    `json:"state"`
+	OldState    string    `json:"old_state,omitempty"`
+}
+
+func newHistoryEntryJSON(e HistoryEntry) historyEntryJSON {
+	res := historyEntryJSON{
+		Time:        e.Time,
+		LamportTime: e.LamportTime,
+		Peer:        e.Event.PeerName(),
+	}
+
+	var p peer.Peer
+	switch ev := e.Event.(type) {
+	case PeerJoined:
+		res.Type, p = "peer_joined", ev.Peer
+	case PeerLeft:
+		res.Type, p = "peer_left", ev.Peer
+	case PeerStateChanged:
+		res.Type, p = "peer_state_changed", ev.Peer
+		res.OldState = ev.Old.String()
+	case PeerUpdated:
+		res.Type, p = "peer_updated", ev.New
+	}
+	res.Addr = p.Addr
+	res.State = p.State.String()
+	return res
+}
@@ -0,0 +1,83 @@
+package ckit
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	require.Empty(t, h.list())
+
+	now := time.Now()
+	h.record(now, 1, []Event{PeerJoined{Peer: peer.Peer{Name: "a"}}, PeerJoined{Peer: peer.Peer{Name: "b"}}})
+
+	names := func() []string {
+		var res []string
+		for _, e := range h.list() {
+			res = append(res, e.Event.PeerName())
+		}
+		return res
+	}
+	require.Equal(t, []string{"a", "b"}, names())
+
+	h.record(now, 2, []Event{PeerJoined{Peer: peer.Peer{Name: "c"}}, PeerLeft{Peer: peer.Peer{Name: "a"}}})
+	require.Equal(t, []string{"b", "c", "a"}, names())
+
+	entries := h.list()
+	require.Equal(t, uint64(1), entries[0].LamportTime)
+	require.Equal(t, uint64(2), entries[2].LamportTime)
+	require.Equal(t, PeerLeft{Peer: peer.Peer{Name: "a"}}, entries[2].Event)
+
+	var disabled *history
+	disabled.record(now, 1, []Event{PeerJoined{Peer: peer.Peer{Name: "a"}}})
+	require.Nil(t, disabled.list())
+}
+
+func TestNode_History(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, e := range n.History() {
+			if joined, ok := e.Event.(PeerJoined); ok && joined.Peer.Name == "node-b" {
+				return true
+			}
+		}
+		return false
+	})
+
+	rec := httptest.NewRecorder()
+	a.HistoryHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var resp []historyEntryJSON
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	var found bool
+	for _, e := range resp {
+		if e.Type == "peer_joined" && e.Peer == "node-b" {
+			found = true
+		}
+	}
+	require.True(t, found, "expected join of node-b in history")
+
+	t.Run("disabled", func(t *testing.T) {
+		n, _ := newTestNodeWithConfig(t, l, Config{Name: "node-c", HistorySize: -1})
+		runTestNode(t, n, nil)
+		require.Nil(t, n.History())
+	})
+}
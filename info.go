@@ -0,0 +1,45 @@
+package ckit
+
+import "github.com/rfratto/ckit/peer"
+
+// PeerInfo describes a peer along with low-level gossip details, intended
+// for debugging.
+type PeerInfo struct {
+	Peer peer.Peer
+
+	// StateTime is the lamport time of the most recent state message
+	// received for the peer. StateTime is 0 if no state message has been
+	// received.
+	StateTime uint64
+
+	// Incarnation of the peer which sent the most recent state message.
+	// Incarnations increase every time a peer restarts.
+	Incarnation uint64
+}
+
+// ClockTime returns the current lamport time of n. The lamport clock moves
+// forward any time n sends a message or receives a message with a later
+// time.
+func (n *Node) ClockTime() uint64 {
+	return uint64(n.clock.Now())
+}
+
+// PeerInfos returns a PeerInfo for every peer returned by Peers, filtered by
+// opts.
+func (n *Node) PeerInfos(opts ...PeersOption) []PeerInfo {
+	peers := n.Peers(opts...)
+
+	n.peerMut.RLock()
+	defer n.peerMut.RUnlock()
+
+	res := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		info := PeerInfo{Peer: p}
+		if msg, ok := n.peerStates[p.Name]; ok {
+			info.StateTime = uint64(msg.Time)
+			info.Incarnation = msg.Incarnation
+		}
+		res = append(res, info)
+	}
+	return res
+}
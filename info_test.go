@@ -0,0 +1,78 @@
+package ckit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_PeerInfos(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-b" {
+				return p.State == peer.StateParticipant
+			}
+		}
+		return false
+	})
+
+	infos := a.PeerInfos(WithNamePrefix("node-b"))
+	require.Len(t, infos, 1)
+	require.Equal(t, "node-b", infos[0].Peer.Name)
+
+	stateTime, ok := b.PeerStateTime("node-b")
+	require.True(t, ok)
+	require.Equal(t, stateTime, infos[0].StateTime)
+	require.Equal(t, b.incarnation, infos[0].Incarnation)
+
+	// a observed the state message from b, so its clock must be past it.
+	require.Greater(t, a.ClockTime(), infos[0].StateTime)
+}
+
+func TestNode_PeerParticipantTime(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	_, ok := a.PeerParticipantTime("node-b")
+	require.False(t, ok, "viewers should not have a participant time")
+
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+	waitClusterState(t, a, func(n *Node) bool {
+		_, ok := n.PeerParticipantTime("node-b")
+		return ok
+	})
+	since, _ := a.PeerParticipantTime("node-b")
+	stateTime, _ := a.PeerStateTime("node-b")
+	require.Equal(t, stateTime, since)
+
+	// Rebroadcasting the state must not move the participant time.
+	require.NoError(t, b.SetLabels(context.Background(), map[string]string{"foo": "bar"}))
+	waitClusterState(t, a, func(n *Node) bool {
+		t, _ := n.PeerStateTime("node-b")
+		return t > stateTime
+	})
+	newSince, ok := a.PeerParticipantTime("node-b")
+	require.True(t, ok)
+	require.Equal(t, since, newSince)
+}
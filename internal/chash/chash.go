@@ -2,8 +2,16 @@
 // A higher level API is exposed by the shard package.
 package chash
 
-// Hash is a consistent hashing algorithm. Implementations of Hash are
-// goroutine safe.
+import (
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hash is a consistent hashing algorithm. Get and Describe may be called
+// concurrently, but methods which modify a Hash must not be called
+// concurrently with any other method. Callers which need to modify a Hash
+// while it's in use should publish a new Hash instead.
 type Hash interface {
 	// Get will retrieve the n owners for key. Get will return an error if there
 	// are not at least n nodes.
@@ -11,4 +19,124 @@ type Hash interface {
 
 	// SetNodes updates the set of nodes used for hashing.
 	SetNodes(nodes []string)
+
+	// Describe returns a deterministic description of the current state of
+	// the Hash.
+	Describe() Description
+}
+
+// HashFunc hashes data to a uint64. HashFunc is used to place nodes within
+// a Hash.
+type HashFunc func(data []byte) uint64
+
+// hashString hashes s with f, defaulting to xxhash if f is nil.
+func hashString(f HashFunc, s string) uint64 {
+	if f == nil {
+		return xxhash.Sum64String(s)
+	}
+	return f([]byte(s))
+}
+
+// Seeded returns a HashFunc which mixes seed into the hashes of f, so
+// hashes with different seeds are independent of each other. If f is nil,
+// xxhash is used.
+func Seeded(f HashFunc, seed uint64) HashFunc {
+	return func(data []byte) uint64 {
+		var h uint64
+		if f == nil {
+			h = xxhash.Sum64(data)
+		} else {
+			h = f(data)
+		}
+		return xorshiftMult64(h ^ seed)
+	}
+}
+
+// Description describes the state of a Hash: its algorithm, the parameters
+// it was created with, and the nodes and tokens used for hashing.
+type Description struct {
+	Algorithm string         `json:"algorithm"`
+	Params    map[string]int `json:"params,omitempty"`
+	Nodes     []string       `json:"nodes"`            // Sorted in the order used by the Hash.
+	Tokens    []Token        `json:"tokens,omitempty"` // Sorted by token.
+}
+
+// Token is a position of a node within a Hash.
+type Token struct {
+	Node  string `json:"node"`
+	Token uint64 `json:"token"`
+}
+
+// describeTokens converts toks into a Description with the given algorithm.
+// toks must already be sorted.
+func describeTokens(algorithm string, params map[string]int, toks []ringToken) Description {
+	var (
+		seen   = make(map[string]struct{})
+		nodes  = make([]string, 0)
+		tokens = make([]Token, len(toks))
+	)
+	for i, tok := range toks {
+		tokens[i] = Token{Node: tok.node, Token: tok.token}
+		if _, ok := seen[tok.node]; !ok {
+			seen[tok.node] = struct{}{}
+			nodes = append(nodes, tok.node)
+		}
+	}
+	sort.Strings(nodes)
+
+	return Description{
+		Algorithm: algorithm,
+		Params:    params,
+		Nodes:     nodes,
+		Tokens:    tokens,
+	}
+}
+
+// WeightedHash is a Hash which supports assigning relative weights to nodes.
+type WeightedHash interface {
+	Hash
+
+	// SetWeightedNodes updates the set of nodes used for hashing. weights[i]
+	// is the weight of nodes[i]; nodes with higher weights are assigned
+	// proportionally more keys. Weights less than 1 are treated as 1.
+	SetWeightedNodes(nodes []string, weights []int)
+}
+
+// NodeCounter is a Hash which may ignore some of the nodes it's given, such as
+// nodes whose share of the total weight is too small to own any keys.
+type NodeCounter interface {
+	Hash
+
+	// NumNodes returns the number of nodes which own keys. Get returns an
+	// error when asked for more owners than NumNodes.
+	NumNodes() int
+}
+
+// IncrementalHash is a Hash which supports adding and removing nodes without
+// recomputing the state of existing nodes.
+type IncrementalHash interface {
+	Hash
+
+	// AddNodes adds nodes which aren't already in the Hash. weights[i] is the
+	// weight of nodes[i], and is ignored by hashes which don't support
+	// weights.
+	AddNodes(nodes []string, weights []int)
+
+	// RemoveNodes removes nodes from the Hash. Nodes which aren't in the Hash
+	// are ignored.
+	RemoveNodes(nodes []string)
+
+	// Clone returns a copy of the Hash. Modifying the copy doesn't affect
+	// the original, so the original may continue to be used while the copy
+	// is modified.
+	Clone() IncrementalHash
+}
+
+// nodeWeight returns the weight of the ith node. Returns 1 if weights is nil
+// or the weight is less than 1.
+func nodeWeight(weights []int, i int) int {
+	if i >= len(weights) || weights[i] < 1 {
+		return 1
+	}
+	return weights[i]
 }
@@ -14,11 +14,17 @@ import (
 var allHashes = []struct {
 	Name string
 	H    func() Hash
+
+	// Positional hashes are only consistent when nodes are added or removed
+	// at the end of the set of nodes.
+	Positional bool
 }{
-	{Name: "ring 256 tokens", H: func() Hash { return Ring(256) }},
-	{Name: "ring 512 tokens", H: func() Hash { return Ring(512) }},
-	{Name: "rendezvous", H: func() Hash { return Rendezvous() }},
-	{Name: "multiprobe", H: func() Hash { return Multiprobe() }},
+	{Name: "ring 256 tokens", H: func() Hash { return Ring(256, nil) }},
+	{Name: "ring 512 tokens", H: func() Hash { return Ring(512, nil) }},
+	{Name: "rendezvous", H: func() Hash { return Rendezvous(nil) }},
+	{Name: "multiprobe", H: func() Hash { return Multiprobe(DefaultProbes, nil) }},
+	{Name: "multiprobe 64 probes", H: func() Hash { return Multiprobe(64, nil) }},
+	{Name: "jump", H: func() Hash { return Jump() }, Positional: true},
 }
 
 // TestHashes_Consistent enforces that all consistent hashing algorithms
@@ -26,6 +32,9 @@ var allHashes = []struct {
 func TestHashes_Consistent(t *testing.T) {
 	for _, tc := range allHashes {
 		t.Run(tc.Name, func(t *testing.T) {
+			if tc.Positional {
+				t.Skip("hash is only consistent for nodes at the end")
+			}
 			h := tc.H()
 
 			// Setting up 3 nodes should return those three unique nodes, in some order.
@@ -133,6 +142,63 @@ func TestHashes_Distribution(t *testing.T) {
 	}
 }
 
+// TestWeightedHashes_Distribution enforces that weighted hashing algorithms
+// distribute data proportionally to node weights within some controlled
+// tolerance.
+func TestWeightedHashes_Distribution(t *testing.T) {
+	var (
+		nodes   = []string{"node-a", "node-b", "node-c", "node-d"}
+		weights = []int{1, 1, 2, 4}
+
+		totalWeight = 8
+		numHashes   = 10_000 * totalWeight
+		errorMargin = 0.25 // Tolerance for distribution (percentage)
+	)
+
+	weightedHashes := []struct {
+		Name string
+		H    func() WeightedHash
+	}{
+		{Name: "ring 256 tokens", H: func() WeightedHash { return Ring(256, nil) }},
+		{Name: "rendezvous", H: func() WeightedHash { return Rendezvous(nil) }},
+	}
+
+	for _, hasher := range weightedHashes {
+		t.Run(hasher.Name, func(t *testing.T) {
+			var (
+				h        = hasher.H()
+				nodeDist = map[string]int{}
+			)
+			h.SetWeightedNodes(nodes, weights)
+
+			r := rand.New(rand.NewSource(0))
+			for i := 0; i < numHashes; i++ {
+				key := make([]byte, 5)
+				_, _ = r.Read(key)
+
+				owners, err := h.Get(xxhash.Sum64String(fmt.Sprintf("%2x", key)), 1)
+				require.NoError(t, err)
+				nodeDist[owners[0]]++
+			}
+
+			for i, node := range nodes {
+				var (
+					perfectDist = numHashes / totalWeight * weights[i]
+					minDist     = perfectDist - int(math.Floor(errorMargin*float64(perfectDist)))
+					maxDist     = perfectDist + int(math.Ceil(errorMargin*float64(perfectDist)))
+				)
+				calls := nodeDist[node]
+				if calls < minDist || calls > maxDist {
+					require.Failf(t, "distribution out of acceptable range",
+						"unacceptable distribution for %s. expected [%d, %d], got %d",
+						node, minDist, maxDist, calls,
+					)
+				}
+			}
+		})
+	}
+}
+
 func median(nums []float64) float64 {
 	mid := len(nums) / 2
 	if len(nums)%2 != 0 {
@@ -175,3 +241,37 @@ func runBenchmarkHashes(b *testing.B, numNodes int) {
 		})
 	}
 }
+
+// TestHashes_DefaultHashFunc ensures that passing xxhash as the hash function
+// places nodes identically to the default.
+func TestHashes_DefaultHashFunc(t *testing.T) {
+	tt := []struct {
+		Name string
+		H    func(hash HashFunc) Hash
+	}{
+		{Name: "ring", H: func(hash HashFunc) Hash { return Ring(16, hash) }},
+		{Name: "rendezvous", H: func(hash HashFunc) Hash { return Rendezvous(hash) }},
+		{Name: "multiprobe", H: func(hash HashFunc) Hash { return Multiprobe(DefaultProbes, hash) }},
+	}
+
+	nodes := []string{"node-a", "node-b", "node-c"}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var (
+				defaultHash = tc.H(nil)
+				customHash  = tc.H(xxhash.Sum64)
+			)
+			defaultHash.SetNodes(nodes)
+			customHash.SetNodes(nodes)
+			require.Equal(t, defaultHash.Describe(), customHash.Describe())
+
+			for key := uint64(0); key < 100; key++ {
+				expect, err := defaultHash.Get(key, 2)
+				require.NoError(t, err)
+				actual, err := customHash.Get(key, 2)
+				require.NoError(t, err)
+				require.Equal(t, expect, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package chash
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TokenHash is a Hash where the tokens of each node are chosen by the caller
+// rather than generated by the Hash.
+type TokenHash interface {
+	Hash
+
+	// SetNodeTokens updates the set of nodes used for hashing. tokens[i] are
+	// the tokens of nodes[i]. Nodes without tokens own no keys and are
+	// ignored.
+	SetNodeTokens(nodes []string, tokens [][]uint32)
+}
+
+// Dskit implements the token ring used by grafana/dskit. Nodes are given
+// tokens with SetNodeTokens, typically the tokens which were registered in
+// the dskit ring. Keys are truncated to 32 bits, and a key is owned by the
+// node with the first token which is strictly greater than the key, wrapping
+// around to the first token. Additional owners are the nodes of the tokens
+// which follow, skipping nodes which were already chosen.
+//
+// If two nodes have the same token, the node that lexicographically comes
+// first owns the token. Dskit runs in O(log N) time, where N is the total
+// number of tokens.
+func Dskit() TokenHash {
+	return &dskitRing{}
+}
+
+type dskitRing struct {
+	// Tokens for all nodes. Must be sorted at all times.
+	numNodes int
+	tokens   []ringToken
+}
+
+func (r *dskitRing) Get(key uint64, n int) ([]string, error) {
+	if n > r.numNodes {
+		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, r.numNodes)
+	} else if n == 0 {
+		return []string{}, nil
+	}
+
+	key32 := uint64(uint32(key))
+	idx := sort.Search(len(r.tokens), func(i int) bool {
+		return r.tokens[i].token > key32
+	})
+	if idx == len(r.tokens) {
+		// Wrap around if we hit the end of the list.
+		idx = 0
+	}
+
+	var (
+		res  = make([]string, 0, n)
+		seen = make(map[string]struct{}, n)
+	)
+	for len(res) < n {
+		owner := r.tokens[idx].node
+		if _, found := seen[owner]; !found {
+			res = append(res, owner)
+			seen[owner] = struct{}{}
+		}
+		idx = (idx + 1) % len(r.tokens)
+	}
+	return res, nil
+}
+
+func (r *dskitRing) SetNodes(nodes []string) {
+	r.SetNodeTokens(nodes, nil)
+}
+
+func (r *dskitRing) SetNodeTokens(nodes []string, tokens [][]uint32) {
+	var (
+		numNodes int
+		toks     []ringToken
+	)
+	for i, node := range nodes {
+		if i >= len(tokens) || len(tokens[i]) == 0 {
+			continue
+		}
+		numNodes++
+
+		seen := make(map[uint32]struct{}, len(tokens[i]))
+		for _, tok := range tokens[i] {
+			if _, dup := seen[tok]; dup {
+				continue
+			}
+			seen[tok] = struct{}{}
+			toks = append(toks, ringToken{node: node, token: uint64(tok)})
+		}
+	}
+	sort.Sort(byRingToken(toks))
+
+	r.numNodes = numNodes
+	r.tokens = toks
+}
+
+func (r *dskitRing) Describe() Description {
+	return describeTokens("dskit", nil, r.tokens)
+}
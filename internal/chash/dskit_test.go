@@ -0,0 +1,37 @@
+package chash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDskit(t *testing.T) {
+	h := Dskit()
+	h.SetNodeTokens(
+		[]string{"a", "b", "no-tokens"},
+		[][]uint32{{100, 300}, {200}, nil},
+	)
+
+	tt := []struct {
+		key    uint64
+		n      int
+		expect []string
+	}{
+		{key: 99, n: 1, expect: []string{"a"}},
+		{key: 100, n: 1, expect: []string{"b"}}, // Tokens own keys lower than the token
+		{key: 150, n: 2, expect: []string{"b", "a"}},
+		{key: 250, n: 1, expect: []string{"a"}},
+		{key: 300, n: 2, expect: []string{"a", "b"}}, // Wraps around to the first token
+		{key: 1<<32 + 150, n: 1, expect: []string{"b"}},
+	}
+	for _, tc := range tt {
+		res, err := h.Get(tc.key, tc.n)
+		require.NoError(t, err)
+		require.Equal(t, tc.expect, res, "key %d", tc.key)
+	}
+
+	// Nodes without tokens can't own keys.
+	_, err := h.Get(0, 3)
+	require.EqualError(t, err, "not enough nodes: need at least 3, have 2")
+}
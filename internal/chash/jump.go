@@ -0,0 +1,109 @@
+package chash
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Jump implements a jump consistent hash: https://arxiv.org/abs/1406.2294
+//
+// Jump uses no memory beyond the set of nodes and performs a lookup in
+// O(log N) time, but requires nodes to be densely numbered: keys are assigned
+// to a node by its position in the set of nodes rather than its name. Nodes
+// are ordered by name, comparing trailing numbers numerically so that
+// "node-10" comes after "node-9".
+//
+// Jump is only consistent when nodes are added or removed at the end of that
+// order, such as when scaling a set of nodes named after their ordinal.
+// Removing any other node moves keys between every node after it.
+func Jump() Hash {
+	return &jump{}
+}
+
+type jump struct {
+	nodes []string // Ordered by byNodeOrdinal
+}
+
+func (j *jump) Get(key uint64, n int) ([]string, error) {
+	if n > len(j.nodes) {
+		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, len(j.nodes))
+	} else if n == 0 {
+		return []string{}, nil
+	}
+
+	var (
+		res    = make([]string, n)
+		bucket = jumpHash(key, len(j.nodes))
+	)
+	for i := 0; i < n; i++ {
+		// NOTE(rfratto): Replicas are the nodes which follow the owner, so
+		// adding a node at the end only changes the replicas of keys owned by
+		// the last few nodes.
+		res[i] = j.nodes[wrapIndex(bucket+i, len(j.nodes))]
+	}
+	return res, nil
+}
+
+func (j *jump) Describe() Description {
+	return Description{
+		Algorithm: "jump",
+		Nodes:     append([]string{}, j.nodes...),
+	}
+}
+
+// jumpHash returns the bucket in [0, numBuckets) for key.
+func jumpHash(key uint64, numBuckets int) int {
+	var b, next int64 = -1, 0
+	for next < int64(numBuckets) {
+		b = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (j *jump) SetNodes(nodes []string) {
+	newNodes := make([]string, len(nodes))
+	copy(newNodes, nodes)
+	sort.Sort(byNodeOrdinal(newNodes))
+
+	j.nodes = newNodes
+}
+
+// byNodeOrdinal sorts node names by their prefix, and then numerically by
+// their trailing number.
+type byNodeOrdinal []string
+
+func (b byNodeOrdinal) Len() int      { return len(b) }
+func (b byNodeOrdinal) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+func (b byNodeOrdinal) Less(i, j int) bool {
+	var (
+		prefixA, numA = splitOrdinal(b[i])
+		prefixB, numB = splitOrdinal(b[j])
+	)
+	if prefixA != prefixB {
+		return prefixA < prefixB
+	}
+	// Compare numbers by length first so numbers of any size can be compared
+	// without parsing them.
+	if len(numA) != len(numB) {
+		return len(numA) < len(numB)
+	}
+	if numA != numB {
+		return numA < numB
+	}
+	return b[i] < b[j]
+}
+
+// splitOrdinal splits name into a prefix and its trailing number. Leading
+// zeros are removed from the number.
+func splitOrdinal(name string) (prefix, num string) {
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	prefix, num = name[:i], strings.TrimLeft(name[i:], "0")
+	return prefix, num
+}
@@ -0,0 +1,44 @@
+package chash
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestJump_Consistent ensures that adding a node at the end of the set of
+// nodes only moves keys to the new node.
+func TestJump_Consistent(t *testing.T) {
+	var (
+		h     = Jump()
+		nodes = make([]string, 10)
+	)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("node-%d", i)
+	}
+
+	h.SetNodes(nodes[:9])
+	before := make([]string, 1000)
+	for key := range before {
+		owners, err := h.Get(uint64(key), 1)
+		require.NoError(t, err)
+		before[key] = owners[0]
+	}
+
+	h.SetNodes(nodes)
+	for key := range before {
+		owners, err := h.Get(uint64(key), 1)
+		require.NoError(t, err)
+		if owners[0] != before[key] {
+			require.Equal(t, "node-9", owners[0], "key %d moved to an existing node", key)
+		}
+	}
+}
+
+func TestJump_NodeOrder(t *testing.T) {
+	nodes := byNodeOrdinal{"node-10", "node-9", "node-009a", "other-1", "node-1", "node"}
+	sort.Sort(nodes)
+	require.Equal(t, byNodeOrdinal{"node", "node-1", "node-9", "node-10", "node-009a", "other-1"}, nodes)
+}
@@ -0,0 +1,123 @@
+package chash
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ketamaDigestsPerServer is the number of MD5 digests given to each node of
+// average weight. Each digest produces four points.
+const ketamaDigestsPerServer = 40
+
+// Ketama implements the continuum used by libketama and memcached clients
+// which are compatible with it. Node names are used as the server strings
+// hashed by libketama, which are typically "host:port".
+//
+// A node is given 40 MD5 digests for each node in the Hash, scaled by its
+// share of the total weight, and each digest produces four points on the
+// continuum. Nodes whose share of the weight is too small to be given a
+// digest own no keys. Keys are truncated to 32 bits, and a key is owned by
+// the node with the first point greater than or equal to the key, wrapping
+// around to the first point. Additional owners are the nodes of the points which
+// follow, skipping nodes which were already chosen.
+//
+// If two nodes have the same point, the node that lexicographically comes
+// first owns the point. Ketama runs in O(log N) time, where N is the total
+// number of points.
+func Ketama() WeightedHash {
+	return &ketama{}
+}
+
+type ketama struct {
+	// Points for all nodes. Must be sorted at all times.
+	numNodes int
+	tokens   []ringToken
+}
+
+func (k *ketama) Get(key uint64, n int) ([]string, error) {
+	if n > k.numNodes {
+		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, k.numNodes)
+	} else if n == 0 {
+		return []string{}, nil
+	}
+
+	key32 := uint64(uint32(key))
+	idx := sort.Search(len(k.tokens), func(i int) bool {
+		return k.tokens[i].token >= key32
+	})
+	if idx == len(k.tokens) {
+		// Wrap around if we hit the end of the list.
+		idx = 0
+	}
+
+	var (
+		res  = make([]string, 0, n)
+		seen = make(map[string]struct{}, n)
+	)
+	for len(res) < n {
+		owner := k.tokens[idx].node
+		if _, found := seen[owner]; !found {
+			res = append(res, owner)
+			seen[owner] = struct{}{}
+		}
+		idx = (idx + 1) % len(k.tokens)
+	}
+	return res, nil
+}
+
+func (k *ketama) SetNodes(nodes []string) {
+	k.SetWeightedNodes(nodes, nil)
+}
+
+func (k *ketama) SetWeightedNodes(nodes []string, weights []int) {
+	var totalWeight int
+	for i := range nodes {
+		totalWeight += nodeWeight(weights, i)
+	}
+
+	var (
+		numNodes int
+		toks     = make([]ringToken, 0, len(nodes)*ketamaDigestsPerServer*4)
+	)
+	for i, node := range nodes {
+		// NOTE(rfratto): libketama calculates the share of each node as a
+		// float and the number of digests as a double; the same precision is
+		// used here so rounding matches.
+		pct := float32(nodeWeight(weights, i)) / float32(totalWeight)
+		digests := int(math.Floor(float64(float32(float64(pct) * ketamaDigestsPerServer * float64(len(nodes))))))
+		if digests > 0 {
+			numNodes++
+		}
+
+		for d := 0; d < digests; d++ {
+			sum := md5.Sum([]byte(node + "-" + strconv.Itoa(d)))
+			for h := 0; h < 4; h++ {
+				toks = append(toks, ringToken{
+					node:  node,
+					token: uint64(binary.LittleEndian.Uint32(sum[h*4:])),
+				})
+			}
+		}
+	}
+	sort.Sort(byRingToken(toks))
+
+	k.numNodes = numNodes
+	k.tokens = toks
+}
+
+func (k *ketama) NumNodes() int { return k.numNodes }
+
+func (k *ketama) Describe() Description {
+	return describeTokens("ketama", nil, k.tokens)
+}
+
+// KetamaHash returns the libketama hash of data: the first four bytes of its
+// MD5 digest, read as a little-endian integer.
+func KetamaHash(data []byte) uint32 {
+	sum := md5.Sum(data)
+	return binary.LittleEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,64 @@
+package chash
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKetama(t *testing.T) {
+	h := Ketama()
+	h.SetNodes([]string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"})
+
+	desc := h.Describe()
+	require.Equal(t, "ketama", desc.Algorithm)
+	require.Len(t, desc.Tokens, 3*160, "every node should have 160 points")
+
+	// The points of a node are read from the digests of "<node>-<index>", and
+	// a key equal to a point is owned by that point's node.
+	sum := md5.Sum([]byte("10.0.0.2:11211-7"))
+	for i := 0; i < 4; i++ {
+		point := binary.LittleEndian.Uint32(sum[i*4:])
+		res, err := h.Get(uint64(point), 1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.2:11211"}, res)
+	}
+
+	// Keys after the last point wrap around to the first point.
+	var (
+		first = desc.Tokens[0]
+		last  = desc.Tokens[len(desc.Tokens)-1]
+	)
+	res, err := h.Get(last.Token+1, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{first.Node}, res)
+
+	res, err = h.Get(1<<32+first.Token, 3)
+	require.NoError(t, err)
+	require.Equal(t, first.Node, res[0], "keys should be truncated to 32 bits")
+	require.ElementsMatch(t, []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}, res)
+}
+
+func TestKetama_Weights(t *testing.T) {
+	h := Ketama()
+	h.SetWeightedNodes([]string{"a", "b", "c"}, []int{1, 1, 2})
+
+	points := make(map[string]int)
+	for _, tok := range h.Describe().Tokens {
+		points[tok.Node]++
+	}
+	// Each node gets floor(share * 40 * 3) digests of 4 points.
+	require.Equal(t, map[string]int{"a": 120, "b": 120, "c": 240}, points)
+
+	// Nodes with too little weight for a digest own no keys.
+	h.SetWeightedNodes([]string{"a", "b"}, []int{1000, 1})
+	_, err := h.Get(0, 2)
+	require.EqualError(t, err, "not enough nodes: need at least 2, have 1")
+}
+
+func TestKetamaHash(t *testing.T) {
+	sum := md5.Sum([]byte("foo"))
+	require.Equal(t, binary.LittleEndian.Uint32(sum[:]), KetamaHash([]byte("foo")))
+}
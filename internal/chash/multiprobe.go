@@ -5,27 +5,39 @@ import (
 	"math"
 	"sort"
 	"strconv"
-	"sync"
 
 	"github.com/cespare/xxhash/v2"
 )
 
+// DefaultProbes is the number of probes which gives multiprobe a median
+// peak-to-average load ratio of 1.05.
+const DefaultProbes = 21
+
 // Multiprobe implements a multi-probe hash: https://arxiv.org/abs/1505.00062
-// Multiprobe is optimized for a median peak-to-average load ratio of 1.05.
-// It performs a lookup in O(K * log N) time, where K is 21.
-func Multiprobe() Hash {
-	return &multiprobe{}
+// Each key is hashed probes times, and the key is owned by the node closest
+// to any of the probes. More probes give a lower peak-to-average load ratio
+// at the cost of slower lookups; see DefaultProbes. Values of probes less
+// than 1 are treated as 1.
+//
+// Multiprobe performs a lookup in O(K * log N) time, where K is probes.
+//
+// hash is used to hash node names and to derive probes from keys. If hash is
+// nil, xxhash is used.
+func Multiprobe(probes int, hash HashFunc) Hash {
+	if probes < 1 {
+		probes = 1
+	}
+	return &multiprobe{probes: probes, hash: hash}
 }
 
 type multiprobe struct {
-	mut    sync.RWMutex
+	probes int
+	hash   HashFunc
+
 	tokens []ringToken
 }
 
 func (mp *multiprobe) Get(key uint64, n int) ([]string, error) {
-	mp.mut.RLock()
-	defer mp.mut.RUnlock()
-
 	if n > len(mp.tokens) {
 		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, len(mp.tokens))
 	} else if n == 0 {
@@ -33,10 +45,8 @@ func (mp *multiprobe) Get(key uint64, n int) ([]string, error) {
 	}
 
 	var (
-		h1 = secondKey(key)
-		h2 = secondKey(h1)
-
-		K = 21
+		h1 = mp.secondKey(key)
+		h2 = mp.secondKey(h1)
 	)
 
 	var (
@@ -53,7 +63,7 @@ func (mp *multiprobe) Get(key uint64, n int) ([]string, error) {
 	// With 100 nodes, that would roughly be 7 nodes per bucket, moving the
 	// lookup time to O(21 * log(100)) to O(21 * log(7)) (roughly 139 to 59,
 	// a 57% improvement).
-	for k := 0; k < K; k++ {
+	for k := 0; k < mp.probes; k++ {
 		h := h1 + uint64(k)*h2
 
 		idx := findClosest(mp.tokens, h)
@@ -79,10 +89,16 @@ func (mp *multiprobe) Get(key uint64, n int) ([]string, error) {
 	return res, nil
 }
 
-func secondKey(key1 uint64) uint64 {
-	dig := xxhash.New()
-	_, _ = dig.Write(strconv.AppendUint(nil, key1, 16))
-	return dig.Sum64()
+func (mp *multiprobe) Describe() Description {
+	return describeTokens("multiprobe", map[string]int{"probes": mp.probes}, mp.tokens)
+}
+
+func (mp *multiprobe) secondKey(key1 uint64) uint64 {
+	data := strconv.AppendUint(nil, key1, 16)
+	if mp.hash != nil {
+		return mp.hash(data)
+	}
+	return xxhash.Sum64(data)
 }
 
 // findClosest returns the index of the tok whose distance to "to" is the
@@ -121,16 +137,32 @@ func distance(a, b uint64) uint64 {
 }
 
 func (mp *multiprobe) SetNodes(nodes []string) {
-	newTokens := make([]ringToken, len(nodes))
+	mp.tokens = mp.generateTokens(nodes)
+}
+
+func (mp *multiprobe) AddNodes(nodes []string, _ []int) {
+	mp.tokens = mergeTokens(mp.tokens, mp.generateTokens(nodes))
+}
+
+func (mp *multiprobe) RemoveNodes(nodes []string) {
+	mp.tokens, _ = removeTokens(mp.tokens, nodes)
+}
+
+func (mp *multiprobe) Clone() IncrementalHash {
+	// tokens is never modified in place, so it can be shared with the copy.
+	clone := *mp
+	return &clone
+}
+
+// generateTokens returns the sorted tokens for nodes.
+func (mp *multiprobe) generateTokens(nodes []string) []ringToken {
+	toks := make([]ringToken, len(nodes))
 	for i, n := range nodes {
-		newTokens[i] = ringToken{
+		toks[i] = ringToken{
 			node:  n,
-			token: xxhash.Sum64String(n),
+			token: hashString(mp.hash, n),
 		}
 	}
-	sort.Sort(byRingToken(newTokens))
-
-	mp.mut.Lock()
-	defer mp.mut.Unlock()
-	mp.tokens = newTokens
+	sort.Sort(byRingToken(toks))
+	return toks
 }
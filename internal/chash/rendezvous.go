@@ -2,35 +2,41 @@ package chash
 
 import (
 	"fmt"
+	"math"
 	"sort"
-	"sync"
-
-	"github.com/cespare/xxhash/v2"
 )
 
 // Rendezvous returns a rendezvous hashing algorithm (HRW, Highest Random
 // Weight). Rendezvous is optimized for excellent load distribution, but
 // has a runtime complexity of O(N).
-func Rendezvous() Hash {
-	return &rendezvous{}
+//
+// Rendezvous supports weighted nodes using logarithmic weighting, where the
+// probability of a node owning a key is proportional to its weight.
+//
+// hash is used to hash node names. If hash is nil, xxhash is used.
+func Rendezvous(hash HashFunc) WeightedHash {
+	return &rendezvous{hash: hash}
 }
 
 type rendezvous struct {
-	mut    sync.RWMutex
-	hashes map[string]uint64
-	nodes  []string
+	hash HashFunc
+
+	hashes  map[string]uint64
+	weights map[string]int // nil if all nodes have the same weight
+	nodes   []string
 }
 
 func (r *rendezvous) Get(key uint64, n int) ([]string, error) {
-	r.mut.RLock()
-	defer r.mut.RUnlock()
-
 	if n > len(r.nodes) {
 		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, len(r.nodes))
 	} else if n == 0 {
 		return []string{}, nil
 	}
 
+	if r.weights != nil {
+		return r.getWeighted(key, n), nil
+	}
+
 	var (
 		res    = make([]string, n)
 		hashes = make([]ringToken, len(r.nodes))
@@ -52,23 +58,81 @@ func (r *rendezvous) Get(key uint64, n int) ([]string, error) {
 	return res, nil
 }
 
+// getWeighted returns the n owners for key, accounting for node weights.
+// r.mut must be held when calling getWeighted.
+func (r *rendezvous) getWeighted(key uint64, n int) []string {
+	type score struct {
+		node  string
+		score float64
+	}
+
+	scores := make([]score, len(r.nodes))
+	for i, node := range r.nodes {
+		// Map the hash to (0, 1] and compute -ln(x)/weight, where x is the hash
+		// inverted so lower hashes still produce lower scores. Nodes with equal
+		// weights are ordered the same as the unweighted algorithm.
+		x := 1 - float64(xorshiftMult64(key^r.hashes[node]))/math.MaxUint64
+		scores[i] = score{
+			node:  node,
+			score: -math.Log(x) / float64(r.weights[node]),
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score == scores[j].score {
+			return scores[i].node < scores[j].node
+		}
+		return scores[i].score < scores[j].score
+	})
+
+	res := make([]string, n)
+	for i := 0; i < n; i++ {
+		res[i] = scores[i].node
+	}
+	return res
+}
+
 func (r *rendezvous) SetNodes(nodes []string) {
+	r.SetWeightedNodes(nodes, nil)
+}
+
+func (r *rendezvous) SetWeightedNodes(nodes []string, weights []int) {
 	var (
-		newHashes = make(map[string]uint64, len(nodes))
-		newNodes  = make([]string, len(nodes))
+		newHashes  = make(map[string]uint64, len(nodes))
+		newWeights = make(map[string]int, len(nodes))
+		newNodes   = make([]string, len(nodes))
+
+		weighted bool
 	)
 	for i, n := range nodes {
-		newHashes[n] = xxhash.Sum64String(n)
+		newHashes[n] = hashString(r.hash, n)
+		newWeights[n] = nodeWeight(weights, i)
 		newNodes[i] = n
+
+		if newWeights[n] != nodeWeight(weights, 0) {
+			weighted = true
+		}
 	}
 	sort.Strings(newNodes)
 
-	r.mut.Lock()
-	defer r.mut.Unlock()
+	if !weighted {
+		// Use the faster unweighted algorithm when all weights are equal.
+		newWeights = nil
+	}
+
 	r.hashes = newHashes
+	r.weights = newWeights
 	r.nodes = newNodes
 }
 
+func (r *rendezvous) Describe() Description {
+	toks := make([]ringToken, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		toks = append(toks, ringToken{node: node, token: r.hashes[node]})
+	}
+	sort.Sort(byRingToken(toks))
+	return describeTokens("rendezvous", nil, toks)
+}
+
 // https://vigna.di.unimi.it/ftp/papers/xorshift.pdf
 func xorshiftMult64(x uint64) uint64 {
 	x ^= x >> 12 // a
@@ -3,7 +3,6 @@ package chash
 import (
 	"fmt"
 	"sort"
-	"sync"
 	"unsafe"
 
 	"github.com/cespare/xxhash/v2"
@@ -18,13 +17,23 @@ import (
 // Ring hash is extremely fast, running in O(log N) time, but increases in
 // memory usage as numTokens increases. Low values of numTokens will cause poor
 // distribution; 256 or 512 is a good starting point.
-func Ring(numTokens int) Hash {
-	return &ringHash{numTokens: numTokens}
+//
+// Ring supports weighted nodes. A node with weight W is given numTokens * W
+// tokens. Values of numTokens less than 1 are treated as 1.
+//
+// hash is used to generate tokens for nodes. Each token is the hash of the
+// node name followed by one byte for each token generated so far. If hash is
+// nil, xxhash is used.
+func Ring(numTokens int, hash HashFunc) WeightedHash {
+	if numTokens < 1 {
+		numTokens = 1
+	}
+	return &ringHash{numTokens: numTokens, hash: hash}
 }
 
 type ringHash struct {
-	mut       sync.RWMutex
 	numTokens int
+	hash      HashFunc
 
 	// Tokens for all nodes. Must be sorted at all times.
 	numNodes int
@@ -37,9 +46,6 @@ type ringToken struct {
 }
 
 func (r *ringHash) Get(key uint64, n int) ([]string, error) {
-	r.mut.RLock()
-	defer r.mut.RUnlock()
-
 	if n > r.numNodes {
 		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", n, r.numNodes)
 	} else if n == 0 {
@@ -78,8 +84,45 @@ func (r *ringHash) Get(key uint64, n int) ([]string, error) {
 }
 
 func (r *ringHash) SetNodes(nodes []string) {
+	r.SetWeightedNodes(nodes, nil)
+}
+
+func (r *ringHash) SetWeightedNodes(nodes []string, weights []int) {
+	r.numNodes = len(nodes)
+	r.tokens = r.generateTokens(nodes, weights)
+}
+
+func (r *ringHash) AddNodes(nodes []string, weights []int) {
+	r.numNodes += len(nodes)
+	r.tokens = mergeTokens(r.tokens, r.generateTokens(nodes, weights))
+}
+
+func (r *ringHash) RemoveNodes(nodes []string) {
+	var removed int
+	r.tokens, removed = removeTokens(r.tokens, nodes)
+	r.numNodes -= removed
+}
+
+func (r *ringHash) Clone() IncrementalHash {
+	// tokens is never modified in place, so it can be shared with the copy.
+	clone := *r
+	return &clone
+}
+
+// generateTokens returns the sorted tokens for nodes.
+func (r *ringHash) generateTokens(nodes []string, weights []int) []ringToken {
 	toks := make([]ringToken, 0, len(nodes)*r.numTokens)
-	for _, node := range nodes {
+	for i, node := range nodes {
+		// The first numTokens tokens for a node are the same regardless of its
+		// weight, so changing weight only moves the keys for the tokens being
+		// added or removed.
+		numTokens := r.numTokens * nodeWeight(weights, i)
+
+		if r.hash != nil {
+			toks = appendHashedTokens(toks, r.hash, node, numTokens)
+			continue
+		}
+
 		dig := xxhash.New()
 		_, _ = dig.Write(unsafeSlice(node))
 
@@ -88,7 +131,7 @@ func (r *ringHash) SetNodes(nodes []string) {
 		// token number truncated to a byte.
 		tokData := []byte{0}
 
-		for t := 0; t < r.numTokens; t++ {
+		for t := 0; t < numTokens; t++ {
 			tokData[0] = byte(t)
 			_, _ = dig.Write(tokData)
 
@@ -99,11 +142,68 @@ func (r *ringHash) SetNodes(nodes []string) {
 		}
 	}
 	sort.Sort(byRingToken(toks))
+	return toks
+}
 
-	r.mut.Lock()
-	defer r.mut.Unlock()
-	r.numNodes = len(nodes)
-	r.tokens = toks
+// mergeTokens merges two sorted lists of tokens into a new sorted list.
+func mergeTokens(a, b []ringToken) []ringToken {
+	res := make([]ringToken, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if lessToken(a[0], b[0]) {
+			res, a = append(res, a[0]), a[1:]
+		} else {
+			res, b = append(res, b[0]), b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// removeTokens returns a new list of toks without the tokens for nodes,
+// along with the number of distinct nodes which were removed.
+func removeTokens(toks []ringToken, nodes []string) ([]ringToken, int) {
+	remove := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		remove[node] = false
+	}
+
+	res := make([]ringToken, 0, len(toks))
+	for _, tok := range toks {
+		if _, ok := remove[tok.node]; ok {
+			remove[tok.node] = true
+			continue
+		}
+		res = append(res, tok)
+	}
+
+	var removed int
+	for _, found := range remove {
+		if found {
+			removed++
+		}
+	}
+	return res, removed
+}
+
+// appendHashedTokens appends numTokens tokens for node to toks using hash.
+// The tokens are equivalent to the tokens generated by the default xxhash
+// digest when hash is xxhash.Sum64.
+func appendHashedTokens(toks []ringToken, hash HashFunc, node string, numTokens int) []ringToken {
+	data := make([]byte, len(node), len(node)+numTokens)
+	copy(data, node)
+
+	for t := 0; t < numTokens; t++ {
+		data = append(data, byte(t))
+		toks = append(toks, ringToken{
+			node:  node,
+			token: hash(data),
+		})
+	}
+	return toks
+}
+
+func (r *ringHash) Describe() Description {
+	return describeTokens("ring", map[string]int{"tokens": r.numTokens}, r.tokens)
 }
 
 // unsafeSlice returns s as a byte slice without making a copy.
@@ -116,9 +216,11 @@ type byRingToken []ringToken
 func (b byRingToken) Len() int      { return len(b) }
 func (b byRingToken) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
 
-func (b byRingToken) Less(i, j int) bool {
-	if b[i].token == b[j].token {
-		return b[i].node < b[j].node
+func (b byRingToken) Less(i, j int) bool { return lessToken(b[i], b[j]) }
+
+func lessToken(a, b ringToken) bool {
+	if a.token == b.token {
+		return a.node < b.node
 	}
-	return b[i].token < b[j].token
+	return a.token < b.token
 }
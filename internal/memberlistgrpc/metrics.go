@@ -1,18 +1,21 @@
 package memberlistgrpc
 
 import (
+	"net"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rfratto/ckit/internal/metricsutil"
 )
 
 type metrics struct {
 	metricsutil.Container
+	peers *metricsutil.PeerLabeler
 
-	packetRxTotal       prometheus.Counter
-	packetRxBytesTotal  prometheus.Counter
-	packetTxTotal       prometheus.Counter
-	packetTxBytesTotal  prometheus.Counter
-	packetTxFailedTotal prometheus.Counter
+	packetRxTotal       *prometheus.CounterVec
+	packetRxBytesTotal  *prometheus.CounterVec
+	packetTxTotal       *prometheus.CounterVec
+	packetTxBytesTotal  *prometheus.CounterVec
+	packetTxFailedTotal *prometheus.GaugeVec
 
 	openStreams         prometheus.Gauge
 	streamRxTotal       prometheus.Counter
@@ -22,29 +25,29 @@ type metrics struct {
 	streamTxFailedTotal prometheus.Counter
 }
 
-func newMetrics() *metrics {
-	var m metrics
+func newMetrics(o Options) *metrics {
+	m := metrics{peers: metricsutil.NewPeerLabeler(o.PeerLabelLimit)}
 
-	m.packetRxTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	m.packetRxTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "cluster_transport_rx_packets_total",
 		Help: "Total number of gRPC gossip transport packets read",
-	})
-	m.packetRxBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"peer"})
+	m.packetRxBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "cluster_transport_rx_bytes_total",
 		Help: "Total number of gRPC gossip transport bytes read",
-	})
-	m.packetTxTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"peer"})
+	m.packetTxTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "cluster_transport_tx_packets_total",
 		Help: "Total number of gRPC gossip transport packets written (failed or otherwise)",
-	})
-	m.packetTxBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"peer"})
+	m.packetTxBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "cluster_transport_tx_bytes_total",
 		Help: "Total number of gRPC gossip transport bytes written (failed or otherwise)",
-	})
-	m.packetTxFailedTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"peer"})
+	m.packetTxFailedTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "cluster_transport_tx_packets_failed_total",
 		Help: "Total number of failed gRPC gossip transport packets",
-	})
+	}, []string{"peer"})
 
 	m.openStreams = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "cluster_transport_streams",
@@ -87,3 +90,20 @@ func newMetrics() *metrics {
 
 	return &m
 }
+
+// peer returns the value of the peer label for addr. The peer label is empty
+// unless Options.PeerLabelLimit is set.
+//
+// Peers are keyed by host only, so that packets sent to a peer and packets
+// received from it share a label: senders connect from ephemeral ports, so
+// the port of an incoming packet never matches the advertised port of its
+// sender.
+func (m *metrics) peer(addr string) string {
+	if m.peers == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return m.peers.Label(addr)
+}
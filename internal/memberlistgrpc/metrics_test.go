@@ -0,0 +1,22 @@
+package memberlistgrpc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_metrics_peer(t *testing.T) {
+	m := newMetrics(Options{PeerLabelLimit: 1})
+
+	// Packets sent to a peer and received from it share a label, even though
+	// the peer sends from an ephemeral port.
+	tx := m.peer("10.0.0.1:7946")
+	rx := m.peer((&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51234}).String())
+	require.Equal(t, "10.0.0.1", tx)
+	require.Equal(t, tx, rx)
+
+	require.Equal(t, "other", m.peer("10.0.0.2:7946"))
+	require.Equal(t, "", newMetrics(Options{}).peer("10.0.0.1:7946"))
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rfratto/ckit/clientpool"
 	"github.com/rfratto/ckit/internal/queue"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
@@ -38,39 +39,51 @@ type Options struct {
 
 	// Timeout to use when sending a packet.
 	PacketTimeout time.Duration
+
+	// PeerLabelLimit, if non-zero, labels packet metrics by peer with the
+	// peer label, up to PeerLabelLimit distinct peers. Peers are labeled by
+	// host without a port: outgoing packets by the host of their destination
+	// and incoming packets by the IP address of their sender. Packets for any
+	// other peer are labeled as "other".
+	PeerLabelLimit int
+}
+
+// Transport is a memberlist.Transport which sends packets over gRPC.
+type Transport interface {
+	memberlist.NodeAwareTransport
+
+	// Flush blocks until there are no queued outgoing packets or until ctx is
+	// canceled.
+	Flush(ctx context.Context) error
+
+	// Reopen reopens a Transport after Shutdown so it can be used by a new
+	// memberlist. Packets queued before Shutdown are discarded. Reopen is a
+	// no-op if the Transport isn't shut down.
+	Reopen() error
 }
 
-// NewTransport returns a new memberlist.Transport. Transport must be closed to
-// prevent leaking resources.
-func NewTransport(srv *grpc.Server, opts Options) (memberlist.Transport, prometheus.Collector, error) {
+// NewTransport returns a new Transport. Transport must be closed to prevent
+// leaking resources.
+func NewTransport(srv *grpc.Server, opts Options) (Transport, prometheus.Collector, error) {
 	if opts.Pool == nil {
 		return nil, nil, fmt.Errorf("client Pool must be provided")
 	}
+	if opts.PeerLabelLimit < 0 {
+		return nil, nil, fmt.Errorf("PeerLabelLimit must not be negative")
+	}
 
 	l := opts.Log
 	if l == nil {
 		l = log.NewNopLogger()
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-
 	tx := &transport{
 		log:     l,
 		opts:    opts,
-		metrics: newMetrics(),
-
-		// TODO(rfratto): is it a problem that these queues have a max size?
-		// Old packets will get dropped if the max size is reached, but
-		// memberlist should be able to tolerate dropped packets in general
-		// since it's designed for UDP.
-		inPacketQueue:  queue.New(packetBufferSize),
-		outPacketQueue: queue.New(packetBufferSize),
+		metrics: newMetrics(opts),
 
 		inPacketCh: make(chan *memberlist.Packet),
 		streamCh:   make(chan net.Conn),
-
-		exited: make(chan struct{}),
-		cancel: cancel,
 	}
 
 	tx.metrics.Add(prometheus.NewGaugeFunc(
@@ -78,17 +91,25 @@ func NewTransport(srv *grpc.Server, opts Options) (memberlist.Transport, prometh
 			Name: "cluster_transport_rx_packet_queue_length",
 			Help: "Current number of unprocessed incoming packets",
 		},
-		func() float64 { return float64(tx.inPacketQueue.Size()) },
+		func() float64 {
+			tx.closedMut.RLock()
+			defer tx.closedMut.RUnlock()
+			return float64(tx.inPacketQueue.Size())
+		},
 	))
 	tx.metrics.Add(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Name: "cluster_transport_tx_packet_queue_length",
 			Help: "Current number of unprocessed outgoing packets",
 		},
-		func() float64 { return float64(tx.outPacketQueue.Size()) },
+		func() float64 {
+			tx.closedMut.RLock()
+			defer tx.closedMut.RUnlock()
+			return float64(tx.outPacketQueue.Size())
+		},
 	))
 
-	go tx.run(ctx)
+	tx.start()
 
 	RegisterTransportServer(srv, &transportServer{t: tx})
 	return tx, tx.metrics, nil
@@ -105,12 +126,18 @@ type transport struct {
 	// background.
 	inPacketQueue, outPacketQueue *queue.Queue
 
+	// outPending is the number of outgoing packets which have been queued but
+	// not yet sent.
+	outPending atomic.Int64
+
 	inPacketCh chan *memberlist.Packet
 	streamCh   chan net.Conn
 
 	// Incoming packets and streams should be rejected when the transport is
-	// closed.
+	// closed. closedMut also protects the packet queues, which are replaced
+	// when the transport is reopened.
 	closedMut sync.RWMutex
+	closed    bool
 	exited    chan struct{}
 	cancel    context.CancelFunc
 
@@ -121,10 +148,30 @@ type transport struct {
 var (
 	_ memberlist.Transport          = (*transport)(nil)
 	_ memberlist.NodeAwareTransport = (*transport)(nil)
+	_ Transport                     = (*transport)(nil)
 )
 
-func (t *transport) run(ctx context.Context) {
-	defer close(t.exited)
+// start creates new packet queues and starts processing them in the
+// background. start must be called with closedMut held or before t is used.
+func (t *transport) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// TODO(rfratto): is it a problem that these queues have a max size?
+	// Old packets will get dropped if the max size is reached, but
+	// memberlist should be able to tolerate dropped packets in general
+	// since it's designed for UDP.
+	t.inPacketQueue = queue.New(packetBufferSize)
+	t.outPacketQueue = queue.New(packetBufferSize)
+	t.outPending.Store(0)
+
+	t.exited = make(chan struct{})
+	t.cancel = cancel
+
+	go t.run(ctx, t.inPacketQueue, t.outPacketQueue, t.exited)
+}
+
+func (t *transport) run(ctx context.Context, inPacketQueue, outPacketQueue *queue.Queue, exited chan struct{}) {
+	defer close(exited)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -132,22 +179,23 @@ func (t *transport) run(ctx context.Context) {
 
 	// Close our queues before shutting down. This must be done before calling
 	// wg.Wait as it will cause the goroutines to exit.
-	defer func() { _ = t.inPacketQueue.Close() }()
-	defer func() { _ = t.outPacketQueue.Close() }()
+	defer func() { _ = inPacketQueue.Close() }()
+	defer func() { _ = outPacketQueue.Close() }()
 
 	// Process queue of incoming packets
 	go func() {
 		defer wg.Done()
 
 		for {
-			v, err := t.inPacketQueue.Dequeue(context.Background())
+			v, err := inPacketQueue.Dequeue(context.Background())
 			if err != nil {
 				return
 			}
 
 			pkt := v.(*memberlist.Packet)
-			t.metrics.packetRxTotal.Inc()
-			t.metrics.packetRxBytesTotal.Add(float64(len(pkt.Buf)))
+			peer := t.metrics.peer(pkt.From.String())
+			t.metrics.packetRxTotal.WithLabelValues(peer).Inc()
+			t.metrics.packetRxBytesTotal.WithLabelValues(peer).Add(float64(len(pkt.Buf)))
 
 			t.inPacketCh <- pkt
 		}
@@ -158,15 +206,17 @@ func (t *transport) run(ctx context.Context) {
 		defer wg.Done()
 
 		for {
-			v, err := t.outPacketQueue.Dequeue(context.Background())
+			v, err := outPacketQueue.Dequeue(context.Background())
 			if err != nil {
 				return
 			}
 
 			pkt := v.(*outPacket)
-			t.metrics.packetTxTotal.Inc()
-			t.metrics.packetTxBytesTotal.Add(float64(len(pkt.Data)))
+			peer := t.metrics.peer(pkt.Addr)
+			t.metrics.packetTxTotal.WithLabelValues(peer).Inc()
+			t.metrics.packetTxBytesTotal.WithLabelValues(peer).Add(float64(len(pkt.Data)))
 			t.writeToSync(pkt.Data, pkt.Addr)
+			t.outPending.Dec()
 		}
 	}()
 
@@ -202,10 +252,34 @@ func (t *transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error)
 }
 
 func (t *transport) WriteTo(b []byte, addr string) (time.Time, error) {
-	t.outPacketQueue.Enqueue(&outPacket{Data: b, Addr: addr})
+	t.closedMut.RLock()
+	defer t.closedMut.RUnlock()
+
+	t.outPending.Inc()
+	if discarded := t.outPacketQueue.Enqueue(&outPacket{Data: b, Addr: addr}); discarded {
+		// The oldest packet was dropped to make room and will never be sent.
+		t.outPending.Dec()
+	}
 	return time.Now(), nil
 }
 
+// flushPollInterval is how often Flush checks for pending packets.
+const flushPollInterval = 10 * time.Millisecond
+
+func (t *transport) Flush(ctx context.Context) error {
+	tick := time.NewTicker(flushPollInterval)
+	defer tick.Stop()
+
+	for t.outPending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
 func (t *transport) writeToSync(b []byte, addr string) {
 	ctx := context.Background()
 	if t.opts.PacketTimeout > 0 {
@@ -217,7 +291,7 @@ func (t *transport) writeToSync(b []byte, addr string) {
 	cc, err := t.opts.Pool.Get(ctx, addr)
 	if err != nil {
 		level.Error(t.log).Log("msg", "failed to get pooled client", "err", err)
-		t.metrics.packetTxFailedTotal.Inc()
+		t.metrics.packetTxFailedTotal.WithLabelValues(t.metrics.peer(addr)).Inc()
 		return
 	}
 
@@ -225,7 +299,7 @@ func (t *transport) writeToSync(b []byte, addr string) {
 	_, err = cli.SendPacket(ctx, &Message{Data: b})
 	if err != nil {
 		level.Debug(t.log).Log("msg", "failed to send packet", "err", err)
-		t.metrics.packetTxFailedTotal.Inc()
+		t.metrics.packetTxFailedTotal.WithLabelValues(t.metrics.peer(addr)).Inc()
 	}
 }
 
@@ -293,11 +367,28 @@ func (t *transport) StreamCh() <-chan net.Conn {
 func (t *transport) Shutdown() error {
 	t.closedMut.Lock()
 	defer t.closedMut.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
 	t.cancel()
 	<-t.exited
 	return nil
 }
 
+func (t *transport) Reopen() error {
+	t.closedMut.Lock()
+	defer t.closedMut.Unlock()
+
+	if !t.closed {
+		return nil
+	}
+	t.start()
+	t.closed = false
+	return nil
+}
+
 type transportServer struct {
 	UnimplementedTransportServer
 
@@ -312,6 +403,12 @@ func (s *transportServer) SendPacket(ctx context.Context, msg *Message) (*emptyp
 		return nil, status.Errorf(codes.Internal, "missing peer in context")
 	}
 
+	s.t.closedMut.RLock()
+	defer s.t.closedMut.RUnlock()
+	if s.t.closed {
+		return nil, status.Errorf(codes.Unavailable, "transport shut down")
+	}
+
 	s.t.inPacketQueue.Enqueue(&memberlist.Packet{
 		Buf:       msg.Data,
 		From:      p.Addr,
@@ -0,0 +1,35 @@
+package messages
+
+import (
+	"fmt"
+
+	"github.com/rfratto/ckit/internal/lamport"
+)
+
+// Ack is sent directly to a node to acknowledge that one of its State
+// messages has been received. Acks are only sent for State messages with
+// AckRequested set.
+type Ack struct {
+	// Name of the node acknowledging the message.
+	NodeName string
+	// Name of the node which sent the acknowledged State message.
+	Target string
+	// Time of the acknowledged State message.
+	Time lamport.Time
+}
+
+// String returns the string representation of the Ack message.
+func (a Ack) String() string {
+	return fmt.Sprintf("%s ack %s @%d", a.NodeName, a.Target, a.Time)
+}
+
+var _ Message = (*Ack)(nil)
+
+// Type implements Message.
+func (a *Ack) Type() Type { return TypeAck }
+
+// Invalidates implements Message.
+func (a *Ack) Invalidates(m Message) bool { return false }
+
+// Cache implements Message.
+func (a *Ack) Cache() bool { return false }
@@ -21,11 +21,17 @@ type Type uint8
 const (
 	TypeInvalid Type = iota // TypeInvalid is an invalid type.
 	TypeState               // TypeState is used for a State broadcast
+	TypeAck                 // TypeAck is used for acknowledging a State broadcast
+	TypeUser                // TypeUser is used for application-defined broadcasts
+	TypeMeta                // TypeMeta is used for node metadata
 )
 
 var knownTypes = map[Type]string{
 	TypeInvalid: "invalid",
 	TypeState:   "state",
+	TypeAck:     "ack",
+	TypeUser:    "user",
+	TypeMeta:    "meta",
 }
 
 // String returns the string representation of t.
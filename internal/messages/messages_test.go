@@ -23,6 +23,24 @@ func TestMessages(t *testing.T) {
 	require.Equal(t, md, actual)
 }
 
+func TestState_Newer(t *testing.T) {
+	var (
+		old      = State{NodeName: "test", Incarnation: 1, Time: 10}
+		later    = State{NodeName: "test", Incarnation: 1, Time: 11}
+		restart  = State{NodeName: "test", Incarnation: 2, Time: 1}
+		sameTime = State{NodeName: "test", Incarnation: 1, Time: 10}
+	)
+
+	require.True(t, later.Newer(old))
+	require.False(t, old.Newer(later))
+	require.False(t, sameTime.Newer(old))
+
+	// Newer incarnations always take precedence, even with an older time.
+	require.True(t, restart.Newer(later))
+	require.False(t, later.Newer(restart))
+	require.True(t, restart.Invalidates(&later))
+}
+
 func TestMessages_Invalid(t *testing.T) {
 	require.Panics(t, func() { Encode(fakeMessage{ty: TypeInvalid}) })
 	require.Panics(t, func() { Encode(fakeMessage{ty: 254}) })
@@ -0,0 +1,36 @@
+package messages
+
+import "fmt"
+
+// Meta is metadata about a node which is sent to peers when they first
+// discover the node. Unlike State, Meta is not broadcast; it is attached to
+// the memberlist alive messages for the node.
+type Meta struct {
+	// Application version of the node.
+	Version string
+	// Name of the cluster the node belongs to.
+	ClusterName string
+	// Leaving is set when the node is gracefully leaving the cluster.
+	Leaving bool
+	// Application-defined payload of the node.
+	Payload []byte
+	// Fingerprint of the node's Sharder, or 0 if the node doesn't publish
+	// one.
+	SharderFingerprint uint64
+}
+
+// String returns the string representation of the Meta message.
+func (m Meta) String() string {
+	return fmt.Sprintf("version %q, cluster %q, leaving %v, payload %d bytes, sharder fingerprint %x", m.Version, m.ClusterName, m.Leaving, len(m.Payload), m.SharderFingerprint)
+}
+
+var _ Message = (*Meta)(nil)
+
+// Type implements Message.
+func (m *Meta) Type() Type { return TypeMeta }
+
+// Invalidates implements Message.
+func (m *Meta) Invalidates(Message) bool { return false }
+
+// Cache implements Message.
+func (m *Meta) Cache() bool { return false }
@@ -13,8 +13,27 @@ type State struct {
 	NodeName string
 	// New State of the node.
 	NewState peer.State
+	// Labels for the node. Labels are sent with every State message.
+	Labels map[string]string
+	// Weight of the node for sharding.
+	Weight int
+	// AvailabilityZone the node is running in.
+	AvailabilityZone string
+	// Roles performed by the node.
+	Roles []string
+	// Incarnation of the node which generated the state. Incarnations
+	// increase every time a node restarts.
+	Incarnation uint64
 	// Time the state was generated.
 	Time lamport.Time
+	// ParticipantSince is the time of the state message which moved the node
+	// to StateParticipant. It is carried over by later state messages so
+	// rebroadcasts of the same state don't reset it, and is 0 if the node
+	// isn't a Participant.
+	ParticipantSince lamport.Time
+	// AckRequested indicates that peers should send an Ack back to NodeName
+	// once they receive this message.
+	AckRequested bool
 }
 
 // String returns the string representation of the State message.
@@ -22,6 +41,16 @@ func (s State) String() string {
 	return fmt.Sprintf("%s @%d: %s", s.NodeName, s.Time, s.NewState)
 }
 
+// Newer returns true if s takes precedence over other. States from a newer
+// incarnation always take precedence; otherwise, the state with the later
+// time takes precedence.
+func (s State) Newer(other State) bool {
+	if s.Incarnation != other.Incarnation {
+		return s.Incarnation > other.Incarnation
+	}
+	return s.Time > other.Time
+}
+
 var _ Message = (*State)(nil)
 
 // Type implements Message.
@@ -33,7 +62,7 @@ func (s *State) Invalidates(m Message) bool {
 	if !ok {
 		return false
 	}
-	return s.NodeName == other.NodeName && s.Time > other.Time
+	return s.NodeName == other.NodeName && s.Newer(*other)
 }
 
 // Cache implements Message.
@@ -0,0 +1,35 @@
+package messages
+
+import (
+	"fmt"
+
+	"github.com/rfratto/ckit/internal/lamport"
+)
+
+// User is an application-defined message broadcast to every node in the
+// cluster.
+type User struct {
+	// Name of the node which originally sent the message.
+	NodeName string
+	// Time the message was sent. Used with NodeName to uniquely identify the
+	// message.
+	Time lamport.Time
+	// Application-defined payload.
+	Payload []byte
+}
+
+// String returns the string representation of the User message.
+func (u User) String() string {
+	return fmt.Sprintf("%s @%d: user message (%d bytes)", u.NodeName, u.Time, len(u.Payload))
+}
+
+var _ Message = (*User)(nil)
+
+// Type implements Message.
+func (u *User) Type() Type { return TypeUser }
+
+// Invalidates implements Message.
+func (u *User) Invalidates(m Message) bool { return false }
+
+// Cache implements Message.
+func (u *User) Cache() bool { return false }
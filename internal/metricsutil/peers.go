@@ -0,0 +1,50 @@
+package metricsutil
+
+import "sync"
+
+// OtherPeers is the peer label value used for peers past the limit of a
+// PeerLabeler.
+const OtherPeers = "other"
+
+// PeerLabeler caps the number of distinct values of a peer label to bound
+// the cardinality of per-peer metrics.
+type PeerLabeler struct {
+	limit int
+
+	mut  sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewPeerLabeler returns a PeerLabeler which allows up to limit distinct
+// peers. NewPeerLabeler returns nil if limit is 0, which disables per-peer
+// labels.
+func NewPeerLabeler(limit int) *PeerLabeler {
+	if limit == 0 {
+		return nil
+	}
+	return &PeerLabeler{
+		limit: limit,
+		seen:  make(map[string]struct{}, limit),
+	}
+}
+
+// Label returns the label value to use for peer. The first limit distinct
+// peers are labeled by their name; any other peer is labeled as OtherPeers.
+// Label returns an empty string if l is nil.
+func (l *PeerLabeler) Label(peer string) string {
+	if l == nil {
+		return ""
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if _, ok := l.seen[peer]; ok {
+		return peer
+	}
+	if len(l.seen) >= l.limit {
+		return OtherPeers
+	}
+	l.seen[peer] = struct{}{}
+	return peer
+}
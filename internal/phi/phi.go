@@ -0,0 +1,116 @@
+// Package phi implements the phi accrual failure detector described in "The
+// φ Accrual Failure Detector" by Hayashibara et al.
+//
+// Rather than deciding whether a process is alive or dead, a phi accrual
+// failure detector outputs a suspicion level, phi, based on the distribution
+// of previously observed heartbeat intervals. A phi of 1 means there is
+// roughly a 10% chance that a failure was suspected in error, a phi of 2
+// roughly a 1% chance, a phi of 3 roughly a 0.1% chance, and so on.
+package phi
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Detector is a phi accrual failure detector for a single process.
+type Detector struct {
+	windowSize int
+	minStdDev  float64
+
+	mut       sync.Mutex
+	intervals []float64 // Ring buffer of intervals in seconds
+	next      int
+	last      time.Time
+}
+
+// New creates a new Detector. windowSize determines how many heartbeat
+// intervals are used to calculate phi. minStdDev is the minimum standard
+// deviation of heartbeat intervals, which avoids phi growing too quickly when
+// heartbeats arrive at very regular intervals.
+func New(windowSize int, minStdDev time.Duration) *Detector {
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	return &Detector{
+		windowSize: windowSize,
+		minStdDev:  minStdDev.Seconds(),
+		intervals:  make([]float64, 0, windowSize),
+	}
+}
+
+// Heartbeat records a heartbeat from the process at the given time.
+func (d *Detector) Heartbeat(now time.Time) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if !d.last.IsZero() {
+		interval := now.Sub(d.last).Seconds()
+		if len(d.intervals) < d.windowSize {
+			d.intervals = append(d.intervals, interval)
+		} else {
+			d.intervals[d.next] = interval
+		}
+		d.next = (d.next + 1) % d.windowSize
+	}
+	d.last = now
+}
+
+// Last returns the time of the most recent heartbeat. Last returns the zero
+// time if no heartbeats have been recorded.
+func (d *Detector) Last() time.Time {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.last
+}
+
+// Phi returns the suspicion level of the process at the given time. Phi
+// returns 0 until at least two heartbeats have been recorded.
+func (d *Detector) Phi(now time.Time) float64 {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.intervals) == 0 {
+		return 0
+	}
+
+	var mean, variance float64
+	for _, i := range d.intervals {
+		mean += i
+	}
+	mean /= float64(len(d.intervals))
+	for _, i := range d.intervals {
+		variance += (i - mean) * (i - mean)
+	}
+	variance /= float64(len(d.intervals))
+
+	stdDev := math.Max(math.Sqrt(variance), d.minStdDev)
+	if stdDev == 0 {
+		// Only possible with a zero minStdDev and identical intervals; avoid
+		// dividing by zero.
+		stdDev = math.SmallestNonzeroFloat64
+	}
+
+	return phi(now.Sub(d.last).Seconds(), mean, stdDev)
+}
+
+// phi calculates the suspicion level for elapsed seconds since the last
+// heartbeat, using a logistic approximation of the cumulative distribution
+// function of the normal distribution.
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+
+	var res float64
+	if elapsed > mean {
+		res = -math.Log10(e / (1.0 + e))
+	} else {
+		res = -math.Log10(1.0 - 1.0/(1.0+e))
+	}
+
+	if math.IsInf(res, 0) || math.IsNaN(res) {
+		return math.MaxFloat64
+	}
+	return res
+}
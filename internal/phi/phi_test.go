@@ -0,0 +1,56 @@
+package phi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetector_Phi(t *testing.T) {
+	var (
+		d     = New(10, 100*time.Millisecond)
+		start = time.Unix(0, 0)
+	)
+
+	require.Equal(t, float64(0), d.Phi(start), "phi should be 0 with no heartbeats")
+
+	// Send heartbeats every second.
+	for i := 0; i < 10; i++ {
+		d.Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+	last := start.Add(9 * time.Second)
+	require.Equal(t, last, d.Last())
+
+	var (
+		onTime = d.Phi(last.Add(time.Second))
+		late   = d.Phi(last.Add(2 * time.Second))
+		later  = d.Phi(last.Add(5 * time.Second))
+	)
+	require.Less(t, onTime, 1.0, "heartbeat arriving on time should not be suspicious")
+	require.Greater(t, late, onTime)
+	require.Greater(t, later, late)
+}
+
+func TestDetector_Window(t *testing.T) {
+	var (
+		d     = New(3, 0)
+		start = time.Unix(0, 0)
+	)
+
+	// Record slow heartbeats followed by fast heartbeats. Once the window is
+	// full of fast heartbeats, the slow ones should no longer be considered.
+	now := start
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * time.Second)
+		d.Heartbeat(now)
+	}
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		d.Heartbeat(now)
+	}
+	require.Len(t, d.intervals, 3)
+	for _, i := range d.intervals {
+		require.Equal(t, float64(1), i)
+	}
+}
@@ -99,8 +99,9 @@ func (q *Queue) TryDequeue() (interface{}, bool) {
 }
 
 // Enqueue queues an item. Messages are guaranteed to be dequeued in call order.
-// If the queue has reached its limit, the oldest message will be discarded.
-func (q *Queue) Enqueue(v interface{}) {
+// If the queue has reached its limit, the oldest message will be discarded
+// and discarded will be true.
+func (q *Queue) Enqueue(v interface{}) (discarded bool) {
 	element := entry{Time: q.clock.Tick(), Value: v}
 
 	q.sema.L.Lock()
@@ -108,7 +109,7 @@ func (q *Queue) Enqueue(v interface{}) {
 
 	if q.closed {
 		// The queue is closed: quit immediately
-		return
+		return false
 	}
 
 	// Perform a sorted insert into the slice.
@@ -124,9 +125,11 @@ func (q *Queue) Enqueue(v interface{}) {
 	// Remove the first element if we've grown too big.
 	if q.limit != Unbounded && len(q.elements) > q.limit {
 		q.elements = q.elements[1:]
+		discarded = true
 	}
 
 	q.sema.Signal()
+	return discarded
 }
 
 // Size of the elements in the queue.
@@ -93,8 +93,9 @@ func TestEnqueue_Race(t *testing.T) {
 func TestEnqueue_Limit(t *testing.T) {
 	q := New(1)
 
-	for i := 0; i < 100; i++ {
-		q.Enqueue(i)
+	require.False(t, q.Enqueue(0), "first element should not be discarded")
+	for i := 1; i < 100; i++ {
+		require.True(t, q.Enqueue(i), "oldest element should be discarded")
 	}
 	v, err := q.Dequeue(context.Background())
 	require.NoError(t, err)
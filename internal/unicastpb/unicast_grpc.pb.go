@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package unicastpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// MessengerClient is the client API for Messenger service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MessengerClient interface {
+	// Send sends a request to the node. The name of the node sending the
+	// request is passed in the ckit-sender metadata key.
+	Send(ctx context.Context, in *wrapperspb.BytesValue, opts ...grpc.CallOption) (*wrapperspb.BytesValue, error)
+	// Probe checks whether the node is reachable over gRPC. Probe does not
+	// invoke the application.
+	Probe(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type messengerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessengerClient(cc grpc.ClientConnInterface) MessengerClient {
+	return &messengerClient{cc}
+}
+
+func (c *messengerClient) Send(ctx context.Context, in *wrapperspb.BytesValue, opts ...grpc.CallOption) (*wrapperspb.BytesValue, error) {
+	out := new(wrapperspb.BytesValue)
+	err := c.cc.Invoke(ctx, "/unicast.ckit.rfratto.v1.Messenger/Send", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messengerClient) Probe(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/unicast.ckit.rfratto.v1.Messenger/Probe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MessengerServer is the server API for Messenger service.
+// All implementations must embed UnimplementedMessengerServer
+// for forward compatibility
+type MessengerServer interface {
+	// Send sends a request to the node. The name of the node sending the
+	// request is passed in the ckit-sender metadata key.
+	Send(context.Context, *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error)
+	// Probe checks whether the node is reachable over gRPC. Probe does not
+	// invoke the application.
+	Probe(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	mustEmbedUnimplementedMessengerServer()
+}
+
+// UnimplementedMessengerServer must be embedded to have forward compatible implementations.
+type UnimplementedMessengerServer struct {
+}
+
+func (UnimplementedMessengerServer) Send(context.Context, *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedMessengerServer) Probe(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Probe not implemented")
+}
+func (UnimplementedMessengerServer) mustEmbedUnimplementedMessengerServer() {}
+
+// UnsafeMessengerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MessengerServer will
+// result in compilation errors.
+type UnsafeMessengerServer interface {
+	mustEmbedUnimplementedMessengerServer()
+}
+
+func RegisterMessengerServer(s grpc.ServiceRegistrar, srv MessengerServer) {
+	s.RegisterService(&Messenger_ServiceDesc, srv)
+}
+
+func _Messenger_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.BytesValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessengerServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/unicast.ckit.rfratto.v1.Messenger/Send",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessengerServer).Send(ctx, req.(*wrapperspb.BytesValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Messenger_Probe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessengerServer).Probe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/unicast.ckit.rfratto.v1.Messenger/Probe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessengerServer).Probe(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Messenger_ServiceDesc is the grpc.ServiceDesc for Messenger service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Messenger_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "unicast.ckit.rfratto.v1.Messenger",
+	HandlerType: (*MessengerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _Messenger_Send_Handler,
+		},
+		{
+			MethodName: "Probe",
+			Handler:    _Messenger_Probe_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "unicast.proto",
+}
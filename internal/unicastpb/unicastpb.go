@@ -0,0 +1,9 @@
+// Package unicastpb holds the gRPC service used for sending requests directly
+// to a node.
+package unicastpb
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/rfratto/ckit/internal/unicastpb --go-grpc_out=. --go-grpc_opt=module=github.com/rfratto/ckit/internal/unicastpb  ./unicast.proto
+
+// SenderKey is the gRPC metadata key which holds the name of the node sending
+// a request.
+const SenderKey = "ckit-sender"
@@ -0,0 +1,256 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/peer"
+)
+
+// defaultRejoinMaxBackoff is the maximum time between rejoin attempts when
+// Config.RejoinMaxBackoff is unset.
+const defaultRejoinMaxBackoff = time.Minute
+
+// resolveTimeout is the maximum time spent resolving join peers during a
+// refresh.
+const resolveTimeout = 10 * time.Second
+
+// runRejoin periodically checks whether n has lost contact with every other
+// peer and, if so, attempts to rejoin the peers passed to Start. Failed
+// attempts are retried with exponential backoff, starting at
+// cfg.RejoinMinBackoff and capped at cfg.RejoinMaxBackoff.
+//
+// runRejoin exits when ctx is canceled.
+func (n *Node) runRejoin(ctx context.Context) {
+	var (
+		minBackoff = n.cfg.RejoinMinBackoff
+		maxBackoff = n.cfg.RejoinMaxBackoff
+		backoff    = minBackoff
+	)
+
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		joined, err := n.tryRejoin()
+		switch {
+		case err != nil:
+			level.Warn(n.log).Log("msg", "failed to rejoin cluster", "err", err, "backoff", backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		case joined:
+			level.Info(n.log).Log("msg", "rejoined cluster after losing contact with all peers")
+			backoff = minBackoff
+		default:
+			backoff = minBackoff
+		}
+
+		t.Reset(backoff)
+	}
+}
+
+// tryRejoin rejoins the join peers if n no longer has any remote peers.
+// joined will be false if no attempt was made.
+func (n *Node) tryRejoin() (joined bool, err error) {
+	joinPeers := n.currentJoinPeers()
+	if len(joinPeers) == 0 {
+		return false, nil
+	}
+
+	n.peerMut.RLock()
+	isolated := len(n.peers) <= 1
+	n.peerMut.RUnlock()
+
+	if !isolated {
+		return false, nil
+	}
+
+	level.Debug(n.log).Log("msg", "lost contact with all peers; attempting to rejoin", "peers", len(joinPeers))
+	n.m.rejoinAttemptsTotal.Inc()
+
+	// Join re-resolves any DNS names in the join peers, so peers which have
+	// moved to a new address will still be found.
+	if _, err := n.memberlist().Join(joinPeers); err != nil {
+		n.m.rejoinFailuresTotal.Inc()
+		return false, err
+	}
+	return true, nil
+}
+
+// currentJoinPeers returns a copy of the peers passed to Start, or nil if n
+// is stopped. The copy allows joining peers without holding stateMut, which
+// would otherwise block state changes for the duration of the network I/O.
+func (n *Node) currentJoinPeers() []string {
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+
+	if n.stopped {
+		return nil
+	}
+	return append([]string(nil), n.joinPeers...)
+}
+
+// runIsolationDemote periodically checks whether n has lost contact with
+// every other peer and demotes n to a viewer once it has been isolated for
+// cfg.IsolationDemoteTimeout.
+//
+// runIsolationDemote exits when ctx is canceled.
+func (n *Node) runIsolationDemote(ctx context.Context) {
+	interval := n.cfg.IsolationDemoteTimeout / 4
+	if interval <= 0 {
+		interval = n.cfg.IsolationDemoteTimeout
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// isolatedSince is the time n was first seen without remote peers. It is
+	// zero while n has remote peers.
+	var isolatedSince time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n.peerMut.RLock()
+		isolated := len(n.peers) <= 1
+		n.peerMut.RUnlock()
+
+		switch {
+		case !isolated:
+			isolatedSince = time.Time{}
+			continue
+		case isolatedSince.IsZero():
+			isolatedSince = time.Now()
+		}
+
+		if time.Since(isolatedSince) < n.cfg.IsolationDemoteTimeout {
+			continue
+		}
+
+		demoted, err := n.demoteIsolated()
+		if err != nil {
+			level.Warn(n.log).Log("msg", "failed to demote isolated node", "err", err)
+			continue
+		}
+		if demoted && n.cfg.OnIsolationDemote != nil {
+			n.cfg.OnIsolationDemote()
+		}
+	}
+}
+
+// demoteIsolated moves n to StateViewer if it is a Participant. demoted will
+// be false if no change was made.
+func (n *Node) demoteIsolated() (demoted bool, err error) {
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	if n.stopped || n.localState != peer.StateParticipant {
+		return false, nil
+	}
+
+	level.Warn(n.log).Log("msg", "lost contact with all peers; demoting node to viewer", "timeout", n.cfg.IsolationDemoteTimeout)
+	if _, err := n.changeState(peer.StateViewer, false, nil); err != nil {
+		return false, err
+	}
+	n.m.isolationDemotions.Inc()
+	return true, nil
+}
+
+// runJoinRefresh re-resolves the join peers every
+// cfg.JoinPeersRefreshInterval, joining any newly discovered addresses which
+// aren't already peers.
+//
+// runJoinRefresh exits when ctx is canceled.
+func (n *Node) runJoinRefresh(ctx context.Context) {
+	t := time.NewTicker(n.cfg.JoinPeersRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := n.refreshJoinPeers(ctx); err != nil {
+			level.Warn(n.log).Log("msg", "failed to join newly discovered peers", "err", err)
+		}
+	}
+}
+
+// refreshJoinPeers resolves the join peers and joins any addresses which
+// aren't currently peers.
+func (n *Node) refreshJoinPeers(ctx context.Context) error {
+	joinPeers := n.currentJoinPeers()
+	if len(joinPeers) == 0 {
+		return nil
+	}
+
+	known := make(map[string]struct{})
+	for _, p := range n.Peers() {
+		known[p.Addr] = struct{}{}
+	}
+
+	var newAddrs []string
+	for _, addr := range resolveJoinPeers(ctx, n.log, joinPeers) {
+		if _, ok := known[addr]; ok {
+			continue
+		}
+		known[addr] = struct{}{}
+		newAddrs = append(newAddrs, addr)
+	}
+	if len(newAddrs) == 0 {
+		return nil
+	}
+
+	level.Debug(n.log).Log("msg", "joining newly discovered peers", "addrs", fmt.Sprint(newAddrs))
+	_, err := n.memberlist().Join(newAddrs)
+	return err
+}
+
+// resolveJoinPeers resolves each host:port in peers into a list of IPv4 and
+// IPv6 host:port addresses. Peers which fail to resolve are logged and
+// skipped.
+func resolveJoinPeers(ctx context.Context, l log.Logger, peers []string) []string {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	var res []string
+	for _, p := range peers {
+		host, port, err := net.SplitHostPort(p)
+		if err != nil {
+			level.Warn(l).Log("msg", "ignoring invalid join peer", "peer", p, "err", err)
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			res = append(res, p)
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			level.Warn(l).Log("msg", "failed to resolve join peer", "peer", p, "err", err)
+			continue
+		}
+		for _, ip := range ips {
+			res = append(res, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return res
+}
@@ -0,0 +1,430 @@
+// Package kvstore implements a small key/value store replicated across a
+// cluster using the gossip channel of a ckit Node.
+//
+// Every Node in the cluster holds a full copy of the store. Writes are
+// broadcast to peers and conflicting writes are resolved with
+// last-writer-wins semantics: the write with the highest version is kept,
+// where versions are derived from the writer's clock. Entries are
+// periodically rebroadcast so that peers which missed a write, such as peers
+// which joined after the write was made, eventually converge.
+//
+// Versions are based on the wall clock of the writer so that writes made
+// after a restart take precedence over writes from before it. As a result,
+// if two nodes write the same key at roughly the same time, the node whose
+// clock runs ahead wins, even if its write happened first. Clocks of nodes
+// should be kept synchronized, such as with NTP.
+//
+// Deleted keys are remembered for Options.TombstoneTTL so the delete
+// propagates through the cluster. A peer which is out of contact for longer
+// than TombstoneTTL may bring a deleted key back when it reconnects.
+//
+// Stores are intended for sharing a small number of cluster-wide settings.
+// Every entry must fit in a single broadcast, and the entire store is
+// regularly gossiped, so stores should be kept small.
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/rfratto/ckit"
+)
+
+// payloadHeader prefixes every broadcast sent by a Store so they can be
+// distinguished from other broadcasts.
+var payloadHeader = []byte("ckv\x01")
+
+// DefaultResyncInterval is the default value for Options.ResyncInterval.
+const DefaultResyncInterval = time.Minute
+
+// DefaultTombstoneTTL is the default value for Options.TombstoneTTL.
+const DefaultTombstoneTTL = 24 * time.Hour
+
+// Node is the subset of methods from *ckit.Node used by a Store.
+type Node interface {
+	Broadcast(payload []byte) error
+	OnBroadcast(h ckit.BroadcastHandler)
+	Observe(o ckit.Observer) (unsubscribe func())
+}
+
+var _ Node = (*ckit.Node)(nil)
+
+// Options configures a Store.
+type Options struct {
+	// ResyncInterval is how often every entry in the Store is rebroadcast to
+	// peers. Entries are also rebroadcast whenever a new peer joins.
+	// Defaults to DefaultResyncInterval.
+	ResyncInterval time.Duration
+
+	// TombstoneTTL is how long a deleted key is remembered and rebroadcast
+	// to peers, measured from the version of the delete. TombstoneTTL should
+	// be much longer than ResyncInterval so the delete reaches every peer.
+	// Defaults to DefaultTombstoneTTL.
+	TombstoneTTL time.Duration
+}
+
+// A WatchFunc is invoked when the value of a key changes. ok will be false if
+// the key was deleted. WatchFuncs are invoked while gossip messages are being
+// processed and must not block. value must not be modified.
+type WatchFunc func(key string, value []byte, ok bool)
+
+// Store is a replicated key/value store. All methods are safe to call
+// concurrently.
+type Store struct {
+	node Node
+	opts Options
+	now  func() time.Time
+
+	mut      sync.RWMutex
+	entries  map[string]entry
+	version  uint64 // Most recent version seen by the Store
+	watchers []*watcher
+	closed   bool
+
+	unsubscribe func()
+	resync      chan struct{}
+	exited      chan struct{}
+	done        chan struct{}
+}
+
+// entry is a versioned value in the Store. Deleted entries are kept as
+// tombstones until they expire so deletes propagate through the cluster.
+type entry struct {
+	Key     string
+	Value   []byte
+	Version uint64
+	Deleted bool
+}
+
+// newer returns true if e takes precedence over o.
+func (e entry) newer(o entry) bool {
+	if e.Version != o.Version {
+		return e.Version > o.Version
+	}
+	// Break ties deterministically so every node converges on the same
+	// value.
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+	return bytes.Compare(e.Value, o.Value) > 0
+}
+
+type watcher struct {
+	prefix string
+	f      WatchFunc
+}
+
+// New creates a new Store which replicates through node. Call Close to stop
+// the Store. Only one Store should be created for each Node.
+func New(node Node, opts Options) *Store {
+	if opts.ResyncInterval <= 0 {
+		opts.ResyncInterval = DefaultResyncInterval
+	}
+	if opts.TombstoneTTL <= 0 {
+		opts.TombstoneTTL = DefaultTombstoneTTL
+	}
+
+	s := &Store{
+		node: node,
+		opts: opts,
+		now:  time.Now,
+
+		entries: make(map[string]entry),
+
+		resync: make(chan struct{}, 1),
+		exited: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	node.OnBroadcast(s.handleBroadcast)
+	s.unsubscribe = node.Observe(ckit.EventsObserver(ckit.FuncEventObserver(func(events []ckit.Event) (reregister bool) {
+		for _, e := range events {
+			if joined, ok := e.(ckit.PeerJoined); ok && !joined.Peer.Self {
+				s.triggerResync()
+				break
+			}
+		}
+		return true
+	})))
+
+	go s.run()
+	return s
+}
+
+// Get returns the value for key. ok will be false if key doesn't exist.
+// The returned value must not be modified.
+func (s *Store) Get(key string) (value []byte, ok bool) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Keys returns the sorted list of keys in the Store.
+func (s *Store) Keys() []string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for k, e := range s.entries {
+		if !e.Deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Set sets key to value and broadcasts the change to peers. An error is
+// returned if the encoded entry doesn't fit in a single broadcast.
+func (s *Store) Set(key string, value []byte) error {
+	return s.write(entry{Key: key, Value: append([]byte(nil), value...)})
+}
+
+// Delete removes key and broadcasts the change to peers.
+func (s *Store) Delete(key string) error {
+	return s.write(entry{Key: key, Deleted: true})
+}
+
+func (s *Store) write(e entry) error {
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return fmt.Errorf("store closed")
+	}
+	e.Version = s.nextVersion()
+
+	payload, err := encodeEntry(e)
+	if err != nil {
+		s.mut.Unlock()
+		return err
+	} else if len(payload) > ckit.MaxBroadcastSize {
+		s.mut.Unlock()
+		return fmt.Errorf("entry for key %q is %d bytes, exceeding limit of %d bytes", e.Key, len(payload), ckit.MaxBroadcastSize)
+	}
+
+	notify := s.applyLocked(e)
+	s.mut.Unlock()
+
+	notify()
+	return s.node.Broadcast(payload)
+}
+
+// nextVersion returns the version to use for a local write. Versions are
+// based on the wall clock so that writes made after a restart take
+// precedence, but always move forward past any version seen from peers.
+// Must be called with s.mut held.
+func (s *Store) nextVersion() uint64 {
+	v := uint64(s.now().UnixNano())
+	if v <= s.version {
+		v = s.version + 1
+	}
+	s.version = v
+	return v
+}
+
+// Watch registers f to be invoked whenever a key starting with prefix
+// changes, whether from a local write or a write received from a peer. Pass
+// an empty prefix to watch every key. Call unsubscribe to stop watching.
+func (s *Store) Watch(prefix string, f WatchFunc) (unsubscribe func()) {
+	w := &watcher{prefix: prefix, f: f}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.watchers = append(s.watchers, w)
+
+	return func() {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+
+		for i, other := range s.watchers {
+			if other == w {
+				s.watchers = append(s.watchers[:i:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// applyLocked stores e if it's newer than the existing entry for its key.
+// The returned function notifies watchers of the change and must be called
+// after s.mut is released. Must be called with s.mut held.
+func (s *Store) applyLocked(e entry) (notify func()) {
+	if e.Version > s.version {
+		s.version = e.Version
+	}
+
+	existing, exists := s.entries[e.Key]
+	if exists && !e.newer(existing) {
+		return func() {}
+	}
+	if e.Deleted && s.expired(e) {
+		// Peers may still be rebroadcasting a tombstone which was already
+		// collected; storing it again would keep it alive.
+		if exists {
+			delete(s.entries, e.Key)
+		}
+		return func() {}
+	}
+	s.entries[e.Key] = e
+
+	if (!exists || existing.Deleted) && e.Deleted {
+		// Nothing visibly changed.
+		return func() {}
+	}
+
+	var watchers []*watcher
+	for _, w := range s.watchers {
+		if strings.HasPrefix(e.Key, w.prefix) {
+			watchers = append(watchers, w)
+		}
+	}
+	return func() {
+		for _, w := range watchers {
+			w.f(e.Key, e.Value, !e.Deleted)
+		}
+	}
+}
+
+func (s *Store) handleBroadcast(_ string, payload []byte) {
+	if !bytes.HasPrefix(payload, payloadHeader) {
+		// Not a broadcast from a Store.
+		return
+	}
+
+	e, err := decodeEntry(payload)
+	if err != nil {
+		return
+	}
+
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return
+	}
+	notify := s.applyLocked(e)
+	s.mut.Unlock()
+
+	notify()
+}
+
+func (s *Store) triggerResync() {
+	select {
+	case s.resync <- struct{}{}:
+	default:
+		// A resync is already pending.
+	}
+}
+
+// run periodically rebroadcasts every entry until the Store is closed.
+func (s *Store) run() {
+	defer close(s.exited)
+
+	t := time.NewTicker(s.opts.ResyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		case <-s.resync:
+		}
+		s.collectTombstones()
+		s.broadcastAll()
+	}
+}
+
+// expired returns true if e is older than Options.TombstoneTTL. Versions are
+// derived from the wall clock of the writer, so every peer expires a
+// tombstone at about the same time.
+func (s *Store) expired(e entry) bool {
+	written := time.Unix(0, int64(e.Version))
+	return s.now().Sub(written) >= s.opts.TombstoneTTL
+}
+
+// collectTombstones removes expired tombstones so they're no longer stored
+// or rebroadcast.
+func (s *Store) collectTombstones() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for key, e := range s.entries {
+		if e.Deleted && s.expired(e) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// broadcastAll broadcasts every entry, including tombstones which haven't
+// expired yet.
+func (s *Store) broadcastAll() {
+	s.mut.RLock()
+	payloads := make([][]byte, 0, len(s.entries))
+	for _, e := range s.entries {
+		payload, err := encodeEntry(e)
+		if err != nil {
+			continue
+		}
+		payloads = append(payloads, payload)
+	}
+	s.mut.RUnlock()
+
+	for _, payload := range payloads {
+		if err := s.node.Broadcast(payload); err != nil {
+			// The Node has stopped; there's no point in trying the rest.
+			return
+		}
+	}
+}
+
+// Close stops the Store. Entries can no longer be written and changes from
+// peers are ignored once Close returns.
+func (s *Store) Close() {
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return
+	}
+	s.closed = true
+	s.watchers = nil
+	s.mut.Unlock()
+
+	s.unsubscribe()
+	close(s.done)
+	<-s.exited
+}
+
+func encodeEntry(e entry) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(payloadHeader)
+
+	var handle codec.MsgpackHandle
+	if err := codec.NewEncoder(buf, &handle).Encode(e); err != nil {
+		return nil, fmt.Errorf("failed to encode entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntry(payload []byte) (entry, error) {
+	var (
+		e      entry
+		handle codec.MsgpackHandle
+	)
+	if err := codec.NewDecoderBytes(payload[len(payloadHeader):], &handle).Decode(&e); err != nil {
+		return e, err
+	}
+	// Broadcast payloads can't be retained, so make sure e doesn't reference
+	// it.
+	e.Value = append([]byte(nil), e.Value...)
+	return e, nil
+}
@@ -0,0 +1,236 @@
+package kvstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	var (
+		net = newFakeNetwork()
+		a   = newTestStore(t, net.Node("a"))
+		b   = newTestStore(t, net.Node("b"))
+	)
+
+	require.NoError(t, a.Set("foo", []byte("bar")))
+
+	val, ok := b.Get("foo")
+	require.True(t, ok)
+	require.Equal(t, "bar", string(val))
+	require.Equal(t, []string{"foo"}, b.Keys())
+
+	require.NoError(t, b.Delete("foo"))
+	_, ok = a.Get("foo")
+	require.False(t, ok)
+	require.Empty(t, a.Keys())
+}
+
+func TestStore_LastWriterWins(t *testing.T) {
+	var (
+		net = newFakeNetwork()
+		a   = newTestStore(t, net.Node("a"))
+		b   = newTestStore(t, net.Node("b"))
+	)
+
+	require.NoError(t, a.Set("foo", []byte("first")))
+
+	// Deliver an older write; it should be ignored.
+	stale, err := encodeEntry(entry{Key: "foo", Value: []byte("stale"), Version: 1})
+	require.NoError(t, err)
+	b.handleBroadcast("a", stale)
+
+	val, _ := b.Get("foo")
+	require.Equal(t, "first", string(val))
+
+	// b's writes should take precedence over anything it has seen, even if
+	// its clock is behind.
+	ahead, err := encodeEntry(entry{Key: "foo", Value: []byte("future"), Version: uint64(time.Now().Add(time.Hour).UnixNano())})
+	require.NoError(t, err)
+	b.handleBroadcast("a", ahead)
+	require.NoError(t, b.Set("foo", []byte("second")))
+
+	val, _ = a.Get("foo")
+	require.Equal(t, "second", string(val))
+}
+
+func TestStore_Watch(t *testing.T) {
+	var (
+		net = newFakeNetwork()
+		a   = newTestStore(t, net.Node("a"))
+		b   = newTestStore(t, net.Node("b"))
+	)
+
+	type change struct {
+		key, value string
+		ok         bool
+	}
+	var changes []change
+
+	unsubscribe := b.Watch("settings/", func(key string, value []byte, ok bool) {
+		changes = append(changes, change{key, string(value), ok})
+	})
+
+	require.NoError(t, a.Set("settings/limit", []byte("10")))
+	require.NoError(t, a.Set("other", []byte("ignored")))
+	require.NoError(t, b.Delete("settings/limit"))
+	require.NoError(t, b.Delete("settings/missing")) // Doesn't exist; no change
+
+	unsubscribe()
+	require.NoError(t, a.Set("settings/limit", []byte("20")))
+
+	require.Equal(t, []change{
+		{key: "settings/limit", value: "10", ok: true},
+		{key: "settings/limit", value: "", ok: false},
+	}, changes)
+}
+
+func TestStore_ResyncOnJoin(t *testing.T) {
+	var (
+		net = newFakeNetwork()
+		a   = newTestStore(t, net.Node("a"))
+	)
+	require.NoError(t, a.Set("foo", []byte("bar")))
+
+	// b joins after the write was made, so it won't receive it until a
+	// resyncs.
+	b := newTestStore(t, net.Node("b"))
+	_, ok := b.Get("foo")
+	require.False(t, ok)
+
+	net.Join("b")
+	require.Eventually(t, func() bool {
+		val, ok := b.Get("foo")
+		return ok && string(val) == "bar"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStore_TombstoneTTL(t *testing.T) {
+	var (
+		net = newFakeNetwork()
+		a   = newTestStore(t, net.Node("a"))
+		b   = newTestStore(t, net.Node("b"))
+
+		mut sync.Mutex
+		now = time.Now()
+	)
+	clock := func() time.Time {
+		mut.Lock()
+		defer mut.Unlock()
+		return now
+	}
+	a.now, b.now = clock, clock
+
+	require.NoError(t, a.Set("foo", []byte("bar")))
+	require.NoError(t, a.Delete("foo"))
+
+	a.collectTombstones()
+	a.mut.RLock()
+	require.Contains(t, a.entries, "foo", "tombstone should be kept until it expires")
+	a.mut.RUnlock()
+
+	mut.Lock()
+	now = now.Add(DefaultTombstoneTTL + time.Second)
+	mut.Unlock()
+
+	// b hasn't collected its tombstone yet, but rebroadcasting it must not
+	// bring it back to a.
+	a.collectTombstones()
+	b.broadcastAll()
+
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	require.Empty(t, a.entries, "expired tombstone should be collected")
+}
+
+func TestStore_SizeLimit(t *testing.T) {
+	s := newTestStore(t, newFakeNetwork().Node("a"))
+	err := s.Set("foo", make([]byte, ckit.MaxBroadcastSize))
+	require.Error(t, err)
+
+	_, ok := s.Get("foo")
+	require.False(t, ok, "rejected write should not be stored")
+}
+
+func newTestStore(t *testing.T, n Node) *Store {
+	t.Helper()
+	s := New(n, Options{ResyncInterval: time.Hour})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fakeNetwork delivers broadcasts between fakeNodes synchronously.
+type fakeNetwork struct {
+	mut   sync.Mutex
+	nodes map[string]*fakeNode
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{nodes: make(map[string]*fakeNode)}
+}
+
+func (fn *fakeNetwork) Node(name string) *fakeNode {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+
+	n := &fakeNode{name: name, net: fn}
+	fn.nodes[name] = n
+	return n
+}
+
+// Join notifies every other node's observers that name joined.
+func (fn *fakeNetwork) Join(name string) {
+	fn.mut.Lock()
+	var observers []ckit.Observer
+	for other, n := range fn.nodes {
+		if other != name {
+			observers = append(observers, n.observers...)
+		}
+	}
+	fn.mut.Unlock()
+
+	for _, o := range observers {
+		o.NotifyPeersChanged([]peer.Peer{{Name: name}})
+	}
+}
+
+type fakeNode struct {
+	name string
+	net  *fakeNetwork
+
+	handlers  []ckit.BroadcastHandler
+	observers []ckit.Observer
+}
+
+func (n *fakeNode) Broadcast(payload []byte) error {
+	n.net.mut.Lock()
+	var handlers []ckit.BroadcastHandler
+	for name, other := range n.net.nodes {
+		if name != n.name {
+			handlers = append(handlers, other.handlers...)
+		}
+	}
+	n.net.mut.Unlock()
+
+	for _, h := range handlers {
+		h(n.name, payload)
+	}
+	return nil
+}
+
+func (n *fakeNode) OnBroadcast(h ckit.BroadcastHandler) {
+	n.net.mut.Lock()
+	defer n.net.mut.Unlock()
+	n.handlers = append(n.handlers, h)
+}
+
+func (n *fakeNode) Observe(o ckit.Observer) (unsubscribe func()) {
+	n.net.mut.Lock()
+	defer n.net.mut.Unlock()
+	n.observers = append(n.observers, o)
+	return func() {}
+}
@@ -0,0 +1,194 @@
+// Package leader implements leader election on top of the membership state
+// gossiped by a ckit Node.
+//
+// Leaders are elected deterministically: every Node which sees the same set
+// of peers will elect the same leader. The leader is the Participant that has
+// been a Participant for the longest, as measured by the lamport time at which
+// it became a Participant. Ties are broken by peer name.
+//
+// Because election happens locally based on gossiped state, two nodes may
+// temporarily disagree on the leader while the cluster state converges.
+// Leaders should not be used for operations which require strict mutual
+// exclusion.
+package leader
+
+import (
+	"sync"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+)
+
+// An Observer is notified when the elected leader changes.
+type Observer interface {
+	// NotifyLeaderChanged is invoked any time the elected leader changes. ok
+	// will be false if there is currently no leader, which happens when there
+	// are no Participants in the cluster.
+	//
+	// If NotifyLeaderChanged returns false, the Observer will no longer receive
+	// any notifications.
+	NotifyLeaderChanged(leader peer.Peer, ok bool) (reregister bool)
+}
+
+// FuncObserver implements Observer.
+type FuncObserver func(leader peer.Peer, ok bool) (reregister bool)
+
+// NotifyLeaderChanged implements Observer.
+func (f FuncObserver) NotifyLeaderChanged(leader peer.Peer, ok bool) (reregister bool) {
+	return f(leader, ok)
+}
+
+// Node is the subset of methods from *ckit.Node used for electing a leader.
+type Node interface {
+	Observe(o ckit.Observer) (unsubscribe func())
+	Peers(opts ...ckit.PeersOption) []peer.Peer
+	PeerParticipantTime(name string) (t uint64, ok bool)
+}
+
+var _ Node = (*ckit.Node)(nil)
+
+// Elector elects a leader from the peers of a Node.
+type Elector struct {
+	node        Node
+	unsubscribe func()
+
+	mut       sync.RWMutex
+	leader    peer.Peer
+	hasLeader bool
+	observers []*registeredObserver
+	closed    bool
+}
+
+// registeredObserver wraps an Observer so it can be identified by pointer
+// when it's removed.
+type registeredObserver struct{ Observer }
+
+// New creates a new Elector which elects a leader from the peers of node.
+// The leader will be updated any time the set of peers changes. Call Close
+// to stop the Elector.
+func New(node Node) *Elector {
+	e := &Elector{node: node}
+	e.update(node.Peers())
+	e.unsubscribe = node.Observe(ckit.FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		return e.update(peers)
+	}))
+	return e
+}
+
+// update elects a new leader from peers, notifying observers if the leader
+// changed. Returns false if the Elector is closed.
+func (e *Elector) update(peers []peer.Peer) (reregister bool) {
+	newLeader, ok := Elect(peers, e.node.PeerParticipantTime)
+
+	e.mut.Lock()
+	if e.closed {
+		e.mut.Unlock()
+		return false
+	}
+	if ok == e.hasLeader && newLeader.Equal(e.leader) {
+		e.mut.Unlock()
+		return true
+	}
+	e.leader, e.hasLeader = newLeader, ok
+
+	// Observers are notified without holding the lock so they can call back
+	// into the Elector.
+	observers := make([]*registeredObserver, len(e.observers))
+	copy(observers, e.observers)
+	e.mut.Unlock()
+
+	var removed []*registeredObserver
+	for _, o := range observers {
+		if !o.NotifyLeaderChanged(newLeader, ok) {
+			removed = append(removed, o)
+		}
+	}
+	if len(removed) > 0 {
+		e.removeObservers(removed)
+	}
+	return true
+}
+
+// removeObservers unregisters observers which no longer want to be notified.
+func (e *Elector) removeObservers(removed []*registeredObserver) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	newObservers := make([]*registeredObserver, 0, len(e.observers))
+Outer:
+	for _, o := range e.observers {
+		for _, r := range removed {
+			if o == r {
+				continue Outer
+			}
+		}
+		newObservers = append(newObservers, o)
+	}
+	e.observers = newObservers
+}
+
+// Leader returns the currently elected leader. ok will be false if there is
+// no leader.
+func (e *Elector) Leader() (leader peer.Peer, ok bool) {
+	e.mut.RLock()
+	defer e.mut.RUnlock()
+	return e.leader, e.hasLeader
+}
+
+// IsLeader returns true if the local Node is the current leader.
+func (e *Elector) IsLeader() bool {
+	leader, ok := e.Leader()
+	return ok && leader.Self
+}
+
+// Observe registers o to be informed when the leader changes. Observers are
+// invoked synchronously while the Node processes a change to its peers, so
+// they should not block.
+func (e *Elector) Observe(o Observer) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.observers = append(e.observers, &registeredObserver{o})
+}
+
+// Close stops the Elector. Observers will no longer be notified after Close
+// returns.
+func (e *Elector) Close() {
+	e.unsubscribe()
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.closed = true
+	e.observers = nil
+}
+
+// Elect deterministically elects a leader from peers. Only peers in
+// StateParticipant can be elected. participantTime is used to retrieve the
+// lamport time at which a peer became a Participant; the eligible peer with
+// the lowest time is elected, breaking ties by name.
+//
+// ok will be false if there are no eligible peers.
+func Elect(peers []peer.Peer, participantTime func(name string) (uint64, bool)) (leader peer.Peer, ok bool) {
+	var leaderTime uint64
+
+	for _, p := range peers {
+		if p.State != peer.StateParticipant {
+			continue
+		}
+
+		t, _ := participantTime(p.Name)
+		switch {
+		case !ok:
+			// First eligible peer.
+		case t < leaderTime:
+			// Older participant.
+		case t == leaderTime && p.Name < leader.Name:
+			// Equally old participant; break the tie by name.
+		default:
+			continue
+		}
+
+		leader, leaderTime, ok = p, t, true
+	}
+
+	return leader, ok
+}
@@ -0,0 +1,145 @@
+package leader
+
+import (
+	"testing"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElect(t *testing.T) {
+	tt := []struct {
+		name   string
+		peers  []peer.Peer
+		times  map[string]uint64
+		expect string // Empty for no leader
+	}{
+		{
+			name:   "no peers",
+			expect: "",
+		},
+		{
+			name: "no participants",
+			peers: []peer.Peer{
+				{Name: "a", State: peer.StateViewer},
+				{Name: "b", State: peer.StateTerminating},
+			},
+			times:  map[string]uint64{"a": 1, "b": 2},
+			expect: "",
+		},
+		{
+			name: "oldest participant",
+			peers: []peer.Peer{
+				{Name: "a", State: peer.StateParticipant},
+				{Name: "b", State: peer.StateParticipant},
+				{Name: "c", State: peer.StateViewer},
+			},
+			times:  map[string]uint64{"a": 10, "b": 5, "c": 1},
+			expect: "b",
+		},
+		{
+			name: "ties broken by name",
+			peers: []peer.Peer{
+				{Name: "b", State: peer.StateParticipant},
+				{Name: "a", State: peer.StateParticipant},
+			},
+			times:  map[string]uint64{"a": 5, "b": 5},
+			expect: "a",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			leader, ok := Elect(tc.peers, func(name string) (uint64, bool) {
+				t, ok := tc.times[name]
+				return t, ok
+			})
+			if tc.expect == "" {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tc.expect, leader.Name)
+		})
+	}
+}
+
+func TestElector(t *testing.T) {
+	node := &fakeNode{times: map[string]uint64{"a": 1, "b": 2}}
+	node.peers = []peer.Peer{
+		{Name: "a", State: peer.StateParticipant},
+		{Name: "b", State: peer.StateParticipant, Self: true},
+	}
+
+	e := New(node)
+	defer e.Close()
+
+	leader, ok := e.Leader()
+	require.True(t, ok)
+	require.Equal(t, "a", leader.Name)
+	require.False(t, e.IsLeader())
+
+	var changes []string
+	e.Observe(FuncObserver(func(leader peer.Peer, ok bool) (reregister bool) {
+		changes = append(changes, leader.Name)
+		return true
+	}))
+
+	// Move the leader to terminating; b should take over.
+	node.set([]peer.Peer{
+		{Name: "a", State: peer.StateTerminating},
+		{Name: "b", State: peer.StateParticipant, Self: true},
+	})
+	require.True(t, e.IsLeader())
+
+	// Unrelated changes shouldn't notify observers.
+	node.set([]peer.Peer{
+		{Name: "b", State: peer.StateParticipant, Self: true},
+	})
+	require.Equal(t, []string{"b"}, changes)
+}
+
+func TestElector_ObserverReentrant(t *testing.T) {
+	node := &fakeNode{times: map[string]uint64{"a": 1, "b": 2}}
+	node.peers = []peer.Peer{{Name: "a", State: peer.StateParticipant}}
+
+	e := New(node)
+	defer e.Close()
+
+	var leaders []string
+	e.Observe(FuncObserver(func(peer.Peer, bool) (reregister bool) {
+		// Calling back into the Elector must not deadlock.
+		leader, _ := e.Leader()
+		leaders = append(leaders, leader.Name)
+		return false
+	}))
+
+	node.set([]peer.Peer{{Name: "b", State: peer.StateParticipant}})
+	node.set([]peer.Peer{{Name: "a", State: peer.StateParticipant}})
+	require.Equal(t, []string{"b"}, leaders, "observer should be removed after returning false")
+}
+
+type fakeNode struct {
+	observers []ckit.Observer
+	peers     []peer.Peer
+	times     map[string]uint64
+}
+
+func (fn *fakeNode) Observe(o ckit.Observer) (unsubscribe func()) {
+	fn.observers = append(fn.observers, o)
+	return func() {}
+}
+func (fn *fakeNode) Peers(...ckit.PeersOption) []peer.Peer { return fn.peers }
+
+func (fn *fakeNode) PeerParticipantTime(name string) (uint64, bool) {
+	t, ok := fn.times[name]
+	return t, ok
+}
+
+func (fn *fakeNode) set(peers []peer.Peer) {
+	fn.peers = peers
+	for _, o := range fn.observers {
+		o.NotifyPeersChanged(peers)
+	}
+}
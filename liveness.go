@@ -0,0 +1,158 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Liveness is the low-level gossip status of a peer, as determined by
+// failure detection. Liveness is independent of the application state of a
+// peer (peer.State): a Participant may be suspected of failing before it is
+// declared dead and removed from the cluster.
+type Liveness uint8
+
+const (
+	// LivenessUnknown is used for peers which have never been seen.
+	LivenessUnknown Liveness = iota
+	// LivenessAlive is used for peers which are responding to probes.
+	LivenessAlive
+	// LivenessSuspect is used for peers which failed a probe and will be
+	// declared dead unless they refute the suspicion.
+	LivenessSuspect
+	// LivenessDead is used for peers which were declared dead and removed
+	// from the cluster.
+	LivenessDead
+	// LivenessLeft is used for peers which gracefully left the cluster.
+	LivenessLeft
+)
+
+// String returns the string representation of l.
+func (l Liveness) String() string {
+	switch l {
+	case LivenessUnknown:
+		return "unknown"
+	case LivenessAlive:
+		return "alive"
+	case LivenessSuspect:
+		return "suspect"
+	case LivenessDead:
+		return "dead"
+	case LivenessLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("Liveness(%d)", l)
+	}
+}
+
+// livenessSuspectPhi is the phi (see PeerHealth) above which a peer is
+// reported as LivenessSuspect. A phi of 8 means there is a roughly 0.000001%
+// chance of being wrong about the peer having failed.
+const livenessSuspectPhi = 8
+
+// PeerStatus returns the liveness of the peer with the given name. ok will be
+// false if the peer is unknown. Peers which were removed from the cluster
+// are reported as LivenessDead or LivenessLeft until they're forgotten.
+//
+// memberlist doesn't expose its internal suspicion of peers, so a peer is
+// reported as LivenessSuspect when the failure detector used for PeerHealth
+// suspects that it has failed. PeerStatus can be polled to react to
+// suspected failures before the peer is removed from the cluster.
+//
+// Peers announce when they start to gracefully leave the cluster. A peer is
+// reported as LivenessDead if it was removed without that announcement
+// having been received.
+func (n *Node) PeerStatus(name string) (status Liveness, ok bool) {
+	for _, m := range n.memberlist().Members() {
+		if m.Name == name {
+			return n.memberLiveness(m.Name, time.Now()), true
+		}
+	}
+
+	n.peerMut.RLock()
+	defer n.peerMut.RUnlock()
+
+	status, ok = n.departed[name]
+	return status, ok
+}
+
+// memberLiveness returns the liveness of a peer which is still a member of
+// the cluster.
+func (n *Node) memberLiveness(name string, now time.Time) Liveness {
+	n.healthMut.Lock()
+	defer n.healthMut.Unlock()
+
+	if h, ok := n.health[name]; ok && h.get(now).Phi >= livenessSuspectPhi {
+		return LivenessSuspect
+	}
+	return LivenessAlive
+}
+
+// departedLiveness returns the liveness of a peer which was removed from the
+// cluster.
+func departedLiveness(node *memberlist.Node) Liveness {
+	if decodeMeta(node.Meta).Leaving {
+		return LivenessLeft
+	}
+	return LivenessDead
+}
+
+// announceLeaving updates the metadata of n to inform peers that n is
+// gracefully leaving the cluster. Failing to announce is logged but otherwise
+// ignored; peers will report n as dead instead of left.
+func (n *Node) announceLeaving(ctx context.Context) {
+	n.metaMut.Lock()
+	n.leaving = true
+	err := n.encodeMetaLocked()
+	n.metaMut.Unlock()
+	if err != nil {
+		level.Warn(n.log).Log("msg", "failed to announce leaving cluster", "err", err)
+		return
+	}
+	if err := n.memberlist().UpdateNode(leaveTimeout(ctx)); err != nil {
+		level.Warn(n.log).Log("msg", "failed to announce leaving cluster", "err", err)
+	}
+}
+
+// livenessCollector exposes the liveness of every peer as metrics.
+type livenessCollector struct {
+	n *Node
+
+	statusDesc *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*livenessCollector)(nil)
+
+func newLivenessCollector(n *Node) *livenessCollector {
+	return &livenessCollector{
+		n: n,
+
+		statusDesc: prometheus.NewDesc(
+			"cluster_node_peer_liveness",
+			"Gossip liveness of a peer. The value is 1 for the current status of the peer.",
+			[]string{"peer", "status"}, nil,
+		),
+	}
+}
+
+func (lc *livenessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.statusDesc
+}
+
+func (lc *livenessCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, m := range lc.n.memberlist().Members() {
+		ch <- prometheus.MustNewConstMetric(lc.statusDesc, prometheus.GaugeValue, 1, m.Name, lc.n.memberLiveness(m.Name, now).String())
+	}
+
+	lc.n.peerMut.RLock()
+	defer lc.n.peerMut.RUnlock()
+
+	for name, status := range lc.n.departed {
+		ch <- prometheus.MustNewConstMetric(lc.statusDesc, prometheus.GaugeValue, 1, name, status.String())
+	}
+}
@@ -0,0 +1,115 @@
+package ckit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_PeerStatus(t *testing.T) {
+	fastFailure := func(name string) Config {
+		return Config{
+			Name:          name,
+			ProbeInterval: 100 * time.Millisecond,
+			ProbeTimeout:  50 * time.Millisecond,
+			SuspicionMult: 1,
+		}
+	}
+
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, fastFailure("node-a"))
+		b, _     = newTestNodeWithConfig(t, l, fastFailure("node-b"))
+		c, _     = newTestNodeWithConfig(t, l, fastFailure("node-c"))
+	)
+
+	runTestNode(t, a, nil)
+	require.NoError(t, b.Start([]string{aAddr}))
+	require.NoError(t, c.Start([]string{aAddr}))
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	status, ok := a.PeerStatus("node-b")
+	require.True(t, ok)
+	require.Equal(t, LivenessAlive, status)
+
+	_, ok = a.PeerStatus("node-z")
+	require.False(t, ok)
+
+	t.Run("left", func(t *testing.T) {
+		require.NoError(t, b.Stop())
+		require.Eventually(t, func() bool {
+			status, _ := a.PeerStatus("node-b")
+			return status == LivenessLeft
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("dead", func(t *testing.T) {
+		// Simulate node-c crashing by shutting down its memberlist without
+		// leaving the cluster.
+		require.NoError(t, c.memberlist().Shutdown())
+		require.Eventually(t, func() bool {
+			status, _ := a.PeerStatus("node-c")
+			return status == LivenessDead
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
+
+func TestNode_UnhealthyPeers(t *testing.T) {
+	n, _ := newTestNodeWithConfig(t, testlogger.New(t), Config{Name: "node-a"})
+
+	// Assign the Sharder after creating the Node so its peers aren't
+	// overwritten with the peers of the Node.
+	sharder := shard.Ring(16, shard.WithUnhealthyPolicy(shard.UnhealthyAvoid))
+	n.cfg.Sharder = sharder
+	sharder.SetPeers([]peer.Peer{
+		{Name: "node-a", Self: true, State: peer.StateParticipant},
+		{Name: "node-b", State: peer.StateParticipant},
+	})
+	require.Empty(t, n.UnhealthyPeers())
+
+	// Find a key owned by node-b.
+	var key shard.Key
+	for i := 0; ; i++ {
+		require.Less(t, i, 1000, "no key owned by node-b")
+
+		key = shard.StringKey(fmt.Sprintf("key-%d", i))
+		owners, err := sharder.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		if owners[0].Name == "node-b" {
+			break
+		}
+	}
+
+	n.recordSend("node-b", false)
+	require.Equal(t, []string{"node-b"}, n.UnhealthyPeers())
+
+	last := n.checkHealth(nil)
+	require.Equal(t, []string{"node-b"}, last)
+	owners, err := sharder.Lookup(key, 1, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Equal(t, "node-a", owners[0].Name, "unhealthy peer should be avoided")
+
+	// A successful ping after the failed send makes the peer healthy again.
+	time.Sleep(time.Millisecond)
+	(&nodeDelegate{n}).NotifyPingComplete(&memberlist.Node{Name: "node-b"}, time.Millisecond, nil)
+	require.Empty(t, n.UnhealthyPeers())
+
+	require.Empty(t, n.checkHealth(last))
+	owners, err = sharder.Lookup(key, 1, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Equal(t, "node-b", owners[0].Name)
+
+	// So does reaching the peer with Send.
+	n.recordSend("node-b", false)
+	n.recordSend("node-b", true)
+	require.Empty(t, n.UnhealthyPeers())
+}
@@ -0,0 +1,111 @@
+package ckit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// MaxMetadataSize is the maximum size of the application payload set by
+// Config.Metadata and Node.SetMetadata. Metadata is sent alongside every
+// message which describes the Node to peers, so payloads should be kept as
+// small as possible.
+const MaxMetadataSize = 192
+
+// A MetadataHandler is invoked when the metadata payload of a remote peer
+// changes, including when a peer with a non-empty payload joins. name is the
+// name of the peer.
+//
+// MetadataHandlers are invoked while gossip messages are being processed and
+// must not block. payload must not be modified.
+type MetadataHandler func(name string, payload []byte)
+
+// SetMetadata changes the application payload gossiped to peers (see
+// Config.Metadata). SetMetadata blocks until the change has been broadcast
+// or until ctx is canceled. Canceling ctx does not stop the change from
+// being broadcast; it just stops waiting for it.
+func (n *Node) SetMetadata(ctx context.Context, payload []byte) error {
+	if len(payload) > MaxMetadataSize {
+		return fmt.Errorf("metadata of %d bytes exceeds limit of %d bytes", len(payload), MaxMetadataSize)
+	}
+
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+	if n.stopped {
+		return ErrStopped
+	}
+
+	n.metaMut.Lock()
+	prev := n.metadata
+	n.metadata = append([]byte(nil), payload...)
+	if err := n.encodeMetaLocked(); err != nil {
+		n.metadata = prev
+		n.metaMut.Unlock()
+		return err
+	}
+	n.metaMut.Unlock()
+
+	return n.memberlist().UpdateNode(leaveTimeout(ctx))
+}
+
+// PeerMetadata returns the most recent metadata payload of the peer with the
+// given name, including the local node. ok will be false if the peer is
+// unknown or has no metadata. The returned payload must not be modified.
+func (n *Node) PeerMetadata(name string) (payload []byte, ok bool) {
+	if name == n.cfg.Name {
+		n.metaMut.RLock()
+		defer n.metaMut.RUnlock()
+		return n.metadata, len(n.metadata) > 0
+	}
+
+	n.metadataMut.Lock()
+	defer n.metadataMut.Unlock()
+	payload, ok = n.peerMetadata[name]
+	return payload, ok
+}
+
+// OnMetadataChange registers h to be invoked whenever the metadata payload
+// of a remote peer changes. Multiple handlers may be registered; they are
+// invoked in the order they were registered.
+func (n *Node) OnMetadataChange(h MetadataHandler) {
+	n.metadataMut.Lock()
+	defer n.metadataMut.Unlock()
+	n.metadataHandlers = append(n.metadataHandlers, h)
+}
+
+// handleMetadata records the metadata payload of node and invokes handlers
+// if it changed. Must not be called with peerMut held.
+func (n *Node) handleMetadata(node *memberlist.Node) {
+	if node.Name == n.cfg.Name || n.isDenied(node) {
+		return
+	}
+	payload := decodeMeta(node.Meta).Payload
+
+	n.metadataMut.Lock()
+	if bytes.Equal(n.peerMetadata[node.Name], payload) {
+		n.metadataMut.Unlock()
+		return
+	}
+	if len(payload) == 0 {
+		delete(n.peerMetadata, node.Name)
+	} else {
+		n.peerMetadata[node.Name] = append([]byte(nil), payload...)
+	}
+	handlers := make([]MetadataHandler, len(n.metadataHandlers))
+	copy(handlers, n.metadataHandlers)
+	n.metadataMut.Unlock()
+
+	for _, h := range handlers {
+		h(node.Name, payload)
+	}
+}
+
+// forgetMetadata removes the metadata payload of a peer which left the
+// cluster.
+func (n *Node) forgetMetadata(name string) {
+	n.metadataMut.Lock()
+	defer n.metadataMut.Unlock()
+	delete(n.peerMetadata, name)
+}
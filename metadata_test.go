@@ -0,0 +1,58 @@
+package ckit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_Metadata(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", Metadata: []byte("hello")})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	changes := make(chan string, 10)
+	a.OnMetadataChange(func(name string, payload []byte) {
+		changes <- name + "=" + string(payload)
+	})
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	waitClusterState(t, b, func(n *Node) bool {
+		payload, _ := n.PeerMetadata("node-a")
+		return string(payload) == "hello"
+	})
+
+	payload, ok := a.PeerMetadata("node-a")
+	require.True(t, ok)
+	require.Equal(t, "hello", string(payload))
+
+	_, ok = a.PeerMetadata("node-b")
+	require.False(t, ok, "node-b should not have metadata")
+
+	require.NoError(t, b.SetMetadata(context.Background(), []byte("world")))
+	select {
+	case change := <-changes:
+		require.Equal(t, "node-b=world", change)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "metadata change not received")
+	}
+
+	payload, ok = a.PeerMetadata("node-b")
+	require.True(t, ok)
+	require.Equal(t, "world", string(payload))
+
+	err := b.SetMetadata(context.Background(), make([]byte, MaxMetadataSize+1))
+	require.EqualError(t, err, "metadata of 193 bytes exceeds limit of 192 bytes")
+}
+
+func TestConfig_MetadataSize(t *testing.T) {
+	cfg := Config{Name: "node-a", AdvertiseAddr: "127.0.0.1:7946", Metadata: make([]byte, MaxMetadataSize+1)}
+	require.EqualError(t, cfg.validate(), "metadata of 193 bytes exceeds limit of 192 bytes")
+}
@@ -9,6 +9,8 @@ import (
 // Possible label values for metrics.gossipEventsTotal
 const (
 	eventStateChange      = "state_change_message"
+	eventStateAck         = "state_ack_message"
+	eventUserMessage      = "user_message"
 	eventUnkownMessage    = "unknown_message"
 	eventGetLocalState    = "get_local_state"
 	eventMergeRemoteState = "merge_remote_state"
@@ -16,6 +18,13 @@ const (
 	eventNodeLeave        = "node_leave"
 	eventNodeUpdate       = "node_update"
 	eventNodeConflict     = "node_conflict"
+	eventNodeMerge        = "node_merge"
+)
+
+// Possible label values for metrics.pushPullDuration
+const (
+	pushPullLocalState       = "local_state"
+	pushPullMergeRemoteState = "merge_remote_state"
 )
 
 // metrics holds the set of metrics for a Node. Additional Collectors can be
@@ -23,12 +32,28 @@ const (
 type metrics struct {
 	metricsutil.Container
 
-	gossipEventsTotal  *prometheus.CounterVec
-	nodePeers          *prometheus.GaugeVec
-	nodeUpdating       prometheus.Gauge
-	nodeUpdateDuration prometheus.Histogram
-	nodeObservers      prometheus.Gauge
-	nodeInfo           *metricsutil.InfoCollector
+	gossipEventsTotal            *prometheus.CounterVec
+	nodePeers                    *prometheus.GaugeVec
+	nodeUpdating                 prometheus.Gauge
+	nodeUpdateDuration           prometheus.Histogram
+	nodeObservers                prometheus.Gauge
+	observerNotificationsDropped prometheus.Counter
+	observerPanicsTotal          prometheus.Counter
+	nodeInfo                     *metricsutil.InfoCollector
+	clusterMergesTotal           prometheus.Counter
+	nameConflictsTotal           prometheus.Counter
+	peersRejectedTotal           prometheus.Counter
+	clusterNameMismatchesTotal   prometheus.Counter
+	pushPullDuration             *prometheus.HistogramVec
+	convergeDuration             prometheus.Histogram
+
+	rejoinAttemptsTotal prometheus.Counter
+	rejoinFailuresTotal prometheus.Counter
+	isolationDemotions  prometheus.Counter
+
+	reachabilityProbesTotal *prometheus.CounterVec
+	sharderDivergentPeers   prometheus.Gauge
+	clockSaveFailuresTotal  prometheus.Counter
 }
 
 var _ prometheus.Collector = (*metrics)(nil)
@@ -62,24 +87,109 @@ func newMetrics() *metrics {
 		Help: "Number of internal observers waiting for changes to cluster state.",
 	})
 
+	m.observerNotificationsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_observer_notifications_dropped_total",
+		Help: "Total number of observer notifications dropped because an observer's queue was full. Dropped notifications are coalesced into newer ones.",
+	})
+	m.observerPanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_observer_panics_total",
+		Help: "Total number of panics recovered from observers.",
+	})
+
 	m.nodeInfo = metricsutil.NewInfoCollector(metricsutil.InfoOpts{
 		Name: "cluster_node_info",
 		Help: "Info about the local node. Label values will change as the node changes state.",
 	}, "state")
 
+	m.clusterMergesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_merges_total",
+		Help: "Total number of times the node detected a merge with a separate cluster.",
+	})
+
+	m.nameConflictsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_name_conflicts_total",
+		Help: "Total number of times the node detected two nodes with the same name and different addresses.",
+	})
+
+	m.peersRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_peers_rejected_total",
+		Help: "Total number of peers rejected from joining the cluster by the admission hook.",
+	})
+
+	m.clusterNameMismatchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_cluster_name_mismatches_total",
+		Help: "Total number of times the node received gossip about a peer belonging to a different cluster.",
+	})
+
+	m.pushPullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cluster_node_push_pull_duration_seconds",
+		Help:    "Histogram of the time spent by the node handling each phase of a full state sync with a peer.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"phase"})
+
+	m.convergeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cluster_node_converge_duration_seconds",
+		Help:    "Histogram of the time WaitConverged waited for cluster membership to converge.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	m.rejoinAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_rejoin_attempts_total",
+		Help: "Total number of times the node attempted to rejoin the cluster after losing contact with all peers.",
+	})
+
+	m.rejoinFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_rejoin_failures_total",
+		Help: "Total number of failed attempts to rejoin the cluster.",
+	})
+
+	m.reachabilityProbesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cluster_node_reachability_probes_total",
+		Help: "Total number of reachability probes sent to peers over gRPC, by result.",
+	}, []string{"result"})
+
+	m.sharderDivergentPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cluster_node_sharder_divergent_peers",
+		Help: "Number of peers whose sharder would compute different owners for the same key than the local sharder.",
+	})
+
+	m.clockSaveFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_clock_save_failures_total",
+		Help: "Total number of times the node failed to persist its clock to the state directory.",
+	})
+
+	m.isolationDemotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_node_isolation_demotions_total",
+		Help: "Total number of times the node demoted itself to a viewer after losing contact with all peers.",
+	})
+
 	m.Add(
 		m.gossipEventsTotal,
 		m.nodePeers,
 		m.nodeUpdating,
 		m.nodeUpdateDuration,
 		m.nodeObservers,
+		m.observerNotificationsDropped,
+		m.observerPanicsTotal,
 		m.nodeInfo,
+		m.clusterMergesTotal,
+		m.nameConflictsTotal,
+		m.peersRejectedTotal,
+		m.clusterNameMismatchesTotal,
+		m.pushPullDuration,
+		m.convergeDuration,
+		m.rejoinAttemptsTotal,
+		m.rejoinFailuresTotal,
+		m.isolationDemotions,
+		m.reachabilityProbesTotal,
+		m.sharderDivergentPeers,
+		m.clockSaveFailuresTotal,
 	)
 
 	return &m
 }
 
-func newMemberlistCollector(ml *memberlist.Memberlist) prometheus.Collector {
+func newMemberlistCollector(ml func() *memberlist.Memberlist) prometheus.Collector {
 	var container metricsutil.Container
 
 	gossipProtoVersion := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
@@ -89,21 +199,21 @@ func newMemberlistCollector(ml *memberlist.Memberlist) prometheus.Collector {
 		// NOTE(rfratto): while this is static at the time of writing, the internal
 		// documentation for memberlist claims that ProtocolVersion may one day be
 		// updated at runtime.
-		return float64(ml.ProtocolVersion())
+		return float64(ml().ProtocolVersion())
 	})
 
 	gossipHealthScore := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "cluster_node_gossip_health_score",
 		Help: "Health value of a node; lower values means healthier. 0 is the minimum.",
 	}, func() float64 {
-		return float64(ml.GetHealthScore())
+		return float64(ml().GetHealthScore())
 	})
 
 	gossipPeers := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "cluster_node_gossip_alive_peers",
 		Help: "How many alive gossip peers a node has, including the local node.",
 	}, func() float64 {
-		return float64(ml.NumMembers())
+		return float64(ml().NumMembers())
 	})
 
 	container.Add(
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"runtime/debug"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,8 +24,10 @@ import (
 	"github.com/rfratto/ckit/internal/memberlistgrpc"
 	"github.com/rfratto/ckit/internal/messages"
 	"github.com/rfratto/ckit/internal/queue"
+	"github.com/rfratto/ckit/internal/unicastpb"
 	"github.com/rfratto/ckit/peer"
 	"github.com/rfratto/ckit/shard"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc"
 )
 
@@ -32,6 +37,22 @@ var (
 	ErrStopped = errors.New("node stopped")
 )
 
+// MaxLabelsSize is the maximum combined size in bytes of all label names and
+// values for a Node.
+const MaxLabelsSize = 1024
+
+// NameConflictError is returned by Start when another node in the cluster is
+// already using the same name.
+type NameConflictError struct {
+	Name string // Name of the node.
+	Addr string // Address of the existing node using Name.
+}
+
+// Error implements error.
+func (e NameConflictError) Error() string {
+	return fmt.Sprintf("name conflict with %s", e.Addr)
+}
+
 // StateTransitionError is returned when a node requests an invalid state
 // transition.
 type StateTransitionError struct {
@@ -52,9 +73,61 @@ type Config struct {
 	// Required.
 	AdvertiseAddr string
 
-	// Optional logger to use.
+	// Optional logger to use. Use NewSlogLogger to log to a *slog.Logger.
 	Log log.Logger
 
+	// Optional set of labels to advertise to peers. Labels are gossiped along
+	// with the state of the Node, and can be changed at runtime by calling
+	// Node.SetLabels. The combined size of all label names and values must not
+	// exceed MaxLabelsSize.
+	Labels map[string]string
+
+	// Optional relative capacity of the Node, gossiped to peers as
+	// peer.Peer.Weight. Sharders which support weights assign Nodes with
+	// higher weights proportionally more keys; a Node with a weight of 2 will
+	// own roughly twice as many keys as a Node with a weight of 1. Defaults to
+	// 1.
+	Weight int
+
+	// Optional availability zone (or other failure domain) the Node is
+	// running in, gossiped to peers as peer.Peer.AvailabilityZone.
+	AvailabilityZone string
+
+	// Optional set of roles the Node performs within the cluster (e.g.,
+	// "ingest" or "query"), gossiped to peers as peer.Peer.Roles. Roles can be
+	// used to build per-role views of the cluster; see shard.WithRoles. Role
+	// names must not be empty.
+	Roles []string
+
+	// Optional application version of the Node, advertised to peers as
+	// peer.Peer.Version. The version is sent to peers when they first
+	// discover the Node, before it is admitted to the cluster. Must not be
+	// longer than 128 bytes.
+	Version string
+
+	// Optional policy for rejecting peers running a Version incompatible with
+	// the local Node, such as SameMajorVersion. Peers rejected by
+	// VersionPolicy are treated the same as peers rejected by
+	// OnPeerAdmission.
+	VersionPolicy VersionPolicy
+
+	// Optional name of the cluster the Node belongs to. The cluster name is
+	// sent to peers when they first discover the Node, and peers with a
+	// different cluster name are rejected. Start fails if the join peers
+	// belong to a different cluster. This prevents accidentally merging
+	// separate clusters, such as by pointing join peers at the wrong
+	// environment.
+	//
+	// Nodes with an empty ClusterName only accept peers with an empty
+	// ClusterName. Must not be longer than 128 bytes.
+	ClusterName string
+
+	// Optional application-defined payload gossiped to peers alongside the
+	// Node's metadata, such as the address of an application endpoint.
+	// Payloads can be retrieved with Node.PeerMetadata and changed at
+	// runtime with Node.SetMetadata. Must not be larger than MaxMetadataSize.
+	Metadata []byte
+
 	// Optional sharder to synchronize cluster changes to. Synchronization of the
 	// Sharder happens prior to Observers being notified of changes.
 	Sharder shard.Sharder
@@ -62,9 +135,237 @@ type Config struct {
 	// Optional client pool to use for establishing gRPC connctions to peers. A
 	// client pool will be made if one is not provided here.
 	Pool *clientpool.Pool
+
+	// Optional set of state transitions to permit in addition to the built-in
+	// transitions. This allows nodes to move into and out of custom states
+	// registered with peer.RegisterState. Every state used in a transition
+	// must be valid.
+	StateTransitions []StateTransition
+
+	// Optional directory to persist local state to across restarts. When set,
+	// the lamport clock of the Node is saved to the directory and restored by
+	// NewNode, preventing stale messages from a previous run from taking
+	// precedence over new ones.
+	//
+	// The last known set of peers is also saved to the directory. If none of
+	// the peers passed to Start can be joined, Start will fall back to joining
+	// the saved peers.
+	//
+	// The directory will be created if it doesn't exist.
+	StateDir string
+
+	// OnClusterMerge is an optional callback invoked when n detects that two
+	// previously separate clusters are merging, such as after a network
+	// partition heals. local is the set of peers n knew about before the
+	// merge, and remote is the set of peers known by the other cluster.
+	//
+	// A merge is detected when joining a remote cluster with at least two
+	// members which shares no members in common with the local cluster. The
+	// states of remote peers may not be known yet when OnClusterMerge is
+	// called. OnClusterMerge is invoked in the background.
+	OnClusterMerge func(local, remote []peer.Peer)
+
+	// OnNameConflict is an optional callback invoked when two live nodes are
+	// detected advertising the same name with different addresses. existing
+	// is the node which was already known, and other is the conflicting node.
+	// The conflicting node is ignored and the existing node is kept.
+	//
+	// If the local node is the one joining with a conflicting name, Start
+	// returns a NameConflictError. OnNameConflict is invoked in the
+	// background.
+	OnNameConflict func(existing, other peer.Peer)
+
+	// OnPeerAdmission is an optional callback invoked when a peer is first
+	// discovered, and again if its address changes. If OnPeerAdmission returns
+	// an error, the peer is rejected: it is excluded from Peers, Sharders,
+	// and Observers, and gossip announcing it is ignored.
+	//
+	// OnPeerAdmission is never invoked for the local node. The state of the
+	// peer may not be known yet when OnPeerAdmission is called.
+	// OnPeerAdmission is invoked while gossip messages are being processed
+	// and must not block.
+	OnPeerAdmission func(p peer.Peer) error
+
+	// DeniedPeers is an optional list of peers to refuse membership to. Each
+	// entry is either the name of a peer or a CIDR (e.g., "10.0.0.0/24")
+	// matching peer addresses. Denied peers are rejected like peers refused
+	// by OnPeerAdmission, and gossip about their state is ignored. More peers
+	// can be denied at runtime with Node.DenyPeer.
+	DeniedPeers []string
+
+	// LeaveQuorum is the number of remote peers which must acknowledge that
+	// this Node is terminating before Leave returns. If 0, a majority of
+	// remote peers must acknowledge the change.
+	LeaveQuorum int
+
+	// RejoinMinBackoff enables automatically rejoining the cluster after the
+	// Node loses contact with every other peer, such as after a network
+	// outage. When set, a Node with no remote peers will periodically attempt
+	// to join the peers passed to Start again. The time between failed
+	// attempts doubles from RejoinMinBackoff up to RejoinMaxBackoff.
+	//
+	// If 0, the Node will not automatically rejoin the cluster.
+	RejoinMinBackoff time.Duration
+
+	// RejoinMaxBackoff is the maximum time between rejoin attempts. Defaults
+	// to 1 minute. Ignored if RejoinMinBackoff is 0.
+	RejoinMaxBackoff time.Duration
+
+	// ReachabilityProbeInterval, if non-zero, enables periodically probing a
+	// random sample of peers over gRPC, independently of gossip. Probes
+	// detect peers which are unreachable over gRPC but still considered
+	// members through gossip, such as during an asymmetric partition. Probe
+	// results are available through Node.PeerReachable and
+	// Node.SuspectedPartition. Each probe times out after half of
+	// ReachabilityProbeInterval.
+	ReachabilityProbeInterval time.Duration
+
+	// ReachabilityProbeSample is the number of peers probed every
+	// ReachabilityProbeInterval. Defaults to 3.
+	ReachabilityProbeSample int
+
+	// HealthCheckInterval, if non-zero, is how often the Node checks for
+	// unhealthy peers (see Node.UnhealthyPeers) and marks them in Sharder
+	// with shard.SetUnhealthy. This allows lookups to skip
+	// Participants which are suspected to have failed before they're
+	// removed from the cluster. Sharders ignore unhealthy peers unless
+	// they're created with shard.WithUnhealthyPolicy.
+	HealthCheckInterval time.Duration
+
+	// IsolationDemoteTimeout enables automatically demoting the Node from
+	// StateParticipant to StateViewer after it has had no remote peers for
+	// at least IsolationDemoteTimeout. This prevents an isolated Node from
+	// believing it owns every key. Demoted Nodes don't automatically move
+	// back to StateParticipant; applications can call ChangeState once the
+	// cluster is reachable again.
+	//
+	// If 0, the Node is never demoted.
+	IsolationDemoteTimeout time.Duration
+
+	// OnIsolationDemote is an optional function invoked after the Node
+	// demoted itself to StateViewer because of IsolationDemoteTimeout.
+	// OnIsolationDemote must not block.
+	OnIsolationDemote func()
+
+	// DivergenceCheckInterval, if non-zero, is how often the Node gossips a
+	// fingerprint of Sharder (see shard.Fingerprint) and compares it with the
+	// fingerprints gossiped by its peers. Peers with a different fingerprint
+	// would compute different owners for the same key, such as when they
+	// disagree about the set of peers or use different sharder parameters.
+	// See Node.DivergentPeers. Ignored if Sharder is nil.
+	DivergenceCheckInterval time.Duration
+
+	// OnSharderDivergence is an optional function invoked with the names of
+	// the divergent peers whenever they change, including with no names once
+	// divergence is resolved. OnSharderDivergence must not block.
+	OnSharderDivergence func(divergent []string)
+
+	// JoinPeersRefreshInterval, if non-zero, is how often the DNS names in the
+	// peers passed to Start are re-resolved. Newly discovered addresses which
+	// aren't already peers are joined automatically. This is useful when the
+	// join peers point at a set of addresses which change over time, such as a
+	// headless service in Kubernetes.
+	JoinPeersRefreshInterval time.Duration
+
+	// ObserverQueueSize, if non-zero, enables notifying each Observer from its
+	// own goroutine. Up to ObserverQueueSize notifications are buffered for
+	// each Observer; when an Observer's buffer is full, the oldest
+	// notification is dropped in favor of the newest one. This prevents a
+	// slow Observer from delaying notifications to other Observers.
+	//
+	// If 0, Observers are notified one at a time in the order they were
+	// registered.
+	ObserverQueueSize int
+
+	// RemovePanickingObservers deregisters an Observer after it panics.
+	// Panics from Observers are always recovered, logged, and counted in the
+	// cluster_node_observer_panics_total metric; by default, an Observer
+	// which panics continues to receive notifications.
+	RemovePanickingObservers bool
+
+	// NotificationDebounce, if non-zero, delays notifying Observers after a
+	// change to the set of peers so that a burst of changes, such as many
+	// Nodes starting at once, is coalesced into a single notification.
+	// Observers are notified about the most recent set of peers at most
+	// NotificationDebounce after the first change in a burst.
+	NotificationDebounce time.Duration
+
+	// HistorySize is the number of membership events retained for
+	// Node.History. Defaults to 256. Set to a negative value to disable
+	// history.
+	HistorySize int
+
+	// PeerMetricLabelLimit, if non-zero, labels the gossip transport packet
+	// metrics by peer with the peer label, so operators can see which peer
+	// packets fail to be sent to. At most PeerMetricLabelLimit distinct peers
+	// are used as label values; any other peer is labeled as "other". If Pool
+	// is nil, the client pool created for the Node uses the same limit (see
+	// clientpool.Options.PeerLabelLimit).
+	PeerMetricLabelLimit int
+
+	// PushPullInterval is how often the Node performs a full state sync with
+	// a random peer. Full state syncs repair any state missed through gossip,
+	// but are more expensive than gossip as the cluster grows. Defaults to 30
+	// seconds.
+	PushPullInterval time.Duration
+
+	// MinimumClusterSize, if non-zero, is the number of nodes (including the
+	// local Node) which must be known before the Node may move to
+	// StateParticipant. ChangeState will block until enough nodes have been
+	// discovered. This prevents a Node which starts before its peers from
+	// temporarily owning every key as the only Participant.
+	MinimumClusterSize int
+
+	// Readiness is the policy used by Ready to determine whether the Node is
+	// ready to serve traffic. The zero value only requires the Node to be
+	// started.
+	Readiness ReadinessPolicy
+
+	// DisablePushPull disables periodic full state syncs. Full state syncs
+	// are still performed when joining the cluster.
+	DisablePushPull bool
+
+	// ProbeInterval is how often the Node probes a random peer to check its
+	// health. Lower values detect failed peers faster at the cost of more
+	// network traffic. Defaults to 1 second.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is how long the Node waits for a probed peer to respond
+	// before falling back to indirect probes through other peers. It should
+	// be set to the 99th percentile of round-trip times in the cluster, and
+	// must be less than ProbeInterval. Defaults to 500 milliseconds.
+	ProbeTimeout time.Duration
+
+	// SuspicionMult scales how long a peer which failed a probe is suspected
+	// before it is declared dead and removed. Suspicion timeouts also grow
+	// with the log of the cluster size. Higher values reduce false positives
+	// but delay removing failed peers. Defaults to 4.
+	SuspicionMult int
+
+	// RetransmitMult scales how many times gossip messages are retransmitted
+	// to peers. Messages are retransmitted RetransmitMult * log(N+1) times,
+	// where N is the number of peers. Defaults to 4.
+	RetransmitMult int
+
+	// GossipNodes is the number of random peers gossip messages are sent to
+	// on each gossip interval. Higher values speed up convergence at the cost
+	// of more network traffic. Defaults to 3.
+	GossipNodes int
+
+	// DeadNodeReclaimTime is how long after a peer is declared dead that
+	// another node may join with the same name but a different address. By
+	// default, a dead peer's name can only be reused at a new address once
+	// the dead peer has been forgotten by the cluster, and nodes joining with
+	// its name before then are treated as name conflicts.
+	//
+	// Setting a short DeadNodeReclaimTime allows replacements of failed
+	// nodes, such as rescheduled Kubernetes pods which keep their name but
+	// receive a new IP, to be accepted quickly. Peers which leave gracefully
+	// can always be replaced immediately.
+	DeadNodeReclaimTime time.Duration
 }
 
-func (c *Config) validate() error {
+func (c Config) validate() error {
 	if len(c.Name) == 0 {
 		return fmt.Errorf("node name is required")
 	}
@@ -73,27 +374,161 @@ func (c *Config) validate() error {
 		return fmt.Errorf("advertise address is required")
 	}
 
+	if c.LeaveQuorum < 0 {
+		return fmt.Errorf("leave quorum must not be negative")
+	}
+
+	if c.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+
+	if c.RejoinMinBackoff < 0 || c.RejoinMaxBackoff < 0 {
+		return fmt.Errorf("rejoin backoff must not be negative")
+	}
+	if c.ReachabilityProbeInterval < 0 || c.ReachabilityProbeSample < 0 {
+		return fmt.Errorf("reachability probe settings must not be negative")
+	}
+	if c.IsolationDemoteTimeout < 0 {
+		return fmt.Errorf("isolation demote timeout must not be negative")
+	}
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("health check interval must not be negative")
+	}
+	if c.PeerMetricLabelLimit < 0 {
+		return fmt.Errorf("peer metric label limit must not be negative")
+	}
+	if c.DivergenceCheckInterval < 0 {
+		return fmt.Errorf("divergence check interval must not be negative")
+	}
+	if c.JoinPeersRefreshInterval < 0 {
+		return fmt.Errorf("join peers refresh interval must not be negative")
+	}
+	if c.NotificationDebounce < 0 {
+		return fmt.Errorf("notification debounce must not be negative")
+	}
+	if c.MinimumClusterSize < 0 {
+		return fmt.Errorf("minimum cluster size must not be negative")
+	}
+	if err := c.Readiness.validate(); err != nil {
+		return fmt.Errorf("invalid readiness policy: %w", err)
+	}
+	if c.PushPullInterval < 0 {
+		return fmt.Errorf("push/pull interval must not be negative")
+	}
+	if c.ObserverQueueSize < 0 {
+		return fmt.Errorf("observer queue size must not be negative")
+	}
+	if err := c.validateTunables(); err != nil {
+		return err
+	}
+
+	if len(c.Version) > maxVersionSize {
+		return fmt.Errorf("version must not be longer than %d bytes", maxVersionSize)
+	}
+	if len(c.ClusterName) > maxClusterNameSize {
+		return fmt.Errorf("cluster name must not be longer than %d bytes", maxClusterNameSize)
+	}
+	if len(c.Metadata) > MaxMetadataSize {
+		return fmt.Errorf("metadata of %d bytes exceeds limit of %d bytes", len(c.Metadata), MaxMetadataSize)
+	}
+
+	if err := validateLabels(c.Labels); err != nil {
+		return err
+	}
+	for _, role := range c.Roles {
+		if role == "" {
+			return fmt.Errorf("role names must not be empty")
+		}
+	}
+
+	if dl, err := parseDenylist(c.DeniedPeers); err != nil {
+		return err
+	} else if dl.match(c.Name, nil) {
+		return fmt.Errorf("cannot deny the local node")
+	}
+
+	for _, t := range c.StateTransitions {
+		if !t.From.Valid() || !t.To.Valid() {
+			return fmt.Errorf("invalid state transition from %s to %s: states must be built-in or registered", t.From, t.To)
+		}
+	}
+
+	return nil
+}
+
+// withDefaults returns a copy of c with defaults applied to unset fields. c
+// must be valid.
+func (c Config) withDefaults() Config {
+	if c.Weight == 0 {
+		c.Weight = 1
+	}
+	if c.RejoinMinBackoff > 0 {
+		if c.RejoinMaxBackoff == 0 {
+			c.RejoinMaxBackoff = defaultRejoinMaxBackoff
+		}
+		if c.RejoinMaxBackoff < c.RejoinMinBackoff {
+			c.RejoinMaxBackoff = c.RejoinMinBackoff
+		}
+	}
+	c.Roles = copyRoles(c.Roles)
 	if c.Log == nil {
 		c.Log = log.NewNopLogger()
 	}
+	return c
+}
 
-	if c.Pool == nil {
-		var err error
-		c.Pool, err = clientpool.New(clientpool.DefaultOptions, grpc.WithInsecure())
-		if err != nil {
-			return fmt.Errorf("failed to build default client pool: %w", err)
-		}
+// validateTunables validates the memberlist tunables in c.
+func (c Config) validateTunables() error {
+	if c.ProbeInterval < 0 {
+		return fmt.Errorf("probe interval must not be negative")
+	}
+	if c.ProbeTimeout < 0 {
+		return fmt.Errorf("probe timeout must not be negative")
+	}
+	if c.SuspicionMult < 0 {
+		return fmt.Errorf("suspicion multiplier must not be negative")
+	}
+	if c.RetransmitMult < 0 {
+		return fmt.Errorf("retransmit multiplier must not be negative")
 	}
+	if c.GossipNodes < 0 {
+		return fmt.Errorf("gossip nodes must not be negative")
+	}
+	if c.DeadNodeReclaimTime < 0 {
+		return fmt.Errorf("dead node reclaim time must not be negative")
+	}
+
+	var (
+		defaults = memberlist.DefaultLANConfig()
 
+		probeInterval = defaults.ProbeInterval
+		probeTimeout  = defaults.ProbeTimeout
+	)
+	if c.ProbeInterval > 0 {
+		probeInterval = c.ProbeInterval
+	}
+	if c.ProbeTimeout > 0 {
+		probeTimeout = c.ProbeTimeout
+	}
+	if probeTimeout >= probeInterval {
+		return fmt.Errorf("probe timeout (%s) must be less than probe interval (%s)", probeTimeout, probeInterval)
+	}
 	return nil
 }
 
 // A Node is a participant in a cluster. Nodes keep track of all of their peers
 // and emit events to Observers when the cluster state changes.
 type Node struct {
-	log                  log.Logger
+	log                  *log.SwapLogger // Swapped by UpdateConfig
 	cfg                  Config
+	mlMut                sync.RWMutex // Protects ml, which is replaced on restart
 	ml                   *memberlist.Memberlist
+	transport            memberlistgrpc.Transport
+	metaMut              sync.RWMutex                    // Protects the fields below
+	meta                 []byte                          // Encoded messages.Meta sent to peers
+	metadata             []byte                          // Application payload sent to peers
+	leaving              bool                            // Set when gracefully leaving the cluster
+	fingerprint          uint64                          // Sharder fingerprint sent to peers
 	broadcasts           memberlist.TransmitLimitedQueue // Make sure peerMut isn't held when updating
 	conflictQueue        *queue.Queue
 	notifyObserversQueue *queue.Queue
@@ -104,13 +539,88 @@ type Node struct {
 	// to be missed if you use multiple in-process nodes.
 	clock lamport.Clock
 
-	stateMut   sync.RWMutex
-	runCancel  context.CancelFunc
-	localState peer.State
-	stopped    bool
+	// clockSaveCh holds a pending request to persist clock to the state
+	// directory. clockSaveMut serializes saves.
+	clockSaveCh  chan struct{}
+	clockSaveMut sync.Mutex
+
+	// incarnation of the node, which increases every time the node restarts.
+	// Messages about the local node from an older incarnation are stale.
+	incarnation uint64
+
+	// updateMut serializes UpdateConfig with Start and Stop, so the memberlist
+	// isn't replaced or shut down while UpdateConfig uses it without holding
+	// stateMut. It must be locked before stateMut.
+	updateMut sync.Mutex
+
+	stateMut      sync.RWMutex
+	runCancel     context.CancelFunc
+	localState    peer.State
+	localSince    lamport.Time // Time localState became StateParticipant
+	localLabels   map[string]string
+	joinPeers     []string // Peers passed to the most recent call to Start
+	restoredPeers []string // Peer addresses from the most recent call to Restore
+	stopped       bool
+	transitions   map[StateTransition]struct{} // Permitted state transitions
 
 	observersMut sync.Mutex
-	observers    []Observer
+	observers    []*registeredObserver
+
+	// Observers with their own queue are notified from goroutines which run
+	// until observersCtx is canceled. observersWG tracks the goroutines so
+	// they can be restarted.
+	observersCtx    context.Context
+	observersCancel context.CancelFunc
+	observersWG     sync.WaitGroup
+
+	// acks tracks acknowledgements for State messages broadcast by this node
+	// with AckRequested set, keyed by the time of the message.
+	acksMut sync.Mutex
+	acks    map[lamport.Time]*ackTracker
+
+	// health tracks the health of remote peers, keyed by name. Entries are
+	// created after the first successful ping to a peer.
+	healthMut sync.Mutex
+	health    map[string]*peerHealth
+
+	// reachable holds the result of the most recent reachability probe to
+	// remote peers, keyed by name.
+	reachMut    sync.Mutex
+	reachable   map[string]bool
+	partitioned bool // Whether a partition was suspected after the last probe
+
+	// divergent holds the names of peers whose sharder fingerprint differed
+	// from the local fingerprint for consecutive checks. mismatched holds
+	// the peers which differed during the most recent check.
+	divergenceMut sync.Mutex
+	divergent     []string
+	mismatched    map[string]struct{}
+
+	// peerFingerprints holds the most recent sharder fingerprint gossiped by
+	// remote peers, keyed by name. It is maintained by memberlist event
+	// callbacks so fingerprints are never decoded from nodes memberlist may
+	// be concurrently updating.
+	fingerprintsMut  sync.Mutex
+	peerFingerprints map[string]uint64
+
+	broadcastMut      sync.Mutex
+	broadcastHandlers []BroadcastHandler
+	broadcastsSeen    map[broadcastID]time.Time // Recently received user broadcasts
+
+	metadataMut      sync.Mutex
+	metadataHandlers []MetadataHandler
+	peerMetadata     map[string][]byte // Most recent metadata payload of remote peers
+
+	requestMut     sync.RWMutex
+	requestHandler RequestHandler
+
+	// rejectedPeers tracks peers rejected by Config.OnPeerAdmission, mapping
+	// the peer name to the rejected address.
+	admissionMut  sync.Mutex
+	rejectedPeers map[string]string
+
+	denyMut sync.RWMutex
+	denied  denylist
 
 	// peerStates is updated any time a messages.State broadcast is received, and
 	// may have keys for node names that do not exist in the peers map. These
@@ -125,75 +635,147 @@ type Node struct {
 	peerStates map[string]messages.State // State lookup for a node name
 	peers      map[string]peer.Peer      // Current list of peers & their states
 	peerCache  []peer.Peer               // Slice version of peers; keep in sync with peers
+	peersTime  time.Time                 // Last time peerCache changed
+	departed   map[string]Liveness       // Liveness of peers which were removed
+	history    *history                  // Recent changes to peerCache; nil if disabled
 }
 
 // NewNode creates an unstarted Node to participulate in a cluster. An error
 // will be returned if the provided config is invalid.
-func NewNode(srv *grpc.Server, cfg Config) (*Node, error) {
+func NewNode(srv *grpc.Server, cfg Config) (_ *Node, err error) {
 	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
+	cfg = cfg.withDefaults()
 
-	advertiseAddr, advertisePortString, err := net.SplitHostPort(cfg.AdvertiseAddr)
+	advertiseIP, advertisePort, err := resolveAdvertiseAddr(cfg.AdvertiseAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read advertise address: %w", err)
+		return nil, err
 	}
 
-	advertiseIP, err := net.ResolveIPAddr("ip4", advertiseAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to lookup advertise address %s: %w", advertiseAddr, err)
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(cfg.StateDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create state directory: %w", err)
+		}
 	}
 
-	advertisePort, err := net.LookupPort("tcp", advertisePortString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse advertise port %s: %w", advertisePortString, err)
+	if cfg.Pool == nil {
+		opts := clientpool.DefaultOptions
+		opts.PeerLabelLimit = cfg.PeerMetricLabelLimit
+		if cfg.Pool, err = clientpool.New(opts, grpc.WithInsecure()); err != nil {
+			return nil, fmt.Errorf("failed to build default client pool: %w", err)
+		}
+
+		// The pool is owned by n; close it if n can't be created.
+		pool := cfg.Pool
+		defer func() {
+			if err != nil {
+				_ = pool.Close()
+			}
+		}()
 	}
 
+	// Wrap the logger so it can be replaced at runtime, including for the
+	// transport.
+	logger := &log.SwapLogger{}
+	logger.Swap(cfg.Log)
+
 	grpcTransport, transportMetrics, err := memberlistgrpc.NewTransport(srv, memberlistgrpc.Options{
-		Log:           cfg.Log,
+		Log:           logger,
 		Pool:          cfg.Pool,
 		PacketTimeout: 3 * time.Second,
+
+		PeerLabelLimit: cfg.PeerMetricLabelLimit,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to build transport: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			_ = grpcTransport.Shutdown()
+		}
+	}()
 
-	mlc := memberlist.DefaultLANConfig()
-	mlc.Name = cfg.Name
-	mlc.Transport = grpcTransport
-	mlc.AdvertiseAddr = advertiseIP.String()
-	mlc.AdvertisePort = advertisePort
-	mlc.LogOutput = io.Discard
+	// DeniedPeers was already checked by cfg.validate.
+	denied, _ := parseDenylist(cfg.DeniedPeers)
 
 	n := &Node{
-		log: cfg.Log,
-		cfg: cfg,
-		m:   newMetrics(),
+		log:       logger,
+		cfg:       cfg,
+		m:         newMetrics(),
+		transport: grpcTransport,
 
 		conflictQueue:        queue.New(1),
 		notifyObserversQueue: queue.New(1),
 
+		localLabels: copyLabels(cfg.Labels),
+		transitions: make(map[StateTransition]struct{}, len(validStateTransitions)+len(cfg.StateTransitions)),
+
+		acks:   make(map[lamport.Time]*ackTracker),
+		health: make(map[string]*peerHealth),
+
+		reachable: make(map[string]bool),
+
+		broadcastsSeen: make(map[broadcastID]time.Time),
+		peerMetadata:   make(map[string][]byte),
+		rejectedPeers:  make(map[string]string),
+		denied:         denied,
+
+		peerFingerprints: make(map[string]uint64),
+		clockSaveCh:      make(chan struct{}, 1),
+
 		peerStates: make(map[string]messages.State),
 		peers:      make(map[string]peer.Peer),
+		peersTime:  time.Now(),
+		departed:   make(map[string]Liveness),
+	}
+	n.observersCtx, n.observersCancel = context.WithCancel(context.Background())
+	switch {
+	case cfg.HistorySize == 0:
+		n.history = newHistory(defaultHistorySize)
+	case cfg.HistorySize > 0:
+		n.history = newHistory(cfg.HistorySize)
 	}
 
-	nd := &nodeDelegate{Node: n}
-	mlc.Events = nd
-	mlc.Delegate = nd
-	mlc.Conflict = nd
+	for t := range validStateTransitions {
+		n.transitions[t] = struct{}{}
+	}
+	for _, t := range cfg.StateTransitions {
+		n.transitions[t] = struct{}{}
+	}
 
-	ml, err := memberlist.Create(mlc)
+	if err := n.loadClock(); err != nil {
+		return nil, err
+	}
+	if n.incarnation, err = n.nextIncarnation(); err != nil {
+		return nil, err
+	}
+
+	n.metadata = append([]byte(nil), cfg.Metadata...)
+	if err := n.encodeMetaLocked(); err != nil {
+		return nil, err
+	}
+
+	ml, err := n.createMemberlist(advertiseIP, advertisePort)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create memberlist: %w", err)
+		return nil, err
 	}
 
+	unicastpb.RegisterMessengerServer(srv, &messengerServer{n: n})
+
 	n.ml = ml
 	n.broadcasts.NumNodes = func() int { return len(n.Peers()) }
-	n.broadcasts.RetransmitMult = mlc.RetransmitMult
+	n.broadcasts.RetransmitMult = memberlist.DefaultLANConfig().RetransmitMult
+	if cfg.RetransmitMult > 0 {
+		n.broadcasts.RetransmitMult = cfg.RetransmitMult
+	}
 
 	// Include some extra metrics.
 	n.m.Add(
-		newMemberlistCollector(ml),
+		newMemberlistCollector(n.memberlist),
+		newHealthCollector(n),
+		newLivenessCollector(n),
+		newReachabilityCollector(n),
 		transportMetrics,
 		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name: "cluster_node_lamport_time",
@@ -206,6 +788,168 @@ func NewNode(srv *grpc.Server, cfg Config) (*Node, error) {
 	return n, nil
 }
 
+// resolveAdvertiseAddr splits addr into the IP address and port to advertise
+// to peers.
+func resolveAdvertiseAddr(addr string) (ip string, port int, err error) {
+	advertiseAddr, advertisePortString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read advertise address: %w", err)
+	}
+
+	advertiseIP, err := net.ResolveIPAddr("ip4", advertiseAddr)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to lookup advertise address %s: %w", advertiseAddr, err)
+	}
+
+	advertisePort, err := net.LookupPort("tcp", advertisePortString)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse advertise port %s: %w", advertisePortString, err)
+	}
+	return advertiseIP.String(), advertisePort, nil
+}
+
+// createMemberlist creates a new memberlist for n which advertises the
+// provided IP address and port.
+func (n *Node) createMemberlist(advertiseIP string, advertisePort int) (*memberlist.Memberlist, error) {
+	mlc := memberlist.DefaultLANConfig()
+	mlc.Name = n.cfg.Name
+	mlc.Transport = sharedTransport{n.transport}
+	mlc.AdvertiseAddr = advertiseIP
+	mlc.AdvertisePort = advertisePort
+	mlc.LogOutput = io.Discard
+
+	if n.cfg.PushPullInterval > 0 {
+		mlc.PushPullInterval = n.cfg.PushPullInterval
+	}
+	if n.cfg.DisablePushPull {
+		// memberlist disables periodic push/pull when the interval is 0.
+		mlc.PushPullInterval = 0
+	}
+	if n.cfg.ProbeInterval > 0 {
+		mlc.ProbeInterval = n.cfg.ProbeInterval
+	}
+	if n.cfg.ProbeTimeout > 0 {
+		mlc.ProbeTimeout = n.cfg.ProbeTimeout
+	}
+	if n.cfg.SuspicionMult > 0 {
+		mlc.SuspicionMult = n.cfg.SuspicionMult
+	}
+	if n.cfg.RetransmitMult > 0 {
+		mlc.RetransmitMult = n.cfg.RetransmitMult
+	}
+	if n.cfg.GossipNodes > 0 {
+		mlc.GossipNodes = n.cfg.GossipNodes
+	}
+	mlc.DeadNodeReclaimTime = n.cfg.DeadNodeReclaimTime
+
+	nd := &nodeDelegate{Node: n}
+	mlc.Events = nd
+	mlc.Delegate = nd
+	mlc.Conflict = nd
+	mlc.Merge = nd
+	mlc.Ping = nd
+	mlc.Alive = nd
+
+	ml, err := memberlist.Create(mlc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create memberlist: %w", err)
+	}
+	return ml, nil
+}
+
+// memberlist returns the current memberlist used by n.
+func (n *Node) memberlist() *memberlist.Memberlist {
+	n.mlMut.RLock()
+	defer n.mlMut.RUnlock()
+	return n.ml
+}
+
+// shutdownMemberlist shuts down the current memberlist and the transport.
+func (n *Node) shutdownMemberlist() error {
+	if err := n.memberlist().Shutdown(); err != nil {
+		return err
+	}
+	return n.transport.Shutdown()
+}
+
+// restart prepares a stopped Node to be started again. The memberlist of n
+// can't be reused after being shut down, so a new one is created with a new
+// incarnation, and everything n knew about the previous cluster is
+// forgotten. Must be called with n.stateMut held.
+func (n *Node) restart() error {
+	advertiseIP, advertisePort, err := resolveAdvertiseAddr(n.cfg.AdvertiseAddr)
+	if err != nil {
+		return err
+	}
+	incarnation, err := n.nextIncarnation()
+	if err != nil {
+		return err
+	}
+
+	n.metaMut.Lock()
+	n.leaving = false
+	err = n.encodeMetaLocked()
+	n.metaMut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := n.transport.Reopen(); err != nil {
+		return fmt.Errorf("failed to reopen transport: %w", err)
+	}
+	n.broadcasts.Reset()
+
+	n.peerMut.Lock()
+	n.incarnation = incarnation
+	n.peers = make(map[string]peer.Peer)
+	n.peerCache = nil
+	n.departed = make(map[string]Liveness)
+	n.peerMut.Unlock()
+
+	n.healthMut.Lock()
+	n.health = make(map[string]*peerHealth)
+	n.healthMut.Unlock()
+
+	n.reachMut.Lock()
+	n.reachable = make(map[string]bool)
+	n.partitioned = false
+	n.reachMut.Unlock()
+
+	n.metadataMut.Lock()
+	n.peerMetadata = make(map[string][]byte)
+	n.metadataMut.Unlock()
+
+	n.fingerprintsMut.Lock()
+	n.peerFingerprints = make(map[string]uint64)
+	n.fingerprintsMut.Unlock()
+
+	// Creating the memberlist adds the local node back to n.peers.
+	ml, err := n.createMemberlist(advertiseIP, advertisePort)
+	if err != nil {
+		_ = n.transport.Shutdown()
+		return err
+	}
+	n.mlMut.Lock()
+	n.ml = ml
+	n.mlMut.Unlock()
+
+	n.restartObservers()
+	n.stopped = false
+
+	level.Info(n.log).Log("msg", "restarted stopped node", "incarnation", incarnation)
+	return nil
+}
+
+// sharedTransport wraps the transport of a Node so it remains open after the
+// memberlist using it is shut down, allowing a new memberlist to be created
+// with the same transport. The transport is shut down by the Node.
+type sharedTransport struct {
+	memberlistgrpc.Transport
+}
+
+// Shutdown implements memberlist.Transport. It is a no-op.
+func (sharedTransport) Shutdown() error { return nil }
+
 // Metrics returns a prometheus.Collector that can be used to collect metrics
 // about the Node.
 func (n *Node) Metrics() prometheus.Collector { return n.m }
@@ -217,27 +961,51 @@ func (n *Node) Metrics() prometheus.Collector { return n.m }
 // Start may be called multiple times to reconnect to a different set of peers.
 // Node will be set into StateViewer every time Start is called.
 //
-// Start may not be called after the Node has been stopped.
+// Start may also be called after the Node has been stopped to rejoin the
+// cluster without creating a new Node. Restarting a Node forgets everything
+// it knew about the cluster and rejoins with a new incarnation. Registered
+// Observers and handlers are kept.
 func (n *Node) Start(peers []string) error {
+	n.updateMut.Lock()
+	defer n.updateMut.Unlock()
+
 	n.stateMut.Lock()
 	defer n.stateMut.Unlock()
 
 	if n.stopped {
-		// n.ml can't be re-used after we stopped, so we need to force error the
-		// Start.
-		//
-		// TODO: maybe create a new n.ml instead?
-		return ErrStopped
+		if err := n.restart(); err != nil {
+			return fmt.Errorf("failed to restart node: %w", err)
+		}
+	}
+
+	// Discard conflicts from previous calls to Start so they're not mistaken
+	// for conflicts caused by this join.
+	for {
+		if _, ok := n.conflictQueue.TryDequeue(); !ok {
+			break
+		}
 	}
 
-	_, err := n.ml.Join(peers)
+	_, err := n.memberlist().Join(peers)
 	if err != nil {
-		return fmt.Errorf("failed to join memberlist: %w", err)
+		fallback := append(n.loadPeers(), n.restoredPeers...)
+		if len(fallback) == 0 {
+			return fmt.Errorf("failed to join memberlist: %w", err)
+		}
+
+		level.Warn(n.log).Log("msg", "failed to join peers; falling back to persisted and restored peers", "err", err, "peers", len(fallback))
+		if _, fallbackErr := n.memberlist().Join(fallback); fallbackErr != nil {
+			return fmt.Errorf("failed to join memberlist: %w", err)
+		}
 	}
 
+	n.joinPeers = append([]string(nil), peers...)
+
 	// Force ourselves back into the pending state. This MUST be done after the
-	// join: join does a state sync and updates our lamport clock.
-	if err := n.changeState(peer.StateViewer, nil); err != nil {
+	// join: join does a state sync and updates our lamport clock, ensuring the
+	// new state is newer than states from previous calls to Start. States from
+	// previous runs of the node are handled by the incarnation instead.
+	if _, err := n.changeState(peer.StateViewer, false, nil); err != nil {
 		return err
 	}
 
@@ -246,15 +1014,39 @@ func (n *Node) Start(peers []string) error {
 	// conflict queue.
 	conflict, ok := n.conflictQueue.TryDequeue()
 	if ok {
-		_ = n.ml.Shutdown()
+		// n.ml can't be used after being shut down, so n must be treated as
+		// stopped.
+		_ = n.shutdownMemberlist()
+		n.stopped = true
 
 		conflict := conflict.(*memberlist.Node)
-		return fmt.Errorf("failed to join memberlist: name conflict with %s", conflict.Address())
+		return fmt.Errorf("failed to join memberlist: %w", NameConflictError{Name: conflict.Name, Addr: conflict.Address()})
 	}
 
 	if n.runCancel == nil {
 		ctx, cancel := context.WithCancel(context.Background())
 		go n.run(ctx)
+		if n.cfg.StateDir != "" {
+			go n.runClockSaver(ctx)
+		}
+		if n.cfg.RejoinMinBackoff > 0 {
+			go n.runRejoin(ctx)
+		}
+		if n.cfg.JoinPeersRefreshInterval > 0 {
+			go n.runJoinRefresh(ctx)
+		}
+		if n.cfg.IsolationDemoteTimeout > 0 {
+			go n.runIsolationDemote(ctx)
+		}
+		if n.cfg.ReachabilityProbeInterval > 0 {
+			go n.runReachability(ctx)
+		}
+		if n.cfg.HealthCheckInterval > 0 && n.cfg.Sharder != nil {
+			go n.runHealthCheck(ctx)
+		}
+		if n.cfg.DivergenceCheckInterval > 0 && n.cfg.Sharder != nil {
+			go n.runDivergenceCheck(ctx)
+		}
 		n.runCancel = cancel
 	}
 
@@ -269,6 +1061,20 @@ func (n *Node) run(ctx context.Context) {
 		if err != nil {
 			break
 		}
+		if n.cfg.NotificationDebounce > 0 {
+			// Wait for more changes to arrive; the queue only holds the most
+			// recent set of peers, so changes made while waiting are coalesced.
+			t := time.NewTimer(n.cfg.NotificationDebounce)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			if newer, ok := n.notifyObserversQueue.TryDequeue(); ok {
+				v = newer
+			}
+		}
 		peers := v.([]peer.Peer)
 
 		// Ignore events if the peer set hasn't changed.
@@ -278,14 +1084,69 @@ func (n *Node) run(ctx context.Context) {
 		lastPeers = peers
 
 		n.notifyObservers(peers)
+		n.savePeers(peers)
 	}
 }
 
-// Stop stops the Node, removing it from the cluster. Callers should first
-// first transition to StateTerminating to gracefully leave the cluster.
-// Observers will no longer be notified about cluster changes after Stop
-// returns.
+// defaultStopTimeout is the timeout used by Stop.
+const defaultStopTimeout = 5 * time.Second
+
+// Steps performed by StopContext which may be reported in a StopError.
+const (
+	stopStepBroadcasts = "broadcasts"
+	stopStepLeave      = "leave"
+	stopStepTransport  = "transport"
+)
+
+// StopError is returned by StopContext when one or more steps of gracefully
+// leaving the cluster did not complete. The Node is stopped regardless.
+type StopError struct {
+	// Steps which did not complete, in the order they were attempted. Steps
+	// are "broadcasts" (sending queued gossip messages, such as a final state
+	// change), "leave" (announcing the Node is leaving), and "transport"
+	// (sending queued packets).
+	Steps []string
+}
+
+// Error implements error.
+func (e StopError) Error() string {
+	return fmt.Sprintf("stopped without completing: %s", strings.Join(e.Steps, ", "))
+}
+
+// Stop stops the Node, removing it from the cluster. Stop is like
+// StopContext with a 5 second timeout, except that steps which do not
+// complete are logged rather than returned as an error.
 func (n *Node) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+	defer cancel()
+
+	err := n.StopContext(ctx)
+
+	var stopErr StopError
+	if errors.As(err, &stopErr) {
+		level.Warn(n.log).Log("msg", "node stopped without completing graceful leave", "err", err)
+		return nil
+	}
+	return err
+}
+
+// StopContext stops the Node, removing it from the cluster. Callers should
+// first transition to StateTerminating to gracefully leave the cluster.
+// Observers will no longer be notified about cluster changes after
+// StopContext returns.
+//
+// Before stopping, StopContext makes a best-effort attempt to gracefully
+// leave the cluster: queued gossip messages are sent to peers, the Node
+// announces that it is leaving, and queued packets are flushed to the network.
+// If ctx is canceled before these steps complete, the Node stops immediately
+// and a StopError listing the incomplete steps is returned.
+func (n *Node) StopContext(ctx context.Context) error {
+	// Persist the final clock once stateMut is released.
+	defer n.saveClock()
+
+	n.updateMut.Lock()
+	defer n.updateMut.Unlock()
+
 	n.stateMut.Lock()
 	defer n.stateMut.Unlock()
 
@@ -301,106 +1162,691 @@ func (n *Node) Stop() error {
 	}
 	n.stopped = true
 
-	// TODO(rfratto): configurable leave timeout
-	leaveTimeout := time.Second * 5
-	if err := n.ml.Leave(leaveTimeout); err != nil {
-		level.Error(n.log).Log("msg", "failed to broadcast leave message to cluster", "err", err)
+	var incomplete []string
+
+	level.Debug(n.log).Log("msg", "stopping node; sending queued broadcasts")
+	if err := n.flushBroadcasts(ctx); err != nil {
+		level.Warn(n.log).Log("msg", "failed to send queued broadcasts before stopping", "err", err)
+		incomplete = append(incomplete, stopStepBroadcasts)
+	}
+
+	level.Debug(n.log).Log("msg", "stopping node; broadcasting leave message")
+	n.announceLeaving(ctx)
+	if err := n.memberlist().Leave(leaveTimeout(ctx)); err != nil {
+		level.Error(n.log).Log("msg", "failed to broadcast leave message to cluster", "err", err)
+		incomplete = append(incomplete, stopStepLeave)
+	}
+
+	level.Debug(n.log).Log("msg", "stopping node; flushing transport")
+	if err := n.transport.Flush(ctx); err != nil {
+		level.Warn(n.log).Log("msg", "failed to flush transport before stopping", "err", err)
+		incomplete = append(incomplete, stopStepTransport)
+	}
+
+	n.stopObservers()
+	if err := n.shutdownMemberlist(); err != nil {
+		return err
+	}
+
+	if len(incomplete) > 0 {
+		return StopError{Steps: incomplete}
+	}
+	return nil
+}
+
+// abortLocked stops n after its memberlist was shut down without leaving
+// gracefully, such as when a replacement memberlist couldn't be created. Like
+// StopContext, background goroutines and observers are stopped and the
+// transport is shut down. Must be called with n.stateMut held.
+func (n *Node) abortLocked() {
+	if n.runCancel != nil {
+		n.runCancel()
+		n.runCancel = nil
+	}
+	n.stopped = true
+	n.stopObservers()
+	_ = n.transport.Shutdown()
+}
+
+// flushBroadcasts waits for queued broadcasts to finish transmitting to
+// peers. flushBroadcasts returns immediately if there are no remote peers to
+// send broadcasts to.
+func (n *Node) flushBroadcasts(ctx context.Context) error {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+	for n.broadcasts.NumQueued() > 0 && n.memberlist().NumMembers() > 1 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// leaveTimeout returns the time remaining before ctx's deadline, or
+// defaultStopTimeout if ctx has no deadline.
+func leaveTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return defaultStopTimeout
+	}
+	if remaining := time.Until(deadline); remaining > 0 {
+		return remaining
+	}
+	// memberlist treats a timeout of 0 as "wait forever," so use the smallest
+	// possible timeout instead.
+	return time.Nanosecond
+}
+
+// CurrentState returns n's current State. Other nodes may not have the same
+// State value for n as the current state propagates throughout the cluster.
+func (n *Node) CurrentState() peer.State {
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+
+	return n.localState
+}
+
+// ChangeState changes the state of the node. ChangeState will block until the
+// message has been broadcast or until the provided ctx is canceled. Canceling
+// the context does not stop the message from being broadcast; it just stops
+// waiting for it.
+//
+// The "to" state must be valid to move to from the current state. Acceptable
+// transitions are:
+//
+//   StateViewer -> StateParticipant
+//   StateParticipant -> StateTerminating
+//   StateParticipant -> StateDraining
+//
+// Draining nodes may only move to StateTerminating by calling Drain or Leave.
+//
+// Additional transitions may be permitted through Config.StateTransitions.
+//
+// Nodes intended to only be viewers should never transition to another state.
+//
+// Pass WaitForPropagation to wait until the new state has been received by
+// peers.
+//
+// If Config.MinimumClusterSize is set, moving to StateParticipant first
+// blocks until enough nodes have been discovered. The state is not changed
+// if ctx is canceled while waiting.
+func (n *Node) ChangeState(ctx context.Context, to peer.State, opts ...ChangeStateOption) error {
+	var o changeStateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if to == peer.StateParticipant && n.cfg.MinimumClusterSize > 0 {
+		// Validate the transition before waiting so invalid changes fail
+		// immediately. It's checked again below in case the state changed
+		// while waiting.
+		n.stateMut.RLock()
+		t := StateTransition{From: n.localState, To: to}
+		_, valid := n.transitions[t]
+		n.stateMut.RUnlock()
+		if !valid {
+			return StateTransitionError(t)
+		}
+
+		if err := n.waitClusterSize(ctx, n.cfg.MinimumClusterSize); err != nil {
+			return err
+		}
+	}
+
+	n.stateMut.Lock()
+
+	t := StateTransition{From: n.localState, To: to}
+	if _, valid := n.transitions[t]; !valid {
+		n.stateMut.Unlock()
+		return StateTransitionError(t)
+	}
+
+	level.Debug(n.log).Log("msg", "changing node state", "from", n.localState, "to", to)
+	if o.waitPeers <= 0 {
+		defer n.stateMut.Unlock()
+		return n.waitChangeState(ctx, to)
+	}
+
+	tracker, err := n.changeState(to, true, nil)
+	n.stateMut.Unlock()
+	if err != nil {
+		return err
+	}
+	defer n.releaseAcks(tracker)
+
+	n.peerMut.RLock()
+	remotePeers := len(n.peers) - 1
+	n.peerMut.RUnlock()
+
+	count := o.waitPeers
+	if count > remotePeers {
+		count = remotePeers
+	}
+	return tracker.Wait(ctx, count)
+}
+
+// A ChangeStateOption configures a call to ChangeState.
+type ChangeStateOption func(*changeStateOptions)
+
+type changeStateOptions struct {
+	waitPeers int
+}
+
+// WaitForPropagation causes ChangeState to block until at least n remote
+// peers have received the new state, rather than returning as soon as the
+// state has been broadcast. If there are fewer than n remote peers,
+// ChangeState waits for all of them instead.
+//
+// If ctx is canceled before enough peers receive the new state, ChangeState
+// returns an error, but the state change is not reverted.
+func WaitForPropagation(n int) ChangeStateOption {
+	return func(o *changeStateOptions) { o.waitPeers = n }
+}
+
+// StateTransition is a permitted change from one State to another.
+type StateTransition struct{ From, To peer.State }
+
+var validStateTransitions = map[StateTransition]struct{}{
+	{peer.StateViewer, peer.StateParticipant}:      {},
+	{peer.StateParticipant, peer.StateTerminating}: {},
+	{peer.StateParticipant, peer.StateDraining}:    {},
+}
+
+// waitClusterSize blocks until at least size nodes are known, including the
+// local node.
+func (n *Node) waitClusterSize(ctx context.Context, size int) error {
+	reached := make(chan struct{})
+	var once sync.Once
+
+	check := func(peers []peer.Peer) (reregister bool) {
+		if len(peers) < size {
+			return true
+		}
+		once.Do(func() { close(reached) })
+		return false
+	}
+
+	unsubscribe := n.Observe(FuncObserver(check))
+	defer unsubscribe()
+
+	if check(n.Peers()) {
+		level.Debug(n.log).Log("msg", "waiting for minimum cluster size", "size", size)
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for minimum cluster size of %d: %w", size, ctx.Err())
+	case <-reached:
+		return nil
+	}
+}
+
+func (n *Node) waitChangeState(ctx context.Context, to peer.State) error {
+	waitBroadcast := make(chan struct{}, 1)
+	afterBroadcast := func() {
+		select {
+		case waitBroadcast <- struct{}{}:
+		default:
+		}
+	}
+
+	if _, err := n.changeState(to, false, afterBroadcast); err != nil {
+		return err
+	}
+
+	// We need at least one remote peer to broadcast the state change to. If
+	// it's just us, we can return immediately.
+	n.peerMut.RLock()
+	hasPeers := len(n.peers) > 1
+	n.peerMut.RUnlock()
+
+	if !hasPeers {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-waitBroadcast:
+		return nil
+	}
+}
+
+// changeState changes the local state and queues a broadcast of the new
+// state. If requestAck is true, peers will be asked to acknowledge the
+// message and the returned ackTracker will be non-nil. Callers must call
+// n.releaseAcks once they are done with the tracker.
+func (n *Node) changeState(to peer.State, requestAck bool, onDone func()) (*ackTracker, error) {
+	now := n.clock.Tick()
+	switch {
+	case to != peer.StateParticipant:
+		n.localSince = 0
+	case n.localState != peer.StateParticipant || n.localSince == 0:
+		n.localSince = now
+	}
+
+	n.localState = to
+	n.m.nodeInfo.MustSet("state", to.String())
+
+	stateMsg := messages.State{
+		NodeName:         n.cfg.Name,
+		NewState:         n.localState,
+		Labels:           n.localLabels,
+		Weight:           n.cfg.Weight,
+		AvailabilityZone: n.cfg.AvailabilityZone,
+		Roles:            n.cfg.Roles,
+		Incarnation:      n.incarnation,
+		Time:             now,
+		ParticipantSince: n.localSince,
+		AckRequested:     requestAck,
+	}
+
+	// Persist the clock so messages sent after a restart are never older than
+	// this one. The clock is saved in the background to avoid writing to disk
+	// with stateMut held; StopContext saves it again once stopped.
+	n.requestClockSave()
+
+	// Register the tracker before the message is broadcast so an early Ack
+	// isn't dropped.
+	var tracker *ackTracker
+	if requestAck {
+		tracker = n.trackAcks(stateMsg.Time)
+	}
+
+	// Treat the stateMsg as if it was received externally to track our own
+	// state along with other nodes.
+	n.handleStateMessage(stateMsg)
+
+	bcast, err := messages.Broadcast(&stateMsg, onDone)
+	if err != nil {
+		if tracker != nil {
+			n.releaseAcks(tracker)
+		}
+		return nil, err
+	}
+	n.broadcasts.QueueBroadcast(bcast)
+	return tracker, nil
+}
+
+// Labels returns the current set of labels for n. The returned map should not
+// be modified.
+func (n *Node) Labels() map[string]string {
+	n.stateMut.RLock()
+	defer n.stateMut.RUnlock()
+	return n.localLabels
+}
+
+// SetLabels replaces the set of labels advertised by n. SetLabels will block
+// until the new labels have been broadcast or until the provided ctx is
+// canceled. Canceling the context does not stop the labels from being
+// broadcast; it just stops waiting for it.
+//
+// The combined size of all label names and values must not exceed
+// MaxLabelsSize.
+func (n *Node) SetLabels(ctx context.Context, labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	if n.stopped {
+		return ErrStopped
+	}
+
+	n.localLabels = copyLabels(labels)
+	level.Debug(n.log).Log("msg", "changing node labels", "labels", fmt.Sprint(n.localLabels))
+	return n.waitChangeState(ctx, n.localState)
+}
+
+// ModifyLabels calls f with a copy of the labels of n and advertises the
+// modified labels, in the same way as SetLabels. Unlike reading Labels and
+// calling SetLabels, ModifyLabels is atomic: labels changed concurrently by
+// another call are never overwritten. Labels are only advertised if f
+// changed them. f must not block, and must not call methods of n.
+func (n *Node) ModifyLabels(ctx context.Context, f func(labels map[string]string)) error {
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	if n.stopped {
+		return ErrStopped
+	}
+
+	labels := make(map[string]string, len(n.localLabels)+1)
+	for k, v := range n.localLabels {
+		labels[k] = v
+	}
+	f(labels)
+	if labelsEqual(labels, n.localLabels) {
+		return nil
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+
+	n.localLabels = copyLabels(labels)
+	level.Debug(n.log).Log("msg", "changing node labels", "labels", fmt.Sprint(n.localLabels))
+	return n.waitChangeState(ctx, n.localState)
+}
+
+// validateLabels returns an error if labels exceeds MaxLabelsSize.
+func validateLabels(labels map[string]string) error {
+	var size int
+	for k, v := range labels {
+		if len(k) == 0 {
+			return fmt.Errorf("label names must not be empty")
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxLabelsSize {
+		return fmt.Errorf("labels are %d bytes, exceeding the limit of %d bytes", size, MaxLabelsSize)
+	}
+	return nil
+}
+
+// copyLabels returns a copy of labels. Returns nil if labels is empty.
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// copyRoles returns a sorted copy of roles with duplicates removed.
+func copyRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return nil
+	}
+	res := append([]string(nil), roles...)
+	sort.Strings(res)
+
+	deduped := res[:1]
+	for _, r := range res[1:] {
+		if r != deduped[len(deduped)-1] {
+			deduped = append(deduped, r)
+		}
+	}
+	return deduped
+}
+
+// Leave gracefully removes n from the cluster. Leave transitions n from
+// StateParticipant or StateDraining into StateTerminating and blocks until
+// enough remote peers have acknowledged the change or until ctx is canceled.
+// The number of required acknowledgements is determined by
+// Config.LeaveQuorum.
+//
+// Leave returns immediately if n is a viewer, since viewers never own keys,
+// or if there are no remote peers to inform. Stop must still be called after
+// Leave to shut down the node.
+func (n *Node) Leave(ctx context.Context) error {
+	n.stateMut.Lock()
+	if n.stopped {
+		n.stateMut.Unlock()
+		return ErrStopped
+	}
+
+	switch n.localState {
+	case peer.StateViewer:
+		n.stateMut.Unlock()
+		return nil
+	case peer.StateParticipant, peer.StateDraining, peer.StateTerminating:
+		// Terminating nodes are permitted to broadcast their state again to
+		// collect acknowledgements.
+	default:
+		n.stateMut.Unlock()
+		return StateTransitionError{From: n.localState, To: peer.StateTerminating}
+	}
+
+	level.Debug(n.log).Log("msg", "leaving cluster", "from", n.localState)
+	tracker, err := n.changeState(peer.StateTerminating, true, nil)
+	n.stateMut.Unlock()
+	if err != nil {
+		return err
+	}
+	defer n.releaseAcks(tracker)
+
+	n.peerMut.RLock()
+	remotePeers := len(n.peers) - 1
+	n.peerMut.RUnlock()
+
+	quorum := n.cfg.LeaveQuorum
+	if quorum == 0 {
+		quorum = remotePeers/2 + 1
+	}
+	if quorum > remotePeers {
+		quorum = remotePeers
+	}
+
+	return tracker.Wait(ctx, quorum)
+}
+
+// Drain hands off ownership of n's keys before terminating. Drain transitions
+// n into StateDraining and blocks until every remote peer has acknowledged the
+// change, after which no peer will consider n an owner for write operations.
+// n is then transitioned into StateTerminating.
+//
+// Peers which leave the cluster while Drain is waiting are no longer waited
+// on. If ctx is canceled before every peer acknowledges the change, n will
+// remain in StateDraining and Drain may be called again to resume.
+//
+// Drain may only be called when n is a Participant or is already Draining.
+// Stop must still be called after Drain to shut down the node.
+func (n *Node) Drain(ctx context.Context) error {
+	n.stateMut.Lock()
+	if n.stopped {
+		n.stateMut.Unlock()
+		return ErrStopped
+	}
+
+	switch n.localState {
+	case peer.StateParticipant, peer.StateDraining:
+		// Draining nodes are permitted to broadcast their state again to
+		// collect acknowledgements.
+	default:
+		n.stateMut.Unlock()
+		return StateTransitionError{From: n.localState, To: peer.StateDraining}
+	}
+
+	level.Debug(n.log).Log("msg", "draining node", "from", n.localState)
+	tracker, err := n.changeState(peer.StateDraining, true, nil)
+	n.stateMut.Unlock()
+	if err != nil {
+		return err
+	}
+	defer n.releaseAcks(tracker)
+
+	// Wake up the tracker whenever the set of peers changes so peers which
+	// leave mid-drain stop being waited on. done guards against notifications
+	// which were already in flight when the observer was unsubscribed.
+	done := make(chan struct{})
+	defer close(done)
+	unsubscribe := n.Observe(FuncObserver(func([]peer.Peer) (reregister bool) {
+		select {
+		case <-done:
+			return false
+		default:
+			tracker.notify()
+			return true
+		}
+	}))
+	defer unsubscribe()
+
+	remotePeers := func() []string {
+		var names []string
+		for _, p := range n.Peers() {
+			if !p.Self {
+				names = append(names, p.Name)
+			}
+		}
+		return names
+	}
+	if err := tracker.WaitAll(ctx, remotePeers); err != nil {
+		return err
+	}
+
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	if n.localState != peer.StateDraining {
+		return StateTransitionError{From: n.localState, To: peer.StateTerminating}
 	}
-	return n.ml.Shutdown()
+	level.Debug(n.log).Log("msg", "node drained; terminating")
+	return n.waitChangeState(ctx, peer.StateTerminating)
 }
 
-// CurrentState returns n's current State. Other nodes may not have the same
-// State value for n as the current state propagates throughout the cluster.
-func (n *Node) CurrentState() peer.State {
-	n.stateMut.RLock()
-	defer n.stateMut.RUnlock()
+// ackTracker tracks the set of peers which have acknowledged a State message.
+type ackTracker struct {
+	time lamport.Time
 
-	return n.localState
+	mut      sync.Mutex
+	ackedBy  map[string]struct{}
+	notifyCh chan struct{}
 }
 
-// ChangeState changes the state of the node. ChangeState will block until the
-// message has been broadcast or until the provided ctx is canceled. Canceling
-// the context does not stop the message from being broadcast; it just stops
-// waiting for it.
-//
-// The "to" state must be valid to move to from the current state. Acceptable
-// transitions are:
-//
-//   StateViewer -> StateParticipant
-//   StateParticipant -> StateTerminating
-//
-// Nodes intended to only be viewers should never transition to another state.
-func (n *Node) ChangeState(ctx context.Context, to peer.State) error {
-	n.stateMut.Lock()
-	defer n.stateMut.Unlock()
-
-	t := stateTransition{From: n.localState, To: to}
-	if _, valid := validStateTransitions[t]; !valid {
-		return StateTransitionError(t)
+// trackAcks creates a new ackTracker for the State message at time t.
+func (n *Node) trackAcks(t lamport.Time) *ackTracker {
+	tracker := &ackTracker{
+		time:     t,
+		ackedBy:  make(map[string]struct{}),
+		notifyCh: make(chan struct{}, 1),
 	}
 
-	level.Debug(n.log).Log("msg", "changing node state", "from", n.localState, "to", to)
-	return n.waitChangeState(ctx, to)
+	n.acksMut.Lock()
+	defer n.acksMut.Unlock()
+	n.acks[t] = tracker
+	return tracker
 }
 
-type stateTransition struct{ From, To peer.State }
-
-var validStateTransitions = map[stateTransition]struct{}{
-	{peer.StateViewer, peer.StateParticipant}:      {},
-	{peer.StateParticipant, peer.StateTerminating}: {},
+// releaseAcks stops tracking acks for a tracker.
+func (n *Node) releaseAcks(tracker *ackTracker) {
+	n.acksMut.Lock()
+	defer n.acksMut.Unlock()
+	delete(n.acks, tracker.time)
 }
 
-func (n *Node) waitChangeState(ctx context.Context, to peer.State) error {
-	waitBroadcast := make(chan struct{}, 1)
-	afterBroadcast := func() {
-		select {
-		case waitBroadcast <- struct{}{}:
-		default:
-		}
-	}
+// handleAck handles an Ack sent from a peer.
+func (n *Node) handleAck(ack messages.Ack) {
+	n.acksMut.Lock()
+	tracker, ok := n.acks[ack.Time]
+	n.acksMut.Unlock()
 
-	if err := n.changeState(to, afterBroadcast); err != nil {
-		return err
+	if !ok || ack.Target != n.cfg.Name {
+		// Nothing is waiting for this ack.
+		return
 	}
+	level.Debug(n.log).Log("msg", "received ack", "ack", ack)
 
-	// We need at least one remote peer to broadcast the state change to. If it's
-	// just us, we can return immediately.
-	n.peerMut.RLock()
-	hasPeers := len(n.peers) > 1
-	n.peerMut.RUnlock()
+	tracker.mut.Lock()
+	tracker.ackedBy[ack.NodeName] = struct{}{}
+	tracker.mut.Unlock()
 
-	if !hasPeers {
-		return nil
-	}
+	tracker.notify()
+}
 
+// notify wakes up any goroutine waiting on t.
+func (t *ackTracker) notify() {
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-waitBroadcast:
-		return nil
+	case t.notifyCh <- struct{}{}:
+	default:
 	}
 }
 
-func (n *Node) changeState(to peer.State, onDone func()) error {
-	n.localState = to
-	n.m.nodeInfo.MustSet("state", to.String())
+// Wait waits until count unique peers have acknowledged the message or until
+// ctx is canceled.
+func (t *ackTracker) Wait(ctx context.Context, count int) error {
+	for {
+		t.mut.Lock()
+		acked := len(t.ackedBy)
+		t.mut.Unlock()
 
-	stateMsg := messages.State{
-		NodeName: n.cfg.Name,
-		NewState: n.localState,
-		Time:     n.clock.Tick(),
+		if acked >= count {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("received %d of %d acknowledgements: %w", acked, count, ctx.Err())
+		case <-t.notifyCh:
+		}
 	}
+}
 
-	// Treat the stateMsg as if it was received externally to track our own state
-	// along with other nodes.
-	n.handleStateMessage(stateMsg)
+// WaitAll waits until every peer returned by peers has acknowledged the
+// message or until ctx is canceled. peers is invoked each time t is notified.
+func (t *ackTracker) WaitAll(ctx context.Context, peers func() []string) error {
+	for {
+		var (
+			names   = peers()
+			pending int
+		)
+
+		t.mut.Lock()
+		for _, name := range names {
+			if _, acked := t.ackedBy[name]; !acked {
+				pending++
+			}
+		}
+		t.mut.Unlock()
 
-	bcast, err := messages.Broadcast(&stateMsg, onDone)
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting on acknowledgements from %d of %d peers: %w", pending, len(names), ctx.Err())
+		case <-t.notifyCh:
+		}
+	}
+}
+
+// sendAck sends an Ack for msg back to the node which sent it. Acks are sent
+// best-effort; failing to send an Ack will only delay the sender.
+//
+// sendAck must not be called while memberlist is holding its node lock (i.e.,
+// from within a memberlist.EventDelegate method).
+func (n *Node) sendAck(msg messages.State) {
+	if !msg.AckRequested || msg.NodeName == n.cfg.Name {
+		return
+	}
+
+	// Look up the target in the peer map rather than Members, whose nodes
+	// memberlist may update concurrently.
+	n.peerMut.RLock()
+	target, ok := n.peers[msg.NodeName]
+	n.peerMut.RUnlock()
+	if !ok {
+		level.Debug(log.With(n.log, stateFields(msg)...)).Log("msg", "cannot ack state message for unknown node")
+		return
+	}
+
+	bb, err := messages.Encode(&messages.Ack{
+		NodeName: n.cfg.Name,
+		Target:   msg.NodeName,
+		Time:     msg.Time,
+	})
 	if err != nil {
-		return err
+		level.Error(n.log).Log("msg", "failed to encode ack", "err", err)
+		return
+	}
+	addr := memberlist.Address{Addr: target.Addr, Name: target.Name}
+	if err := n.memberlist().SendToAddress(addr, bb); err != nil {
+		level.Warn(n.log).Log("msg", "failed to send ack", "node", msg.NodeName, "err", err)
 	}
-	n.broadcasts.QueueBroadcast(bcast)
-	return nil
+}
+
+// stateFields returns the fields used to log msg: the name of the peer, its
+// new state, and the lamport time of the message.
+func stateFields(msg messages.State) []interface{} {
+	return []interface{}{"peer", msg.NodeName, "state", msg.NewState, "time", msg.Time}
 }
 
 // handleStateMessage handles a state message from a peer. Returns true if the
@@ -411,31 +1857,81 @@ func (n *Node) handleStateMessage(msg messages.State) (newMessage bool) {
 	n.peerMut.Lock()
 	defer n.peerMut.Unlock()
 
+	if n.staleSelfState(msg) || n.isDeniedName(msg.NodeName) {
+		return false
+	}
+
 	curr, exist := n.peerStates[msg.NodeName]
-	if exist && msg.Time <= curr.Time {
+	if exist && !msg.Newer(curr) {
 		// Ignore a state message if we have the same or a newer one.
 		return false
 	}
-	level.Debug(n.log).Log("msg", "handling state message", "msg", msg)
+	level.Debug(log.With(n.log, stateFields(msg)...)).Log("msg", "handling state message")
 
 	n.peerStates[msg.NodeName] = msg
 
 	if p, ok := n.peers[msg.NodeName]; ok {
-		p.State = msg.NewState
-		n.peers[msg.NodeName] = p
+		n.peers[msg.NodeName] = applyStateMessage(p, msg)
 		n.handlePeersChanged()
 	}
 
 	return true
 }
 
-// Peers returns all Peers currently known by n. The Peers list will include
-// peers regardless of their current State. The returned slice should not be
-// modified.
-func (n *Node) Peers() []peer.Peer {
+// staleSelfState returns true if msg is about the local node and was sent by
+// a previous run of it. Stale messages about ourselves may still be gossiped
+// by peers shortly after a restart, and must never be applied.
+func (n *Node) staleSelfState(msg messages.State) bool {
+	return msg.NodeName == n.cfg.Name && msg.Incarnation < n.incarnation
+}
+
+// Peers returns all Peers currently known by n, sorted by name. The Peers
+// list will include peers regardless of their current State unless filtered
+// by opts. The returned slice should not be modified.
+func (n *Node) Peers(opts ...PeersOption) []peer.Peer {
+	n.peerMut.RLock()
+	defer n.peerMut.RUnlock()
+
+	if len(opts) == 0 {
+		return n.peerCache
+	}
+	return filterPeers(n.peerCache, opts)
+}
+
+// PeerStateTime returns the lamport time of the most recent state message
+// received for the peer with the given name. ok will be false if no state
+// message has been received for that peer.
+//
+// All peers eventually agree on the state time of a peer, so it can be used
+// to deterministically order peers across the cluster.
+func (n *Node) PeerStateTime(name string) (t uint64, ok bool) {
+	n.peerMut.RLock()
+	defer n.peerMut.RUnlock()
+
+	msg, ok := n.peerStates[name]
+	return uint64(msg.Time), ok
+}
+
+// PeerParticipantTime returns the lamport time at which the peer with the
+// given name became a Participant. Unlike PeerStateTime, it doesn't change
+// when the peer rebroadcasts its state, such as after changing its labels.
+// ok will be false if the peer isn't known to be a Participant.
+//
+// Peers running older versions of ckit don't report when they became a
+// Participant; the time of their most recent state message is returned
+// instead.
+func (n *Node) PeerParticipantTime(name string) (t uint64, ok bool) {
 	n.peerMut.RLock()
 	defer n.peerMut.RUnlock()
-	return n.peerCache
+
+	msg, ok := n.peerStates[name]
+	if !ok || msg.NewState != peer.StateParticipant {
+		return 0, false
+	}
+	if msg.ParticipantSince == 0 {
+		return uint64(msg.Time), true
+	}
+	return uint64(msg.ParticipantSince), true
 }
 
 // handlePeersChanged should be called when the peers map is updated. The peer
@@ -446,7 +1942,8 @@ func (n *Node) handlePeersChanged() {
 	var (
 		newPeers = make([]peer.Peer, 0, len(n.peers))
 
-		peerCountByState = make(map[peer.State]int, len(peer.AllStates))
+		allStates        = peer.States()
+		peerCountByState = make(map[peer.State]int, len(allStates))
 	)
 
 	for _, peer := range n.peers {
@@ -455,7 +1952,7 @@ func (n *Node) handlePeersChanged() {
 	}
 
 	// Update the metric based on the peers we just processed.
-	for _, state := range peer.AllStates {
+	for _, state := range allStates {
 		count := peerCountByState[state]
 		n.m.nodePeers.WithLabelValues(state.String()).Set(float64(count))
 	}
@@ -470,6 +1967,10 @@ func (n *Node) handlePeersChanged() {
 		n.cfg.Sharder.SetPeers(newPeers)
 	}
 
+	if !peersEqual(n.peerCache, newPeers) {
+		n.peersTime = time.Now()
+		n.history.record(n.peersTime, n.clock.Now(), DiffPeers(n.peerCache, newPeers))
+	}
 	n.peerCache = newPeers
 	n.notifyObserversQueue.Enqueue(newPeers)
 }
@@ -481,34 +1982,168 @@ func (n *Node) handlePeersChanged() {
 //
 // Observers are notified in the background about the most recent state of the
 // cluster, ignoring intermediate changed events that occurred while a
-// long-running observer is still processing an older change.
-func (n *Node) Observe(o Observer) {
+// long-running observer is still processing an older change. If
+// Config.ObserverQueueSize is set, each observer is notified independently
+// of the others.
+//
+// Calling the returned unsubscribe function deregisters o. o will not be
+// notified of any changes after unsubscribe returns, unless unsubscribe is
+// called while o is being notified. It is safe to call unsubscribe multiple
+// times, including from within o.
+func (n *Node) Observe(o Observer) (unsubscribe func()) {
 	n.observersMut.Lock()
 	defer n.observersMut.Unlock()
-	n.observers = append(n.observers, o)
+
+	ro := &registeredObserver{Observer: o}
+	if n.cfg.ObserverQueueSize > 0 {
+		ro.queue = queue.New(n.cfg.ObserverQueueSize)
+
+		// If n is stopped, the goroutine will be started if n is restarted.
+		if n.observersCtx.Err() == nil {
+			n.observersWG.Add(1)
+			go n.runObserver(n.observersCtx, ro)
+		}
+	}
+	n.observers = append(n.observers, ro)
 	n.m.nodeObservers.Set(float64(len(n.observers)))
+
+	return func() { n.removeObserver(ro) }
 }
 
-func (n *Node) notifyObservers(peers []peer.Peer) {
+// ObserveContext registers o to be informed when the cluster changes until
+// ctx is canceled. See Observe for more information.
+func (n *Node) ObserveContext(ctx context.Context, o Observer) {
+	unsubscribe := n.Observe(o)
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+	}()
+}
+
+// ObserveFiltered registers o to be informed when the cluster changes in a
+// way that matches filter. It is equivalent to calling Observe with a
+// FilterObserver.
+func (n *Node) ObserveFiltered(filter ObserveFilter, o Observer) (unsubscribe func()) {
+	return n.Observe(FilterObserver(filter, o))
+}
+
+// registeredObserver is an Observer registered with Observe. Observers are
+// wrapped so they can be removed by identity; Observer implementations are
+// not guaranteed to be comparable.
+type registeredObserver struct {
+	Observer
+	removed atomic.Bool
+
+	// queue holds pending notifications when Config.ObserverQueueSize is set.
+	queue *queue.Queue
+}
+
+// runObserver notifies ro of changes from its queue until ro is removed or
+// ctx is canceled.
+func (n *Node) runObserver(ctx context.Context, ro *registeredObserver) {
+	defer n.observersWG.Done()
+
+	for {
+		v, err := ro.queue.Dequeue(ctx)
+		if err != nil {
+			return
+		}
+		if ro.removed.Load() {
+			return
+		}
+		if rereg := n.invokeObserver(ro, v.([]peer.Peer)); !rereg {
+			n.removeObserver(ro)
+			return
+		}
+	}
+}
+
+// stopObservers stops the goroutines of observers notified from their own
+// queue.
+func (n *Node) stopObservers() {
+	n.observersMut.Lock()
+	defer n.observersMut.Unlock()
+	n.observersCancel()
+}
+
+// restartObservers restarts the goroutines stopped by stopObservers. It waits
+// for observers which are still being notified from before they were
+// stopped.
+func (n *Node) restartObservers() {
+	n.observersWG.Wait()
+
 	n.observersMut.Lock()
 	defer n.observersMut.Unlock()
 
+	n.observersCtx, n.observersCancel = context.WithCancel(context.Background())
+	for _, o := range n.observers {
+		if o.queue != nil && !o.removed.Load() {
+			n.observersWG.Add(1)
+			go n.runObserver(n.observersCtx, o)
+		}
+	}
+}
+
+func (n *Node) removeObserver(ro *registeredObserver) {
+	ro.removed.Store(true)
+	if ro.queue != nil {
+		_ = ro.queue.Close()
+	}
+
+	n.observersMut.Lock()
+	defer n.observersMut.Unlock()
+
+	for i, o := range n.observers {
+		if o == ro {
+			n.observers = append(n.observers[:i:i], n.observers[i+1:]...)
+			break
+		}
+	}
+	n.m.nodeObservers.Set(float64(len(n.observers)))
+}
+
+func (n *Node) notifyObservers(peers []peer.Peer) {
+	// Observers are invoked without holding observersMut so they may call
+	// Observe or unsubscribe without deadlocking.
+	n.observersMut.Lock()
+	observers := make([]*registeredObserver, len(n.observers))
+	copy(observers, n.observers)
+	n.observersMut.Unlock()
+
 	n.m.nodeUpdating.Set(1)
 	defer n.m.nodeUpdating.Set(0)
 
 	timer := prometheus.NewTimer(n.m.nodeUpdateDuration)
 	defer timer.ObserveDuration()
 
-	newObservers := make([]Observer, 0, len(n.observers))
-	for _, o := range n.observers {
-		rereg := o.NotifyPeersChanged(peers)
-		if rereg {
-			newObservers = append(newObservers, o)
+	for _, o := range observers {
+		if o.removed.Load() {
+			continue
+		}
+		if o.queue != nil {
+			if discarded := o.queue.Enqueue(peers); discarded {
+				n.m.observerNotificationsDropped.Inc()
+			}
+			continue
+		}
+		if rereg := n.invokeObserver(o, peers); !rereg {
+			n.removeObserver(o)
 		}
 	}
+}
 
-	n.observers = newObservers
-	n.m.nodeObservers.Set(float64(len(n.observers)))
+// invokeObserver notifies o about peers, recovering from any panic raised by
+// o. Observers which panic are kept registered unless
+// Config.RemovePanickingObservers is set.
+func (n *Node) invokeObserver(o *registeredObserver, peers []peer.Peer) (reregister bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.m.observerPanicsTotal.Inc()
+			level.Error(n.log).Log("msg", "observer panicked", "panic", fmt.Sprint(r), "remove", n.cfg.RemovePanickingObservers, "stack", string(debug.Stack()))
+			reregister = !n.cfg.RemovePanickingObservers
+		}
+	}()
+	return o.NotifyPeersChanged(peers)
 }
 
 // nodeDelegate is used to implement memberlist.*Delegate types without
@@ -522,6 +2157,8 @@ var (
 	_ memberlist.Delegate         = (*nodeDelegate)(nil)
 	_ memberlist.EventDelegate    = (*nodeDelegate)(nil)
 	_ memberlist.ConflictDelegate = (*nodeDelegate)(nil)
+	_ memberlist.MergeDelegate    = (*nodeDelegate)(nil)
+	_ memberlist.PingDelegate     = (*nodeDelegate)(nil)
 )
 
 //
@@ -529,8 +2166,9 @@ var (
 //
 
 func (nd *nodeDelegate) NodeMeta(limit int) []byte {
-	// Nodes don't have any additional metadata to send; return nil.
-	return nil
+	nd.metaMut.RLock()
+	defer nd.metaMut.RUnlock()
+	return nd.meta
 }
 
 func (nd *nodeDelegate) NotifyMsg(raw []byte) {
@@ -559,7 +2197,34 @@ func (nd *nodeDelegate) NotifyMsg(raw []byte) {
 			// messages would still converge eventually using push/pulls.
 			bcast, _ := messages.Broadcast(&s, nil)
 			nd.broadcasts.QueueBroadcast(bcast)
+
+			nd.sendAck(s)
+		}
+
+	case messages.TypeUser:
+		nd.m.gossipEventsTotal.WithLabelValues(eventUserMessage).Inc()
+
+		var u messages.User
+		if err := messages.Decode(buf, &u); err != nil {
+			level.Error(nd.log).Log("msg", "failed to decode user message", "err", err)
+			return
+		}
+
+		if nd.handleUserMessage(u) {
+			// Continue gossiping the message to other peers.
+			bcast, _ := messages.Broadcast(&u, nil)
+			nd.broadcasts.QueueBroadcast(bcast)
+		}
+
+	case messages.TypeAck:
+		nd.m.gossipEventsTotal.WithLabelValues(eventStateAck).Inc()
+
+		var a messages.Ack
+		if err := messages.Decode(buf, &a); err != nil {
+			level.Error(nd.log).Log("msg", "failed to decode ack message", "err", err)
+			return
 		}
+		nd.handleAck(a)
 
 	default:
 		nd.m.gossipEventsTotal.WithLabelValues(eventUnkownMessage).Inc()
@@ -573,6 +2238,8 @@ func (nd *nodeDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 }
 
 func (nd *nodeDelegate) LocalState(join bool) []byte {
+	defer prometheus.NewTimer(nd.m.pushPullDuration.WithLabelValues(pushPullLocalState)).ObserveDuration()
+
 	nd.peerMut.RLock()
 	defer nd.peerMut.RUnlock()
 
@@ -611,6 +2278,8 @@ func (nd *nodeDelegate) LocalState(join bool) []byte {
 }
 
 func (nd *nodeDelegate) MergeRemoteState(buf []byte, join bool) {
+	defer prometheus.NewTimer(nd.m.pushPullDuration.WithLabelValues(pushPullMergeRemoteState)).ObserveDuration()
+
 	rs, err := decodeLocalState(buf)
 	if err != nil {
 		level.Error(nd.log).Log("msg", "failed to decode remote state", "join", join, "err", err)
@@ -629,6 +2298,8 @@ func (nd *nodeDelegate) MergeRemoteState(buf []byte, join bool) {
 		for _, msg := range newMessages {
 			bcast, _ := messages.Broadcast(&msg, nil)
 			nd.broadcasts.QueueBroadcast(bcast)
+
+			nd.sendAck(msg)
 		}
 	}()
 
@@ -650,18 +2321,21 @@ func (nd *nodeDelegate) MergeRemoteState(buf []byte, join bool) {
 		// to the end of the merge.
 		remoteStates[msg.NodeName] = msg
 
+		if nd.staleSelfState(msg) || nd.isDeniedName(msg.NodeName) {
+			continue
+		}
+
 		curr, exist := nd.peerStates[msg.NodeName]
-		if exist && msg.Time <= curr.Time {
+		if exist && !msg.Newer(curr) {
 			// Ignore a state message if we have a newer one.
 			continue
 		}
-		level.Debug(nd.log).Log("msg", "handling state message", "msg", msg)
+		level.Debug(log.With(nd.log, stateFields(msg)...)).Log("msg", "handling state message")
 
 		nd.peerStates[msg.NodeName] = msg
 
 		if p, ok := nd.peers[msg.NodeName]; ok {
-			p.State = msg.NewState
-			nd.peers[msg.NodeName] = p
+			nd.peers[msg.NodeName] = applyStateMessage(p, msg)
 			peersChanged = true
 		}
 
@@ -683,6 +2357,13 @@ func (nd *nodeDelegate) MergeRemoteState(buf []byte, join bool) {
 			delete(nd.peerStates, nodeName)
 		}
 	}
+	for nodeName := range nd.departed {
+		// Forget about departed peers once the remote peer has also forgotten
+		// about them.
+		if _, peerExistsRemote := remoteStates[nodeName]; !peerExistsRemote {
+			delete(nd.departed, nodeName)
+		}
+	}
 
 	if peersChanged {
 		nd.handlePeersChanged()
@@ -721,22 +2402,77 @@ func decodeLocalState(buf []byte) (*localState, error) {
 //
 
 func (nd *nodeDelegate) NotifyJoin(node *memberlist.Node) {
+	defer nd.handleMetadata(node) // Invoked after peerMut is released
+	nd.recordFingerprint(node)
+
 	nd.peerMut.Lock()
 	defer nd.peerMut.Unlock()
 
 	nd.m.gossipEventsTotal.WithLabelValues(eventNodeJoin).Inc()
+	delete(nd.departed, node.Name)
+	if nd.isDenied(node) {
+		return
+	}
 	nd.updatePeer(nd.nodeToPeer(node))
 }
 
 // nodeToPeer converts a memberlist Node to a Peer. Should only be called with
 // peerMut held.
 func (nd *nodeDelegate) nodeToPeer(node *memberlist.Node) peer.Peer {
-	return peer.Peer{
-		Name:  node.Name,
-		Addr:  node.Address(),
-		Self:  node.Name == nd.cfg.Name,
-		State: nd.peerStates[node.Name].NewState,
+	p := peer.Peer{
+		Name:    node.Name,
+		Addr:    node.Address(),
+		Self:    node.Name == nd.cfg.Name,
+		Version: decodeMeta(node.Meta).Version,
+	}
+	return applyStateMessage(p, nd.peerStates[node.Name])
+}
+
+// encodeMetaLocked encodes the metadata of the local node to send to peers.
+// Must be called with n.metaMut held.
+func (n *Node) encodeMetaLocked() error {
+	meta, err := messages.Encode(&messages.Meta{
+		Version:     n.cfg.Version,
+		ClusterName: n.cfg.ClusterName,
+		Leaving:     n.leaving,
+		Payload:     n.metadata,
+
+		SharderFingerprint: n.fingerprint,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode node metadata: %w", err)
+	} else if len(meta) > memberlist.MetaMaxSize {
+		return fmt.Errorf("encoded node metadata of %d bytes exceeds limit of %d bytes", len(meta), memberlist.MetaMaxSize)
+	}
+	n.meta = meta
+	return nil
+}
+
+// decodeMeta decodes metadata sent by a peer. Peers which didn't send
+// metadata or sent invalid metadata will have empty metadata.
+func decodeMeta(raw []byte) messages.Meta {
+	var meta messages.Meta
+	if len(raw) == 0 {
+		return meta
+	}
+	if buf, ty, err := messages.Parse(raw); err == nil && ty == messages.TypeMeta {
+		_ = messages.Decode(buf, &meta)
 	}
+	return meta
+}
+
+// applyStateMessage updates p with the values from msg.
+func applyStateMessage(p peer.Peer, msg messages.State) peer.Peer {
+	p.State = msg.NewState
+	p.Labels = copyLabels(msg.Labels)
+	p.Weight = msg.Weight
+	if p.Weight < 1 {
+		// Peers which haven't sent a weight yet default to 1.
+		p.Weight = 1
+	}
+	p.AvailabilityZone = msg.AvailabilityZone
+	p.Roles = copyRoles(msg.Roles)
+	return p
 }
 
 func (nd *nodeDelegate) NotifyLeave(node *memberlist.Node) {
@@ -744,14 +2480,24 @@ func (nd *nodeDelegate) NotifyLeave(node *memberlist.Node) {
 	defer nd.peerMut.Unlock()
 
 	nd.m.gossipEventsTotal.WithLabelValues(eventNodeLeave).Inc()
+	nd.departed[node.Name] = departedLiveness(node)
 	nd.removePeer(node.Name)
+	nd.forgetHealth(node.Name)
+	nd.forgetMetadata(node.Name)
+	nd.forgetFingerprint(node.Name)
 }
 
 func (nd *nodeDelegate) NotifyUpdate(node *memberlist.Node) {
+	defer nd.handleMetadata(node) // Invoked after peerMut is released
+	nd.recordFingerprint(node)
+
 	nd.peerMut.Lock()
 	defer nd.peerMut.Unlock()
 
 	nd.m.gossipEventsTotal.WithLabelValues(eventNodeUpdate).Inc()
+	if nd.isDenied(node) {
+		return
+	}
 	nd.updatePeer(nd.nodeToPeer(node))
 }
 
@@ -771,5 +2517,92 @@ func (nd *nodeDelegate) removePeer(name string) {
 
 func (nd *nodeDelegate) NotifyConflict(existing, other *memberlist.Node) {
 	nd.m.gossipEventsTotal.WithLabelValues(eventNodeConflict).Inc()
-	nd.conflictQueue.Enqueue(other)
+	nd.m.nameConflictsTotal.Inc()
+
+	level.Warn(nd.log).Log(
+		"msg", "detected nodes with conflicting names",
+		"name", existing.Name,
+		"existing_addr", existing.Address(),
+		"conflicting_addr", other.Address(),
+	)
+
+	if existing.Name == nd.cfg.Name {
+		// Another node is using our name. If we're currently joining, Start
+		// will fail.
+		nd.conflictQueue.Enqueue(other)
+	}
+
+	if cb := nd.cfg.OnNameConflict; cb != nil {
+		go cb(
+			peer.Peer{Name: existing.Name, Addr: existing.Address()},
+			peer.Peer{Name: other.Name, Addr: other.Address()},
+		)
+	}
+}
+
+//
+// memberlist.MergeDelegate methods
+//
+
+func (nd *nodeDelegate) NotifyMerge(remoteNodes []*memberlist.Node) error {
+	nd.peerMut.RLock()
+	defer nd.peerMut.RUnlock()
+
+	nd.m.gossipEventsTotal.WithLabelValues(eventNodeMerge).Inc()
+
+	// Refuse to join peers from a different cluster.
+	for _, node := range remoteNodes {
+		if node.Name == nd.cfg.Name {
+			continue
+		}
+		if err := nd.checkClusterName(node); err != nil {
+			level.Error(nd.log).Log("msg", "refusing to merge with peer from a different cluster", "peer", node.Name, "addr", node.Address(), "err", err)
+			return fmt.Errorf("peer %s rejected: %w", node.Name, err)
+		}
+	}
+
+	var (
+		local  = make([]peer.Peer, 0, len(nd.peerCache))
+		remote = make([]peer.Peer, 0, len(remoteNodes))
+
+		overlap bool
+	)
+
+	for _, p := range nd.peerCache {
+		if !p.Self {
+			local = append(local, p)
+		}
+	}
+
+	for _, node := range remoteNodes {
+		if node.Name == nd.cfg.Name {
+			continue
+		}
+		if node.State != memberlist.StateAlive && node.State != memberlist.StateSuspect {
+			continue
+		}
+		if _, known := nd.peers[node.Name]; known {
+			overlap = true
+		}
+
+		p := nd.nodeToPeer(node)
+		remote = append(remote, p)
+	}
+
+	// A lone node joining a cluster (or a cluster being joined by a lone node)
+	// isn't a merge. A merge only happens when two multi-node clusters with
+	// disjoint members join together.
+	if overlap || len(local) == 0 || len(remote) < 2 {
+		return nil
+	}
+
+	sort.Slice(remote, func(i, j int) bool { return remote[i].Name < remote[j].Name })
+
+	level.Warn(nd.log).Log("msg", "detected merge with another cluster", "local_peers", len(local), "remote_peers", len(remote))
+	nd.m.clusterMergesTotal.Inc()
+
+	if nd.cfg.OnClusterMerge != nil {
+		go nd.cfg.OnClusterMerge(local, remote)
+	}
+	return nil
 }
@@ -5,12 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rfratto/ckit/internal/messages"
 	"github.com/rfratto/ckit/internal/testlogger"
 	"github.com/rfratto/ckit/peer"
 	"github.com/stretchr/testify/require"
@@ -20,6 +26,26 @@ import (
 
 func newTestNode(t *testing.T, l log.Logger, name string) (n *Node, addr string) {
 	t.Helper()
+	return newTestNodeWithConfig(t, l, Config{Name: name})
+}
+
+// newTestNodeWithConfig creates a new test node from cfg. The AdvertiseAddr
+// and Log fields of cfg are overridden.
+func newTestNodeWithConfig(t *testing.T, l log.Logger, cfg Config) (n *Node, addr string) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	n, addr, _ = newTestNodeWithListener(t, l, lis, cfg)
+	return n, addr
+}
+
+// newTestNodeWithListener creates a new test node from cfg which serves on
+// lis. The returned gRPC server is stopped when the test completes, but may be
+// stopped earlier by the caller.
+func newTestNodeWithListener(t *testing.T, l log.Logger, lis net.Listener, cfg Config) (n *Node, addr string, srv *grpc.Server) {
+	t.Helper()
 
 	if l == nil {
 		l = log.NewNopLogger()
@@ -27,14 +53,8 @@ func newTestNode(t *testing.T, l log.Logger, name string) (n *Node, addr string)
 
 	grpcServer := grpc.NewServer()
 
-	lis, err := net.Listen("tcp", "127.0.0.1:0")
-	require.NoError(t, err)
-
-	cfg := Config{
-		Name:          name,
-		AdvertiseAddr: lis.Addr().String(),
-		Log:           log.With(l, "node", name),
-	}
+	cfg.AdvertiseAddr = lis.Addr().String()
+	cfg.Log = log.With(l, "node", cfg.Name)
 
 	node, err := NewNode(grpcServer, cfg)
 	require.NoError(t, err)
@@ -45,7 +65,7 @@ func newTestNode(t *testing.T, l log.Logger, name string) (n *Node, addr string)
 			require.NoError(t, err)
 		}
 	}()
-	t.Cleanup(grpcServer.GracefulStop)
+	t.Cleanup(func() { stopTestServer(grpcServer) })
 
 	node.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
 		names := make([]string, len(peers))
@@ -56,7 +76,24 @@ func newTestNode(t *testing.T, l log.Logger, name string) (n *Node, addr string)
 		return true
 	}))
 
-	return node, cfg.AdvertiseAddr
+	return node, cfg.AdvertiseAddr, grpcServer
+}
+
+// stopTestServer gracefully stops srv. srv is forcibly stopped if open
+// streams aren't closed in a timely manner, such as streams left behind by
+// a stopped Node.
+func stopTestServer(srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.GracefulStop()
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		srv.Stop()
+	}
 }
 
 func runTestNode(t *testing.T, n *Node, join []string) {
@@ -282,6 +319,230 @@ func TestNode_Observe(t *testing.T) {
 		})
 		time.Sleep(500 * time.Millisecond)
 	})
+
+	t.Run("observers can unsubscribe", func(t *testing.T) {
+		var (
+			l       = testlogger.New(t)
+			invoked atomic.Int64
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		unsubscribe := a.Observe(FuncObserver(func(_ []peer.Peer) (reregister bool) {
+			invoked.Inc()
+			return true
+		}))
+
+		runTestNode(t, a, nil)
+		require.Eventually(t, func() bool {
+			return invoked.Load() > 0
+		}, 5*time.Second, 250*time.Millisecond)
+
+		unsubscribe()
+		unsubscribe() // Calling multiple times should be a no-op
+		previousInvokes := invoked.Load()
+
+		runTestNode(t, b, []string{aAddr})
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+		time.Sleep(500 * time.Millisecond)
+		require.Equal(t, previousInvokes, invoked.Load())
+	})
+
+	t.Run("slow observers do not block others", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNodeWithConfig(t, l, Config{
+				Name:              "node-a",
+				ObserverQueueSize: 1,
+			})
+			b, _ = newTestNode(t, l, "node-b")
+		)
+
+		unblock := make(chan struct{})
+		t.Cleanup(func() { close(unblock) })
+
+		var slowInvoked, fastInvoked atomic.Int64
+		a.Observe(FuncObserver(func(_ []peer.Peer) (reregister bool) {
+			slowInvoked.Inc()
+			<-unblock
+			return true
+		}))
+		a.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+			if len(peers) == 2 {
+				fastInvoked.Inc()
+			}
+			return true
+		}))
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+
+		require.Eventually(t, func() bool {
+			return fastInvoked.Load() > 0
+		}, 5*time.Second, 50*time.Millisecond, "fast observer should be notified while slow observer is blocked")
+		require.Equal(t, int64(1), slowInvoked.Load())
+	})
+
+	t.Run("observers removed when context canceled", func(t *testing.T) {
+		var (
+			l       = testlogger.New(t)
+			invoked atomic.Int64
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		a.observersMut.Lock()
+		initialObservers := len(a.observers)
+		a.observersMut.Unlock()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		a.ObserveContext(ctx, FuncObserver(func(_ []peer.Peer) (reregister bool) {
+			invoked.Inc()
+			return true
+		}))
+
+		runTestNode(t, a, nil)
+		require.Eventually(t, func() bool {
+			return invoked.Load() > 0
+		}, 5*time.Second, 250*time.Millisecond)
+
+		cancel()
+		require.Eventually(t, func() bool {
+			a.observersMut.Lock()
+			defer a.observersMut.Unlock()
+			return len(a.observers) == initialObservers
+		}, 5*time.Second, 50*time.Millisecond)
+		previousInvokes := invoked.Load()
+
+		runTestNode(t, b, []string{aAddr})
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+		time.Sleep(500 * time.Millisecond)
+		require.Equal(t, previousInvokes, invoked.Load())
+	})
+
+	t.Run("panicking observers are recovered", func(t *testing.T) {
+		for _, remove := range []bool{false, true} {
+			var (
+				l = testlogger.New(t)
+
+				a, aAddr = newTestNodeWithConfig(t, l, Config{
+					Name:                     "node-a",
+					RemovePanickingObservers: remove,
+				})
+				b, _ = newTestNode(t, l, "node-b")
+
+				panicked, invoked atomic.Int64
+			)
+
+			a.Observe(FuncObserver(func(_ []peer.Peer) (reregister bool) {
+				panicked.Inc()
+				panic("observer failure")
+			}))
+			a.Observe(FuncObserver(func(_ []peer.Peer) (reregister bool) {
+				invoked.Inc()
+				return true
+			}))
+
+			runTestNode(t, a, nil)
+			require.Eventually(t, func() bool {
+				return invoked.Load() > 0
+			}, 5*time.Second, 50*time.Millisecond, "observers after a panicking observer should be notified")
+
+			previousInvokes := invoked.Load()
+			runTestNode(t, b, []string{aAddr})
+			require.Eventually(t, func() bool {
+				return invoked.Load() > previousInvokes
+			}, 5*time.Second, 50*time.Millisecond, "node should keep processing changes after a panic")
+
+			if remove {
+				require.Equal(t, int64(1), panicked.Load(), "panicking observer should be removed")
+			} else {
+				require.Greater(t, panicked.Load(), int64(1), "panicking observer should be kept")
+			}
+			require.Equal(t, float64(panicked.Load()), testutil.ToFloat64(a.m.observerPanicsTotal))
+		}
+	})
+
+	t.Run("bursts of changes are debounced", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNodeWithConfig(t, l, Config{
+				Name:                 "node-a",
+				NotificationDebounce: time.Second,
+			})
+			b, _ = newTestNode(t, l, "node-b")
+			c, _ = newTestNode(t, l, "node-c")
+			d, _ = newTestNode(t, l, "node-d")
+
+			invoked, lastSize atomic.Int64
+		)
+
+		a.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+			invoked.Inc()
+			lastSize.Store(int64(len(peers)))
+			return true
+		}))
+
+		runTestNode(t, a, nil)
+		for _, n := range []*Node{b, c, d} {
+			runTestNode(t, n, []string{aAddr})
+		}
+		require.Eventually(t, func() bool {
+			return lastSize.Load() == 4
+		}, 5*time.Second, 50*time.Millisecond)
+
+		// Every join and state change is recorded in the history; observers
+		// should have been notified fewer times than that.
+		require.Less(t, invoked.Load(), int64(len(a.History())), "bursts of changes should be coalesced")
+	})
+}
+
+func TestNode_Events(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := a.Events(ctx)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	timeout := time.After(5 * time.Second)
+	for joined := false; !joined; {
+		select {
+		case e := <-events:
+			_, joined = e.(PeerJoined)
+			joined = joined && e.PeerName() == "node-b"
+		case <-timeout:
+			require.FailNow(t, "never received join event for node-b")
+		}
+	}
+
+	// The channel should be closed after the context is canceled, though
+	// buffered events may be received first.
+	cancel()
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-events:
+			closed = !ok
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "events channel never closed")
+		}
+	}
 }
 
 func TestNode_Peers(t *testing.T) {
@@ -303,9 +564,9 @@ func TestNode_Peers(t *testing.T) {
 		})
 
 		expectPeers := []peer.Peer{
-			{Name: "node-a", Addr: aAddr, Self: true, State: peer.StateViewer},
-			{Name: "node-b", Addr: bAddr, Self: false, State: peer.StateViewer},
-			{Name: "node-c", Addr: cAddr, Self: false, State: peer.StateViewer},
+			{Name: "node-a", Addr: aAddr, Self: true, State: peer.StateViewer, Weight: 1},
+			{Name: "node-b", Addr: bAddr, Self: false, State: peer.StateViewer, Weight: 1},
+			{Name: "node-c", Addr: cAddr, Self: false, State: peer.StateViewer, Weight: 1},
 		}
 		require.ElementsMatch(t, expectPeers, a.Peers())
 	})
@@ -339,9 +600,1334 @@ func TestNode_Peers(t *testing.T) {
 		})
 
 		expectPeers := []peer.Peer{
-			{Name: "node-a", Addr: aAddr, Self: true, State: peer.StateViewer},
-			{Name: "node-b", Addr: bAddr, Self: false, State: peer.StateViewer},
+			{Name: "node-a", Addr: aAddr, Self: true, State: peer.StateViewer, Weight: 1},
+			{Name: "node-b", Addr: bAddr, Self: false, State: peer.StateViewer, Weight: 1},
 		}
 		require.ElementsMatch(t, expectPeers, a.Peers())
 	})
 }
+
+func TestNode_Leave(t *testing.T) {
+	t.Run("viewers leave immediately", func(t *testing.T) {
+		n, _ := newTestNode(t, testlogger.New(t), "node-a")
+		runTestNode(t, n, nil)
+
+		require.NoError(t, n.Leave(context.Background()))
+		require.Equal(t, peer.StateViewer, n.CurrentState())
+	})
+
+	t.Run("waits for peers to acknowledge", func(t *testing.T) {
+		var (
+			l   = testlogger.New(t)
+			ctx = context.Background()
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+			c, _     = newTestNode(t, l, "node-c")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		runTestNode(t, c, []string{aAddr})
+
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 3
+		})
+
+		require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+
+		leaveCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		require.NoError(t, a.Leave(leaveCtx))
+		require.Equal(t, peer.StateTerminating, a.CurrentState())
+
+		// A majority of remote peers (both b and c) must have acknowledged the
+		// change, so they must already know about it.
+		for _, n := range []*Node{b, c} {
+			var found bool
+			for _, p := range n.Peers() {
+				if p.Name == a.cfg.Name {
+					found = true
+					require.Equal(t, peer.StateTerminating, p.State)
+				}
+			}
+			require.True(t, found, "peer %s not found", a.cfg.Name)
+		}
+	})
+}
+
+func TestNode_Drain(t *testing.T) {
+	t.Run("viewers cannot drain", func(t *testing.T) {
+		n, _ := newTestNode(t, testlogger.New(t), "node-a")
+		runTestNode(t, n, nil)
+
+		err := n.Drain(context.Background())
+		require.Equal(t, StateTransitionError{From: peer.StateViewer, To: peer.StateDraining}, err)
+	})
+
+	t.Run("draining nodes cannot terminate directly", func(t *testing.T) {
+		ctx := context.Background()
+
+		n, _ := newTestNode(t, testlogger.New(t), "node-a")
+		runTestNode(t, n, nil)
+
+		require.NoError(t, n.ChangeState(ctx, peer.StateParticipant))
+		require.NoError(t, n.ChangeState(ctx, peer.StateDraining))
+
+		err := n.ChangeState(ctx, peer.StateTerminating)
+		require.Equal(t, StateTransitionError{From: peer.StateDraining, To: peer.StateTerminating}, err)
+
+		n.observersMut.Lock()
+		observers := len(n.observers)
+		n.observersMut.Unlock()
+
+		// Drain should still be able to finish the transition.
+		require.NoError(t, n.Drain(ctx))
+		require.Equal(t, peer.StateTerminating, n.CurrentState())
+
+		n.observersMut.Lock()
+		defer n.observersMut.Unlock()
+		require.Len(t, n.observers, observers, "Drain should unsubscribe its observer")
+	})
+
+	t.Run("waits for all peers to acknowledge", func(t *testing.T) {
+		var (
+			l   = testlogger.New(t)
+			ctx = context.Background()
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+			c, _     = newTestNode(t, l, "node-c")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		runTestNode(t, c, []string{aAddr})
+
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 3
+		})
+
+		require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+
+		drainCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		require.NoError(t, a.Drain(drainCtx))
+		require.Equal(t, peer.StateTerminating, a.CurrentState())
+
+		// Every remote peer must have acknowledged that a was draining.
+		for _, n := range []*Node{b, c} {
+			var found bool
+			for _, p := range n.Peers() {
+				if p.Name == a.cfg.Name {
+					found = true
+					require.Contains(t, []peer.State{peer.StateDraining, peer.StateTerminating}, p.State)
+				}
+			}
+			require.True(t, found, "peer %s not found", a.cfg.Name)
+		}
+	})
+}
+
+func TestNode_Labels(t *testing.T) {
+	t.Run("labels are validated", func(t *testing.T) {
+		n, _ := newTestNode(t, testlogger.New(t), "node-a")
+		runTestNode(t, n, nil)
+
+		err := n.SetLabels(context.Background(), map[string]string{"big": strings.Repeat("a", MaxLabelsSize)})
+		require.Error(t, err)
+	})
+
+	t.Run("concurrent modifications are kept", func(t *testing.T) {
+		n, _ := newTestNode(t, testlogger.New(t), "node-a")
+		runTestNode(t, n, nil)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key-%d", i)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := n.ModifyLabels(context.Background(), func(labels map[string]string) { labels[key] = "set" })
+				require.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		require.Len(t, n.Labels(), 10)
+	})
+
+	t.Run("labels are gossiped to peers", func(t *testing.T) {
+		var (
+			l   = testlogger.New(t)
+			ctx = context.Background()
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+
+		labels := map[string]string{"zone": "us-east-1a"}
+		require.NoError(t, b.SetLabels(ctx, labels))
+		require.Equal(t, labels, b.Labels())
+
+		waitClusterState(t, a, func(n *Node) bool {
+			for _, p := range n.Peers() {
+				if p.Name == b.cfg.Name {
+					return p.Labels["zone"] == "us-east-1a"
+				}
+			}
+			return false
+		})
+	})
+}
+
+var stateWarming = peer.MinCustomState
+
+func init() { peer.RegisterState(stateWarming, "warming") }
+
+func TestNode_CustomStates(t *testing.T) {
+	grpcServer := grpc.NewServer()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	n, err := NewNode(grpcServer, Config{
+		Name:          "node-a",
+		AdvertiseAddr: lis.Addr().String(),
+		Log:           testlogger.New(t),
+		StateTransitions: []StateTransition{
+			{From: peer.StateViewer, To: stateWarming},
+			{From: stateWarming, To: peer.StateParticipant},
+		},
+	})
+	require.NoError(t, err)
+
+	go func() { _ = grpcServer.Serve(lis) }()
+	t.Cleanup(func() { stopTestServer(grpcServer) })
+	runTestNode(t, n, nil)
+
+	ctx := context.Background()
+	require.NoError(t, n.ChangeState(ctx, stateWarming))
+	require.Equal(t, "warming", n.CurrentState().String())
+	require.NoError(t, n.ChangeState(ctx, peer.StateParticipant))
+
+	err = n.ChangeState(ctx, stateWarming)
+	require.EqualError(t, err, "invalid transition from participant to warming")
+}
+
+func TestNode_OnClusterMerge(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		merged = make(chan []peer.Peer, 1)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+		c, cAddr = newTestNodeWithConfig(t, l, Config{
+			Name: "node-c",
+			OnClusterMerge: func(local, remote []peer.Peer) {
+				merged <- remote
+			},
+		})
+		d, _ = newTestNode(t, l, "node-d")
+	)
+
+	// Create two separate clusters: (a, b) and (c, d).
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, nil)
+	runTestNode(t, d, []string{cAddr})
+
+	waitClusterState(t, c, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// Joining a regular node shouldn't be treated as a merge.
+	select {
+	case <-merged:
+		require.FailNow(t, "unexpected merge")
+	default:
+	}
+
+	// Join the clusters together.
+	require.NoError(t, c.Start([]string{aAddr}))
+
+	select {
+	case remote := <-merged:
+		names := make([]string, len(remote))
+		for i, p := range remote {
+			names[i] = p.Name
+		}
+		require.Equal(t, []string{"node-a", "node-b"}, names)
+	case <-time.After(30 * time.Second):
+		require.FailNow(t, "merge never detected")
+	}
+}
+
+func TestNode_StateDir(t *testing.T) {
+	var (
+		l   = testlogger.New(t)
+		dir = t.TempDir()
+	)
+
+	a, _ := newTestNodeWithConfig(t, l, Config{Name: "node-a", StateDir: dir})
+	require.NoError(t, a.Start(nil))
+	require.NoError(t, a.ChangeState(context.Background(), peer.StateParticipant))
+
+	// The clock is persisted in the background after changing state.
+	require.Eventually(t, func() bool {
+		bb, err := os.ReadFile(filepath.Join(dir, clockFile))
+		return err == nil && string(bb) == strconv.FormatUint(uint64(a.clock.Now()), 10)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, a.Stop())
+
+	lastTime := a.clock.Now()
+	require.NotZero(t, lastTime)
+
+	lastIncarnation := a.incarnation
+
+	// Recreating the node should restore the clock past its last value.
+	a, _ = newTestNodeWithConfig(t, l, Config{Name: "node-a", StateDir: dir})
+	require.Greater(t, uint64(a.clock.Now()), uint64(lastTime))
+	require.Greater(t, a.incarnation, lastIncarnation)
+}
+
+func TestNode_Incarnation(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-b" {
+				return p.State == peer.StateParticipant
+			}
+		}
+		return false
+	})
+	require.NoError(t, b.Stop())
+
+	// Restart node-b. Its previous state is newer in lamport time, but should
+	// be ignored since it's from an older incarnation.
+	b, _ = newTestNode(t, l, "node-b")
+	stale := messages.State{
+		NodeName:    "node-b",
+		NewState:    peer.StateParticipant,
+		Incarnation: b.incarnation - 1,
+		Time:        b.clock.Now() + 100,
+	}
+	require.False(t, b.handleStateMessage(stale), "stale message about self should be ignored")
+
+	runTestNode(t, b, []string{aAddr})
+
+	for _, n := range []*Node{a, b} {
+		waitClusterState(t, n, func(n *Node) bool {
+			for _, p := range n.Peers() {
+				if p.Name == "node-b" {
+					return p.State == peer.StateViewer
+				}
+			}
+			return false
+		})
+	}
+}
+
+func TestNode_PeersSnapshot(t *testing.T) {
+	var (
+		l   = testlogger.New(t)
+		dir = t.TempDir()
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", StateDir: dir})
+	)
+
+	runTestNode(t, a, nil)
+	require.NoError(t, b.Start([]string{aAddr}))
+
+	// Wait for the peers snapshot to be written.
+	require.Eventually(t, func() bool {
+		return len(b.loadPeers()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, b.Stop())
+
+	// Restart b with an unreachable join peer. It should fall back to joining
+	// a.
+	b, _ = newTestNodeWithConfig(t, l, Config{Name: "node-b", StateDir: dir})
+	runTestNode(t, b, []string{"127.0.0.1:1"})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+}
+
+func TestNode_Rejoin(t *testing.T) {
+	l := testlogger.New(t)
+
+	a, _ := newTestNodeWithConfig(t, l, Config{
+		Name:             "node-a",
+		RejoinMinBackoff: 50 * time.Millisecond,
+		RejoinMaxBackoff: 100 * time.Millisecond,
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b, bAddr, bServer := newTestNodeWithListener(t, l, lis, Config{Name: "node-b"})
+	require.NoError(t, b.Start(nil))
+
+	runTestNode(t, a, []string{bAddr})
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// Remove b from the cluster, leaving a on its own.
+	require.NoError(t, b.Stop())
+	bServer.Stop()
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 1
+	})
+
+	// Bring up a new node at the address a originally joined. a should
+	// rejoin through it.
+	lis, err = net.Listen("tcp", bAddr)
+	require.NoError(t, err)
+	c, _, _ := newTestNodeWithListener(t, l, lis, Config{Name: "node-c"})
+	runTestNode(t, c, nil)
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+}
+
+func TestNode_IsolationDemote(t *testing.T) {
+	var (
+		l       = testlogger.New(t)
+		demoted = make(chan struct{}, 1)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name:                   "node-a",
+			IsolationDemoteTimeout: 250 * time.Millisecond,
+			OnIsolationDemote:      func() { demoted <- struct{}{} },
+		})
+		b, _ = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	require.NoError(t, a.ChangeState(context.Background(), peer.StateParticipant))
+	require.NoError(t, b.Start([]string{aAddr}))
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// a has a peer, so it should stay a participant.
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, peer.StateParticipant, a.CurrentState())
+
+	require.NoError(t, b.Stop())
+	select {
+	case <-demoted:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "node was never demoted")
+	}
+	require.Equal(t, peer.StateViewer, a.CurrentState())
+	require.Equal(t, float64(1), testutil.ToFloat64(a.m.isolationDemotions))
+}
+
+func TestNode_JoinPeersRefresh(t *testing.T) {
+	l := testlogger.New(t)
+
+	var (
+		a, _     = newTestNodeWithConfig(t, l, Config{Name: "node-a", JoinPeersRefreshInterval: 50 * time.Millisecond})
+		b, bAddr = newTestNode(t, l, "node-b")
+		c, cAddr = newTestNode(t, l, "node-c")
+	)
+	runTestNode(t, b, nil)
+	runTestNode(t, c, nil)
+	runTestNode(t, a, []string{bAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// Emulate the join peers resolving to a new address by using a DNS name
+	// for node-c. node-a should discover and join it on the next refresh.
+	_, cPort, err := net.SplitHostPort(cAddr)
+	require.NoError(t, err)
+
+	a.stateMut.Lock()
+	a.joinPeers = append(a.joinPeers, net.JoinHostPort("localhost", cPort))
+	a.stateMut.Unlock()
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+}
+
+func TestNode_PeerHealth(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	_, ok := a.PeerHealth("node-a")
+	require.False(t, ok, "local node should not have health information")
+
+	require.Eventually(t, func() bool {
+		_, ok := a.PeerHealth("node-b")
+		return ok
+	}, 10*time.Second, 50*time.Millisecond)
+
+	health, _ := a.PeerHealth("node-b")
+	require.False(t, health.LastContact.IsZero())
+	require.Greater(t, health.RTT, time.Duration(0))
+}
+
+func TestNode_Weight(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", Weight: 3})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-a" {
+				return p.Weight == 3
+			}
+		}
+		return false
+	})
+
+	// Weight should default to 1.
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-b" {
+				return p.Weight == 1
+			}
+		}
+		return false
+	})
+}
+
+func TestNode_AvailabilityZone(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", AvailabilityZone: "us-east-1a"})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-a" {
+				return p.AvailabilityZone == "us-east-1a"
+			}
+		}
+		return false
+	})
+}
+
+func TestNode_Roles(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", Roles: []string{"query", "ingest", "query"}})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-a" {
+				return p.Equal(peer.Peer{
+					Name:   "node-a",
+					Addr:   p.Addr,
+					State:  p.State,
+					Weight: p.Weight,
+					Roles:  []string{"ingest", "query"},
+				})
+			}
+		}
+		return false
+	})
+
+	_, err := NewNode(grpc.NewServer(), Config{Name: "node-c", AdvertiseAddr: "127.0.0.1:80", Roles: []string{""}})
+	require.EqualError(t, err, "role names must not be empty")
+}
+
+func TestNode_Broadcast(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+		c, _     = newTestNode(t, l, "node-c")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	type received struct {
+		node, from, payload string
+	}
+	receivedCh := make(chan received, 10)
+	for _, n := range []*Node{a, b, c} {
+		n := n
+		n.OnBroadcast(func(from string, payload []byte) {
+			receivedCh <- received{node: n.cfg.Name, from: from, payload: string(payload)}
+		})
+	}
+
+	require.NoError(t, a.Broadcast([]byte("flush now")))
+
+	var got []received
+	for len(got) < 2 {
+		select {
+		case r := <-receivedCh:
+			got = append(got, r)
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "timed out waiting for broadcast")
+		}
+	}
+	require.ElementsMatch(t, []received{
+		{node: "node-b", from: "node-a", payload: "flush now"},
+		{node: "node-c", from: "node-a", payload: "flush now"},
+	}, got)
+
+	// Each node should only receive the broadcast once, and the sender should
+	// never receive it.
+	select {
+	case r := <-receivedCh:
+		require.FailNow(t, "unexpected broadcast", "%#v", r)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err := a.Broadcast(make([]byte, MaxBroadcastSize+1))
+	require.Error(t, err)
+}
+
+func TestNode_Send(t *testing.T) {
+	var (
+		l   = testlogger.New(t)
+		ctx = context.Background()
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+
+	waitClusterState(t, b, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		_, err := b.Send(ctx, "node-a", []byte("ping"))
+		require.Error(t, err)
+	})
+
+	t.Run("unknown peer", func(t *testing.T) {
+		_, err := b.Send(ctx, "node-z", []byte("ping"))
+		require.EqualError(t, err, `unknown peer "node-z"`)
+	})
+
+	t.Run("request and response", func(t *testing.T) {
+		a.OnRequest(func(_ context.Context, from string, payload []byte) ([]byte, error) {
+			if string(payload) == "fail" {
+				return nil, fmt.Errorf("request failed")
+			}
+			return []byte(fmt.Sprintf("%s from %s", payload, from)), nil
+		})
+
+		resp, err := b.Send(ctx, "node-a", []byte("ping"))
+		require.NoError(t, err)
+		require.Equal(t, "ping from node-b", string(resp))
+
+		_, err = b.Send(ctx, "node-a", []byte("fail"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "request failed")
+	})
+}
+
+func TestNode_NameConflict(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		conflicts = make(chan [2]peer.Peer, 10)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name: "node-a",
+			OnNameConflict: func(existing, other peer.Peer) {
+				conflicts <- [2]peer.Peer{existing, other}
+			},
+		})
+		b, bAddr = newTestNode(t, l, "node-a")
+	)
+
+	runTestNode(t, a, nil)
+
+	err := b.Start([]string{aAddr})
+	var conflictErr NameConflictError
+	require.True(t, errors.As(err, &conflictErr), "expected NameConflictError, got %v", err)
+	require.Equal(t, NameConflictError{Name: "node-a", Addr: aAddr}, conflictErr)
+
+	// Starting again restarts the node, which conflicts again.
+	err = b.Start([]string{aAddr})
+	require.True(t, errors.As(err, &conflictErr), "expected NameConflictError, got %v", err)
+
+	select {
+	case c := <-conflicts:
+		require.Equal(t, [2]peer.Peer{{Name: "node-a", Addr: aAddr}, {Name: "node-a", Addr: bAddr}}, c)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for conflict")
+	}
+
+	// The existing node should be unaffected.
+	for _, p := range a.Peers() {
+		require.Equal(t, aAddr, p.Addr)
+	}
+}
+
+func TestNode_ChangeState_WaitForPropagation(t *testing.T) {
+	var (
+		l   = testlogger.New(t)
+		ctx = context.Background()
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+		c, _     = newTestNode(t, l, "node-c")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Ask for more peers than exist; ChangeState should wait for every remote
+	// peer instead.
+	require.NoError(t, a.ChangeState(waitCtx, peer.StateParticipant, WaitForPropagation(5)))
+
+	for _, n := range []*Node{b, c} {
+		var found bool
+		for _, p := range n.Peers() {
+			if p.Name == a.cfg.Name {
+				found = true
+				require.Equal(t, peer.StateParticipant, p.State)
+			}
+		}
+		require.True(t, found, "peer %s not found", a.cfg.Name)
+	}
+}
+
+func TestNode_UpdateConfig(t *testing.T) {
+	t.Run("join peers", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, nil)
+
+		err := b.UpdateConfig(context.Background(), ConfigUpdate{JoinPeers: []string{aAddr}})
+		require.NoError(t, err)
+
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+		require.Equal(t, []string{aAddr}, b.joinPeers)
+	})
+
+	t.Run("log", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, _ = newTestNode(t, l, "node-a")
+		)
+		runTestNode(t, a, nil)
+
+		var logged atomic.Bool
+		newLogger := log.LoggerFunc(func(keyvals ...interface{}) error {
+			for i := 0; i+1 < len(keyvals); i += 2 {
+				if keyvals[i] == "msg" && keyvals[i+1] == "changing node labels" {
+					logged.Store(true)
+				}
+			}
+			return nil
+		})
+
+		err := a.UpdateConfig(context.Background(), ConfigUpdate{Log: newLogger})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, a.SetLabels(ctx, map[string]string{"foo": "bar"}))
+		require.True(t, logged.Load(), "new logger should be used after UpdateConfig")
+	})
+
+	t.Run("advertise address", func(t *testing.T) {
+		l := testlogger.New(t)
+
+		bLis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		var (
+			a, aAddr   = newTestNode(t, l, "node-a")
+			b, _, bSrv = newTestNodeWithListener(t, l, bLis, Config{Name: "node-b"})
+		)
+
+		// Serve node-b on a second address to move it to.
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() { _ = bSrv.Serve(lis) }()
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+
+		oldIncarnation := b.incarnation
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = b.UpdateConfig(ctx, ConfigUpdate{AdvertiseAddr: lis.Addr().String()})
+		require.NoError(t, err)
+		require.Greater(t, b.incarnation, oldIncarnation)
+
+		waitClusterState(t, a, func(n *Node) bool {
+			for _, p := range n.Peers() {
+				if p.Name == "node-b" {
+					return p.Addr == lis.Addr().String() && p.State == peer.StateParticipant
+				}
+			}
+			return false
+		})
+		waitClusterState(t, b, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, _ = newTestNode(t, l, "node-a")
+		)
+		require.NoError(t, a.Start(nil))
+		require.NoError(t, a.Stop())
+
+		err := a.UpdateConfig(context.Background(), ConfigUpdate{Log: l})
+		require.ErrorIs(t, err, ErrStopped)
+	})
+}
+
+func TestNode_Restart(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", ObserverQueueSize: 1})
+
+		observed atomic.Int64
+	)
+
+	b.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		observed.Store(int64(len(peers)))
+		return true
+	}))
+
+	runTestNode(t, a, nil)
+	require.NoError(t, b.Start([]string{aAddr}))
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers(WithStates(peer.StateParticipant))) == 1
+	})
+
+	require.NoError(t, b.Stop())
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 1
+	})
+	observed.Store(0)
+
+	// Restart b on the same instance.
+	runTestNode(t, b, []string{aAddr})
+	require.Equal(t, peer.StateViewer, b.CurrentState())
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+	require.Eventually(t, func() bool {
+		return observed.Load() == 2
+	}, 5*time.Second, 50*time.Millisecond, "observers should be notified after restarting")
+
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers(WithStates(peer.StateParticipant))) == 1
+	})
+}
+
+func TestNode_StopContext(t *testing.T) {
+	t.Run("gracefully leaves", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+
+		require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, b.StopContext(ctx))
+
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 1
+		})
+	})
+
+	t.Run("reports incomplete steps", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNode(t, l, "node-a")
+			b, _     = newTestNode(t, l, "node-b")
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		waitClusterState(t, b, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var stopErr StopError
+		require.ErrorAs(t, b.StopContext(ctx), &stopErr)
+		require.NotEmpty(t, stopErr.Steps)
+	})
+}
+
+func TestNode_PeerAdmission(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name: "node-a",
+			OnPeerAdmission: func(p peer.Peer) error {
+				if p.Name == "node-c" {
+					return fmt.Errorf("node-c is not allowed")
+				}
+				return nil
+			},
+		})
+		b, _ = newTestNode(t, l, "node-b")
+		c, _ = newTestNode(t, l, "node-c")
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// node-c can still contact node-a, but node-a should ignore it.
+	runTestNode(t, c, []string{aAddr})
+
+	require.Eventually(t, func() bool {
+		a.admissionMut.Lock()
+		defer a.admissionMut.Unlock()
+		_, rejected := a.rejectedPeers["node-c"]
+		return rejected
+	}, 5*time.Second, 50*time.Millisecond)
+
+	time.Sleep(500 * time.Millisecond)
+	for _, p := range a.Peers() {
+		require.NotEqual(t, "node-c", p.Name, "rejected peer should not be in the peer list")
+	}
+}
+
+func TestNode_ClusterName(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", ClusterName: "prod"})
+		b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", ClusterName: "prod"})
+		c, _     = newTestNodeWithConfig(t, l, Config{Name: "node-c", ClusterName: "staging"})
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	err := c.Start([]string{aAddr})
+	t.Cleanup(func() { _ = c.Stop() })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cluster name mismatch: local cluster is "staging", peer is in cluster "prod"`)
+
+	time.Sleep(500 * time.Millisecond)
+	for _, p := range a.Peers() {
+		require.NotEqual(t, "node-c", p.Name, "peer from another cluster should not be in the peer list")
+	}
+	require.Len(t, c.Peers(), 1)
+	require.Greater(t, testutil.ToFloat64(c.m.clusterNameMismatchesTotal), float64(0))
+}
+
+func TestNode_Version(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name:          "node-a",
+			Version:       "v1.2.0",
+			VersionPolicy: SameMajorVersion,
+		})
+		b, _ = newTestNodeWithConfig(t, l, Config{Name: "node-b", Version: "v1.5.0"})
+		c, _ = newTestNodeWithConfig(t, l, Config{Name: "node-c", Version: "v2.0.0"})
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	runTestNode(t, c, []string{aAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	require.Eventually(t, func() bool {
+		a.admissionMut.Lock()
+		defer a.admissionMut.Unlock()
+		_, rejected := a.rejectedPeers["node-c"]
+		return rejected
+	}, 5*time.Second, 50*time.Millisecond, "node-c should be rejected for its version")
+
+	versions := make(map[string]string)
+	for _, p := range a.Peers() {
+		versions[p.Name] = p.Version
+	}
+	require.Equal(t, map[string]string{"node-a": "v1.2.0", "node-b": "v1.5.0"}, versions)
+}
+
+func TestNode_PushPull(t *testing.T) {
+	merges := func(n *Node) float64 {
+		return testutil.ToFloat64(n.m.gossipEventsTotal.WithLabelValues(eventMergeRemoteState))
+	}
+
+	t.Run("custom interval", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", PushPullInterval: 50 * time.Millisecond})
+			b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", PushPullInterval: 50 * time.Millisecond})
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+
+		require.Eventually(t, func() bool {
+			return merges(a) >= 5
+		}, 5*time.Second, 50*time.Millisecond, "expected periodic full state syncs")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var (
+			l = testlogger.New(t)
+
+			a, aAddr = newTestNodeWithConfig(t, l, Config{
+				Name:             "node-a",
+				PushPullInterval: 50 * time.Millisecond,
+				DisablePushPull:  true,
+			})
+			b, _ = newTestNodeWithConfig(t, l, Config{Name: "node-b", DisablePushPull: true})
+		)
+
+		runTestNode(t, a, nil)
+		runTestNode(t, b, []string{aAddr})
+		waitClusterState(t, a, func(n *Node) bool {
+			return len(n.Peers()) == 2
+		})
+
+		// Only the sync from joining should have happened.
+		time.Sleep(500 * time.Millisecond)
+		require.Equal(t, float64(1), merges(a))
+	})
+
+	t.Run("negative interval", func(t *testing.T) {
+		_, err := NewNode(grpc.NewServer(), Config{
+			Name:             "node-a",
+			AdvertiseAddr:    "127.0.0.1:80",
+			PushPullInterval: -time.Second,
+		})
+		require.EqualError(t, err, "push/pull interval must not be negative")
+	})
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", Roles: []string{"ingester", "querier"}})
+	)
+
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	require.NoError(t, b.ChangeState(context.Background(), peer.StateParticipant))
+
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-b" {
+				return p.State == peer.StateParticipant
+			}
+		}
+		return false
+	})
+
+	snapshot, err := a.Snapshot()
+	require.NoError(t, err)
+
+	t.Run("restore", func(t *testing.T) {
+		c, _ := newTestNode(t, l, "node-c")
+		require.NoError(t, c.Restore(snapshot))
+
+		a.peerMut.RLock()
+		bTime := a.peerStates["node-b"].Time
+		a.peerMut.RUnlock()
+		require.GreaterOrEqual(t, c.clock.Now(), bTime)
+		require.Equal(t, []string{aAddr, b.cfg.AdvertiseAddr}, c.restoredPeers)
+
+		restored, ok := c.peerStates["node-b"]
+		require.True(t, ok)
+		require.Equal(t, peer.StateParticipant, restored.NewState)
+		require.Equal(t, b.incarnation, restored.Incarnation)
+		require.Equal(t, []string{"ingester", "querier"}, restored.Roles)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		c, _ := newTestNode(t, l, "node-c")
+		err := c.Restore([]byte(`{"version": 100}`))
+		require.EqualError(t, err, "unsupported snapshot version 100")
+	})
+}
+
+func TestNode_MinimumClusterSize(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", MinimumClusterSize: 2})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+	runTestNode(t, a, nil)
+
+	t.Run("times out", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+
+		err := a.ChangeState(ctx, peer.StateParticipant)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, peer.StateViewer, a.CurrentState())
+	})
+
+	t.Run("waits for peers", func(t *testing.T) {
+		errCh := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errCh <- a.ChangeState(ctx, peer.StateParticipant)
+		}()
+
+		runTestNode(t, b, []string{aAddr})
+		require.NoError(t, <-errCh)
+		require.Equal(t, peer.StateParticipant, a.CurrentState())
+	})
+}
+
+func TestConfig_validate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+
+	cfg := Config{
+		Name:          "node-a",
+		AdvertiseAddr: "127.0.0.1:80",
+		StateDir:      dir,
+	}
+	require.NoError(t, cfg.validate())
+
+	// Validating must not create resources or apply defaults.
+	require.Nil(t, cfg.Pool)
+	require.Nil(t, cfg.Log)
+	require.Zero(t, cfg.Weight)
+	_, err := os.Stat(dir)
+	require.True(t, os.IsNotExist(err), "validate created the state directory")
+
+	n, err := NewNode(grpc.NewServer(), cfg)
+	require.NoError(t, err)
+	require.NotNil(t, n.cfg.Pool)
+	require.Equal(t, 1, n.cfg.Weight)
+	require.DirExists(t, dir)
+}
+
+func TestNode_Tunables(t *testing.T) {
+	t.Run("applied", func(t *testing.T) {
+		n, err := NewNode(grpc.NewServer(), Config{
+			Name:           "node-a",
+			AdvertiseAddr:  "127.0.0.1:80",
+			RetransmitMult: 7,
+		})
+		require.NoError(t, err)
+		defer func() { _ = n.Stop() }()
+
+		require.Equal(t, 7, n.broadcasts.RetransmitMult)
+	})
+
+	tt := []struct {
+		name        string
+		cfg         Config
+		expectError string
+	}{
+		{
+			name: "valid",
+			cfg: Config{
+				ProbeInterval:  2 * time.Second,
+				ProbeTimeout:   time.Second,
+				SuspicionMult:  6,
+				RetransmitMult: 2,
+				GossipNodes:    5,
+			},
+		},
+		{
+			name:        "negative probe interval",
+			cfg:         Config{ProbeInterval: -time.Second},
+			expectError: "probe interval must not be negative",
+		},
+		{
+			name:        "negative suspicion multiplier",
+			cfg:         Config{SuspicionMult: -1},
+			expectError: "suspicion multiplier must not be negative",
+		},
+		{
+			name:        "negative gossip nodes",
+			cfg:         Config{GossipNodes: -1},
+			expectError: "gossip nodes must not be negative",
+		},
+		{
+			name:        "negative dead node reclaim time",
+			cfg:         Config{DeadNodeReclaimTime: -time.Second},
+			expectError: "dead node reclaim time must not be negative",
+		},
+		{
+			name:        "probe timeout exceeds interval",
+			cfg:         Config{ProbeInterval: time.Second, ProbeTimeout: 2 * time.Second},
+			expectError: "probe timeout (2s) must be less than probe interval (1s)",
+		},
+		{
+			name:        "probe timeout exceeds default interval",
+			cfg:         Config{ProbeTimeout: time.Second},
+			expectError: "probe timeout (1s) must be less than probe interval (1s)",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.Name = "node-a"
+			cfg.AdvertiseAddr = "127.0.0.1:80"
+
+			err := cfg.validate()
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNode_DeadNodeReclaimTime(t *testing.T) {
+	fastFailure := func(name string) Config {
+		return Config{
+			Name:                name,
+			ProbeInterval:       100 * time.Millisecond,
+			ProbeTimeout:        50 * time.Millisecond,
+			SuspicionMult:       1,
+			DeadNodeReclaimTime: 100 * time.Millisecond,
+		}
+	}
+
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, fastFailure("node-a"))
+		b, _     = newTestNodeWithConfig(t, l, fastFailure("node-b"))
+	)
+
+	runTestNode(t, a, nil)
+	require.NoError(t, b.Start([]string{aAddr}))
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+
+	// Simulate node-b crashing by shutting down its memberlist without
+	// leaving the cluster.
+	require.NoError(t, b.memberlist().Shutdown())
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 1
+	})
+
+	// A replacement for node-b at a new address should be accepted.
+	replacement, replacementAddr := newTestNodeWithConfig(t, l, fastFailure("node-b"))
+	runTestNode(t, replacement, []string{aAddr})
+
+	waitClusterState(t, a, func(n *Node) bool {
+		for _, p := range n.Peers() {
+			if p.Name == "node-b" {
+				return p.Addr == replacementAddr
+			}
+		}
+		return false
+	})
+}
@@ -56,13 +56,82 @@ func (po *participantObserver) NotifyPeersChanged(peers []peer.Peer) (reregister
 	return po.next.NotifyPeersChanged(peers)
 }
 
+// ObserveFilter filters the changes an Observer is notified about. The zero
+// value matches all changes.
+type ObserveFilter struct {
+	// Peers, if non-empty, limits notifications to changes affecting peers with
+	// one of the provided names.
+	Peers []string
+
+	// States, if non-empty, limits notifications to changes affecting peers in
+	// one of the provided states. A peer moving into or out of one of the
+	// states is considered a change.
+	States []peer.State
+}
+
+// FilterObserver wraps an observer and filters out events where the set of
+// peers matching filter haven't changed. When the set of matching peers has
+// changed, next.NotifyPeersChanged will be invoked with the full set of peers
+// (i.e., not just matching peers).
+func FilterObserver(filter ObserveFilter, next Observer) Observer {
+	fo := &filterObserver{next: next}
+
+	if len(filter.Peers) > 0 {
+		fo.names = make(map[string]struct{}, len(filter.Peers))
+		for _, name := range filter.Peers {
+			fo.names[name] = struct{}{}
+		}
+	}
+	if len(filter.States) > 0 {
+		fo.states = make(map[peer.State]struct{}, len(filter.States))
+		for _, state := range filter.States {
+			fo.states[state] = struct{}{}
+		}
+	}
+
+	return fo
+}
+
+type filterObserver struct {
+	names  map[string]struct{}     // nil means all names
+	states map[peer.State]struct{} // nil means all states
+
+	lastMatched []peer.Peer // Matched peers ordered by name
+	next        Observer
+}
+
+func (fo *filterObserver) NotifyPeersChanged(peers []peer.Peer) (reregister bool) {
+	matched := make([]peer.Peer, 0, len(peers))
+	for _, p := range peers {
+		if fo.names != nil {
+			if _, ok := fo.names[p.Name]; !ok {
+				continue
+			}
+		}
+		if fo.states != nil {
+			if _, ok := fo.states[p.State]; !ok {
+				continue
+			}
+		}
+		matched = append(matched, p)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+
+	if peersEqual(matched, fo.lastMatched) {
+		return true
+	}
+
+	fo.lastMatched = matched
+	return fo.next.NotifyPeersChanged(peers)
+}
+
 func peersEqual(a, b []peer.Peer) bool {
 	if len(a) != len(b) {
 		return false
 	}
 
 	for i := 0; i < len(a); i++ {
-		if a[i] != b[i] {
+		if !a[i].Equal(b[i]) {
 			return false
 		}
 	}
@@ -62,3 +62,78 @@ func TestParticipantObserver(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerEqual(t *testing.T) {
+	a := peer.Peer{Name: "foo", Labels: map[string]string{"a": "1"}}
+	b := peer.Peer{Name: "foo", Labels: map[string]string{"a": "2"}}
+	c := peer.Peer{Name: "foo", Labels: map[string]string{"a": "1"}}
+
+	require.False(t, a.Equal(b))
+	require.True(t, a.Equal(c))
+	require.True(t, peersEqual([]peer.Peer{a}, []peer.Peer{c}))
+
+	d := c
+	d.AvailabilityZone = "zone-b"
+	require.False(t, c.Equal(d))
+}
+
+func TestFilterObserver(t *testing.T) {
+	tt := []struct {
+		name          string
+		filter        ObserveFilter
+		before, after []peer.Peer
+		shouldCall    bool
+	}{
+		{
+			name:       "empty filter matches new peers",
+			after:      []peer.Peer{{Name: "foo", State: peer.StateViewer}},
+			shouldCall: true,
+		},
+		{
+			name:       "unwatched peer",
+			filter:     ObserveFilter{Peers: []string{"bar"}},
+			after:      []peer.Peer{{Name: "foo", State: peer.StateViewer}},
+			shouldCall: false,
+		},
+		{
+			name:       "watched peer changed",
+			filter:     ObserveFilter{Peers: []string{"foo"}},
+			before:     []peer.Peer{{Name: "foo", State: peer.StateViewer}},
+			after:      []peer.Peer{{Name: "foo", State: peer.StateParticipant}},
+			shouldCall: true,
+		},
+		{
+			name:       "peer moved out of watched state",
+			filter:     ObserveFilter{States: []peer.State{peer.StateParticipant}},
+			before:     []peer.Peer{{Name: "foo", State: peer.StateParticipant}},
+			after:      []peer.Peer{{Name: "foo", State: peer.StateTerminating}},
+			shouldCall: true,
+		},
+		{
+			name:   "change outside of watched state",
+			filter: ObserveFilter{States: []peer.State{peer.StateParticipant}},
+			before: []peer.Peer{{Name: "foo", State: peer.StateViewer}},
+			after: []peer.Peer{
+				{Name: "foo", State: peer.StateViewer},
+				{Name: "bar", State: peer.StateViewer},
+			},
+			shouldCall: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var called bool
+
+			obs := FilterObserver(tc.filter, FuncObserver(func([]peer.Peer) bool {
+				called = true
+				return true
+			}))
+			_ = obs.NotifyPeersChanged(tc.before)
+			called = false
+
+			_ = obs.NotifyPeersChanged(tc.after)
+			require.Equal(t, tc.shouldCall, called)
+		})
+	}
+}
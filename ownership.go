@@ -0,0 +1,289 @@
+package ckit
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+)
+
+// OwnershipOptions configures WatchOwnership.
+type OwnershipOptions struct {
+	// NumOwners is the number of owners of each key. The local Node owns a key
+	// when it's any of the first NumOwners owners. Defaults to 1.
+	NumOwners int
+
+	// Op used to determine ownership. Defaults to shard.OpRead.
+	Op shard.Op
+
+	// OnKeyspaceGained is invoked with the ranges of keys which the local
+	// Node started owning. Optional.
+	OnKeyspaceGained func(ranges []shard.KeyRange)
+
+	// OnKeyspaceLost is invoked with the ranges of keys which the local Node
+	// stopped owning. Optional.
+	OnKeyspaceLost func(ranges []shard.KeyRange)
+}
+
+// WatchOwnership invokes the callbacks in opts whenever the ranges of keys
+// owned by n within s change, such as to hand off data when peers join or
+// leave the cluster.
+//
+// s is typically Config.Sharder of n. If s is a different Sharder, the peers
+// of n are synchronized to s before ownership is checked.
+//
+// OnKeyspaceGained is invoked with the initial ranges owned by n before
+// WatchOwnership returns. Afterwards, callbacks are invoked from an Observer
+// of n and must not block for long periods. An error is returned if s
+// doesn't assign keys by range; see shard.OwnedRanges.
+//
+// Calling the returned unsubscribe function stops watching for changes.
+func WatchOwnership(n *Node, s shard.Sharder, opts OwnershipOptions) (unsubscribe func(), err error) {
+	if opts.NumOwners < 1 {
+		opts.NumOwners = 1
+	}
+
+	w := &ownershipWatcher{
+		n:      n,
+		s:      s,
+		opts:   opts,
+		shared: s == n.cfg.Sharder,
+	}
+
+	// Observe before checking the initial ownership so changes in between
+	// aren't missed.
+	unsubscribe = n.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		w.update(peers)
+		return true
+	}))
+
+	if err := w.check(n.Peers()); err != nil {
+		unsubscribe()
+		return nil, err
+	}
+	return unsubscribe, nil
+}
+
+type ownershipWatcher struct {
+	n      *Node
+	s      shard.Sharder
+	opts   OwnershipOptions
+	shared bool // True if s is updated by n.
+
+	mut    sync.Mutex
+	ranges []shard.KeyRange
+}
+
+func (w *ownershipWatcher) update(peers []peer.Peer) {
+	if err := w.check(peers); err != nil {
+		level.Warn(w.n.log).Log("msg", "failed to check keyspace ownership", "err", err)
+	}
+}
+
+// check updates the ranges owned by the local node, invoking callbacks for
+// ranges which were gained or lost.
+func (w *ownershipWatcher) check(peers []peer.Peer) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if !w.shared {
+		w.s.SetPeers(peers)
+	}
+
+	ranges, err := shard.OwnedRanges(w.s, w.n.cfg.Name, w.opts.NumOwners, w.opts.Op)
+	if err == shard.ErrRangesUnsupported {
+		return err
+	} else if err != nil {
+		// There may not be enough peers to own keys yet, such as before the
+		// local Node is a Participant.
+		level.Debug(w.n.log).Log("msg", "local node owns no keys", "reason", err)
+		ranges = nil
+	}
+
+	gained, lost := shard.DiffRanges(w.ranges, ranges)
+	w.ranges = ranges
+
+	if len(lost) > 0 && w.opts.OnKeyspaceLost != nil {
+		w.opts.OnKeyspaceLost(lost)
+	}
+	if len(gained) > 0 && w.opts.OnKeyspaceGained != nil {
+		w.opts.OnKeyspaceGained(gained)
+	}
+	return nil
+}
+
+// KeyOwnershipOptions configures WatchKeys.
+type KeyOwnershipOptions struct {
+	// NumOwners is the number of owners of each key. The local Node owns a key
+	// when it's any of the first NumOwners owners. Defaults to 1.
+	NumOwners int
+
+	// Op used to determine ownership. Defaults to shard.OpRead.
+	Op shard.Op
+
+	// OnKeysGained is invoked with the watched keys which the local Node
+	// started owning. Optional.
+	OnKeysGained func(keys []shard.Key)
+
+	// OnKeysLost is invoked with the watched keys which the local Node
+	// stopped owning. Optional.
+	OnKeysLost func(keys []shard.Key)
+}
+
+// A KeyWatcher notifies when the local Node gains or loses ownership of a
+// set of watched keys, such as keys identifying singleton tasks which must
+// only run on their owner. KeyWatchers are created by WatchKeys.
+type KeyWatcher struct {
+	n           *Node
+	s           shard.Sharder
+	opts        KeyOwnershipOptions
+	shared      bool // True if s is updated by n.
+	unsubscribe func()
+
+	mut     sync.Mutex
+	watched map[shard.Key]bool // Watched keys and whether they're owned
+}
+
+// WatchKeys returns a KeyWatcher which invokes the callbacks in opts
+// whenever the local Node gains or loses ownership of watched keys within
+// s. Unlike WatchOwnership, WatchKeys supports every Sharder.
+//
+// s is typically Config.Sharder of n. If s is a different Sharder, the peers
+// of n are synchronized to s before ownership is checked.
+//
+// No keys are watched initially; call KeyWatcher.Watch to add keys. Changes
+// to membership are handled from an Observer of n, so callbacks must not
+// block for long periods. Call KeyWatcher.Close to stop watching.
+func WatchKeys(n *Node, s shard.Sharder, opts KeyOwnershipOptions) *KeyWatcher {
+	if opts.NumOwners < 1 {
+		opts.NumOwners = 1
+	}
+
+	kw := &KeyWatcher{
+		n:       n,
+		s:       s,
+		opts:    opts,
+		shared:  s == n.cfg.Sharder,
+		watched: make(map[shard.Key]bool),
+	}
+
+	// Observe before checking the initial peers so changes in between aren't
+	// missed.
+	kw.unsubscribe = n.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		kw.update(peers)
+		return true
+	}))
+	kw.update(n.Peers())
+	return kw
+}
+
+// Watch adds keys to the set of watched keys. OnKeysGained is invoked with
+// the added keys which are already owned by the local Node before Watch
+// returns. Keys which are already watched are ignored.
+func (kw *KeyWatcher) Watch(keys ...shard.Key) {
+	kw.mut.Lock()
+	defer kw.mut.Unlock()
+
+	var gained []shard.Key
+	for _, key := range keys {
+		if _, ok := kw.watched[key]; ok {
+			continue
+		}
+		owned := kw.ownsKey(key)
+		kw.watched[key] = owned
+		if owned {
+			gained = append(gained, key)
+		}
+	}
+	sortKeys(gained)
+	kw.notify(gained, nil)
+}
+
+// Unwatch removes keys from the set of watched keys. OnKeysLost isn't
+// invoked for removed keys, even if they were owned.
+func (kw *KeyWatcher) Unwatch(keys ...shard.Key) {
+	kw.mut.Lock()
+	defer kw.mut.Unlock()
+
+	for _, key := range keys {
+		delete(kw.watched, key)
+	}
+}
+
+// Owned returns the watched keys which are owned by the local Node, sorted
+// in ascending order.
+func (kw *KeyWatcher) Owned() []shard.Key {
+	kw.mut.Lock()
+	defer kw.mut.Unlock()
+
+	var owned []shard.Key
+	for key, ok := range kw.watched {
+		if ok {
+			owned = append(owned, key)
+		}
+	}
+	sortKeys(owned)
+	return owned
+}
+
+// Close stops watching for changes to membership. Callbacks may still be
+// invoked by calls to Watch after Close returns.
+func (kw *KeyWatcher) Close() { kw.unsubscribe() }
+
+// update rechecks the ownership of every watched key after the peers of n
+// changed, invoking callbacks for keys which were gained or lost.
+func (kw *KeyWatcher) update(peers []peer.Peer) {
+	kw.mut.Lock()
+	defer kw.mut.Unlock()
+
+	if !kw.shared {
+		kw.s.SetPeers(peers)
+	}
+
+	var gained, lost []shard.Key
+	for key, wasOwned := range kw.watched {
+		owned := kw.ownsKey(key)
+		if owned == wasOwned {
+			continue
+		}
+		kw.watched[key] = owned
+		if owned {
+			gained = append(gained, key)
+		} else {
+			lost = append(lost, key)
+		}
+	}
+	sortKeys(gained)
+	sortKeys(lost)
+	kw.notify(gained, lost)
+}
+
+// ownsKey returns true if the local Node owns key. Lookups which fail, such
+// as when there aren't enough peers, own no keys.
+func (kw *KeyWatcher) ownsKey(key shard.Key) bool {
+	owners, err := kw.s.Lookup(key, kw.opts.NumOwners, kw.opts.Op)
+	if err != nil {
+		return false
+	}
+	for _, owner := range owners {
+		if owner.Name == kw.n.cfg.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (kw *KeyWatcher) notify(gained, lost []shard.Key) {
+	if len(lost) > 0 && kw.opts.OnKeysLost != nil {
+		kw.opts.OnKeysLost(lost)
+	}
+	if len(gained) > 0 && kw.opts.OnKeysGained != nil {
+		kw.opts.OnKeysGained(gained)
+	}
+}
+
+func sortKeys(keys []shard.Key) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+}
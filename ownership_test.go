@@ -0,0 +1,147 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchOwnership(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		ring     = shard.Ring(16)
+		a, aAddr = newTestNodeWithConfig(t, l, Config{Name: "node-a", Sharder: ring})
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	var (
+		gained = make(chan []shard.KeyRange, 10)
+		lost   = make(chan []shard.KeyRange, 10)
+	)
+	unsubscribe, err := WatchOwnership(a, ring, OwnershipOptions{
+		Op:               shard.OpReadWrite,
+		OnKeyspaceGained: func(ranges []shard.KeyRange) { gained <- ranges },
+		OnKeyspaceLost:   func(ranges []shard.KeyRange) { lost <- ranges },
+	})
+	require.NoError(t, err)
+	defer unsubscribe()
+	require.Empty(t, gained, "viewer should not own any keys")
+
+	receive := func(ch chan []shard.KeyRange) []shard.KeyRange {
+		t.Helper()
+		select {
+		case ranges := <-ch:
+			return ranges
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "ownership change not received")
+			return nil
+		}
+	}
+
+	ctx := context.Background()
+	runTestNode(t, a, nil)
+	require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+	require.Equal(t, []shard.KeyRange{{Start: 0, End: math.MaxUint64}}, receive(gained))
+
+	runTestNode(t, b, []string{aAddr})
+	require.NoError(t, b.ChangeState(ctx, peer.StateParticipant))
+	lostRanges := receive(lost)
+	require.NotEmpty(t, lostRanges)
+
+	for _, r := range lostRanges {
+		owners, err := ring.Lookup(r.Start, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, "node-b", owners[0].Name)
+	}
+
+	_, err = WatchOwnership(a, shard.Rendezvous(), OwnershipOptions{})
+	require.ErrorIs(t, err, shard.ErrRangesUnsupported)
+}
+
+func TestWatchKeys(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNode(t, l, "node-b")
+	)
+
+	var (
+		gained = make(chan []shard.Key, 10)
+		lost   = make(chan []shard.Key, 10)
+	)
+	rendezvous := shard.Rendezvous()
+	kw := WatchKeys(a, rendezvous, KeyOwnershipOptions{
+		Op:           shard.OpReadWrite,
+		OnKeysGained: func(keys []shard.Key) { gained <- keys },
+		OnKeysLost:   func(keys []shard.Key) { lost <- keys },
+	})
+	defer kw.Close()
+
+	receive := func(ch chan []shard.Key) []shard.Key {
+		t.Helper()
+		select {
+		case keys := <-ch:
+			return keys
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "ownership change not received")
+			return nil
+		}
+	}
+
+	// Find a key which will be owned by node-b once it joins.
+	var (
+		keys  = []shard.Key{shard.StringKey("task-a"), shard.StringKey("task-b")}
+		moved shard.Key
+	)
+	rendezvous.SetPeers([]peer.Peer{
+		{Name: "node-a", State: peer.StateParticipant},
+		{Name: "node-b", State: peer.StateParticipant},
+	})
+	for i := 0; ; i++ {
+		require.Less(t, i, 1000, "no key found which is owned by node-b")
+
+		key := shard.StringKey(fmt.Sprintf("task-%d", i))
+		owners, err := rendezvous.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		if owners[0].Name == "node-b" {
+			moved = key
+			break
+		}
+	}
+	keys = append(keys, moved)
+	rendezvous.SetPeers(a.Peers())
+
+	kw.Watch(keys...)
+	require.Empty(t, gained, "viewer should not own any keys")
+	require.Empty(t, kw.Owned())
+
+	ctx := context.Background()
+	runTestNode(t, a, nil)
+	require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+
+	expect := append([]shard.Key(nil), keys...)
+	sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+	require.Equal(t, expect, receive(gained))
+	require.Equal(t, expect, kw.Owned())
+
+	runTestNode(t, b, []string{aAddr})
+	require.NoError(t, b.ChangeState(ctx, peer.StateParticipant))
+	require.Contains(t, receive(lost), moved)
+	require.NotContains(t, kw.Owned(), moved)
+
+	// Newly watched keys which are already owned are reported immediately.
+	kw.Unwatch(keys...)
+	require.Empty(t, kw.Owned())
+	kw.Watch(keys...)
+	require.NotContains(t, receive(gained), moved)
+}
@@ -3,11 +3,60 @@ package peer
 
 // Peer is a discovered node within the cluster.
 type Peer struct {
-	Name  string // Name of the Peer. Unique across the cluster.
-	Addr  string // host:port address of the peer.
-	Self  bool   // True if Peer is the local Node.
-	State State  // State of the peer.
+	Name   string            // Name of the Peer. Unique across the cluster.
+	Addr   string            // host:port address of the peer.
+	Self   bool              // True if Peer is the local Node.
+	State  State             // State of the peer.
+	Labels map[string]string // Labels advertised by the peer. May be nil.
+	Weight int               // Relative capacity of the peer for sharding. 0 is treated as 1.
+
+	// AvailabilityZone of the peer, if known. May be empty.
+	AvailabilityZone string
+
+	// Roles advertised by the peer, sorted by name. May be nil.
+	Roles []string
+
+	// Application version of the peer, if known. May be empty.
+	Version string
 }
 
 // String returns the name of p.
 func (p Peer) String() string { return p.Name }
+
+// Equal returns true if p and o are identical.
+func (p Peer) Equal(o Peer) bool {
+	if p.Name != o.Name || p.Addr != o.Addr || p.Self != o.Self ||
+		p.State != o.State || p.Weight != o.Weight ||
+		p.AvailabilityZone != o.AvailabilityZone || p.Version != o.Version {
+		return false
+	}
+
+	if len(p.Labels) != len(o.Labels) {
+		return false
+	}
+	for k, v := range p.Labels {
+		if ov, ok := o.Labels[k]; !ok || ov != v {
+			return false
+		}
+	}
+
+	if len(p.Roles) != len(o.Roles) {
+		return false
+	}
+	for i := range p.Roles {
+		if p.Roles[i] != o.Roles[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasRole returns true if p advertises the given role.
+func (p Peer) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
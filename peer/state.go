@@ -1,6 +1,10 @@
 package peer
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
 
 // State is used by Nodes to inform their peers what their role is as part of
 // gossip.
@@ -20,13 +24,88 @@ const (
 	// Terminating nodes are considered potential owners while hashing read
 	// operations.
 	StateTerminating
+
+	// StateDraining is used when a Participant node is handing off ownership
+	// of its keys before terminating. Like Terminating nodes, Draining nodes
+	// are considered potential owners while hashing read operations.
+	StateDraining
 )
 
-// AllStates holds a list of all valid states.
+// MinCustomState is the lowest value that may be used for a custom State
+// registered with RegisterState. States with lower values are reserved for
+// ckit.
+const MinCustomState State = 32
+
+// AllStates holds a list of all valid built-in states. Call States to also
+// retrieve custom states.
 var AllStates = [...]State{
 	StateViewer,
 	StateParticipant,
 	StateTerminating,
+	StateDraining,
+}
+
+var (
+	customStatesMut sync.RWMutex
+	customStates    = map[State]string{}
+)
+
+// RegisterState registers a custom State with the given name. Custom states
+// allow applications to define roles beyond the built-in states, such as a
+// read-only or warming phase.
+//
+// Nodes only permit transitions between custom states which have been
+// explicitly allowed; see ckit.Config.StateTransitions. Sharders only assign
+// ownership to custom states when configured with an eligibility predicate
+// which accepts them.
+//
+// RegisterState panics if s is less than MinCustomState or if s or name has
+// already been registered. It should be called during program initialization,
+// and every node in the cluster must register the same custom states.
+func RegisterState(s State, name string) {
+	if s < MinCustomState {
+		panic(fmt.Sprintf("custom state %d must not be less than %d", s, MinCustomState))
+	}
+
+	customStatesMut.Lock()
+	defer customStatesMut.Unlock()
+
+	if existing, ok := customStates[s]; ok {
+		panic(fmt.Sprintf("state %d already registered as %q", s, existing))
+	}
+	for _, existing := range customStates {
+		if existing == name {
+			panic(fmt.Sprintf("state name %q already registered", name))
+		}
+	}
+	customStates[s] = name
+}
+
+// States returns all built-in and custom states, sorted by value.
+func States() []State {
+	customStatesMut.RLock()
+	defer customStatesMut.RUnlock()
+
+	res := make([]State, 0, len(AllStates)+len(customStates))
+	res = append(res, AllStates[:]...)
+	for s := range customStates {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// Valid returns true if s is a built-in state or a registered custom state.
+func (s State) Valid() bool {
+	switch s {
+	case StateViewer, StateParticipant, StateTerminating, StateDraining:
+		return true
+	}
+
+	customStatesMut.RLock()
+	defer customStatesMut.RUnlock()
+	_, ok := customStates[s]
+	return ok
 }
 
 // String returns the string representation of s.
@@ -38,7 +117,14 @@ func (s State) String() string {
 		return "participant"
 	case StateTerminating:
 		return "terminating"
-	default:
-		return fmt.Sprintf("<unknown state %d>", s)
+	case StateDraining:
+		return "draining"
+	}
+
+	customStatesMut.RLock()
+	defer customStatesMut.RUnlock()
+	if name, ok := customStates[s]; ok {
+		return name
 	}
+	return fmt.Sprintf("<unknown state %d>", s)
 }
@@ -0,0 +1,88 @@
+package ckit
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rfratto/ckit/peer"
+)
+
+// A PeersOption filters the peers returned by Node.Peers.
+type PeersOption func(*peersOptions)
+
+type peersOptions struct {
+	states     map[peer.State]struct{}
+	prefix     string
+	startAfter string
+	limit      int
+}
+
+// WithStates only returns peers which are in one of the provided states.
+func WithStates(states ...peer.State) PeersOption {
+	return func(o *peersOptions) {
+		if o.states == nil {
+			o.states = make(map[peer.State]struct{}, len(states))
+		}
+		for _, s := range states {
+			o.states[s] = struct{}{}
+		}
+	}
+}
+
+// WithNamePrefix only returns peers whose name starts with prefix.
+func WithNamePrefix(prefix string) PeersOption {
+	return func(o *peersOptions) { o.prefix = prefix }
+}
+
+// WithStartAfter only returns peers whose name sorts after name. Combined
+// with WithLimit, WithStartAfter can be used to paginate through peers by
+// passing the name of the last peer from the previous page.
+func WithStartAfter(name string) PeersOption {
+	return func(o *peersOptions) { o.startAfter = name }
+}
+
+// WithLimit returns at most n peers. Values less than 1 are ignored.
+func WithLimit(n int) PeersOption {
+	return func(o *peersOptions) { o.limit = n }
+}
+
+// FilterPeers returns the subset of peers which match opts, in the same way
+// as Node.Peers. peers must be sorted by name. FilterPeers is useful for
+// implementing Cluster.
+func FilterPeers(peers []peer.Peer, opts ...PeersOption) []peer.Peer {
+	return filterPeers(peers, opts)
+}
+
+// filterPeers returns the subset of peers which match opts. peers must be
+// sorted by name.
+func filterPeers(peers []peer.Peer, opts []PeersOption) []peer.Peer {
+	var o peersOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// peers is sorted by name, so the first candidate can be found with a
+	// binary search rather than scanning the entire slice.
+	idx := sort.Search(len(peers), func(i int) bool {
+		name := peers[i].Name
+		return name >= o.prefix && (o.startAfter == "" || name > o.startAfter)
+	})
+
+	res := make([]peer.Peer, 0)
+	for _, p := range peers[idx:] {
+		if o.limit > 0 && len(res) >= o.limit {
+			break
+		}
+		if !strings.HasPrefix(p.Name, o.prefix) {
+			// No other peers can match the prefix.
+			break
+		}
+		if o.states != nil {
+			if _, ok := o.states[p.State]; !ok {
+				continue
+			}
+		}
+		res = append(res, p)
+	}
+	return res
+}
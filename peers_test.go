@@ -0,0 +1,70 @@
+package ckit
+
+import (
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterPeers(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "ingester-0", State: peer.StateParticipant},
+		{Name: "ingester-1", State: peer.StateViewer},
+		{Name: "ingester-2", State: peer.StateParticipant},
+		{Name: "querier-0", State: peer.StateParticipant},
+		{Name: "querier-1", State: peer.StateTerminating},
+	}
+
+	tt := []struct {
+		name   string
+		opts   []PeersOption
+		expect []string
+	}{
+		{
+			name:   "states",
+			opts:   []PeersOption{WithStates(peer.StateViewer, peer.StateTerminating)},
+			expect: []string{"ingester-1", "querier-1"},
+		},
+		{
+			name:   "name prefix",
+			opts:   []PeersOption{WithNamePrefix("querier-")},
+			expect: []string{"querier-0", "querier-1"},
+		},
+		{
+			name:   "prefix and states",
+			opts:   []PeersOption{WithNamePrefix("ingester-"), WithStates(peer.StateParticipant)},
+			expect: []string{"ingester-0", "ingester-2"},
+		},
+		{
+			name:   "first page",
+			opts:   []PeersOption{WithLimit(2)},
+			expect: []string{"ingester-0", "ingester-1"},
+		},
+		{
+			name:   "next page",
+			opts:   []PeersOption{WithStartAfter("ingester-1"), WithLimit(2)},
+			expect: []string{"ingester-2", "querier-0"},
+		},
+		{
+			name:   "start after prefix",
+			opts:   []PeersOption{WithNamePrefix("ingester-"), WithStartAfter("querier-0")},
+			expect: []string{},
+		},
+		{
+			name:   "no matches",
+			opts:   []PeersOption{WithNamePrefix("distributor-")},
+			expect: []string{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			names := make([]string, 0)
+			for _, p := range filterPeers(peers, tc.opts) {
+				names = append(names, p.Name)
+			}
+			require.Equal(t, tc.expect, names)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package ckit
+
+import "github.com/rfratto/ckit/peer"
+
+// HasQuorum returns true if a majority of an expected cluster size of
+// Participants is visible to n. expected is typically the number of
+// Participants the cluster is intended to have.
+//
+// HasQuorum only reflects the local view of the cluster. During a network
+// partition, at most one side of the partition can have quorum.
+func (n *Node) HasQuorum(expected int) bool {
+	return hasQuorum(n.Peers(), expected)
+}
+
+// QuorumSize returns the minimum number of Participants required for quorum in
+// a cluster of the expected size.
+func QuorumSize(expected int) int {
+	return expected/2 + 1
+}
+
+func hasQuorum(peers []peer.Peer, expected int) bool {
+	var participants int
+	for _, p := range peers {
+		if p.State == peer.StateParticipant {
+			participants++
+		}
+	}
+	return participants >= QuorumSize(expected)
+}
+
+// QuorumObserver returns an Observer which invokes f whenever quorum is gained
+// or lost for a cluster of the expected size. f is invoked with the initial
+// quorum status on the first notification.
+//
+// If f returns false, the Observer will no longer receive any
+// notifications.
+func QuorumObserver(expected int, f func(hasQuorum bool) (reregister bool)) Observer {
+	return &quorumObserver{expected: expected, f: f}
+}
+
+type quorumObserver struct {
+	expected int
+	f        func(hasQuorum bool) (reregister bool)
+
+	notified bool
+	last     bool
+}
+
+func (qo *quorumObserver) NotifyPeersChanged(peers []peer.Peer) (reregister bool) {
+	quorum := hasQuorum(peers, qo.expected)
+	if qo.notified && quorum == qo.last {
+		return true
+	}
+	qo.notified, qo.last = true, quorum
+	return qo.f(quorum)
+}
@@ -0,0 +1,31 @@
+package ckit
+
+import (
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuorumObserver(t *testing.T) {
+	var (
+		participant = func(name string) peer.Peer {
+			return peer.Peer{Name: name, State: peer.StateParticipant}
+		}
+
+		received []bool
+	)
+
+	obs := QuorumObserver(3, func(hasQuorum bool) bool {
+		received = append(received, hasQuorum)
+		return true
+	})
+
+	obs.NotifyPeersChanged([]peer.Peer{participant("a")})
+	obs.NotifyPeersChanged([]peer.Peer{participant("a"), {Name: "b"}})
+	obs.NotifyPeersChanged([]peer.Peer{participant("a"), participant("b")})
+	obs.NotifyPeersChanged([]peer.Peer{participant("a"), participant("b"), participant("c")})
+	obs.NotifyPeersChanged([]peer.Peer{participant("a")})
+
+	require.Equal(t, []bool{false, true, false}, received)
+}
@@ -0,0 +1,212 @@
+package ckit
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/internal/unicastpb"
+	"github.com/rfratto/ckit/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// defaultReachabilityProbeSample is the default value of
+// Config.ReachabilityProbeSample.
+const defaultReachabilityProbeSample = 3
+
+// PeerReachable returns whether the most recent reachability probe to the
+// peer with the given name succeeded. ok will be false if the peer hasn't
+// been probed yet or Config.ReachabilityProbeInterval isn't set.
+func (n *Node) PeerReachable(name string) (reachable, ok bool) {
+	n.reachMut.Lock()
+	defer n.reachMut.Unlock()
+
+	reachable, ok = n.reachable[name]
+	return reachable, ok
+}
+
+// SuspectedPartition returns true if reachability probes suggest that n is
+// partitioned from part of the cluster: more than one peer (or every peer,
+// in a cluster with only one remote peer) which is still a member of the
+// cluster according to gossip failed its most recent reachability probe.
+//
+// A partition can only be suspected when Config.ReachabilityProbeInterval is
+// set.
+func (n *Node) SuspectedPartition() bool {
+	n.reachMut.Lock()
+	defer n.reachMut.Unlock()
+	return suspectedPartition(n.reachable)
+}
+
+func suspectedPartition(reachable map[string]bool) bool {
+	var unreachable int
+	for _, ok := range reachable {
+		if !ok {
+			unreachable++
+		}
+	}
+	return unreachable > 1 || (unreachable == 1 && len(reachable) == 1)
+}
+
+// runReachability probes a random sample of remote peers every
+// cfg.ReachabilityProbeInterval.
+//
+// runReachability exits when ctx is canceled.
+func (n *Node) runReachability(ctx context.Context) {
+	t := time.NewTicker(n.cfg.ReachabilityProbeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n.probeReachability(ctx)
+	}
+}
+
+// probeReachability probes a random sample of remote peers and records the
+// results. Peers which are no longer members of the cluster are forgotten.
+func (n *Node) probeReachability(ctx context.Context) {
+	var remote []peer.Peer
+	for _, p := range n.Peers() {
+		if !p.Self {
+			remote = append(remote, p)
+		}
+	}
+
+	sample := n.cfg.ReachabilityProbeSample
+	if sample <= 0 {
+		sample = defaultReachabilityProbeSample
+	}
+	rand.Shuffle(len(remote), func(i, j int) { remote[i], remote[j] = remote[j], remote[i] })
+	if len(remote) < sample {
+		sample = len(remote)
+	}
+
+	timeout := n.cfg.ReachabilityProbeInterval / 2
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]bool, sample)
+	)
+	for i, p := range remote[:sample] {
+		wg.Add(1)
+		go func(i int, p peer.Peer) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			err := n.probePeer(probeCtx, p.Addr)
+			if err != nil {
+				level.Debug(n.log).Log("msg", "reachability probe failed", "peer", p.Name, "err", err)
+				n.m.reachabilityProbesTotal.WithLabelValues("failure").Inc()
+			} else {
+				n.m.reachabilityProbesTotal.WithLabelValues("success").Inc()
+			}
+			results[i] = err == nil
+		}(i, p)
+	}
+	wg.Wait()
+
+	// Don't record results if n is stopping; probes will have been canceled.
+	if ctx.Err() != nil {
+		return
+	}
+
+	members := make(map[string]struct{}, len(remote))
+	for _, p := range remote {
+		members[p.Name] = struct{}{}
+	}
+
+	n.reachMut.Lock()
+	defer n.reachMut.Unlock()
+
+	for name := range n.reachable {
+		if _, ok := members[name]; !ok {
+			delete(n.reachable, name)
+		}
+	}
+	for i, p := range remote[:sample] {
+		n.reachable[p.Name] = results[i]
+	}
+
+	partitioned := suspectedPartition(n.reachable)
+	if partitioned && !n.partitioned {
+		level.Warn(n.log).Log("msg", "peers are unreachable over gRPC while still cluster members; partition suspected")
+	} else if !partitioned && n.partitioned {
+		level.Info(n.log).Log("msg", "suspected partition resolved")
+	}
+	n.partitioned = partitioned
+}
+
+// probePeer sends a reachability probe to the peer at addr. Peers running
+// a version of ckit which doesn't support probes are treated as reachable.
+func (n *Node) probePeer(ctx context.Context, addr string) error {
+	cc, err := n.cfg.Pool.Get(ctx, addr)
+	if err != nil {
+		return err
+	}
+	_, err = unicastpb.NewMessengerClient(cc).Probe(ctx, &emptypb.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	return err
+}
+
+// reachabilityCollector exposes the results of reachability probes as
+// metrics.
+type reachabilityCollector struct {
+	n *Node
+
+	reachableDesc   *prometheus.Desc
+	partitionedDesc *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*reachabilityCollector)(nil)
+
+func newReachabilityCollector(n *Node) *reachabilityCollector {
+	return &reachabilityCollector{
+		n: n,
+
+		reachableDesc: prometheus.NewDesc(
+			"cluster_node_peer_reachable",
+			"1 if the most recent reachability probe to a peer succeeded, 0 otherwise.",
+			[]string{"peer"}, nil,
+		),
+		partitionedDesc: prometheus.NewDesc(
+			"cluster_node_suspected_partition",
+			"1 if reachability probes suggest the node is partitioned from part of the cluster.",
+			nil, nil,
+		),
+	}
+}
+
+func (rc *reachabilityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.reachableDesc
+	ch <- rc.partitionedDesc
+}
+
+func (rc *reachabilityCollector) Collect(ch chan<- prometheus.Metric) {
+	rc.n.reachMut.Lock()
+	defer rc.n.reachMut.Unlock()
+
+	for name, ok := range rc.n.reachable {
+		ch <- prometheus.MustNewConstMetric(rc.reachableDesc, prometheus.GaugeValue, boolToFloat(ok), name)
+	}
+	ch <- prometheus.MustNewConstMetric(rc.partitionedDesc, prometheus.GaugeValue, boolToFloat(suspectedPartition(rc.n.reachable)))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
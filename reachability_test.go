@@ -0,0 +1,77 @@
+package ckit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_Reachability(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name:                      "node-a",
+			ReachabilityProbeInterval: 100 * time.Millisecond,
+		})
+	)
+
+	newPeer := func(name string) (n *Node, stop func()) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		n, _, srv := newTestNodeWithListener(t, l, lis, Config{Name: name})
+		require.NoError(t, n.Start([]string{aAddr}))
+		return n, func() {
+			// Simulate the peer becoming unreachable without leaving the
+			// cluster, so a has to notice through probes or failure detection.
+			srv.Stop()
+			require.NoError(t, n.memberlist().Shutdown())
+		}
+	}
+
+	runTestNode(t, a, nil)
+	_, stopB := newPeer("node-b")
+	_, stopC := newPeer("node-c")
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 3
+	})
+
+	require.Eventually(t, func() bool {
+		bOK, _ := a.PeerReachable("node-b")
+		cOK, _ := a.PeerReachable("node-c")
+		return bOK && cOK
+	}, 5*time.Second, 50*time.Millisecond)
+	require.False(t, a.SuspectedPartition())
+
+	stopB()
+	require.Eventually(t, func() bool {
+		ok, known := a.PeerReachable("node-b")
+		return known && !ok
+	}, 5*time.Second, 50*time.Millisecond)
+	require.False(t, a.SuspectedPartition(), "a single unreachable peer should not be a partition")
+
+	stopC()
+	require.Eventually(t, a.SuspectedPartition, 5*time.Second, 50*time.Millisecond)
+}
+
+func Test_suspectedPartition(t *testing.T) {
+	tt := []struct {
+		name      string
+		reachable map[string]bool
+		expect    bool
+	}{
+		{"no peers", nil, false},
+		{"all reachable", map[string]bool{"a": true, "b": true}, false},
+		{"one of many unreachable", map[string]bool{"a": false, "b": true, "c": true}, false},
+		{"only peer unreachable", map[string]bool{"a": false}, true},
+		{"several unreachable", map[string]bool{"a": false, "b": false, "c": true}, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, suspectedPartition(tc.reachable))
+		})
+	}
+}
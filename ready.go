@@ -0,0 +1,108 @@
+package ckit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rfratto/ckit/peer"
+)
+
+// ErrNotStarted is returned by Ready when the Node hasn't been started.
+var ErrNotStarted = errors.New("node not started")
+
+// ReadinessPolicy configures the conditions checked by Node.Ready. A Node
+// must always be started to be ready; other conditions are only checked when
+// set.
+type ReadinessPolicy struct {
+	// RequireJoined requires the Node to know about at least one remote peer.
+	RequireJoined bool
+
+	// ConvergeWindow requires no membership changes to have been observed
+	// for at least this long. See Node.WaitConverged.
+	ConvergeWindow time.Duration
+
+	// MinParticipants requires at least this many peers in StateParticipant
+	// to be known, including the local Node.
+	MinParticipants int
+}
+
+func (p ReadinessPolicy) validate() error {
+	if p.ConvergeWindow < 0 {
+		return fmt.Errorf("converge window must not be negative")
+	}
+	if p.MinParticipants < 0 {
+		return fmt.Errorf("minimum participants must not be negative")
+	}
+	return nil
+}
+
+// Ready returns nil if n satisfies Config.Readiness, otherwise an error
+// describing the first unmet condition. Ready is cheap to call and is
+// intended to back readiness probes; see ReadyHandler.
+//
+// Ready only reflects the local view of the cluster.
+func (n *Node) Ready() error {
+	n.stateMut.RLock()
+	var (
+		stopped = n.stopped
+		started = n.runCancel != nil
+	)
+	n.stateMut.RUnlock()
+
+	switch {
+	case stopped:
+		return ErrStopped
+	case !started:
+		return ErrNotStarted
+	}
+
+	n.peerMut.RLock()
+	var (
+		peers      = n.peerCache
+		lastChange = n.peersTime
+	)
+	n.peerMut.RUnlock()
+
+	policy := n.cfg.Readiness
+
+	if policy.RequireJoined && len(peers) < 2 {
+		return fmt.Errorf("no peers joined")
+	}
+
+	if window := policy.ConvergeWindow; window > 0 {
+		if since := time.Since(lastChange); since < window {
+			return fmt.Errorf("membership changed %s ago; waiting for %s without changes", since.Round(time.Millisecond), window)
+		}
+	}
+
+	if policy.MinParticipants > 0 {
+		var participants int
+		for _, p := range peers {
+			if p.State == peer.StateParticipant {
+				participants++
+			}
+		}
+		if participants < policy.MinParticipants {
+			return fmt.Errorf("%d of %d required participants present", participants, policy.MinParticipants)
+		}
+	}
+
+	return nil
+}
+
+// ReadyHandler returns an http.Handler which responds with 200 OK if Ready
+// returns nil, and 503 Service Unavailable with the reason otherwise.
+// ReadyHandler can be used directly as a Kubernetes readiness probe.
+func (n *Node) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := n.Ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+}
@@ -0,0 +1,60 @@
+package ckit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_Ready(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNodeWithConfig(t, l, Config{
+			Name: "node-a",
+			Readiness: ReadinessPolicy{
+				RequireJoined:   true,
+				ConvergeWindow:  250 * time.Millisecond,
+				MinParticipants: 2,
+			},
+		})
+		b, _ = newTestNode(t, l, "node-b")
+	)
+
+	require.ErrorIs(t, a.Ready(), ErrNotStarted)
+
+	runTestNode(t, a, nil)
+	require.EqualError(t, a.Ready(), "no peers joined")
+
+	runTestNode(t, b, []string{aAddr})
+	waitClusterState(t, a, func(n *Node) bool {
+		return len(n.Peers()) == 2
+	})
+	require.Contains(t, a.Ready().Error(), "membership changed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, a.WaitConverged(ctx, 250*time.Millisecond))
+	require.EqualError(t, a.Ready(), "0 of 2 required participants present")
+
+	rec := httptest.NewRecorder()
+	a.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "not ready: 0 of 2 required participants present\n", rec.Body.String())
+
+	require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+	require.NoError(t, b.ChangeState(ctx, peer.StateParticipant))
+	require.Eventually(t, func() bool {
+		return a.Ready() == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	a.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,229 @@
+// Package rollout coordinates rolling restarts across a cluster using the
+// labels gossiped by a ckit Node.
+//
+// Before restarting, a Node calls Acquire to request the restart slot. The
+// request is advertised to peers with the LabelSlot label, and Acquire
+// blocks until the local Node holds the slot: the holder is the peer with
+// the oldest request, breaking ties by peer name. Once the slot is held,
+// Acquire gracefully removes the Node from the cluster so it can be
+// restarted.
+//
+// The slot is released when the restarted Node rejoins the cluster without
+// the LabelSlot label, or when the Node is removed from the cluster entirely.
+// Call Release to abandon a request without restarting.
+//
+// Because requests are gossiped, two peers may briefly disagree on which peer
+// holds the slot. Acquire waits for the request to settle before returning,
+// but the slot should only be used to limit disruption, not for operations
+// which require strict mutual exclusion.
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+)
+
+// LabelSlot is the label used to request the restart slot. The label value
+// is the lamport time the slot was requested at.
+const LabelSlot = "ckit.rollout/slot"
+
+// DefaultSettleTime is the default value for Options.SettleTime.
+const DefaultSettleTime = 5 * time.Second
+
+// Node is the subset of methods from *ckit.Node used for coordinating
+// restarts.
+type Node interface {
+	ClockTime() uint64
+	CurrentState() peer.State
+	Labels() map[string]string
+	ModifyLabels(ctx context.Context, f func(labels map[string]string)) error
+	Leave(ctx context.Context) error
+	Observe(o ckit.Observer) (unsubscribe func())
+	Peers(opts ...ckit.PeersOption) []peer.Peer
+}
+
+var _ Node = (*ckit.Node)(nil)
+
+// Options configures Acquire.
+type Options struct {
+	// SettleTime is how long the local Node must continuously hold the slot
+	// before Acquire returns, giving time for requests from other peers to
+	// be gossiped. Defaults to DefaultSettleTime.
+	SettleTime time.Duration
+}
+
+// Acquire requests the restart slot and blocks until the local Node holds
+// it or ctx is canceled. Once the slot is held, Acquire calls Leave to move a
+// Participant or Draining Node into StateTerminating. The caller should then
+// stop and restart the Node.
+//
+// If Acquire fails, the request for the slot is withdrawn.
+func Acquire(ctx context.Context, node Node, opts Options) (err error) {
+	if opts.SettleTime <= 0 {
+		opts.SettleTime = DefaultSettleTime
+	}
+
+	notify := make(chan struct{}, 1)
+	unsubscribe := node.Observe(ckit.FuncObserver(func([]peer.Peer) (reregister bool) {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+		return true
+	}))
+	defer unsubscribe()
+
+	request := strconv.FormatUint(node.ClockTime(), 10)
+	if err := setSlotLabel(ctx, node, request); err != nil {
+		return fmt.Errorf("failed to request restart slot: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// ctx may already be canceled, so use a new context to withdraw the
+		// request.
+		releaseCtx, cancel := context.WithTimeout(context.Background(), opts.SettleTime)
+		defer cancel()
+		_ = Release(releaseCtx, node)
+	}()
+
+	if err := waitSlot(ctx, node, request, opts.SettleTime, notify); err != nil {
+		return err
+	}
+
+	switch node.CurrentState() {
+	case peer.StateParticipant, peer.StateDraining:
+		if err := node.Leave(ctx); err != nil {
+			return fmt.Errorf("failed to leave cluster: %w", err)
+		}
+	}
+	return nil
+}
+
+// waitSlot waits until the local node has held the slot for settleTime.
+func waitSlot(ctx context.Context, node Node, request string, settleTime time.Duration, notify <-chan struct{}) error {
+	var (
+		settle  *time.Timer
+		settled <-chan time.Time
+	)
+	defer func() {
+		if settle != nil {
+			settle.Stop()
+		}
+	}()
+
+	for {
+		holding := holdsSlot(node, request)
+		switch {
+		case holding && settle == nil:
+			settle = time.NewTimer(settleTime)
+			settled = settle.C
+		case !holding && settle != nil:
+			settle.Stop()
+			settle, settled = nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		case <-settled:
+			if holdsSlot(node, request) {
+				return nil
+			}
+			settle, settled = nil, nil
+		}
+	}
+}
+
+// holdsSlot returns true if the local node holds the slot with the given
+// request.
+func holdsSlot(node Node, request string) bool {
+	peers := node.Peers()
+
+	// The local peer may not reflect our request yet, so always use our
+	// request for the local peer.
+	candidates := make([]peer.Peer, 0, len(peers)+1)
+	var self peer.Peer
+	for _, p := range peers {
+		if p.Self {
+			self = p
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	self.Self = true
+	self.Labels = map[string]string{LabelSlot: request}
+	candidates = append(candidates, self)
+
+	holder, ok := Holder(candidates)
+	return ok && holder.Self
+}
+
+// Holder returns the peer in peers which holds the restart slot. ok will be
+// false if no peer has requested the slot.
+func Holder(peers []peer.Peer) (holder peer.Peer, ok bool) {
+	var holderTime uint64
+
+	for _, p := range peers {
+		t, requested := requestTime(p)
+		if !requested {
+			continue
+		}
+
+		switch {
+		case !ok:
+			// First request.
+		case t < holderTime:
+			// Older request.
+		case t == holderTime && p.Name < holder.Name:
+			// Equally old request; break the tie by name.
+		default:
+			continue
+		}
+
+		holder, holderTime, ok = p, t, true
+	}
+
+	return holder, ok
+}
+
+// requestTime returns the time p requested the slot. Requests with invalid
+// times are ignored.
+func requestTime(p peer.Peer) (t uint64, ok bool) {
+	v, ok := p.Labels[LabelSlot]
+	if !ok {
+		return 0, false
+	}
+	t, err := strconv.ParseUint(v, 10, 64)
+	return t, err == nil
+}
+
+// Release withdraws the request for the restart slot made by Acquire, or
+// releases the slot if it is held. Release is only needed when a Node which
+// called Acquire will not be restarted.
+func Release(ctx context.Context, node Node) error {
+	if _, ok := node.Labels()[LabelSlot]; !ok {
+		return nil
+	}
+	return setSlotLabel(ctx, node, "")
+}
+
+// setSlotLabel sets the LabelSlot label of node to value, removing the label
+// if value is empty. Other labels are kept, including labels changed
+// concurrently.
+func setSlotLabel(ctx context.Context, node Node, value string) error {
+	return node.ModifyLabels(ctx, func(labels map[string]string) {
+		if value == "" {
+			delete(labels, LabelSlot)
+		} else {
+			labels[LabelSlot] = value
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package rollout
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolder(t *testing.T) {
+	tt := []struct {
+		name   string
+		peers  []peer.Peer
+		expect string // Empty for no holder
+	}{
+		{
+			name: "no requests",
+			peers: []peer.Peer{
+				{Name: "a"},
+				{Name: "b", Labels: map[string]string{"foo": "bar"}},
+			},
+			expect: "",
+		},
+		{
+			name: "oldest request",
+			peers: []peer.Peer{
+				{Name: "a", Labels: map[string]string{LabelSlot: "10"}},
+				{Name: "b", Labels: map[string]string{LabelSlot: "5"}},
+				{Name: "c"},
+			},
+			expect: "b",
+		},
+		{
+			name: "ties broken by name",
+			peers: []peer.Peer{
+				{Name: "b", Labels: map[string]string{LabelSlot: "5"}},
+				{Name: "a", Labels: map[string]string{LabelSlot: "5"}},
+			},
+			expect: "a",
+		},
+		{
+			name: "invalid requests ignored",
+			peers: []peer.Peer{
+				{Name: "a", Labels: map[string]string{LabelSlot: "invalid"}},
+				{Name: "b", Labels: map[string]string{LabelSlot: "20"}},
+			},
+			expect: "b",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			holder, ok := Holder(tc.peers)
+			if tc.expect == "" {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tc.expect, holder.Name)
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	node := newFakeNode("b", 20)
+	node.setPeers([]peer.Peer{
+		{Name: "a", State: peer.StateParticipant, Labels: map[string]string{LabelSlot: "10"}},
+	})
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- Acquire(context.Background(), node, Options{SettleTime: 50 * time.Millisecond})
+	}()
+
+	// node-a holds the slot, so Acquire must wait.
+	require.Eventually(t, func() bool {
+		_, requested := node.Labels()[LabelSlot]
+		return requested
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case err := <-acquired:
+		require.FailNow(t, "Acquire returned while another peer held the slot", "err: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// node-a restarts without the label, releasing the slot.
+	node.setPeers([]peer.Peer{{Name: "a", State: peer.StateParticipant}})
+
+	select {
+	case err := <-acquired:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Acquire did not return after the slot was released")
+	}
+	require.True(t, node.left(), "Acquire should leave the cluster")
+	require.Equal(t, "20", node.Labels()[LabelSlot])
+
+	require.NoError(t, Release(context.Background(), node))
+	require.NotContains(t, node.Labels(), LabelSlot)
+}
+
+func TestAcquire_Canceled(t *testing.T) {
+	node := newFakeNode("b", 20)
+	node.setPeers([]peer.Peer{
+		{Name: "a", State: peer.StateParticipant, Labels: map[string]string{LabelSlot: "10"}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := Acquire(ctx, node, Options{SettleTime: 50 * time.Millisecond})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotContains(t, node.Labels(), LabelSlot, "request should be withdrawn")
+	require.False(t, node.left())
+}
+
+type fakeNode struct {
+	mut       sync.Mutex
+	name      string
+	clock     uint64
+	labels    map[string]string
+	peers     []peer.Peer
+	observers []ckit.Observer
+	hasLeft   bool
+}
+
+var _ Node = (*fakeNode)(nil)
+
+func newFakeNode(name string, clock uint64) *fakeNode {
+	return &fakeNode{name: name, clock: clock}
+}
+
+func (fn *fakeNode) ClockTime() uint64 {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+	return fn.clock
+}
+
+func (fn *fakeNode) CurrentState() peer.State { return peer.StateParticipant }
+
+func (fn *fakeNode) Labels() map[string]string {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+	return fn.labels
+}
+
+func (fn *fakeNode) ModifyLabels(_ context.Context, f func(labels map[string]string)) error {
+	fn.mut.Lock()
+	labels := make(map[string]string, len(fn.labels)+1)
+	for k, v := range fn.labels {
+		labels[k] = v
+	}
+	f(labels)
+	fn.labels = labels
+	fn.mut.Unlock()
+
+	fn.notify()
+	return nil
+}
+
+func (fn *fakeNode) Leave(context.Context) error {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+	fn.hasLeft = true
+	return nil
+}
+
+func (fn *fakeNode) left() bool {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+	return fn.hasLeft
+}
+
+func (fn *fakeNode) Observe(o ckit.Observer) (unsubscribe func()) {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+	fn.observers = append(fn.observers, o)
+	return func() {}
+}
+
+func (fn *fakeNode) Peers(...ckit.PeersOption) []peer.Peer {
+	fn.mut.Lock()
+	defer fn.mut.Unlock()
+
+	self := peer.Peer{Name: fn.name, Self: true, State: peer.StateParticipant, Labels: fn.labels}
+	return append(append([]peer.Peer(nil), fn.peers...), self)
+}
+
+func (fn *fakeNode) setPeers(peers []peer.Peer) {
+	fn.mut.Lock()
+	fn.peers = peers
+	fn.mut.Unlock()
+
+	fn.notify()
+}
+
+func (fn *fakeNode) notify() {
+	peers := fn.Peers()
+
+	fn.mut.Lock()
+	observers := append([]ckit.Observer(nil), fn.observers...)
+	fn.mut.Unlock()
+
+	for _, o := range observers {
+		o.NotifyPeersChanged(peers)
+	}
+}
@@ -0,0 +1,103 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rfratto/ckit/internal/unicastpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// A RequestHandler handles a request sent directly to the local node with
+// Node.Send. from is the name of the peer which sent the request. The
+// returned response is sent back to the peer. If RequestHandler returns an
+// error, the error message is returned to the peer as an error from Send.
+type RequestHandler func(ctx context.Context, from string, payload []byte) (response []byte, err error)
+
+// Send sends payload directly to the peer with the given name and waits for
+// its response. Send connects to the peer over the client pool using the
+// peer's advertised address. The peer handles the request using the handler
+// registered with OnRequest.
+//
+// An error is returned if the peer is unknown, the peer has no
+// RequestHandler, or the peer's RequestHandler returned an error.
+func (n *Node) Send(ctx context.Context, peerName string, payload []byte) (response []byte, err error) {
+	var (
+		addr  string
+		found bool
+	)
+	for _, p := range n.Peers() {
+		if p.Name == peerName {
+			addr, found = p.Addr, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown peer %q", peerName)
+	}
+
+	cc, err := n.cfg.Pool.Get(ctx, addr)
+	if err != nil {
+		n.recordSend(peerName, false)
+		return nil, fmt.Errorf("failed to connect to peer %q: %w", peerName, err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, unicastpb.SenderKey, n.cfg.Name)
+	resp, err := unicastpb.NewMessengerClient(cc).Send(ctx, wrapperspb.Bytes(payload))
+
+	// Errors from the peer's RequestHandler mean the peer was reached.
+	n.recordSend(peerName, status.Code(err) != codes.Unavailable)
+	if err != nil {
+		return nil, fmt.Errorf("request to peer %q failed: %w", peerName, err)
+	}
+	return resp.GetValue(), nil
+}
+
+// OnRequest registers h to handle requests sent by peers with Send.
+// Registering a new handler replaces the previous one. Requests received
+// while no handler is registered fail with an error.
+func (n *Node) OnRequest(h RequestHandler) {
+	n.requestMut.Lock()
+	defer n.requestMut.Unlock()
+	n.requestHandler = h
+}
+
+// messengerServer implements unicastpb.MessengerServer for a Node.
+type messengerServer struct {
+	unicastpb.UnimplementedMessengerServer
+
+	n *Node
+}
+
+func (s *messengerServer) Send(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	s.n.requestMut.RLock()
+	h := s.n.requestHandler
+	s.n.requestMut.RUnlock()
+
+	if h == nil {
+		return nil, status.Error(codes.Unimplemented, "node does not handle requests")
+	}
+
+	var from string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(unicastpb.SenderKey); len(vals) > 0 {
+			from = vals[0]
+		}
+	}
+
+	resp, err := h(ctx, from, req.GetValue())
+	if err != nil {
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+	return wrapperspb.Bytes(resp), nil
+}
+
+// Probe responds to reachability probes from peers. See
+// Config.ReachabilityProbeInterval.
+func (s *messengerServer) Probe(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,105 @@
+package shard
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/peer"
+)
+
+// lookupCache is an LRU cache of lookup results. Cached results are
+// discarded whenever the peers of the Sharder change.
+type lookupCache struct {
+	size         int
+	hits, misses prometheus.Counter
+
+	mut     sync.Mutex
+	gen     uint64 // Generation of peers that entries were cached for
+	entries map[lookupCacheKey]*list.Element
+	lru     *list.List // Most recently used entries are at the front
+}
+
+type lookupCacheKey struct {
+	key       Key
+	numOwners int
+	op        Op
+}
+
+type lookupCacheEntry struct {
+	key   lookupCacheKey
+	peers []peer.Peer
+}
+
+func newLookupCache(size int, constLabels prometheus.Labels) *lookupCache {
+	return &lookupCache{
+		size: size,
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "shard_lookup_cache_hits_total",
+			Help:        "Total number of lookups served from the lookup cache.",
+			ConstLabels: constLabels,
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "shard_lookup_cache_misses_total",
+			Help:        "Total number of lookups which weren't found in the lookup cache.",
+			ConstLabels: constLabels,
+		}),
+
+		entries: make(map[lookupCacheKey]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached result for k, if one exists for the
+// generation of peers gen.
+func (c *lookupCache) get(gen uint64, k lookupCacheKey) ([]peer.Peer, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.checkGen(gen)
+
+	elem, ok := c.entries[k]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(elem)
+
+	cached := elem.Value.(*lookupCacheEntry).peers
+	return append(make([]peer.Peer, 0, len(cached)), cached...), true
+}
+
+// put caches a copy of peers as the result for k, evicting the least
+// recently used entry if the cache is full.
+func (c *lookupCache) put(gen uint64, k lookupCacheKey, peers []peer.Peer) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.checkGen(gen)
+
+	peers = append(make([]peer.Peer, 0, len(peers)), peers...)
+	if elem, ok := c.entries[k]; ok {
+		elem.Value.(*lookupCacheEntry).peers = peers
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupCacheEntry).key)
+	}
+	c.entries[k] = c.lru.PushFront(&lookupCacheEntry{key: k, peers: peers})
+}
+
+// checkGen discards all entries if they were cached for a different
+// generation of peers than gen. Must be called with c.mut held.
+func (c *lookupCache) checkGen(gen uint64) {
+	if c.gen == gen {
+		return
+	}
+	c.gen = gen
+	c.entries = make(map[lookupCacheKey]*list.Element, c.size)
+	c.lru.Init()
+}
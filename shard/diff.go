@@ -0,0 +1,235 @@
+package shard
+
+import (
+	"math"
+	"sort"
+
+	"github.com/rfratto/ckit/peer"
+)
+
+// A KeySampler returns a sample of keys representing the keyspace.
+type KeySampler func() []Key
+
+// UniformKeys returns a KeySampler which returns n keys spread evenly across
+// the entire keyspace. UniformKeys is a good default for hashes with keys
+// generated by KeyBuilder or StringKey, which are uniformly distributed.
+func UniformKeys(n int) KeySampler {
+	return func() []Key {
+		if n < 1 {
+			return nil
+		}
+		var (
+			keys = make([]Key, n)
+			step = math.MaxUint64 / uint64(n)
+		)
+		for i := range keys {
+			keys[i] = Key(uint64(i) * step)
+		}
+		return keys
+	}
+}
+
+// SampleKeys returns a KeySampler which always returns keys, such as a
+// sample of keys known to be used by an application.
+func SampleKeys(keys ...Key) KeySampler {
+	return func() []Key { return keys }
+}
+
+// OwnershipDiff describes how ownership of the keyspace changes between two
+// sets of peers.
+type OwnershipDiff struct {
+	// Moved is the fraction of sampled keys whose owner changed, from 0 to 1.
+	Moved float64
+
+	// Movements describes which peers keys moved between, sorted by From and
+	// then To. Movements for keys which didn't change owners are excluded.
+	Movements []Movement
+}
+
+// Movement is a fraction of the keyspace which moved from one peer to
+// another. From or To are empty if keys didn't have an owner before or after
+// the change, such as when no peers were eligible.
+type Movement struct {
+	From, To string
+	Fraction float64 // Fraction of the sampled keys, from 0 to 1.
+}
+
+// Diff predicts how ownership of the keyspace changes when the set of peers
+// changes from oldPeers to newPeers, without modifying a running Sharder.
+// newSharder must return a new, empty Sharder configured the same way as the
+// Sharder being changed; it's called once for each set of peers.
+//
+// Ownership is determined by the first owner of each key returned by
+// sampler for OpReadWrite.
+func Diff(newSharder func() Sharder, oldPeers, newPeers []peer.Peer, sampler KeySampler) OwnershipDiff {
+	keys := sampler()
+	if len(keys) == 0 {
+		return OwnershipDiff{}
+	}
+	return diffOwners(
+		primaryOwners(newSharder, oldPeers, keys),
+		primaryOwners(newSharder, newPeers, keys),
+	)
+}
+
+// diffOwners compares the primary owners of the same keys before and after a
+// change.
+func diffOwners(oldOwners, newOwners []string) OwnershipDiff {
+	var (
+		moved  int
+		counts = make(map[Movement]int)
+	)
+	for i := range oldOwners {
+		from, to := oldOwners[i], newOwners[i]
+		if from == to {
+			continue
+		}
+		moved++
+		counts[Movement{From: from, To: to}]++
+	}
+
+	diff := OwnershipDiff{
+		Moved:     float64(moved) / float64(len(oldOwners)),
+		Movements: make([]Movement, 0, len(counts)),
+	}
+	for m, count := range counts {
+		m.Fraction = float64(count) / float64(len(oldOwners))
+		diff.Movements = append(diff.Movements, m)
+	}
+	sort.Slice(diff.Movements, func(i, j int) bool {
+		a, b := diff.Movements[i], diff.Movements[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return diff
+}
+
+// ChurnReport describes how ownership of the keyspace changed across a
+// sequence of sets of peers.
+type ChurnReport struct {
+	// Steps describes each change: Steps[i] is the diff from the ith set of
+	// peers to the next.
+	Steps []OwnershipDiff
+
+	// Moved is the fraction of sampled keys which changed owners, summed
+	// across every step. Moved may be greater than 1 if keys moved multiple
+	// times.
+	Moved float64
+
+	// Peers is the churn of each peer which owned keys at any step, sorted
+	// by name.
+	Peers []PeerChurn
+}
+
+// PeerChurn describes how much of the keyspace a peer gained and lost across
+// a sequence of changes. Fractions are of the sampled keys, from 0 to 1.
+type PeerChurn struct {
+	Name string
+
+	// Gained[i] and Lost[i] are the fractions of the keyspace which the peer
+	// gained and lost in step i.
+	Gained, Lost []float64
+
+	// TotalGained and TotalLost are the sums of Gained and Lost.
+	TotalGained, TotalLost float64
+}
+
+// Churn reports how ownership of the keyspace changes across a sequence of
+// sets of peers, such as to plan capacity for expected membership changes or
+// to compare how much data different hashing algorithms move. peerSets must
+// be in order; each consecutive pair of sets is one step. newSharder must
+// return a new, empty Sharder; it's called once for each set of peers.
+//
+// Like Diff, ownership is determined by the first owner of each key returned
+// by sampler for OpReadWrite.
+func Churn(newSharder func() Sharder, peerSets [][]peer.Peer, sampler KeySampler) ChurnReport {
+	keys := sampler()
+	if len(keys) == 0 || len(peerSets) < 2 {
+		return ChurnReport{}
+	}
+
+	var (
+		report = ChurnReport{Steps: make([]OwnershipDiff, 0, len(peerSets)-1)}
+		churn  = make(map[string]*PeerChurn)
+		steps  = len(peerSets) - 1
+	)
+	getChurn := func(name string) *PeerChurn {
+		pc, ok := churn[name]
+		if !ok {
+			pc = &PeerChurn{
+				Name:   name,
+				Gained: make([]float64, steps),
+				Lost:   make([]float64, steps),
+			}
+			churn[name] = pc
+		}
+		return pc
+	}
+
+	prev := primaryOwners(newSharder, peerSets[0], keys)
+	for _, owner := range prev {
+		if owner != "" {
+			getChurn(owner)
+		}
+	}
+
+	for step, peers := range peerSets[1:] {
+		cur := primaryOwners(newSharder, peers, keys)
+		diff := diffOwners(prev, cur)
+		report.Steps = append(report.Steps, diff)
+		report.Moved += diff.Moved
+
+		for _, owner := range cur {
+			if owner != "" {
+				getChurn(owner)
+			}
+		}
+		for _, m := range diff.Movements {
+			if m.From != "" {
+				getChurn(m.From).Lost[step] += m.Fraction
+			}
+			if m.To != "" {
+				getChurn(m.To).Gained[step] += m.Fraction
+			}
+		}
+		prev = cur
+	}
+
+	report.Peers = make([]PeerChurn, 0, len(churn))
+	for _, pc := range churn {
+		for step := range pc.Gained {
+			pc.TotalGained += pc.Gained[step]
+			pc.TotalLost += pc.Lost[step]
+		}
+		report.Peers = append(report.Peers, *pc)
+	}
+	sort.Slice(report.Peers, func(i, j int) bool { return report.Peers[i].Name < report.Peers[j].Name })
+	return report
+}
+
+// primaryOwners returns the primary owner of each key in a new Sharder with
+// the provided peers.
+func primaryOwners(newSharder func() Sharder, peers []peer.Peer, keys []Key) []string {
+	// Sharders may sort the slice passed to SetPeers, so pass a copy to avoid
+	// modifying the caller's slice.
+	s := newSharder()
+	s.SetPeers(append([]peer.Peer(nil), peers...))
+
+	owners := make([]string, len(keys))
+	for i, key := range keys {
+		owners[i] = primaryOwner(s, key)
+	}
+	return owners
+}
+
+// primaryOwner returns the name of the first owner of key, or an empty
+// string if key has no owner.
+func primaryOwner(s Sharder, key Key) string {
+	owners, err := s.Lookup(key, 1, OpReadWrite)
+	if err != nil || len(owners) == 0 {
+		return ""
+	}
+	return owners[0].Name
+}
@@ -0,0 +1,79 @@
+package shard
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rfratto/ckit/internal/chash"
+	"github.com/rfratto/ckit/peer"
+)
+
+// DskitRing returns a Sharder which assigns keys to peers the same way as
+// the token ring of grafana/dskit, used by Cortex, Loki, and Mimir. Given
+// the same tokens, DskitRing selects the same owners as dskit, so services
+// can migrate from dskit to ckit without moving existing data.
+//
+// dskit generates tokens randomly and stores them in its KV store, so
+// DskitRing can't generate tokens itself. tokens returns the tokens of a
+// peer, typically the tokens which the peer registered in the dskit ring;
+// LabelTokens reads tokens advertised through a peer label. Peers without
+// tokens are ignored.
+//
+// Keys are truncated to 32 bits, and must be built by hashing the same data
+// with the same hash function as the keys passed to dskit. A key is owned by
+// the peer with the first token strictly greater than the key, and replicas
+// are the peers of the tokens which follow. When combined with
+// WithZoneAwareness, owners are the same as dskit's zone-aware replication
+// as long as every peer has a zone and there are at least as many zones as
+// owners.
+//
+// DskitRing runs in O(log N) time, where N is the total number of tokens.
+// Peer weights and WithHashFunc are ignored.
+func DskitRing(tokens func(p peer.Peer) []uint32, opts ...Option) Sharder {
+	o := buildOptions(opts)
+	o.tokens = tokens
+
+	eligible := o.eligible
+	o.eligible = func(p peer.Peer, op Op) bool {
+		return eligible(p, op) && len(tokens(p)) > 0
+	}
+
+	return newChasher(o, func() chash.Hash { return chash.Dskit() })
+}
+
+// LabelTokens returns a function for DskitRing which reads the tokens of a
+// peer from the label with the provided name. The label must contain a list
+// of comma-separated tokens, as returned by FormatTokens. Peers with a
+// missing or invalid label have no tokens.
+func LabelTokens(label string) func(p peer.Peer) []uint32 {
+	return func(p peer.Peer) []uint32 {
+		value, ok := p.Labels[label]
+		if !ok || value == "" {
+			return nil
+		}
+
+		parts := strings.Split(value, ",")
+		tokens := make([]uint32, 0, len(parts))
+		for _, part := range parts {
+			tok, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil
+			}
+			tokens = append(tokens, uint32(tok))
+		}
+		return tokens
+	}
+}
+
+// FormatTokens formats tokens as a label value which can be read by
+// LabelTokens.
+func FormatTokens(tokens []uint32) string {
+	var sb strings.Builder
+	for i, tok := range tokens {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(tok), 10))
+	}
+	return sb.String()
+}
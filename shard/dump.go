@@ -0,0 +1,317 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rfratto/ckit/internal/chash"
+)
+
+// DumpFormat is the format used by DebugDump.
+type DumpFormat uint8
+
+const (
+	// DumpText writes a human-readable dump.
+	DumpText DumpFormat = iota
+	// DumpJSON writes a dump encoded as JSON.
+	DumpJSON
+)
+
+// dumpSampleKeys is the number of keys sampled to estimate ownership for
+// hashes which don't assign token ranges to peers.
+const dumpSampleKeys = 10_000
+
+// DumpOptions configures DebugDump.
+type DumpOptions struct {
+	// Format of the dump. Defaults to DumpText.
+	Format DumpFormat
+
+	// Replicas is the number of owners used for replica chains and replica
+	// ownership. Defaults to 1, and is capped to the number of eligible
+	// peers.
+	Replicas int
+
+	// Keys to include the owners of in the dump, such as keys which were
+	// assigned to an unexpected peer.
+	Keys []Key
+}
+
+type debugDump struct {
+	Algorithm string         `json:"algorithm"`
+	Params    map[string]int `json:"params,omitempty"`
+	Replicas  int            `json:"replicas"`
+	Ops       []debugDumpOp  `json:"ops"`
+}
+
+type debugDumpOp struct {
+	Op string `json:"op"`
+
+	// Estimated is true if ownership was estimated by sampling keys rather
+	// than calculated from token ranges.
+	Estimated bool             `json:"estimated"`
+	Peers     []debugDumpPeer  `json:"peers"`
+	Ranges    []debugDumpRange `json:"ranges,omitempty"`
+	Keys      []debugDumpKey   `json:"keys,omitempty"`
+}
+
+type debugDumpPeer struct {
+	Name string `json:"name"`
+
+	// Fraction of the keyspace where the peer is the first owner, and where
+	// the peer is any of the replicas.
+	Primary float64 `json:"primary"`
+	Replica float64 `json:"replica"`
+}
+
+// debugDumpRange is a range of keys with the same replica chain. Start may be
+// greater than End if the range wraps around the keyspace.
+type debugDumpRange struct {
+	Start  uint64   `json:"start"`
+	End    uint64   `json:"end"`
+	Owners []string `json:"owners"`
+}
+
+type debugDumpKey struct {
+	Key    uint64   `json:"key"`
+	Owners []string `json:"owners,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Dumper is implemented by Sharders which can describe how they assign keys.
+type Dumper interface {
+	// DebugDump writes a description of how the Sharder assigns keys to w:
+	// the fraction of the keyspace owned by each peer, the token ranges and
+	// replica chains for Sharders which use token ranges, and the owners of
+	// specific keys. Ownership is estimated by sampling keys for Sharders
+	// which don't use token ranges.
+	//
+	// DebugDump is intended for debugging why a key was assigned to a peer.
+	// The format of the dump may change between versions of ckit.
+	DebugDump(w io.Writer, opts DumpOptions) error
+}
+
+// DebugDump calls Dumper.DebugDump on s or the Sharder it wraps.
+// ErrUnsupported is returned if s doesn't implement Dumper.
+func DebugDump(s Sharder, w io.Writer, opts DumpOptions) error {
+	d, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Dumper)
+		return ok
+	}).(Dumper)
+	if !ok {
+		return ErrUnsupported
+	}
+	return d.DebugDump(w, opts)
+}
+
+func (ch *chasher) DebugDump(w io.Writer, opts DumpOptions) error {
+	st := ch.loadState()
+	dump := debugDump{
+		Ops: []debugDumpOp{
+			ch.dumpOp(st, OpRead, opts),
+			ch.dumpOp(st, OpReadWrite, opts),
+		},
+	}
+	desc := st.read.Describe()
+
+	dump.Algorithm, dump.Params = desc.Algorithm, desc.Params
+	dump.Replicas = opts.Replicas
+	if dump.Replicas < 1 {
+		dump.Replicas = 1
+	}
+
+	switch opts.Format {
+	case DumpJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dump)
+	case DumpText:
+		return dump.writeText(w)
+	default:
+		return fmt.Errorf("unknown dump format %d", opts.Format)
+	}
+}
+
+// dumpOp dumps the state of the hash used for op within st. op must be
+// known.
+func (ch *chasher) dumpOp(st *sharderState, op Op, opts DumpOptions) debugDumpOp {
+	res := debugDumpOp{Op: op.String()}
+	h, numNodes := st.hashForOp(op)
+
+	replicas := opts.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+	if replicas > numNodes {
+		replicas = numNodes
+	}
+
+	var (
+		desc    = h.Describe()
+		primary = make(map[string]float64, len(desc.Nodes))
+		replica = make(map[string]float64, len(desc.Nodes))
+	)
+
+	// Ring keys are owned by the next token, so ownership can be calculated
+	// exactly from the ranges between tokens.
+	if desc.Algorithm == "ring" && len(desc.Tokens) > 0 {
+		res.Ranges = ch.ringRanges(st, h, numNodes, desc.Tokens, replicas)
+		for _, r := range res.Ranges {
+			size := rangeFraction(r.Start, r.End)
+			primary[r.Owners[0]] += size
+			for _, owner := range r.Owners {
+				replica[owner] += size
+			}
+		}
+	} else if numNodes > 0 {
+		res.Estimated = true
+
+		keys := UniformKeys(dumpSampleKeys)()
+		for _, key := range keys {
+			owners, err := ch.lookupNames(st, h, numNodes, key, replicas, lookupOptions{})
+			if err != nil || len(owners) == 0 {
+				continue
+			}
+			primary[owners[0]] += 1 / float64(len(keys))
+			for _, owner := range owners {
+				replica[owner] += 1 / float64(len(keys))
+			}
+		}
+	}
+
+	res.Peers = make([]debugDumpPeer, 0, len(desc.Nodes))
+	for _, name := range desc.Nodes {
+		res.Peers = append(res.Peers, debugDumpPeer{
+			Name:    name,
+			Primary: primary[name],
+			Replica: replica[name],
+		})
+	}
+	sort.Slice(res.Peers, func(i, j int) bool { return res.Peers[i].Name < res.Peers[j].Name })
+
+	for _, key := range opts.Keys {
+		dk := debugDumpKey{Key: uint64(key)}
+		owners, err := ch.lookupNames(st, h, numNodes, key, replicas, lookupOptions{})
+		if err != nil {
+			dk.Error = err.Error()
+		} else {
+			dk.Owners = owners
+		}
+		res.Keys = append(res.Keys, dk)
+	}
+
+	return res
+}
+
+// ringRanges returns the ranges of keys owned between each pair of tokens
+// of h, a ring hash of st, merging adjacent ranges with the same replica
+// chain.
+func (ch *chasher) ringRanges(st *sharderState, h chash.Hash, numNodes int, tokens []chash.Token, replicas int) []debugDumpRange {
+	var ranges []debugDumpRange
+	for i, tok := range tokens {
+		if i > 0 && tokens[i-1].Token == tok.Token {
+			// Keys are owned by the first of the tokens with the same value.
+			continue
+		}
+
+		// The keys in (previous token, tok] are owned by the same replicas as
+		// tok.
+		start := tokens[len(tokens)-1].Token + 1
+		if i > 0 {
+			start = tokens[i-1].Token + 1
+		}
+		owners, err := ch.lookupNames(st, h, numNodes, Key(tok.Token), replicas, lookupOptions{})
+		if err != nil {
+			continue
+		}
+
+		if n := len(ranges); n > 0 && stringsEqual(ranges[n-1].Owners, owners) {
+			ranges[n-1].End = tok.Token
+			continue
+		}
+		ranges = append(ranges, debugDumpRange{Start: start, End: tok.Token, Owners: owners})
+	}
+
+	// The first and last ranges are adjacent by wrapping around the keyspace.
+	if n := len(ranges); n > 1 && stringsEqual(ranges[0].Owners, ranges[n-1].Owners) {
+		ranges[0].Start = ranges[n-1].Start
+		ranges = ranges[:n-1]
+	}
+	return ranges
+}
+
+// rangeFraction returns the fraction of the keyspace in [start, end],
+// wrapping around the keyspace if start > end.
+func rangeFraction(start, end uint64) float64 {
+	size := end - start + 1 // Overflows to 0 for the full keyspace
+	if size == 0 {
+		return 1
+	}
+	return float64(size) / (float64(math.MaxUint64) + 1)
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d debugDump) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "algorithm: %s\n", d.Algorithm)
+	if len(d.Params) > 0 {
+		names := make([]string, 0, len(d.Params))
+		for name := range d.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(tw, "%s: %d\n", name, d.Params[name])
+		}
+	}
+	fmt.Fprintf(tw, "replicas: %d\n", d.Replicas)
+
+	for _, op := range d.Ops {
+		fmt.Fprintf(tw, "\nop %s", op.Op)
+		if op.Estimated {
+			fmt.Fprintf(tw, " (ownership estimated from %d sampled keys)", dumpSampleKeys)
+		}
+		fmt.Fprintf(tw, "\n")
+
+		fmt.Fprintf(tw, "PEER\tPRIMARY\tREPLICA\n")
+		for _, p := range op.Peers {
+			fmt.Fprintf(tw, "%s\t%.2f%%\t%.2f%%\n", p.Name, 100*p.Primary, 100*p.Replica)
+		}
+
+		if len(op.Ranges) > 0 {
+			fmt.Fprintf(tw, "\nSTART\tEND\tOWNERS\n")
+			for _, r := range op.Ranges {
+				fmt.Fprintf(tw, "%d\t%d\t%s\n", r.Start, r.End, strings.Join(r.Owners, ", "))
+			}
+		}
+
+		if len(op.Keys) > 0 {
+			fmt.Fprintf(tw, "\nKEY\tOWNERS\n")
+			for _, k := range op.Keys {
+				if k.Error != "" {
+					fmt.Fprintf(tw, "%d\terror: %s\n", k.Key, k.Error)
+					continue
+				}
+				fmt.Fprintf(tw, "%d\t%s\n", k.Key, strings.Join(k.Owners, ", "))
+			}
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,125 @@
+package shard
+
+import (
+	"encoding/binary"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Fingerprinter is implemented by Sharders which can summarize how they
+// place keys as a fingerprint.
+type Fingerprinter interface {
+	// Fingerprint returns a hash of everything which affects the owners of
+	// keys: the algorithm and its parameters, the options of the Sharder,
+	// and the name, weight, and placement attributes of every eligible peer.
+	// Sharders which would compute the same owners for every key have the
+	// same fingerprint, so fingerprints can be compared across nodes to
+	// detect divergence. Fingerprint never returns 0.
+	Fingerprint() uint64
+}
+
+// Fingerprint calls Fingerprinter.Fingerprint on s or the Sharder it wraps.
+// ErrUnsupported is returned if s doesn't implement Fingerprinter.
+func Fingerprint(s Sharder) (uint64, error) {
+	fp, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Fingerprinter)
+		return ok
+	}).(Fingerprinter)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return fp.Fingerprint(), nil
+}
+
+func (ch *chasher) Fingerprint() uint64 {
+	var (
+		st   = ch.loadState()
+		desc = ch.newHash().Describe() // Empty hashes are cheap to describe.
+		opts = ch.opts.snapshotOptions()
+		d    = xxhash.New()
+	)
+
+	writeString(d, desc.Algorithm)
+	params := make([]string, 0, len(desc.Params))
+	for name := range desc.Params {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		writeString(d, name)
+		writeUint(d, uint64(desc.Params[name]))
+	}
+
+	writeUint(d, uint64(len(opts.Roles)))
+	for _, role := range opts.Roles {
+		writeString(d, role)
+	}
+	writeBool(d, opts.ZoneAware)
+	writeString(d, opts.ShuffleTenant)
+	writeUint(d, uint64(opts.ShuffleSize))
+	writeUint(d, opts.Seed)
+
+	// Only peers which are eligible for an Op affect placement, so other
+	// peers and attributes, such as labels, are ignored.
+	names := make([]string, 0, len(st.all))
+	for name := range st.all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, op := range []Op{OpRead, OpReadWrite} {
+		writeUint(d, uint64(op))
+		for _, name := range names {
+			p := st.all[name]
+			if !ch.opts.eligible(p, op) {
+				continue
+			}
+
+			weight := p.Weight
+			if weight < 1 {
+				weight = 1
+			}
+			writeString(d, p.Name)
+			writeUint(d, uint64(weight))
+			if ch.opts.zoneAware {
+				writeString(d, p.AvailabilityZone)
+			}
+			if ch.opts.tokens != nil {
+				tokens := ch.opts.tokens(p)
+				writeUint(d, uint64(len(tokens)))
+				for _, tok := range tokens {
+					writeUint(d, uint64(tok))
+				}
+			}
+		}
+	}
+
+	if fp := d.Sum64(); fp != 0 {
+		return fp
+	}
+	return 1
+}
+
+// writeUint writes v to h.
+func writeUint(h hash.Hash64, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	_, _ = h.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// writeString writes s to h, prefixed by its length so that adjacent strings
+// can't be confused with each other.
+func writeString(h hash.Hash64, s string) {
+	writeUint(h, uint64(len(s)))
+	_, _ = h.Write([]byte(s))
+}
+
+// writeBool writes b to h.
+func writeBool(h hash.Hash64, b bool) {
+	if b {
+		writeUint(h, 1)
+	} else {
+		writeUint(h, 0)
+	}
+}
@@ -0,0 +1,303 @@
+package shard
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/internal/metricsutil"
+	"github.com/rfratto/ckit/peer"
+)
+
+// HotKeyOptions configures TrackHotKeys.
+type HotKeyOptions struct {
+	// SampleEvery is the interval between sampled lookups: one in every
+	// SampleEvery lookups is recorded. Defaults to 100. Set to 1 to record
+	// every lookup.
+	SampleEvery int
+
+	// Capacity is the number of distinct keys tracked. Defaults to 64.
+	//
+	// Keys are tracked with the Space-Saving algorithm: once Capacity keys
+	// are tracked, a new key replaces the least frequently sampled key and
+	// inherits its count. Counts of infrequent keys may be overestimated, but
+	// keys which are sampled more often than 1/Capacity of the time are
+	// always tracked.
+	Capacity int
+}
+
+// HotKey is a frequently looked up key reported by HotKeySharder.
+type HotKey struct {
+	Key Key `json:"key"`
+
+	// Lookups is the estimated number of lookups of Key: the number of
+	// sampled lookups multiplied by HotKeyOptions.SampleEvery.
+	Lookups uint64 `json:"lookups"`
+
+	// Owner is the first owner returned by the most recent sampled lookup of
+	// Key.
+	Owner string `json:"owner"`
+}
+
+// OwnerLookups is the estimated number of lookups where a peer was the first
+// owner.
+type OwnerLookups struct {
+	Name    string `json:"name"`
+	Lookups uint64 `json:"lookups"`
+}
+
+// HotKeySharder is a Sharder which samples lookups to find the keys which are
+// looked up most often and how lookups are spread across owners. It helps
+// diagnose load imbalance caused by the workload rather than by the
+// distribution of the keyspace. Only successful calls to Lookup are sampled.
+type HotKeySharder struct {
+	Sharder
+
+	lookups uint64 // Accessed atomically; total number of lookups
+	opts    HotKeyOptions
+	metrics *metricsutil.Container
+
+	mut     sync.Mutex
+	keys    map[Key]*hotKeyCounter
+	owners  map[string]uint64 // Number of sampled lookups by first owner
+	sampled uint64            // Total number of sampled lookups
+}
+
+type hotKeyCounter struct {
+	count uint64
+	owner string
+}
+
+// TrackHotKeys returns a HotKeySharder which tracks the lookups of s.
+func TrackHotKeys(s Sharder, opts HotKeyOptions) *HotKeySharder {
+	if opts.SampleEvery < 1 {
+		opts.SampleEvery = 100
+	}
+	if opts.Capacity < 1 {
+		opts.Capacity = 64
+	}
+
+	h := &HotKeySharder{
+		Sharder: s,
+		opts:    opts,
+		metrics: &metricsutil.Container{},
+
+		keys:   make(map[Key]*hotKeyCounter, opts.Capacity),
+		owners: make(map[string]uint64),
+	}
+	h.metrics.Add(Metrics(s), newHotKeyCollector(h))
+	return h
+}
+
+// Unwrap returns the Sharder wrapped by h.
+func (h *HotKeySharder) Unwrap() Sharder { return h.Sharder }
+
+// Lookup implements Sharder, sampling the result.
+func (h *HotKeySharder) Lookup(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+	res, err := h.Sharder.Lookup(key, numOwners, op, opts...)
+	if err != nil || len(res) == 0 {
+		return res, err
+	}
+	if atomic.AddUint64(&h.lookups, 1)%uint64(h.opts.SampleEvery) == 0 {
+		h.record(key, res[0].Name)
+	}
+	return res, nil
+}
+
+// record records a sampled lookup of key owned by owner.
+func (h *HotKeySharder) record(key Key, owner string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.sampled++
+	h.owners[owner]++
+
+	if c, ok := h.keys[key]; ok {
+		c.count++
+		c.owner = owner
+		return
+	}
+
+	c := &hotKeyCounter{count: 1, owner: owner}
+	if len(h.keys) >= h.opts.Capacity {
+		var (
+			minKey Key
+			min    *hotKeyCounter
+		)
+		for k, other := range h.keys {
+			if min == nil || other.count < min.count || (other.count == min.count && k < minKey) {
+				minKey, min = k, other
+			}
+		}
+		delete(h.keys, minKey)
+		c.count += min.count
+	}
+	h.keys[key] = c
+}
+
+// HotKeys returns up to n of the most frequently looked up keys, sorted by
+// the number of lookups. If n is less than 1, every tracked key is returned.
+func (h *HotKeySharder) HotKeys(n int) []HotKey {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	res := make([]HotKey, 0, len(h.keys))
+	for k, c := range h.keys {
+		res = append(res, HotKey{
+			Key:     k,
+			Lookups: c.count * uint64(h.opts.SampleEvery),
+			Owner:   c.owner,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Lookups != res[j].Lookups {
+			return res[i].Lookups > res[j].Lookups
+		}
+		return res[i].Key < res[j].Key
+	})
+
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// OwnerLookups returns the estimated number of lookups owned by each current
+// peer of h, sorted by name. Peers which weren't the first owner of any
+// sampled lookup are included with no lookups.
+func (h *HotKeySharder) OwnerLookups() []OwnerLookups {
+	peers := h.Peers()
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	res := make([]OwnerLookups, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, OwnerLookups{
+			Name:    p.Name,
+			Lookups: h.owners[p.Name] * uint64(h.opts.SampleEvery),
+		})
+	}
+	return res
+}
+
+// Skew returns the ratio of lookups owned by the most loaded peer to the
+// average number of lookups owned by each peer. A skew of 1 means lookups
+// are spread evenly. Skew returns 0 if no lookups have been sampled.
+func (h *HotKeySharder) Skew() float64 {
+	return lookupSkew(h.OwnerLookups())
+}
+
+func lookupSkew(owners []OwnerLookups) float64 {
+	var max, total uint64
+	for _, o := range owners {
+		total += o.Lookups
+		if o.Lookups > max {
+			max = o.Lookups
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(max) / (float64(total) / float64(len(owners)))
+}
+
+// Reset discards all sampled lookups, such as to only track lookups after a
+// change to the workload.
+func (h *HotKeySharder) Reset() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.keys = make(map[Key]*hotKeyCounter, h.opts.Capacity)
+	h.owners = make(map[string]uint64)
+	h.sampled = 0
+}
+
+// Metrics returns the metrics of the wrapped Sharder along with the
+// estimated number of lookups owned by each peer, the skew of lookups across
+// peers, and the fraction of sampled lookups for the hottest key.
+func (h *HotKeySharder) Metrics() prometheus.Collector { return h.metrics }
+
+// Handler returns an http.Handler which responds with the hot keys, the
+// lookups owned by each peer, and the skew of lookups encoded as JSON.
+// Handler is intended for debugging.
+func (h *HotKeySharder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owners := h.OwnerLookups()
+		resp := struct {
+			SampleEvery int            `json:"sample_every"`
+			Skew        float64        `json:"skew"`
+			Keys        []HotKey       `json:"keys"`
+			Owners      []OwnerLookups `json:"owners"`
+		}{
+			SampleEvery: h.opts.SampleEvery,
+			Skew:        lookupSkew(owners),
+			Keys:        h.HotKeys(0),
+			Owners:      owners,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	})
+}
+
+// hotKeyCollector exposes the lookups sampled by a HotKeySharder.
+type hotKeyCollector struct {
+	h *HotKeySharder
+
+	ownerLookupsDesc, skewDesc, hottestDesc *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*hotKeyCollector)(nil)
+
+func newHotKeyCollector(h *HotKeySharder) *hotKeyCollector {
+	return &hotKeyCollector{
+		h: h,
+
+		ownerLookupsDesc: prometheus.NewDesc(
+			"shard_owner_lookups_estimated",
+			"Estimated number of sampled lookups where a peer was the first owner.",
+			[]string{"peer"}, nil,
+		),
+		skewDesc: prometheus.NewDesc(
+			"shard_owner_lookups_skew_ratio",
+			"Ratio of lookups owned by the most loaded peer to the average lookups owned by each peer.",
+			nil, nil,
+		),
+		hottestDesc: prometheus.NewDesc(
+			"shard_hot_key_lookups_ratio",
+			"Fraction of sampled lookups for the most frequently looked up key.",
+			nil, nil,
+		),
+	}
+}
+
+func (hc *hotKeyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hc.ownerLookupsDesc
+	ch <- hc.skewDesc
+	ch <- hc.hottestDesc
+}
+
+func (hc *hotKeyCollector) Collect(ch chan<- prometheus.Metric) {
+	owners := hc.h.OwnerLookups()
+	for _, o := range owners {
+		ch <- prometheus.MustNewConstMetric(hc.ownerLookupsDesc, prometheus.GaugeValue, float64(o.Lookups), o.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(hc.skewDesc, prometheus.GaugeValue, lookupSkew(owners))
+
+	var hottest float64
+	if keys := hc.h.HotKeys(1); len(keys) > 0 {
+		hc.h.mut.Lock()
+		sampled := hc.h.sampled * uint64(hc.h.opts.SampleEvery)
+		hc.h.mut.Unlock()
+		if sampled > 0 {
+			hottest = float64(keys[0].Lookups) / float64(sampled)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(hc.hottestDesc, prometheus.GaugeValue, hottest)
+}
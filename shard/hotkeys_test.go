@@ -0,0 +1,115 @@
+package shard_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackHotKeys(t *testing.T) {
+	ring := shard.Ring(16)
+	ring.SetPeers([]peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+	})
+	hk := shard.TrackHotKeys(ring, shard.HotKeyOptions{SampleEvery: 1, Capacity: 16})
+
+	var (
+		hot     = shard.StringKey("hot")
+		warm    = shard.StringKey("warm")
+		owner   = lookupOwner(t, ring, hot)
+		expects = map[string]uint64{}
+	)
+	for i := 0; i < 100; i++ {
+		lookupOwner(t, hk, hot)
+		expects[owner]++
+	}
+	for i := 0; i < 20; i++ {
+		expects[lookupOwner(t, hk, warm)]++
+	}
+	// Many distinct cold keys exceed the capacity, but never evict the hot
+	// keys.
+	for i := 0; i < 50; i++ {
+		expects[lookupOwner(t, hk, shard.StringKey(fmt.Sprintf("cold-%d", i)))]++
+	}
+
+	keys := hk.HotKeys(2)
+	require.Equal(t, []shard.HotKey{
+		{Key: hot, Lookups: 100, Owner: owner},
+		{Key: warm, Lookups: 20, Owner: lookupOwner(t, ring, warm)},
+	}, keys)
+	require.Len(t, hk.HotKeys(0), 16)
+
+	owners := hk.OwnerLookups()
+	require.Equal(t, []shard.OwnerLookups{
+		{Name: "peer-a", Lookups: expects["peer-a"]},
+		{Name: "peer-b", Lookups: expects["peer-b"]},
+	}, owners)
+
+	max := expects["peer-a"]
+	if expects["peer-b"] > max {
+		max = expects["peer-b"]
+	}
+	require.InDelta(t, float64(max)/(170.0/2), hk.Skew(), 1e-9)
+
+	// Ranges are reported for the wrapped Sharder.
+	expectRanges, err := shard.OwnedRanges(ring, "peer-a", 1, shard.OpRead)
+	require.NoError(t, err)
+	actualRanges, err := shard.OwnedRanges(hk, "peer-a", 1, shard.OpRead)
+	require.NoError(t, err)
+	require.Equal(t, expectRanges, actualRanges)
+
+	rec := httptest.NewRecorder()
+	hk.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var resp struct {
+		Keys []shard.HotKey `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, keys, resp.Keys[:2])
+
+	hk.Reset()
+	require.Empty(t, hk.HotKeys(0))
+	require.Zero(t, hk.Skew())
+}
+
+func TestTrackHotKeys_Sampling(t *testing.T) {
+	ring := shard.Ring(16)
+	ring.SetPeers([]peer.Peer{{Name: "peer-a", State: peer.StateParticipant}})
+	hk := shard.TrackHotKeys(ring, shard.HotKeyOptions{SampleEvery: 10})
+
+	for i := 0; i < 95; i++ {
+		lookupOwner(t, hk, shard.StringKey("key"))
+	}
+	require.Equal(t, []shard.HotKey{{Key: shard.StringKey("key"), Lookups: 90, Owner: "peer-a"}}, hk.HotKeys(0))
+
+	expect := `
+# HELP shard_hot_key_lookups_ratio Fraction of sampled lookups for the most frequently looked up key.
+# TYPE shard_hot_key_lookups_ratio gauge
+shard_hot_key_lookups_ratio 1
+# HELP shard_owner_lookups_estimated Estimated number of sampled lookups where a peer was the first owner.
+# TYPE shard_owner_lookups_estimated gauge
+shard_owner_lookups_estimated{peer="peer-a"} 90
+# HELP shard_owner_lookups_skew_ratio Ratio of lookups owned by the most loaded peer to the average lookups owned by each peer.
+# TYPE shard_owner_lookups_skew_ratio gauge
+shard_owner_lookups_skew_ratio 1
+`
+	require.NoError(t, testutil.CollectAndCompare(hk.Metrics(), strings.NewReader(expect),
+		"shard_hot_key_lookups_ratio", "shard_owner_lookups_estimated", "shard_owner_lookups_skew_ratio",
+	))
+}
+
+// lookupOwner returns the first owner of key in s.
+func lookupOwner(t *testing.T, s shard.Sharder, key shard.Key) string {
+	t.Helper()
+
+	owners, err := s.Lookup(key, 1, shard.OpRead)
+	require.NoError(t, err)
+	return owners[0].Name
+}
@@ -0,0 +1,217 @@
+package shard
+
+import (
+	"github.com/rfratto/ckit/internal/chash"
+	"github.com/rfratto/ckit/peer"
+)
+
+// Incremental is implemented by Sharders which can add and remove peers
+// without being given the full set of peers.
+type Incremental interface {
+	// AddPeers adds ps to the set of peers used for sharding, replacing
+	// existing peers with the same name. AddPeers is equivalent to calling
+	// SetPeers with the updated set of peers, but Sharders which support it
+	// only compute the state of the added peers.
+	AddPeers(ps ...peer.Peer)
+
+	// RemovePeers removes the peers with the provided names from the set of
+	// peers used for sharding. Names which aren't known are ignored.
+	// RemovePeers is equivalent to calling SetPeers with the updated set of
+	// peers, but Sharders which support it only remove the state of the
+	// removed peers.
+	RemovePeers(names ...string)
+}
+
+// findIncremental returns the Incremental implementation of s or the Sharder
+// it wraps.
+func findIncremental(s Sharder) (Incremental, bool) {
+	inc, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Incremental)
+		return ok
+	}).(Incremental)
+	return inc, ok
+}
+
+// AddPeers adds ps to the peers of s. Incremental.AddPeers is used if s or
+// the Sharder it wraps implements Incremental; otherwise, SetPeers is called
+// with the current peers of s and ps.
+func AddPeers(s Sharder, ps ...peer.Peer) {
+	if inc, ok := findIncremental(s); ok {
+		inc.AddPeers(ps...)
+		return
+	}
+
+	added := make(map[string]struct{}, len(ps))
+	for _, p := range ps {
+		added[p.Name] = struct{}{}
+	}
+	var peers []peer.Peer
+	for _, p := range s.Peers() {
+		if _, ok := added[p.Name]; !ok {
+			peers = append(peers, p)
+		}
+	}
+	s.SetPeers(append(peers, ps...))
+}
+
+// RemovePeers removes the peers named by names from s.
+// Incremental.RemovePeers is used if s or the Sharder it wraps implements
+// Incremental; otherwise, SetPeers is called with the remaining peers of s.
+func RemovePeers(s Sharder, names ...string) {
+	if inc, ok := findIncremental(s); ok {
+		inc.RemovePeers(names...)
+		return
+	}
+
+	removed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		removed[name] = struct{}{}
+	}
+	var peers []peer.Peer
+	for _, p := range s.Peers() {
+		if _, ok := removed[p.Name]; !ok {
+			peers = append(peers, p)
+		}
+	}
+	s.SetPeers(peers)
+}
+
+func (ch *chasher) AddPeers(ps ...peer.Peer) {
+	ch.writeMut.Lock()
+	defer ch.writeMut.Unlock()
+
+	// Deduplicate ps so the last peer with a given name wins.
+	added := make(map[string]peer.Peer, len(ps))
+	for _, p := range ps {
+		added[p.Name] = p
+	}
+
+	names := make([]string, 0, len(added))
+	for name := range added {
+		names = append(names, name)
+	}
+	ch.updatePeersLocked(names, added)
+}
+
+func (ch *chasher) RemovePeers(names ...string) {
+	ch.writeMut.Lock()
+	defer ch.writeMut.Unlock()
+
+	ch.updatePeersLocked(names, nil)
+}
+
+// updatePeersLocked publishes a new state which removes the peers named by
+// remove and then adds the peers in add. If the hashes of ch don't support
+// incremental updates, new hashes are computed from every peer. Must be
+// called with ch.writeMut held.
+func (ch *chasher) updatePeersLocked(remove []string, add map[string]peer.Peer) {
+	old := ch.loadState()
+
+	all := make(map[string]peer.Peer, len(old.all)+len(add))
+	for name, p := range old.all {
+		all[name] = p
+	}
+	for _, name := range remove {
+		delete(all, name)
+	}
+	for name, p := range add {
+		all[name] = p
+	}
+
+	var (
+		readHash, readOK           = old.read.(chash.IncrementalHash)
+		readWriteHash, readWriteOK = old.readWrite.(chash.IncrementalHash)
+	)
+
+	// Shuffle shard subsets depend on every eligible peer, so they can't be
+	// updated incrementally.
+	if !readOK || !readWriteOK || ch.opts.shuffleSize > 0 {
+		ps := make([]peer.Peer, 0, len(all))
+		for _, p := range all {
+			ps = append(ps, p)
+		}
+		ch.setPeersLocked(all, ps)
+		return
+	}
+
+	st := &sharderState{
+		peers: make(map[string]peer.Peer, len(old.peers)+len(add)),
+		all:   all,
+		self:  old.self,
+		gen:   old.gen + 1,
+
+		unhealthy: old.unhealthy,
+	}
+	for name, p := range old.peers {
+		st.peers[name] = p
+	}
+
+	var removeRead, removeReadWrite []string
+	for _, name := range remove {
+		p, ok := st.peers[name]
+		if !ok {
+			continue
+		}
+		if ch.opts.eligible(p, OpRead) {
+			removeRead = append(removeRead, name)
+		}
+		if ch.opts.eligible(p, OpReadWrite) {
+			removeReadWrite = append(removeReadWrite, name)
+		}
+		delete(st.peers, name)
+	}
+	for _, name := range remove {
+		if name == st.self {
+			st.self = ""
+		}
+	}
+
+	var (
+		addRead, addReadWrite         []string
+		readWeights, readWriteWeights []int
+	)
+	for _, p := range add {
+		if p.Self {
+			st.self = p.Name
+		}
+
+		var (
+			read      = ch.opts.eligible(p, OpRead)
+			readWrite = ch.opts.eligible(p, OpReadWrite)
+		)
+		if read {
+			addRead = append(addRead, p.Name)
+			readWeights = append(readWeights, p.Weight)
+		}
+		if readWrite {
+			addReadWrite = append(addReadWrite, p.Name)
+			readWriteWeights = append(readWriteWeights, p.Weight)
+		}
+		if read || readWrite {
+			st.peers[p.Name] = p
+		}
+	}
+
+	st.read = updateNodes(readHash, removeRead, addRead, readWeights)
+	st.readWrite = updateNodes(readWriteHash, removeReadWrite, addReadWrite, readWriteWeights)
+	st.numRead = old.numRead + len(addRead) - len(removeRead)
+	st.numReadWrite = old.numReadWrite + len(addReadWrite) - len(removeReadWrite)
+	ch.state.Store(st)
+}
+
+// updateNodes returns a copy of h with nodes removed and then added. h is
+// returned unmodified if the update is empty.
+func updateNodes(h chash.IncrementalHash, remove, add []string, weights []int) chash.Hash {
+	if len(remove) == 0 && len(add) == 0 {
+		return h
+	}
+
+	h = h.Clone()
+	if len(remove) > 0 {
+		h.RemoveNodes(remove)
+	}
+	if len(add) > 0 {
+		h.AddNodes(add, weights)
+	}
+	return h
+}
@@ -0,0 +1,30 @@
+package shard
+
+import "github.com/rfratto/ckit/internal/chash"
+
+// Ketama returns a Sharder which assigns keys to peers the same way as
+// libketama, the consistent hashing used by most memcached clients. Given
+// the same servers, Ketama selects the same owners as libketama, so ckit can
+// be used where existing clients already dictate placement.
+//
+// Peers are hashed by name, so peers must be named after the server strings
+// used by existing clients, typically "host:port". Ketama supports weights:
+// like libketama, each peer is given a number of points proportional to its
+// share of the total weight.
+//
+// Keys are truncated to 32 bits, and must be built with KetamaKey to match
+// libketama. A key is owned by the peer with the first point greater than or
+// equal to the key. libketama doesn't support replication; replicas are the
+// peers of the points which follow.
+//
+// Ketama runs in O(log N) time, where N is the total number of points.
+// WithHashFunc and WithSeed are ignored.
+func Ketama(opts ...Option) Sharder {
+	return newChasher(buildOptions(opts), func() chash.Hash { return chash.Ketama() })
+}
+
+// KetamaKey returns the key of s used by libketama: the first four bytes of
+// the MD5 digest of s.
+func KetamaKey(s string) Key {
+	return Key(chash.KetamaHash([]byte(s)))
+}
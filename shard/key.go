@@ -1,17 +1,31 @@
 package shard
 
-import "github.com/cespare/xxhash/v2"
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+)
 
 // A Key is used to identify the set of owners for some given objects. Keys
-// may be constructed from a string by calling StringKey or by writing data
-// through a KeyBuilder.
+// may be constructed from a string by calling StringKey, from binary data by
+// calling BytesKey or Uint64Key, or by writing data through a KeyBuilder.
+// Values which are already well-distributed hashes may be converted directly
+// with Key(hash).
 type Key uint64
 
 // KeyBuilder generate Keys for performing hash lookup. To generate a Key,
 // first write to the KeyBuilder, then call Key. The KeyBuilder can be re-used
 // afterwards by calling Reset. KeyBuilder can not be used concurrently.
 //
-// KeyBuilder implements io.Writer.
+// KeyBuilder implements io.Writer and io.StringWriter, so keys made of
+// multiple parts can be generated by writing each part in turn without
+// concatenating them into a single string first:
+//
+//	kb.Reset()
+//	kb.WriteString(tenant)
+//	kb.WriteString("/")
+//	kb.WriteString(series)
+//	key := kb.Key()
 type KeyBuilder struct {
 	dig *xxhash.Digest
 }
@@ -22,6 +36,10 @@ func NewKeyBuilder() *KeyBuilder { return &KeyBuilder{dig: xxhash.New()} }
 // Write appends b to kb's state. Write always returns len(b), nil.
 func (kb *KeyBuilder) Write(b []byte) (n int, err error) { return kb.dig.Write(b) }
 
+// WriteString appends s to kb's state without allocating. WriteString
+// always returns len(s), nil.
+func (kb *KeyBuilder) WriteString(s string) (n int, err error) { return kb.dig.WriteString(s) }
+
 // Reset resets kb's state.
 func (kb *KeyBuilder) Reset() { kb.dig.Reset() }
 
@@ -35,3 +53,19 @@ func StringKey(s string) Key {
 	// more efficient for this use case but still produces equivalent results.
 	return Key(xxhash.Sum64String(s))
 }
+
+// BytesKey generates a Key directly from b without allocating. It is
+// equivalent to writing b to a new KeyBuilder.
+func BytesKey(b []byte) Key {
+	return Key(xxhash.Sum64(b))
+}
+
+// Uint64Key generates a Key from v without allocating, such as for numeric
+// IDs. v is hashed so that sequential values are spread across the keyspace;
+// it is equivalent to writing the 8-byte big-endian encoding of v to a new
+// KeyBuilder. Use Key(v) instead if v is already a well-distributed hash.
+func Uint64Key(v uint64) Key {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return Key(xxhash.Sum64(buf[:]))
+}
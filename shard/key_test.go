@@ -48,3 +48,39 @@ func TestKeyBuilder_Key_Equivalence(t *testing.T) {
 
 	require.Equal(t, kb.Key(), StringKey(in))
 }
+
+func TestKeyBuilder_WriteString(t *testing.T) {
+	kb := NewKeyBuilder()
+	_, _ = kb.WriteString("tenant-a/")
+	_, _ = kb.Write([]byte("series-1/"))
+	_, _ = kb.WriteString("2021-01-01")
+
+	require.Equal(t, StringKey("tenant-a/series-1/2021-01-01"), kb.Key())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		kb.Reset()
+		_, _ = kb.WriteString("tenant-a/")
+		_, _ = kb.WriteString("series-1/")
+		_, _ = kb.WriteString("2021-01-01")
+		_ = kb.Key()
+	})
+	require.Zero(t, allocs)
+}
+
+func TestBytesKey(t *testing.T) {
+	in := []byte("Hello, world!")
+	require.Equal(t, StringKey(string(in)), BytesKey(in))
+
+	allocs := testing.AllocsPerRun(100, func() { _ = BytesKey(in) })
+	require.Zero(t, allocs)
+}
+
+func TestUint64Key(t *testing.T) {
+	kb := NewKeyBuilder()
+	_, _ = kb.Write([]byte{0, 0, 0, 0, 0, 0, 0x12, 0x34})
+	require.Equal(t, kb.Key(), Uint64Key(0x1234))
+	require.NotEqual(t, Uint64Key(1), Uint64Key(2))
+
+	allocs := testing.AllocsPerRun(100, func() { _ = Uint64Key(0x1234) })
+	require.Zero(t, allocs)
+}
@@ -0,0 +1,168 @@
+package shard
+
+import (
+	"math"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/internal/metricsutil"
+)
+
+// Instrumented is implemented by Sharders which expose metrics.
+type Instrumented interface {
+	// Metrics returns a prometheus.Collector exposing how the keyspace is
+	// distributed across peers: the fraction of the keyspace owned by the
+	// local peer (the peer passed to SetPeers with Self set), and the
+	// smallest, largest, and standard deviation of the fraction owned by each
+	// peer. Ownership is recomputed on the first collection after SetPeers
+	// is called. Sharders created with WithLookupCache also expose cache hits
+	// and misses. Use WithName to distinguish the metrics of multiple
+	// Sharders.
+	Metrics() prometheus.Collector
+}
+
+// Metrics calls Instrumented.Metrics on s or the Sharder it wraps. If s
+// doesn't implement Instrumented, Metrics returns a Collector with no
+// metrics.
+func Metrics(s Sharder) prometheus.Collector {
+	if i, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Instrumented)
+		return ok
+	}).(Instrumented); ok {
+		return i.Metrics()
+	}
+	return &metricsutil.Container{}
+}
+
+// ownershipCollector exposes the distribution of ownership of the keyspace
+// across the peers of a Sharder, along with the metrics of its lookup cache.
+type ownershipCollector struct {
+	ch *chasher
+
+	localDesc, minDesc, maxDesc, stddevDesc *prometheus.Desc
+
+	// Ownership is recomputed on the first collection after the peers of ch
+	// change.
+	mut   sync.Mutex
+	gen   uint64
+	stats []ownershipStats
+}
+
+type ownershipStats struct {
+	op                    Op
+	hasLocal              bool
+	local, min, max, mean float64
+	stddev                float64
+}
+
+var _ prometheus.Collector = (*ownershipCollector)(nil)
+
+func newOwnershipCollector(ch *chasher) *ownershipCollector {
+	constLabels := ch.opts.constLabels()
+
+	return &ownershipCollector{
+		ch: ch,
+
+		localDesc: prometheus.NewDesc(
+			"shard_local_ownership_ratio",
+			"Fraction of the keyspace owned by the local node.",
+			[]string{"op"}, constLabels,
+		),
+		minDesc: prometheus.NewDesc(
+			"shard_peer_ownership_min_ratio",
+			"Smallest fraction of the keyspace owned by any peer.",
+			[]string{"op"}, constLabels,
+		),
+		maxDesc: prometheus.NewDesc(
+			"shard_peer_ownership_max_ratio",
+			"Largest fraction of the keyspace owned by any peer.",
+			[]string{"op"}, constLabels,
+		),
+		stddevDesc: prometheus.NewDesc(
+			"shard_peer_ownership_stddev_ratio",
+			"Standard deviation of the fraction of the keyspace owned by each peer.",
+			[]string{"op"}, constLabels,
+		),
+	}
+}
+
+func (oc *ownershipCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- oc.localDesc
+	ch <- oc.minDesc
+	ch <- oc.maxDesc
+	ch <- oc.stddevDesc
+
+	if oc.ch.cache != nil {
+		oc.ch.cache.hits.Describe(ch)
+		oc.ch.cache.misses.Describe(ch)
+	}
+}
+
+func (oc *ownershipCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range oc.ownershipStats() {
+		op := s.op.String()
+		if s.hasLocal {
+			ch <- prometheus.MustNewConstMetric(oc.localDesc, prometheus.GaugeValue, s.local, op)
+		}
+		ch <- prometheus.MustNewConstMetric(oc.minDesc, prometheus.GaugeValue, s.min, op)
+		ch <- prometheus.MustNewConstMetric(oc.maxDesc, prometheus.GaugeValue, s.max, op)
+		ch <- prometheus.MustNewConstMetric(oc.stddevDesc, prometheus.GaugeValue, s.stddev, op)
+	}
+
+	if oc.ch.cache != nil {
+		oc.ch.cache.hits.Collect(ch)
+		oc.ch.cache.misses.Collect(ch)
+	}
+}
+
+// constLabels returns the labels added to every metric of a Sharder.
+func (o options) constLabels() prometheus.Labels {
+	if o.name == "" {
+		return nil
+	}
+	return prometheus.Labels{"sharder": o.name}
+}
+
+// ownershipStats returns ownership statistics for each Op which has
+// eligible peers, recomputing them if the peers have changed.
+func (oc *ownershipCollector) ownershipStats() []ownershipStats {
+	oc.mut.Lock()
+	defer oc.mut.Unlock()
+
+	st := oc.ch.loadState()
+	if oc.stats != nil && oc.gen == st.gen {
+		return oc.stats
+	}
+
+	stats := make([]ownershipStats, 0, 2)
+	for _, op := range []Op{OpRead, OpReadWrite} {
+		if _, numNodes := st.hashForOp(op); numNodes == 0 {
+			continue
+		}
+		dump := oc.ch.dumpOp(st, op, DumpOptions{})
+
+		s := ownershipStats{
+			op:       op,
+			hasLocal: st.self != "",
+			min:      math.Inf(1),
+			max:      math.Inf(-1),
+		}
+		for _, p := range dump.Peers {
+			if p.Name == st.self {
+				s.local = p.Primary
+			}
+			s.min = math.Min(s.min, p.Primary)
+			s.max = math.Max(s.max, p.Primary)
+			s.mean += p.Primary / float64(len(dump.Peers))
+		}
+		for _, p := range dump.Peers {
+			s.stddev += (p.Primary - s.mean) * (p.Primary - s.mean) / float64(len(dump.Peers))
+		}
+		s.stddev = math.Sqrt(s.stddev)
+
+		stats = append(stats, s)
+	}
+
+	oc.gen, oc.stats = st.gen, stats
+	return stats
+}
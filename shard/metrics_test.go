@@ -0,0 +1,37 @@
+package shard
+
+import (
+	"math"
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnershipCollector_Stats(t *testing.T) {
+	ring := Ring(16).(*chasher)
+	ring.SetPeers([]peer.Peer{
+		{Name: "peer-a", Self: true, State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+		{Name: "peer-c", State: peer.StateDraining},
+	})
+
+	stats := ring.m.ownershipStats()
+	require.Len(t, stats, 2)
+
+	for _, s := range stats {
+		require.True(t, s.hasLocal)
+		require.Greater(t, s.local, 0.0)
+		require.LessOrEqual(t, s.min, s.local)
+		require.GreaterOrEqual(t, s.max, s.local)
+		require.Greater(t, s.stddev, 0.0)
+	}
+
+	// Only peer-a and peer-b own keys for OpReadWrite, so the standard
+	// deviation is half the difference between them.
+	readWrite := stats[1]
+	require.Equal(t, OpReadWrite, readWrite.op)
+	require.InDelta(t, 1, readWrite.min+readWrite.max, 1e-9)
+	require.InDelta(t, (readWrite.max-readWrite.min)/2, readWrite.stddev, 1e-9)
+	require.False(t, math.IsInf(readWrite.min, 0))
+}
@@ -0,0 +1,130 @@
+package shard
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ckit/internal/metricsutil"
+	"github.com/rfratto/ckit/peer"
+)
+
+// Middleware wraps a Sharder to add behavior to it, such as instrumentation.
+// Middleware must return a Sharder which calls next for the methods it
+// doesn't change, and should implement Unwrap so optional interfaces of
+// next, such as Preferencer, remain reachable.
+type Middleware func(next Sharder) Sharder
+
+// Wrap returns s wrapped by each Middleware in mw. The first Middleware is
+// the outermost, so it's invoked first for every call.
+//
+// Sharders returned by the Middleware in this package implement Unwrap,
+// which functions such as OwnedRanges and Preference use to find the
+// underlying Sharder.
+func Wrap(s Sharder, mw ...Middleware) Sharder {
+	for i := len(mw) - 1; i >= 0; i-- {
+		s = mw[i](s)
+	}
+	return s
+}
+
+// LookupFunc is the signature of Sharder.Lookup.
+type LookupFunc func(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error)
+
+// LookupMiddleware returns a Middleware which wraps Sharder.Lookup with f.
+// f is invoked once with the Lookup method of the wrapped Sharder and
+// returns the LookupFunc to use instead. Other methods are passed through to
+// the wrapped Sharder.
+//
+// collectors are added to the metrics of the wrapped Sharder, and may be
+// nil.
+func LookupMiddleware(f func(next LookupFunc) LookupFunc, collectors ...prometheus.Collector) Middleware {
+	return func(next Sharder) Sharder {
+		w := &lookupWrapper{
+			Sharder: next,
+			lookup:  f(next.Lookup),
+			metrics: &metricsutil.Container{},
+		}
+		w.metrics.Add(Metrics(next))
+		for _, c := range collectors {
+			if c != nil {
+				w.metrics.Add(c)
+			}
+		}
+		return w
+	}
+}
+
+// lookupWrapper is a Sharder with a wrapped Lookup method.
+type lookupWrapper struct {
+	Sharder
+	lookup  LookupFunc
+	metrics *metricsutil.Container
+}
+
+func (w *lookupWrapper) Unwrap() Sharder { return w.Sharder }
+
+func (w *lookupWrapper) Lookup(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+	return w.lookup(key, numOwners, op, opts...)
+}
+
+func (w *lookupWrapper) Metrics() prometheus.Collector { return w.metrics }
+
+// InstrumentLookups returns a Middleware which records the number and
+// latency of lookups by Op and result. Each wrapped Sharder has its own
+// metrics, which are added to the Metrics of the wrapped Sharder. Use
+// prometheus.WrapRegistererWith to distinguish the metrics of multiple
+// instrumented Sharders.
+func InstrumentLookups() Middleware {
+	return func(next Sharder) Sharder {
+		var (
+			lookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "shard_lookups_total",
+				Help: "Total number of lookups by op and result.",
+			}, []string{"op", "result"})
+
+			lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "shard_lookup_duration_seconds",
+				Help:    "Histogram of the time taken to look up the owners of a key.",
+				Buckets: prometheus.ExponentialBuckets(1e-7, 4, 10),
+			}, []string{"op"})
+		)
+
+		instrument := func(next LookupFunc) LookupFunc {
+			return func(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+				start := time.Now()
+				res, err := next(key, numOwners, op, opts...)
+				lookupDuration.WithLabelValues(op.String()).Observe(time.Since(start).Seconds())
+
+				result := "success"
+				if err != nil {
+					result = "error"
+				}
+				lookupsTotal.WithLabelValues(op.String(), result).Inc()
+				return res, err
+			}
+		}
+		return LookupMiddleware(instrument, lookupsTotal, lookupDuration)(next)
+	}
+}
+
+// LookupTracer is invoked before a lookup with its arguments. The returned
+// function, which may be nil, is invoked with the result of the lookup once
+// it completes.
+//
+// LookupTracer can be used to create tracing spans without ckit depending on
+// a tracing library. Package shardotel creates OpenTelemetry spans.
+type LookupTracer func(key Key, numOwners int, op Op) (finish func(owners []peer.Peer, err error))
+
+// TraceLookups returns a Middleware which invokes t for every lookup.
+func TraceLookups(t LookupTracer) Middleware {
+	return LookupMiddleware(func(next LookupFunc) LookupFunc {
+		return func(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+			finish := t(key, numOwners, op)
+			res, err := next(key, numOwners, op, opts...)
+			if finish != nil {
+				finish(res, err)
+			}
+			return res, err
+		}
+	})
+}
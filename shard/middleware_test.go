@@ -0,0 +1,89 @@
+package shard_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	var calls []string
+	record := func(name string) shard.Middleware {
+		return shard.LookupMiddleware(func(next shard.LookupFunc) shard.LookupFunc {
+			return func(key shard.Key, numOwners int, op shard.Op, opts ...shard.LookupOption) ([]peer.Peer, error) {
+				calls = append(calls, name)
+				return next(key, numOwners, op, opts...)
+			}
+		})
+	}
+
+	ring := shard.Ring(16)
+	s := shard.Wrap(ring, record("outer"), record("inner"))
+	s.SetPeers([]peer.Peer{{Name: "peer-a", State: peer.StateParticipant}})
+	require.Equal(t, ring.Peers(), s.Peers(), "other methods should be passed through")
+
+	require.Equal(t, "peer-a", lookupOwner(t, s, 0))
+	require.Equal(t, []string{"outer", "inner"}, calls)
+
+	expectRanges, err := shard.OwnedRanges(ring, "peer-a", 1, shard.OpRead)
+	require.NoError(t, err)
+	actualRanges, err := shard.OwnedRanges(s, "peer-a", 1, shard.OpRead)
+	require.NoError(t, err)
+	require.Equal(t, expectRanges, actualRanges)
+}
+
+func TestInstrumentLookups(t *testing.T) {
+	s := shard.Wrap(shard.Ring(16), shard.InstrumentLookups())
+	s.SetPeers([]peer.Peer{{Name: "peer-a", State: peer.StateParticipant}})
+
+	for i := 0; i < 3; i++ {
+		lookupOwner(t, s, shard.Key(i))
+	}
+	_, err := s.Lookup(0, 2, shard.OpReadWrite)
+	require.Error(t, err)
+
+	expect := `
+# HELP shard_lookups_total Total number of lookups by op and result.
+# TYPE shard_lookups_total counter
+shard_lookups_total{op="Read",result="success"} 3
+shard_lookups_total{op="ReadWrite",result="error"} 1
+`
+	require.NoError(t, testutil.CollectAndCompare(shard.Metrics(s), strings.NewReader(expect), "shard_lookups_total"))
+
+	// The metrics of the wrapped Sharder are still exposed.
+	require.NotZero(t, testutil.CollectAndCount(shard.Metrics(s), "shard_peer_ownership_max_ratio"))
+	require.Equal(t, 2, testutil.CollectAndCount(shard.Metrics(s), "shard_lookup_duration_seconds"))
+}
+
+func TestTraceLookups(t *testing.T) {
+	type span struct {
+		key    shard.Key
+		owners []string
+		err    error
+	}
+	var spans []span
+
+	s := shard.Wrap(shard.Ring(16), shard.TraceLookups(func(key shard.Key, numOwners int, op shard.Op) func([]peer.Peer, error) {
+		return func(owners []peer.Peer, err error) {
+			sp := span{key: key, err: err}
+			for _, o := range owners {
+				sp.owners = append(sp.owners, o.Name)
+			}
+			spans = append(spans, sp)
+		}
+	}))
+	s.SetPeers([]peer.Peer{{Name: "peer-a", State: peer.StateParticipant}})
+
+	lookupOwner(t, s, 1)
+	_, err := s.Lookup(2, 2, shard.OpRead)
+	require.Error(t, err)
+
+	require.Equal(t, []span{
+		{key: 1, owners: []string{"peer-a"}},
+		{key: 2, err: err},
+	}, spans)
+}
@@ -0,0 +1,279 @@
+package shard
+
+import (
+	"context"
+
+	"github.com/rfratto/ckit/internal/chash"
+	"github.com/rfratto/ckit/peer"
+)
+
+// Option configures a Sharder.
+type Option func(*options)
+
+type options struct {
+	eligible  func(p peer.Peer, op Op) bool
+	roles     []string
+	zoneAware bool
+
+	shuffleTenant string
+	shuffleSize   int
+
+	constraints []PlacementConstraint
+
+	hash      chash.HashFunc
+	seed      uint64
+	name      string
+	cacheSize int
+	unhealthy UnhealthyPolicy
+
+	tokens func(p peer.Peer) []uint32 // Tokens of peers for chash.TokenHash
+}
+
+func buildOptions(opts []Option) options {
+	o := options{eligible: DefaultEligibility}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.seed != 0 {
+		o.hash = chash.Seeded(o.hash, o.seed)
+	}
+
+	if len(o.roles) > 0 {
+		var (
+			eligible = o.eligible
+			roles    = o.roles
+		)
+		o.eligible = func(p peer.Peer, op Op) bool {
+			for _, role := range roles {
+				if p.HasRole(role) {
+					return eligible(p, op)
+				}
+			}
+			return false
+		}
+	}
+	return o
+}
+
+// WithEligibility overrides how a Sharder determines which peers may own
+// keys for an Op. f is invoked for every peer passed to SetPeers, once per
+// Op. Peers for which f returns false for every Op are ignored entirely.
+//
+// WithEligibility is useful for assigning ownership to custom states
+// registered with peer.RegisterState. The default is DefaultEligibility.
+func WithEligibility(f func(p peer.Peer, op Op) bool) Option {
+	return func(o *options) { o.eligible = f }
+}
+
+// WithRoles restricts a Sharder to peers which advertise at least one of the
+// provided roles, creating a per-role view of the cluster. Peers must also
+// be eligible according to WithEligibility. Calling WithRoles multiple times
+// appends to the set of roles.
+func WithRoles(roles ...string) Option {
+	return func(o *options) { o.roles = append(o.roles, roles...) }
+}
+
+// WithZoneAwareness makes a Sharder spread the owners of a key across
+// distinct availability zones, using peer.Peer.AvailabilityZone. Owners are
+// chosen in the order preferred by the underlying hash, skipping peers in a
+// zone which already owns the key. If there are fewer zones than requested
+// owners, the remaining owners are chosen from the skipped peers in order of
+// preference. Peers without a zone are treated as being in the same zone.
+//
+// Zone-aware lookups for more than one owner must consider every eligible
+// peer, and run in at least O(N) time.
+func WithZoneAwareness() Option {
+	return func(o *options) { o.zoneAware = true }
+}
+
+// WithName names a Sharder. The name is added as a "sharder" label to the
+// metrics of the Sharder, distinguishing the metrics of multiple Sharders
+// registered to the same registry.
+func WithName(name string) Option {
+	return func(o *options) { o.name = name }
+}
+
+// WithLookupCache caches the results of up to size lookups, such as for
+// workloads which repeatedly look up a small set of hot keys. Results are
+// cached by key, number of owners, and Op, evicting the least recently used
+// result when the cache is full. The cache is discarded whenever the peers
+// of the Sharder change.
+//
+// Lookups which exclude peers bypass the cache, as do lookups which skip
+// unhealthy peers because of WithUnhealthyPolicy. Unlike other lookups, cached
+// lookups take a lock, so the cache may not help highly concurrent
+// workloads. Hits and misses are exposed through the metrics of the Sharder.
+func WithLookupCache(size int) Option {
+	return func(o *options) { o.cacheSize = size }
+}
+
+// UnhealthyPolicy determines how a Sharder treats peers which were marked as
+// unhealthy with SetUnhealthy.
+type UnhealthyPolicy uint8
+
+const (
+	// UnhealthyIgnore ignores the health of peers: unhealthy peers continue
+	// to own keys. UnhealthyIgnore is the default.
+	UnhealthyIgnore UnhealthyPolicy = iota
+
+	// UnhealthyAvoid skips unhealthy peers for lookups, choosing the
+	// next-best owners in their place. If there aren't enough healthy peers
+	// to satisfy a lookup, unhealthy peers are used.
+	UnhealthyAvoid
+
+	// UnhealthyExclude skips unhealthy peers for lookups, choosing the
+	// next-best owners in their place. Lookups fail if there aren't enough
+	// healthy peers.
+	UnhealthyExclude
+)
+
+// WithUnhealthyPolicy determines how a Sharder treats peers which were marked
+// as unhealthy with SetUnhealthy, such as Participants which are suspected
+// to have failed but haven't been removed from the cluster yet.
+// The default is UnhealthyIgnore.
+//
+// Unhealthy peers are skipped as if they were excluded with WithExclude, so
+// healthy owners keep their position. Only Lookup is affected by the health
+// of peers; ownership reported by OwnedRanges, DebugDump, and metrics
+// ignores it.
+func WithUnhealthyPolicy(p UnhealthyPolicy) Option {
+	return func(o *options) { o.unhealthy = p }
+}
+
+// HashFunc hashes data to a uint64.
+type HashFunc func(data []byte) uint64
+
+// WithHashFunc overrides the hash function used by a Sharder to place peers,
+// such as to match the placement of an existing system or to use a faster
+// hash. The default is xxhash, matching KeyBuilder and StringKey. Keys are
+// not hashed by the Sharder; use Key(f(data)) to build keys with the same
+// hash function.
+//
+// Ring hashes each token as the peer name followed by one byte for each
+// token generated so far. Rendezvous and Multiprobe hash the peer name, and
+// Multiprobe also uses f to derive probes from keys. Jump doesn't hash peers
+// and ignores WithHashFunc.
+func WithHashFunc(f HashFunc) Option {
+	return func(o *options) { o.hash = chash.HashFunc(f) }
+}
+
+// WithSeed mixes seed into the hashes used by a Sharder to place peers.
+// Sharders with the same peers and seed always agree on placement, while
+// Sharders with different seeds place peers independently, such as to keep
+// independent clusters from sharing hot spots or to reproduce a distribution
+// exactly in tests. Seeds are applied on top of WithHashFunc. A seed of 0
+// uses the default placement.
+//
+// The seed also changes the subset of peers chosen by ShuffleShard. Keys are
+// not seeded. Jump and DskitRing don't hash peers and ignore WithSeed.
+func WithSeed(seed uint64) Option {
+	return func(o *options) { o.seed = seed }
+}
+
+// A PlacementConstraint determines whether candidate may own a key alongside
+// the owners which have already been selected for a lookup. selected is in
+// the order owners were chosen and is empty when choosing the first owner.
+//
+// Placement constraints must only reject candidates because of conflicts with
+// selected owners: a rejected candidate must continue to be rejected as more
+// owners are selected.
+type PlacementConstraint func(selected []peer.Peer, candidate peer.Peer) bool
+
+// WithPlacementConstraints makes a Sharder evaluate constraints when
+// selecting owners for lookups of more than one owner. Owners are chosen in
+// the order preferred by the underlying hash, skipping candidates which are
+// rejected by any constraint. Lookup returns an error if not enough peers
+// satisfy the constraints. Calling WithPlacementConstraints multiple times
+// appends to the set of constraints.
+//
+// Lookups with placement constraints must consider every eligible peer, and
+// run in at least O(N) time.
+func WithPlacementConstraints(constraints ...PlacementConstraint) Option {
+	return func(o *options) { o.constraints = append(o.constraints, constraints...) }
+}
+
+// DistinctLabel returns a PlacementConstraint which prevents two owners of a
+// key from having the same value for the label key, such as a label for the
+// host or rack of a peer. Peers without the label never conflict.
+func DistinctLabel(key string) PlacementConstraint {
+	return func(selected []peer.Peer, candidate peer.Peer) bool {
+		value, ok := candidate.Labels[key]
+		if !ok {
+			return true
+		}
+		for _, p := range selected {
+			if other, ok := p.Labels[key]; ok && other == value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// LookupOption configures a single call to Sharder.Lookup.
+type LookupOption func(*lookupOptions)
+
+type lookupOptions struct {
+	exclude map[string]struct{}
+	ctx     context.Context
+}
+
+func buildLookupOptions(opts []LookupOption) lookupOptions {
+	var lo lookupOptions
+	for _, opt := range opts {
+		opt(&lo)
+	}
+	return lo
+}
+
+// WithExclude excludes the peers with the provided names from owning the
+// key, such as peers which are known to be overloaded. The next-best owners
+// in the Sharder's order of preference are returned in their place, so
+// owners which aren't excluded keep their position. Calling WithExclude
+// multiple times appends to the set of excluded peers.
+//
+// Lookups with excluded peers must consider more candidates, and may be
+// slower for some Sharders.
+func WithExclude(names ...string) LookupOption {
+	return func(lo *lookupOptions) {
+		if lo.exclude == nil {
+			lo.exclude = make(map[string]struct{}, len(names))
+		}
+		for _, name := range names {
+			lo.exclude[name] = struct{}{}
+		}
+	}
+}
+
+// WithContext associates ctx with a lookup, such as to parent the tracing
+// spans created by Middleware. Sharders don't use ctx themselves, and
+// lookups aren't canceled when ctx is.
+func WithContext(ctx context.Context) LookupOption {
+	return func(lo *lookupOptions) { lo.ctx = ctx }
+}
+
+// LookupContext returns the context passed to WithContext in opts, or
+// context.Background if there is none. LookupContext is intended for
+// Middleware which need the context of a lookup.
+func LookupContext(opts ...LookupOption) context.Context {
+	if lo := buildLookupOptions(opts); lo.ctx != nil {
+		return lo.ctx
+	}
+	return context.Background()
+}
+
+// DefaultEligibility implements the default eligibility rules for sharders:
+// Participants are eligible for OpRead and OpReadWrite, while Draining and
+// Terminating peers are only eligible for OpRead. Peers in any other state
+// are never eligible.
+func DefaultEligibility(p peer.Peer, op Op) bool {
+	switch p.State {
+	case peer.StateParticipant:
+		return true
+	case peer.StateDraining, peer.StateTerminating:
+		return op == OpRead
+	default:
+		return false
+	}
+}
@@ -0,0 +1,81 @@
+package shard
+
+import "github.com/rfratto/ckit/peer"
+
+// ReplicaSet is the set of replicas which own a key, along with the number
+// of replicas which must respond for reads and writes to succeed.
+type ReplicaSet struct {
+	// Replicas are the owners of the key, in the order returned by Lookup.
+	Replicas []peer.Peer
+
+	// WriteQuorum is the number of replicas which must acknowledge a write:
+	// a majority of Replicas.
+	WriteQuorum int
+
+	// ReadQuorum is the number of replicas which must respond to a read. Any
+	// ReadQuorum replicas include at least one replica which acknowledged
+	// the most recent successful write.
+	ReadQuorum int
+}
+
+// Quorum returns the rf replicas of key for op, along with majority read and
+// write quorums for them. LookupOptions are passed to Lookup. An error is
+// returned if there are fewer than rf eligible peers.
+func Quorum(s Sharder, key Key, rf int, op Op, opts ...LookupOption) (ReplicaSet, error) {
+	replicas, err := s.Lookup(key, rf, op, opts...)
+	if err != nil {
+		return ReplicaSet{}, err
+	}
+
+	write := len(replicas)/2 + 1
+	return ReplicaSet{
+		Replicas:    replicas,
+		WriteQuorum: write,
+		ReadQuorum:  len(replicas) - write + 1,
+	}, nil
+}
+
+// Satisfies returns true if at least quorum of the replicas of rs are named
+// in succeeded, such as the names of replicas which acknowledged a write.
+// Names which aren't replicas and duplicate names are ignored.
+func (rs ReplicaSet) Satisfies(quorum int, succeeded []string) bool {
+	return rs.countReplicas(succeeded) >= quorum
+}
+
+// Achievable returns true if quorum can still be reached when the replicas
+// named in failed don't respond. Callers can stop waiting for responses
+// once Achievable returns false. Names which aren't replicas and duplicate
+// names are ignored.
+func (rs ReplicaSet) Achievable(quorum int, failed []string) bool {
+	return len(rs.Replicas)-rs.countReplicas(failed) >= quorum
+}
+
+// countReplicas returns the number of distinct replicas of rs in names.
+func (rs ReplicaSet) countReplicas(names []string) int {
+	var count int
+	for i, name := range names {
+		if !rs.isReplica(name) || containsString(names[:i], name) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (rs ReplicaSet) isReplica(name string) bool {
+	for _, p := range rs.Replicas {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
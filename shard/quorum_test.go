@@ -0,0 +1,62 @@
+package shard_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuorum(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 5; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+	ring := shard.Ring(16)
+	ring.SetPeers(peers)
+
+	for _, tc := range []struct {
+		rf          int
+		write, read int
+	}{
+		{rf: 1, write: 1, read: 1},
+		{rf: 2, write: 2, read: 1},
+		{rf: 3, write: 2, read: 2},
+		{rf: 4, write: 3, read: 2},
+		{rf: 5, write: 3, read: 3},
+	} {
+		rs, err := shard.Quorum(ring, shard.StringKey("key"), tc.rf, shard.OpReadWrite)
+		require.NoError(t, err)
+
+		owners, err := ring.Lookup(shard.StringKey("key"), tc.rf, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, shard.ReplicaSet{Replicas: owners, WriteQuorum: tc.write, ReadQuorum: tc.read}, rs, "rf %d", tc.rf)
+		require.Greater(t, rs.WriteQuorum+rs.ReadQuorum, tc.rf, "reads should overlap with writes")
+	}
+
+	_, err := shard.Quorum(ring, shard.StringKey("key"), 6, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 6, have 5")
+}
+
+func TestReplicaSet(t *testing.T) {
+	rs := shard.ReplicaSet{
+		Replicas: []peer.Peer{
+			{Name: "peer-a"},
+			{Name: "peer-b"},
+			{Name: "peer-c"},
+		},
+		WriteQuorum: 2,
+		ReadQuorum:  2,
+	}
+
+	require.False(t, rs.Satisfies(rs.WriteQuorum, nil))
+	require.False(t, rs.Satisfies(rs.WriteQuorum, []string{"peer-a", "peer-a"}), "duplicates should be ignored")
+	require.False(t, rs.Satisfies(rs.WriteQuorum, []string{"peer-a", "peer-d"}), "non-replicas should be ignored")
+	require.True(t, rs.Satisfies(rs.WriteQuorum, []string{"peer-c", "peer-a"}))
+
+	require.True(t, rs.Achievable(rs.WriteQuorum, nil))
+	require.True(t, rs.Achievable(rs.WriteQuorum, []string{"peer-b", "peer-b", "peer-d"}))
+	require.False(t, rs.Achievable(rs.WriteQuorum, []string{"peer-b", "peer-c"}))
+}
@@ -0,0 +1,175 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrRangesUnsupported is returned by OwnedRanges for Sharders which don't
+// assign keys to peers by range.
+var ErrRangesUnsupported = errors.New("sharder does not assign keys by range")
+
+// KeyRange is an inclusive range of keys from Start to End.
+type KeyRange struct {
+	Start, End Key
+}
+
+// Contains returns true if k is within r.
+func (r KeyRange) Contains(k Key) bool { return k >= r.Start && k <= r.End }
+
+// String returns a string representation of r.
+func (r KeyRange) String() string { return fmt.Sprintf("[%d, %d]", r.Start, r.End) }
+
+// KeyRanges is a sorted list of non-overlapping KeyRange.
+type KeyRanges []KeyRange
+
+// Contains returns true if k is within any of the ranges in rs. Contains runs
+// in O(log N) time.
+func (rs KeyRanges) Contains(k Key) bool {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].End >= k })
+	return i < len(rs) && rs[i].Contains(k)
+}
+
+// rangeSharder is implemented by Sharders which can report the ranges of
+// keys owned by a peer.
+type rangeSharder interface {
+	ownedRanges(name string, numOwners int, op Op) (KeyRanges, error)
+}
+
+// OwnedRanges returns the ranges of keys for which the peer name is one of
+// the first numOwners owners for op. The returned ranges are sorted and
+// don't overlap. Adjacent token ranges owned by name are merged.
+//
+// Only Sharders created by Ring assign keys by range. ErrRangesUnsupported
+// is returned for other Sharders. Sharders which wrap another Sharder, such
+// as TrackHotKeys, are unwrapped.
+func OwnedRanges(s Sharder, name string, numOwners int, op Op) (KeyRanges, error) {
+	rs, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(rangeSharder)
+		return ok
+	}).(rangeSharder)
+	if !ok {
+		return nil, ErrRangesUnsupported
+	}
+	return rs.ownedRanges(name, numOwners, op)
+}
+
+// WalkOwnedRanges invokes f for each range returned by OwnedRanges, in
+// order, such as to scan storage for the keys owned by a peer after a
+// membership change. Walking stops early if f returns false.
+//
+// The ranges are computed before f is first invoked, so f may call methods
+// of s, and changes to s while walking are not observed.
+func WalkOwnedRanges(s Sharder, name string, numOwners int, op Op, f func(r KeyRange) bool) error {
+	ranges, err := OwnedRanges(s, name, numOwners, op)
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if !f(r) {
+			break
+		}
+	}
+	return nil
+}
+
+func (ch *chasher) ownedRanges(name string, numOwners int, op Op) (KeyRanges, error) {
+	st := ch.loadState()
+
+	h, numNodes := st.hashForOp(op)
+	if h == nil {
+		return nil, fmt.Errorf("unknown op %s", op)
+	}
+
+	desc := h.Describe()
+	if desc.Algorithm != "ring" {
+		return nil, ErrRangesUnsupported
+	}
+	if numOwners < 1 {
+		numOwners = 1
+	}
+	if numOwners > numNodes {
+		return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", numOwners, numNodes)
+	}
+
+	var ranges []KeyRange
+	for _, r := range ch.ringRanges(st, h, numNodes, desc.Tokens, numOwners) {
+		for _, owner := range r.Owners {
+			if owner == name {
+				ranges = append(ranges, KeyRange{Start: Key(r.Start), End: Key(r.End)})
+				break
+			}
+		}
+	}
+	return normalizeRanges(ranges), nil
+}
+
+// DiffRanges returns the ranges of keys which are in newRanges but not
+// oldRanges (gained), and the ranges of keys which are in oldRanges but not
+// newRanges (lost). The inputs don't need to be sorted. The returned ranges
+// are sorted and don't overlap.
+func DiffRanges(oldRanges, newRanges []KeyRange) (gained, lost []KeyRange) {
+	var (
+		oldNorm = normalizeRanges(oldRanges)
+		newNorm = normalizeRanges(newRanges)
+	)
+	return subtractRanges(newNorm, oldNorm), subtractRanges(oldNorm, newNorm)
+}
+
+// normalizeRanges splits ranges which wrap around the keyspace (Start >
+// End), then sorts and merges overlapping or adjacent ranges.
+func normalizeRanges(ranges []KeyRange) []KeyRange {
+	split := make([]KeyRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start > r.End {
+			split = append(split, KeyRange{Start: r.Start, End: math.MaxUint64}, KeyRange{Start: 0, End: r.End})
+			continue
+		}
+		split = append(split, r)
+	}
+	if len(split) == 0 {
+		return nil
+	}
+	sort.Slice(split, func(i, j int) bool { return split[i].Start < split[j].Start })
+
+	res := []KeyRange{split[0]}
+	for _, r := range split[1:] {
+		last := &res[len(res)-1]
+		if last.End == math.MaxUint64 || r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// subtractRanges returns the keys of a which aren't in b. a and b must be
+// normalized.
+func subtractRanges(a, b []KeyRange) []KeyRange {
+	var res []KeyRange
+	for _, r := range a {
+		start, covered := r.Start, false
+		for _, other := range b {
+			if other.End < start || other.Start > r.End {
+				continue
+			}
+			if other.Start > start {
+				res = append(res, KeyRange{Start: start, End: other.Start - 1})
+			}
+			if other.End >= r.End {
+				covered = true
+				break
+			}
+			start = other.End + 1
+		}
+		if !covered {
+			res = append(res, KeyRange{Start: start, End: r.End})
+		}
+	}
+	return res
+}
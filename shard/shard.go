@@ -3,10 +3,13 @@
 package shard
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rfratto/ckit/internal/chash"
 	"github.com/rfratto/ckit/peer"
 )
@@ -15,11 +18,11 @@ import (
 type Op uint8
 
 const (
-	// OpRead is used for read-only lookups. Only nodes in the Participant
-	// or Terminating state are considered.
+	// OpRead is used for read-only lookups. By default, only nodes in the
+	// Participant, Draining, or Terminating state are considered.
 	OpRead Op = iota
-	// OpReadWrite is used for read or write lookups. Only nodes in the
-	// Participant state are considered.
+	// OpReadWrite is used for read or write lookups. By default, only nodes in
+	// the Participant state are considered.
 	OpReadWrite
 )
 
@@ -36,36 +39,192 @@ func (ht Op) String() string {
 }
 
 // A Sharder can lookup the owner for a specific key.
+//
+// Sharders may implement optional interfaces to support more capabilities,
+// such as Preferencer, Incremental, HealthAware, Snapshotter, Dumper, and
+// Instrumented. Use the package-level function of the same name as a method,
+// such as Preference or SetUnhealthy, to call it on any Sharder. Sharders
+// returned by this package support every optional interface, either directly
+// or through the Sharder they wrap.
 type Sharder interface {
 	// Lookup returns numOwners Peers for the provided key. The provided op
 	// is used to determine which peers may be considered potential owners.
 	//
 	// An error will be returned if the type of eligible peers for the provided
 	// op is less than numOwners.
-	Lookup(key Key, numOwners int, op Op) ([]peer.Peer, error)
+	//
+	// LookupOptions may be provided to change how owners are selected for a
+	// single lookup, such as excluding peers with WithExclude.
+	//
+	// Lookup doesn't take a lock and never waits for concurrent changes to
+	// the peers; it observes the peers either before or after the change.
+	Lookup(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error)
 
-	// Peers gets the current set of non-viewer peers used for sharding.
+	// Peers gets the current set of peers used for sharding. Peers which are
+	// not eligible to own keys for any Op are excluded.
 	Peers() []peer.Peer
 
 	// SetPeers updates the set of peers used for sharding. Peers will be ignored
-	// if they are a viewer.
+	// if they are not eligible to own keys for any Op. By default, only
+	// Participant, Draining, and Terminating peers are eligible; see
+	// WithEligibility.
+	//
+	// Sharders which support weights use peer.Peer.Weight to assign
+	// proportionally more keys to peers with higher weights.
 	SetPeers(ps []peer.Peer)
 }
 
+// ErrUnsupported is returned when calling an optional method on a Sharder
+// which doesn't implement it.
+var ErrUnsupported = errors.New("operation not supported by sharder")
+
+// findSharder returns the first Sharder for which ok returns true, starting
+// at s and unwrapping Sharders which wrap another Sharder, such as
+// TrackHotKeys. findSharder returns nil if there is no such Sharder.
+func findSharder(s Sharder, ok func(s Sharder) bool) Sharder {
+	for s != nil {
+		if ok(s) {
+			return s
+		}
+		u, isWrapper := s.(interface{ Unwrap() Sharder })
+		if !isWrapper {
+			return nil
+		}
+		s = u.Unwrap()
+	}
+	return nil
+}
+
+// Preferencer is implemented by Sharders which can list the preferred owners
+// of a key.
+type Preferencer interface {
+	// Preference returns up to maxN eligible peers for key and op, in the
+	// order they would be chosen as owners. If maxN is less than 1, every
+	// eligible peer is returned. Preference is intended for callers which
+	// implement their own fallback logic, walking candidates until one
+	// succeeds without repeated lookups of a growing number of owners.
+	//
+	// The first numOwners peers of the preference list are the peers
+	// returned by Lookup with the same options, unless Lookup would fall
+	// back to using unhealthy peers. Unlike Lookup, Preference
+	// doesn't return an error when there are fewer than maxN eligible peers.
+	// Excluded peers and peers rejected by placement constraints are omitted,
+	// and unhealthy peers are omitted or moved to the end of the list
+	// depending on WithUnhealthyPolicy.
+	//
+	// Preference considers every eligible peer, and runs in at least O(N)
+	// time.
+	Preference(key Key, maxN int, op Op, opts ...LookupOption) ([]peer.Peer, error)
+}
+
+// Preference calls Preferencer.Preference on s or the Sharder it wraps.
+// ErrUnsupported is returned if s doesn't implement Preferencer.
+func Preference(s Sharder, key Key, maxN int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+	p, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Preferencer)
+		return ok
+	}).(Preferencer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return p.Preference(key, maxN, op, opts...)
+}
+
+// HealthAware is implemented by Sharders which can skip unhealthy peers.
+type HealthAware interface {
+	// SetUnhealthy replaces the set of peers which are suspected to be
+	// unhealthy. Unhealthy peers remain peers of the Sharder, but may be
+	// skipped for lookups depending on WithUnhealthyPolicy. The set is
+	// retained when the peers change; names which aren't peers are ignored.
+	SetUnhealthy(names ...string)
+}
+
+// SetUnhealthy calls HealthAware.SetUnhealthy on s or the Sharder it wraps.
+// SetUnhealthy does nothing if s doesn't implement HealthAware.
+func SetUnhealthy(s Sharder, names ...string) {
+	if h, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(HealthAware)
+		return ok
+	}).(HealthAware); ok {
+		h.SetUnhealthy(names...)
+	}
+}
+
 // chasher wraps around two chash.Hash and adds logic for Op.
+//
+// The peers and hashes of a chasher are published as an immutable
+// sharderState. Updates build a new sharderState and atomically replace the
+// old one, so reads never take a lock and always observe a consistent set of
+// peers and hashes.
 type chasher struct {
-	peersMut sync.RWMutex
-	peers    map[string]peer.Peer // Set of all peers shared across both hashes
+	opts    options
+	newHash func() chash.Hash
+
+	writeMut sync.Mutex   // Serializes updates to state
+	state    atomic.Value // *sharderState
+
+	m     *ownershipCollector
+	cache *lookupCache // nil if caching is disabled
+}
+
+// sharderState is the state of a chasher. It must not be modified once it
+// has been published.
+type sharderState struct {
+	peers map[string]peer.Peer // Set of all peers shared across both hashes
+	all   map[string]peer.Peer // Every peer passed to the sharder, including ineligible peers
+
+	read, readWrite       chash.Hash
+	numRead, numReadWrite int    // Number of nodes in read and readWrite
+	self                  string // Name of the local peer, if known
+	gen                   uint64 // Incremented whenever peers change
 
-	read, readWrite chash.Hash
+	unhealthy map[string]struct{} // Names passed to SetUnhealthy
+}
+
+// newChasher returns a chasher which uses hashes created by newHash.
+func newChasher(o options, newHash func() chash.Hash) *chasher {
+	ch := &chasher{
+		opts:    o,
+		newHash: newHash,
+	}
+	ch.state.Store(&sharderState{
+		peers:     make(map[string]peer.Peer),
+		all:       make(map[string]peer.Peer),
+		read:      newHash(),
+		readWrite: newHash(),
+	})
+	if o.cacheSize > 0 {
+		ch.cache = newLookupCache(o.cacheSize, o.constLabels())
+	}
+	ch.m = newOwnershipCollector(ch)
+	return ch
+}
+
+func (ch *chasher) Metrics() prometheus.Collector { return ch.m }
+
+// loadState returns the current state of ch.
+func (ch *chasher) loadState() *sharderState {
+	return ch.state.Load().(*sharderState)
+}
+
+// hashForOp returns the hash used for op and its number of nodes, or a nil
+// hash if op is unknown.
+func (st *sharderState) hashForOp(op Op) (chash.Hash, int) {
+	switch op {
+	case OpRead:
+		return st.read, st.numRead
+	case OpReadWrite:
+		return st.readWrite, st.numReadWrite
+	default:
+		return nil, 0
+	}
 }
 
 func (ch *chasher) Peers() []peer.Peer {
-	ch.peersMut.RLock()
-	defer ch.peersMut.RUnlock()
+	st := ch.loadState()
 
-	ps := make([]peer.Peer, 0, len(ch.peers))
-	for _, p := range ch.peers {
+	ps := make([]peer.Peer, 0, len(st.peers))
+	for _, p := range st.peers {
 		ps = append(ps, p)
 	}
 	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
@@ -74,102 +233,438 @@ func (ch *chasher) Peers() []peer.Peer {
 }
 
 func (ch *chasher) SetPeers(ps []peer.Peer) {
+	all := make(map[string]peer.Peer, len(ps))
+	for _, p := range ps {
+		all[p.Name] = p
+	}
+
+	ch.writeMut.Lock()
+	defer ch.writeMut.Unlock()
+
+	ch.setPeersLocked(all, ps)
+}
+
+// setPeersLocked publishes a new state with new hashes computed from ps.
+// all is the set of every peer passed to ch, and ps are the peers in all.
+// Must be called with ch.writeMut held.
+func (ch *chasher) setPeersLocked(all map[string]peer.Peer, ps []peer.Peer) {
 	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
 
 	var (
 		newPeers     = make(map[string]peer.Peer, len(ps))
 		newRead      = make([]string, 0, len(ps))
 		newReadWrite = make([]string, 0, len(ps))
+
+		readWeights      = make([]int, 0, len(ps))
+		readWriteWeights = make([]int, 0, len(ps))
 	)
 
+	var self string
 	for _, p := range ps {
+		if p.Self {
+			self = p.Name
+		}
+
 		// NOTE(rfratto): newRead and newReadWrite remain in sorted order since we
 		// append to them from the already-sorted ps slice.
-		switch p.State {
-		case peer.StateParticipant:
+		var (
+			read      = ch.opts.eligible(p, OpRead)
+			readWrite = ch.opts.eligible(p, OpReadWrite)
+		)
+		if read {
 			newRead = append(newRead, p.Name)
+			readWeights = append(readWeights, p.Weight)
+		}
+		if readWrite {
 			newReadWrite = append(newReadWrite, p.Name)
-			newPeers[p.Name] = p
-		case peer.StateTerminating:
-			newRead = append(newRead, p.Name)
+			readWriteWeights = append(readWriteWeights, p.Weight)
+		}
+		if read || readWrite {
 			newPeers[p.Name] = p
 		}
 	}
 
-	ch.peersMut.Lock()
-	defer ch.peersMut.Unlock()
+	if ch.opts.shuffleSize > 0 {
+		newRead, readWeights = ch.opts.shuffleShard(newRead, readWeights)
+		newReadWrite, readWriteWeights = ch.opts.shuffleShard(newReadWrite, readWriteWeights)
+		newPeers = keepPeers(newPeers, newRead, newReadWrite)
+	}
 
-	ch.peers = newPeers
-	ch.read.SetNodes(newRead)
-	ch.readWrite.SetNodes(newReadWrite)
+	st := &sharderState{
+		peers:     newPeers,
+		all:       all,
+		read:      ch.newHash(),
+		readWrite: ch.newHash(),
+		self:      self,
+		gen:       ch.loadState().gen + 1,
+		unhealthy: ch.loadState().unhealthy,
+	}
+	st.numRead = ch.setNodes(st.read, newRead, readWeights, newPeers)
+	st.numReadWrite = ch.setNodes(st.readWrite, newReadWrite, readWriteWeights, newPeers)
+	ch.state.Store(st)
 }
 
-func (ch *chasher) Lookup(key Key, numOwners int, op Op) ([]peer.Peer, error) {
-	ch.peersMut.RLock()
-	defer ch.peersMut.RUnlock()
+// setNodes updates the nodes for h, passing weights or tokens along if h
+// supports them. peers must contain every node in nodes. setNodes returns the
+// number of nodes which own keys in h, which may be fewer than len(nodes).
+func (ch *chasher) setNodes(h chash.Hash, nodes []string, weights []int, peers map[string]peer.Peer) int {
+	switch h := h.(type) {
+	case chash.TokenHash:
+		tokens := make([][]uint32, len(nodes))
+		for i, node := range nodes {
+			tokens[i] = ch.opts.tokens(peers[node])
+		}
+		h.SetNodeTokens(nodes, tokens)
+	case chash.WeightedHash:
+		h.SetWeightedNodes(nodes, weights)
+	default:
+		h.SetNodes(nodes)
+	}
 
-	var (
-		names []string
-		err   error
-	)
+	if nc, ok := h.(chash.NodeCounter); ok {
+		return nc.NumNodes()
+	}
+	return len(nodes)
+}
 
-	switch op {
-	case OpRead:
-		names, err = ch.read.Get(uint64(key), numOwners)
-	case OpReadWrite:
-		names, err = ch.readWrite.Get(uint64(key), numOwners)
-	default:
+func (ch *chasher) Lookup(key Key, numOwners int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+	lo := buildLookupOptions(opts)
+
+	st := ch.loadState()
+
+	h, numNodes := st.hashForOp(op)
+	if h == nil {
 		return nil, fmt.Errorf("unknown op %s", op)
 	}
+
+	if ch.opts.unhealthy != UnhealthyIgnore && len(st.unhealthy) > 0 {
+		return ch.lookupHealthy(st, h, numNodes, key, numOwners, lo)
+	}
+
+	// Excluding peers changes the result, so lookups which exclude peers
+	// aren't cached.
+	cacheKey := lookupCacheKey{key: key, numOwners: numOwners, op: op}
+	useCache := ch.cache != nil && len(lo.exclude) == 0
+	if useCache {
+		if res, ok := ch.cache.get(st.gen, cacheKey); ok {
+			return res, nil
+		}
+	}
+
+	names, err := ch.lookupNames(st, h, numNodes, key, numOwners, lo)
 	if err != nil {
 		return nil, err
 	}
 
+	res := st.namesToPeers(names)
+	if useCache {
+		ch.cache.put(st.gen, cacheKey, res)
+	}
+	return res, nil
+}
+
+// lookupHealthy performs a lookup which skips the unhealthy peers of st
+// according to the unhealthy policy of ch.
+func (ch *chasher) lookupHealthy(st *sharderState, h chash.Hash, numNodes int, key Key, numOwners int, lo lookupOptions) ([]peer.Peer, error) {
+	healthy := lookupOptions{exclude: make(map[string]struct{}, len(lo.exclude)+len(st.unhealthy))}
+	for name := range lo.exclude {
+		healthy.exclude[name] = struct{}{}
+	}
+	for name := range st.unhealthy {
+		if _, ok := st.peers[name]; ok {
+			healthy.exclude[name] = struct{}{}
+		}
+	}
+
+	names, err := ch.lookupNames(st, h, numNodes, key, numOwners, healthy)
+	if err != nil && ch.opts.unhealthy == UnhealthyAvoid {
+		// Fall back to using unhealthy peers.
+		names, err = ch.lookupNames(st, h, numNodes, key, numOwners, lo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st.namesToPeers(names), nil
+}
+
+func (ch *chasher) Preference(key Key, maxN int, op Op, opts ...LookupOption) ([]peer.Peer, error) {
+	lo := buildLookupOptions(opts)
+
+	st := ch.loadState()
+
+	h, numNodes := st.hashForOp(op)
+	if h == nil {
+		return nil, fmt.Errorf("unknown op %s", op)
+	}
+	if maxN < 1 || maxN > numNodes {
+		maxN = numNodes
+	}
+
+	candidates, err := h.Get(uint64(key), numNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		allowed   = make([]string, 0, len(candidates))
+		unhealthy []string
+	)
+	for _, name := range candidates {
+		if _, excluded := lo.exclude[name]; excluded {
+			continue
+		}
+		if _, ok := st.unhealthy[name]; ok && ch.opts.unhealthy != UnhealthyIgnore {
+			if ch.opts.unhealthy == UnhealthyAvoid {
+				unhealthy = append(unhealthy, name)
+			}
+			continue
+		}
+		allowed = append(allowed, name)
+	}
+
+	// Unhealthy peers are only used once there aren't enough healthy peers,
+	// so they're least preferred.
+	names := ch.orderOwners(st, allowed, maxN)
+	if len(names) < maxN && len(unhealthy) > 0 {
+		names = ch.orderOwners(st, append(allowed, unhealthy...), maxN)
+	}
+	return st.namesToPeers(names), nil
+}
+
+// namesToPeers returns the peers of st with the given names.
+func (st *sharderState) namesToPeers(names []string) []peer.Peer {
 	res := make([]peer.Peer, len(names))
 	for i, name := range names {
-		p, ok := ch.peers[name]
+		p, ok := st.peers[name]
 		if !ok {
 			panic("Unexpected peer " + name)
 		}
 		res[i] = p
 	}
+	return res
+}
+
+func (ch *chasher) SetUnhealthy(names ...string) {
+	unhealthy := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		unhealthy[name] = struct{}{}
+	}
+
+	ch.writeMut.Lock()
+	defer ch.writeMut.Unlock()
+
+	// The peers and hashes don't change, so the rest of the state (including
+	// its generation) is shared with the new state. Lookups skipping
+	// unhealthy peers aren't cached, so cached results remain valid.
+	st := *ch.loadState()
+	st.unhealthy = unhealthy
+	ch.state.Store(&st)
+}
+
+// lookupNames returns the names of the numOwners owners of key within h,
+// which is a hash of st with numNodes nodes.
+func (ch *chasher) lookupNames(st *sharderState, h chash.Hash, numNodes int, key Key, numOwners int, lo lookupOptions) ([]string, error) {
+	// Get extra candidates when some of them may not be selected as owners.
+	var (
+		numCandidates = numOwners
+		selective     = ch.opts.zoneAware || len(ch.opts.constraints) > 0
+	)
+	if numOwners <= numNodes {
+		if len(lo.exclude) > 0 {
+			// At most len(lo.exclude) candidates will be skipped.
+			numCandidates = numOwners + len(lo.exclude)
+			if numCandidates > numNodes {
+				numCandidates = numNodes
+			}
+		}
+		if selective && numOwners > 1 {
+			// Zone-aware and constrained lookups need the full order of
+			// preference to find owners which satisfy them.
+			numCandidates = numNodes
+		}
+	}
+
+	names, err := h.Get(uint64(key), numCandidates)
+	if err != nil {
+		return nil, err
+	}
+	if numCandidates != numOwners || len(lo.exclude) > 0 || (selective && numOwners > 1) {
+		return ch.selectOwners(st, names, numOwners, lo)
+	}
+	return names, nil
+}
+
+// DefaultMultiprobeProbes is the number of probes used by Multiprobe.
+const DefaultMultiprobeProbes = chash.DefaultProbes
+
+// selectOwners returns numOwners names from candidates, which are in the
+// order of preference of the hash. Excluded names and names rejected by a
+// placement constraint are never selected. If zone awareness is enabled,
+// names in zones which haven't been chosen yet are preferred. candidates
+// must be peers of st.
+func (ch *chasher) selectOwners(st *sharderState, candidates []string, numOwners int, lo lookupOptions) ([]string, error) {
+	if len(lo.exclude) > 0 {
+		allowed := make([]string, 0, len(candidates))
+		for _, name := range candidates {
+			if _, excluded := lo.exclude[name]; !excluded {
+				allowed = append(allowed, name)
+			}
+		}
+		if len(allowed) < numOwners {
+			// Every node is a candidate when there's not enough allowed
+			// candidates, so len(allowed) is the number of nodes which could
+			// be returned.
+			return nil, fmt.Errorf("not enough nodes: need at least %d, have %d", numOwners, len(allowed))
+		}
+		candidates = allowed
+	}
+
+	res := ch.orderOwners(st, candidates, numOwners)
+	if len(res) < numOwners {
+		return nil, fmt.Errorf("not enough nodes satisfy placement constraints: need at least %d, have %d", numOwners, len(res))
+	}
 	return res, nil
 }
 
+// orderOwners returns up to numOwners names from candidates in the order
+// they're selected as owners, skipping names rejected by a placement
+// constraint and preferring names in zones which haven't been chosen yet if
+// zone awareness is enabled. candidates must be peers of st.
+func (ch *chasher) orderOwners(st *sharderState, candidates []string, numOwners int) []string {
+	if !ch.opts.zoneAware && len(ch.opts.constraints) == 0 {
+		if len(candidates) > numOwners {
+			candidates = candidates[:numOwners]
+		}
+		return candidates
+	}
+
+	var (
+		res      = make([]string, 0, numOwners)
+		selected = make([]peer.Peer, 0, numOwners)
+		skipped  = make([]string, 0, len(candidates))
+		zones    = make(map[string]struct{}, numOwners)
+	)
+	selectOwner := func(p peer.Peer) {
+		res = append(res, p.Name)
+		selected = append(selected, p)
+	}
+
+	for _, name := range candidates {
+		if len(res) == numOwners {
+			break
+		}
+		p := st.peers[name]
+		if !ch.satisfiesConstraints(selected, p) {
+			continue
+		}
+		if ch.opts.zoneAware {
+			if _, seen := zones[p.AvailabilityZone]; seen {
+				skipped = append(skipped, name)
+				continue
+			}
+			zones[p.AvailabilityZone] = struct{}{}
+		}
+		selectOwner(p)
+	}
+
+	// Fall back to reusing zones if there are fewer zones than owners.
+	for _, name := range skipped {
+		if len(res) == numOwners {
+			break
+		}
+		if p := st.peers[name]; ch.satisfiesConstraints(selected, p) {
+			selectOwner(p)
+		}
+	}
+	return res
+}
+
+// satisfiesConstraints returns true if candidate is accepted by every
+// placement constraint.
+func (ch *chasher) satisfiesConstraints(selected []peer.Peer, candidate peer.Peer) bool {
+	for _, c := range ch.opts.constraints {
+		if !c(selected, candidate) {
+			return false
+		}
+	}
+	return true
+}
+
 // Multiprobe implements a multi-probe sharder: https://arxiv.org/abs/1505.00062
 //
 // Multiprobe is optimized for a median peak-to-average load ratio of 1.05. It
-// performs a lookup in O(K * log N) time, where K is 21.
-func Multiprobe() Sharder {
-	return &chasher{
-		read:      chash.Multiprobe(),
-		readWrite: chash.Multiprobe(),
-	}
+// performs a lookup in O(K * log N) time, where K is DefaultMultiprobeProbes.
+//
+// Multiprobe does not support weights; every peer is treated as having the
+// same capacity.
+func Multiprobe(opts ...Option) Sharder {
+	return MultiprobeK(DefaultMultiprobeProbes, opts...)
+}
+
+// MultiprobeK is like Multiprobe, but hashes each key probes times. Each peer
+// has a single position on the unit circle, and a key is owned by the peer
+// closest to any of its probes. Unlike Ring, low peak-to-average load is
+// achieved without giving peers multiple tokens: increasing probes lowers the
+// peak-to-average load ratio at the cost of slower lookups. Values of probes
+// less than 1 are treated as 1.
+//
+// MultiprobeK performs a lookup in O(K * log N) time, where K is probes.
+func MultiprobeK(probes int, opts ...Option) Sharder {
+	o := buildOptions(opts)
+	return newChasher(o, func() chash.Hash { return chash.Multiprobe(probes, o.hash) })
+}
+
+// Jump implements a jump consistent hash sharder:
+// https://arxiv.org/abs/1406.2294
+//
+// Jump is designed for densely numbered peers, such as peers named after
+// their ordinal in a StatefulSet. Keys are assigned to peers by position:
+// peers are ordered by name, comparing trailing numbers numerically so that
+// "node-10" comes after "node-9". Jump is only consistent when peers are
+// added or removed at the end of that order; removing any other peer moves
+// keys between every peer after it.
+//
+// Jump uses almost no memory and performs a lookup in O(log N) time. Jump
+// does not support weights; every peer is treated as having the same
+// capacity.
+func Jump(opts ...Option) Sharder {
+	return newChasher(buildOptions(opts), chash.Jump)
 }
 
 // Rendezvous returns a rendezvous sharder (HRW, Highest Random Weight).
 //
 // Rendezvous is optimized for excellent load distribution, but has a runtime
 // complexity of O(N).
-func Rendezvous() Sharder {
-	return &chasher{
-		read:      chash.Rendezvous(),
-		readWrite: chash.Rendezvous(),
-	}
+//
+// Rendezvous supports weights: the probability of a peer owning a key is
+// proportional to its weight.
+func Rendezvous(opts ...Option) Sharder {
+	o := buildOptions(opts)
+	return newChasher(o, func() chash.Hash { return chash.Rendezvous(o.hash) })
 }
 
-// Ring implements a ring sharder. numTokens determines how many tokens each
-// node should have. Tokens are mapped to the unit circle, and then ownership
-// of a key is determined by finding the next token on the unit circle. If two
-// nodes have the same token, the node that lexicographically comes first will
-// be used as the first owner.
+// Ring implements a ring sharder. numTokens determines how many tokens
+// (virtual nodes) each node should have. Tokens are mapped to the unit
+// circle, and then ownership of a key is determined by finding the next token
+// on the unit circle. If two nodes have the same token, the node that
+// lexicographically comes first will be used as the first owner. Values of
+// numTokens less than 1 are treated as 1.
 //
 // Ring is extremely fast, running in O(log N) time, but increases in memory
 // usage as numTokens increases. Low values of numTokens will cause poor
 // distribution; 256 or 512 is a good starting point.
-func Ring(numTokens int) Sharder {
-	return &chasher{
-		read:      chash.Ring(numTokens),
-		readWrite: chash.Ring(numTokens),
-	}
+//
+// numTokens trades memory for balance. Each token uses roughly 24 bytes, and
+// tokens are stored once per Op, so a Ring uses about 48 * numTokens bytes
+// per peer. With 100 peers, the most loaded peer owns roughly 1.25x the
+// average number of keys at 64 tokens, 1.15x at 256 tokens, and 1.1x at 512
+// tokens; more tokens give diminishing returns. Balance-sensitive workloads
+// which can't afford more tokens should consider MultiprobeK.
+//
+// Ring supports weights: a peer with weight W is given numTokens * W tokens,
+// so the number of tokens can differ per peer. Use peer weights to give
+// larger peers proportionally more keys.
+func Ring(numTokens int, opts ...Option) Sharder {
+	o := buildOptions(opts)
+	return newChasher(o, func() chash.Hash { return chash.Ring(numTokens, o.hash) })
 }
@@ -1,11 +1,19 @@
 package shard_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rfratto/ckit/peer"
 	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -61,11 +69,36 @@ func Example() {
 	// Owner of example-key: node-b
 }
 
+func ExampleWithEligibility() {
+	// Applications can control which peers receive keys, such as only giving
+	// keys to Participants which advertise a "storage" label.
+	ring := shard.Ring(256, shard.WithEligibility(func(p peer.Peer, op shard.Op) bool {
+		if p.Labels["storage"] != "true" {
+			return false
+		}
+		return shard.DefaultEligibility(p, op)
+	}))
+
+	ring.SetPeers([]peer.Peer{
+		{Name: "node-a", State: peer.StateParticipant},
+		{Name: "node-b", State: peer.StateParticipant, Labels: map[string]string{"storage": "true"}},
+		{Name: "node-c", State: peer.StateViewer, Labels: map[string]string{"storage": "true"}},
+	})
+
+	for _, p := range ring.Peers() {
+		fmt.Println(p.Name)
+	}
+
+	// Output:
+	// node-b
+}
+
 func Test_Lookup(t *testing.T) {
 	var (
 		viewerPeer      = peer.Peer{Name: "viewer-peer", State: peer.StateViewer}
 		participantPeer = peer.Peer{Name: "participant-peer", State: peer.StateParticipant}
 		terminatingPeer = peer.Peer{Name: "terminating-peer", State: peer.StateTerminating}
+		drainingPeer    = peer.Peer{Name: "draining-peer", State: peer.StateDraining}
 	)
 
 	tt := []struct {
@@ -94,9 +127,15 @@ func Test_Lookup(t *testing.T) {
 			hashTy:     shard.OpRead,
 			expectPeer: terminatingPeer,
 		},
+		{
+			name:       "HashTypeRead permits Draining nodes",
+			peers:      []peer.Peer{viewerPeer, drainingPeer},
+			hashTy:     shard.OpRead,
+			expectPeer: drainingPeer,
+		},
 		{
 			name:        "HashTypeReadWrite fails if there are no Participant nodes",
-			peers:       []peer.Peer{viewerPeer, terminatingPeer},
+			peers:       []peer.Peer{viewerPeer, terminatingPeer, drainingPeer},
 			hashTy:      shard.OpReadWrite,
 			expectError: "not enough nodes: need at least 1, have 0",
 		},
@@ -123,3 +162,1218 @@ func Test_Lookup(t *testing.T) {
 		})
 	}
 }
+
+var stateReadOnly = peer.MinCustomState
+
+func init() { peer.RegisterState(stateReadOnly, "read-only") }
+
+func Test_WithEligibility(t *testing.T) {
+	var (
+		readOnlyPeer    = peer.Peer{Name: "read-only-peer", State: stateReadOnly}
+		participantPeer = peer.Peer{Name: "participant-peer", State: peer.StateParticipant}
+	)
+
+	ring := shard.Ring(128, shard.WithEligibility(func(p peer.Peer, op shard.Op) bool {
+		if p.State == stateReadOnly {
+			return op == shard.OpRead
+		}
+		return shard.DefaultEligibility(p, op)
+	}))
+	ring.SetPeers([]peer.Peer{readOnlyPeer, participantPeer})
+
+	require.Equal(t, []peer.Peer{participantPeer, readOnlyPeer}, ring.Peers())
+
+	owners, err := ring.Lookup(0, 2, shard.OpRead)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.Peer{readOnlyPeer, participantPeer}, owners)
+
+	_, err = ring.Lookup(0, 2, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 2, have 1")
+}
+
+func Test_WithRoles(t *testing.T) {
+	var (
+		ingestPeer = peer.Peer{Name: "ingest-peer", State: peer.StateParticipant, Roles: []string{"ingest"}}
+		queryPeer  = peer.Peer{Name: "query-peer", State: peer.StateParticipant, Roles: []string{"query"}}
+		bothPeer   = peer.Peer{Name: "both-peer", State: peer.StateParticipant, Roles: []string{"ingest", "query"}}
+		noRolePeer = peer.Peer{Name: "no-role-peer", State: peer.StateParticipant}
+		viewerPeer = peer.Peer{Name: "viewer-peer", State: peer.StateViewer, Roles: []string{"ingest"}}
+	)
+	allPeers := []peer.Peer{ingestPeer, queryPeer, bothPeer, noRolePeer, viewerPeer}
+
+	ingest := shard.Ring(128, shard.WithRoles("ingest"))
+	ingest.SetPeers(allPeers)
+	require.Equal(t, []peer.Peer{bothPeer, ingestPeer}, ingest.Peers())
+
+	query := shard.Ring(128, shard.WithRoles("query"))
+	query.SetPeers(allPeers)
+	require.Equal(t, []peer.Peer{bothPeer, queryPeer}, query.Peers())
+
+	owners, err := query.Lookup(0, 2, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.Peer{bothPeer, queryPeer}, owners)
+
+	_, err = query.Lookup(0, 3, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 3, have 2")
+}
+
+func Test_WithZoneAwareness(t *testing.T) {
+	var peers []peer.Peer
+	for _, zone := range []string{"zone-a", "zone-b", "zone-c"} {
+		for i := 0; i < 3; i++ {
+			peers = append(peers, peer.Peer{
+				Name:             fmt.Sprintf("%s-peer-%d", zone, i),
+				State:            peer.StateParticipant,
+				AvailabilityZone: zone,
+			})
+		}
+	}
+
+	ring := shard.Ring(128, shard.WithZoneAwareness())
+	ring.SetPeers(peers)
+
+	zonesOf := func(owners []peer.Peer) map[string]int {
+		zones := make(map[string]int)
+		for _, owner := range owners {
+			zones[owner.AvailabilityZone]++
+		}
+		return zones
+	}
+
+	for key := shard.Key(0); key < 100; key++ {
+		owners, err := ring.Lookup(key, 3, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Len(t, zonesOf(owners), 3, "owners of key %d not spread across zones", key)
+
+		// With fewer zones than owners, every zone is still used and the
+		// remaining owners are unique peers.
+		owners, err = ring.Lookup(key, 5, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Len(t, zonesOf(owners), 3, "owners of key %d not spread across zones", key)
+
+		unique := make(map[string]struct{})
+		for _, owner := range owners {
+			unique[owner.Name] = struct{}{}
+		}
+		require.Len(t, unique, 5)
+	}
+
+	// The first owner is unaffected by zone awareness.
+	plain := shard.Ring(128)
+	plain.SetPeers(peers)
+	for key := shard.Key(0); key < 100; key++ {
+		expect, err := plain.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		owners, err := ring.Lookup(key, 3, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, expect[0], owners[0])
+	}
+
+	_, err := ring.Lookup(0, 10, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 10, have 9")
+}
+
+func Test_ShuffleShard(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 10; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	subset := func(tenant string, peers []peer.Peer) []peer.Peer {
+		s := shard.Ring(128, shard.ShuffleShard(tenant, 3))
+		s.SetPeers(peers)
+		return s.Peers()
+	}
+
+	tenantA := subset("tenant-a", peers)
+	require.Len(t, tenantA, 3)
+	require.Equal(t, tenantA, subset("tenant-a", peers), "subset should be deterministic")
+	require.NotEqual(t, tenantA, subset("tenant-b", peers), "tenants should have different subsets")
+
+	s := shard.Ring(128, shard.ShuffleShard("tenant-a", 3))
+	s.SetPeers(peers)
+	for key := shard.Key(0); key < 100; key++ {
+		owners, err := s.Lookup(key, 2, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Subset(t, tenantA, owners)
+	}
+	_, err := s.Lookup(0, 4, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 4, have 3")
+
+	// Removing a peer from the subset should only replace that peer.
+	var remaining []peer.Peer
+	for _, p := range peers {
+		if p.Name != tenantA[0].Name {
+			remaining = append(remaining, p)
+		}
+	}
+	newSubset := subset("tenant-a", remaining)
+	require.Len(t, newSubset, 3)
+	require.Subset(t, newSubset, tenantA[1:])
+	require.NotContains(t, newSubset, tenantA[0])
+
+	// Subsets larger than the cluster use every peer.
+	require.Len(t, subset("tenant-a", peers[:2]), 2)
+}
+
+func Test_Ring_MinimumTokens(t *testing.T) {
+	ring := shard.Ring(0)
+	ring.SetPeers([]peer.Peer{{Name: "peer", State: peer.StateParticipant}})
+
+	owners, err := ring.Lookup(0, 1, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Len(t, owners, 1)
+}
+
+func Test_Snapshot(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-c", State: peer.StateParticipant, Weight: 2},
+		{Name: "peer-a", State: peer.StateParticipant, AvailabilityZone: "zone-a"},
+		{Name: "peer-b", State: peer.StateDraining, Labels: map[string]string{"foo": "bar"}},
+		{Name: "peer-d", State: peer.StateViewer},
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  func() shard.Sharder
+	}{
+		{name: "ring", new: func() shard.Sharder { return shard.Ring(16) }},
+		{name: "multiprobe", new: func() shard.Sharder { return shard.Multiprobe() }},
+		{name: "rendezvous", new: func() shard.Sharder { return shard.Rendezvous() }},
+		{name: "jump", new: func() shard.Sharder { return shard.Jump() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := tc.new()
+			src.SetPeers(peers)
+
+			snapshot, err := shard.Snapshot(src)
+			require.NoError(t, err)
+
+			dst := tc.new()
+			require.NoError(t, shard.Restore(dst, snapshot))
+			require.Equal(t, src.Peers(), dst.Peers())
+
+			restored, err := shard.Snapshot(dst)
+			require.NoError(t, err)
+			require.Equal(t, string(snapshot), string(restored), "snapshots should be deterministic")
+
+			for key := shard.Key(0); key < 100; key++ {
+				expect, err := src.Lookup(key, 2, shard.OpRead)
+				require.NoError(t, err)
+				actual, err := dst.Lookup(key, 2, shard.OpRead)
+				require.NoError(t, err)
+				require.Equal(t, expect, actual)
+			}
+		})
+	}
+
+	src := shard.Ring(16)
+	src.SetPeers(peers)
+	snapshot, err := shard.Snapshot(src)
+	require.NoError(t, err)
+
+	err = shard.Restore(shard.Ring(32), snapshot)
+	require.EqualError(t, err, "snapshot was taken from a ring sharder with params map[tokens:16], not a ring sharder with params map[tokens:32]")
+
+	err = shard.Restore(shard.Ring(16, shard.WithZoneAwareness()), snapshot)
+	require.EqualError(t, err, "snapshot was taken from a sharder with different options")
+
+	err = shard.Restore(shard.Ring(16), []byte(`{"version": 2}`))
+	require.EqualError(t, err, "unsupported snapshot version 2")
+}
+
+func Test_Diff(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 4; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	diff := shard.Diff(func() shard.Sharder { return shard.Rendezvous() }, peers[:3], peers, shard.UniformKeys(10_000))
+	require.InDelta(t, 0.25, diff.Moved, 0.02)
+	require.Len(t, diff.Movements, 3)
+
+	var total float64
+	for _, m := range diff.Movements {
+		require.Equal(t, "peer-3", m.To, "keys should only move to the new peer")
+		total += m.Fraction
+	}
+	require.InDelta(t, diff.Moved, total, 1e-9)
+
+	noChange := shard.Diff(func() shard.Sharder { return shard.Rendezvous() }, peers, peers, shard.UniformKeys(100))
+	require.Equal(t, shard.OwnershipDiff{Movements: []shard.Movement{}}, noChange)
+
+	removed := shard.Diff(func() shard.Sharder { return shard.Rendezvous() }, peers[:1], nil, shard.SampleKeys(1, 2))
+	require.Equal(t, shard.OwnershipDiff{
+		Moved:     1,
+		Movements: []shard.Movement{{From: "peer-0", To: "", Fraction: 1}},
+	}, removed)
+}
+
+func Test_Churn(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 4; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	report := shard.Churn(
+		func() shard.Sharder { return shard.Rendezvous() },
+		[][]peer.Peer{peers[:3], peers, peers[1:]},
+		shard.UniformKeys(10_000),
+	)
+	require.Len(t, report.Steps, 2)
+	require.InDelta(t, 0.25, report.Steps[0].Moved, 0.02)
+	require.InDelta(t, 0.25, report.Steps[1].Moved, 0.02)
+	require.InDelta(t, report.Steps[0].Moved+report.Steps[1].Moved, report.Moved, 1e-9)
+
+	byName := make(map[string]shard.PeerChurn)
+	for _, pc := range report.Peers {
+		byName[pc.Name] = pc
+	}
+	require.Len(t, byName, 4)
+
+	// peer-3 only gains keys when it joins, and peer-0 only loses keys when
+	// it leaves.
+	require.InDelta(t, 0.25, byName["peer-3"].Gained[0], 0.02)
+	require.Zero(t, byName["peer-3"].TotalLost)
+	require.Zero(t, byName["peer-0"].TotalGained)
+	require.InDelta(t, 0.25, byName["peer-0"].Lost[1], 0.02)
+	require.InDelta(t, byName["peer-0"].Lost[0]+byName["peer-0"].Lost[1], byName["peer-0"].TotalLost, 1e-9)
+
+	require.Equal(t, shard.ChurnReport{}, shard.Churn(func() shard.Sharder { return shard.Rendezvous() }, [][]peer.Peer{peers}, shard.UniformKeys(10)))
+}
+
+func Test_WithExclude(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 5; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	ring := shard.Ring(128)
+	ring.SetPeers(peers)
+
+	for key := shard.Key(0); key < 100; key++ {
+		all, err := ring.Lookup(key, 5, shard.OpReadWrite)
+		require.NoError(t, err)
+
+		// Excluding the first owner should promote the remaining owners.
+		owners, err := ring.Lookup(key, 3, shard.OpReadWrite, shard.WithExclude(all[0].Name))
+		require.NoError(t, err)
+		require.Equal(t, all[1:4], owners)
+
+		owners, err = ring.Lookup(key, 2, shard.OpReadWrite, shard.WithExclude(all[1].Name), shard.WithExclude(all[2].Name))
+		require.NoError(t, err)
+		require.Equal(t, []peer.Peer{all[0], all[3]}, owners)
+	}
+
+	_, err := ring.Lookup(0, 4, shard.OpReadWrite, shard.WithExclude("peer-0", "peer-1", "unknown-peer"))
+	require.EqualError(t, err, "not enough nodes: need at least 4, have 3")
+
+	// Excluded peers must not be returned when every peer is requested.
+	_, err = ring.Lookup(0, 5, shard.OpReadWrite, shard.WithExclude("peer-0"))
+	require.EqualError(t, err, "not enough nodes: need at least 5, have 4")
+}
+
+func Test_WithPlacementConstraints(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 6; i++ {
+		peers = append(peers, peer.Peer{
+			Name:   fmt.Sprintf("peer-%d", i),
+			State:  peer.StateParticipant,
+			Labels: map[string]string{"host": fmt.Sprintf("host-%d", i%3)},
+		})
+	}
+
+	ring := shard.Ring(128, shard.WithPlacementConstraints(shard.DistinctLabel("host")))
+	ring.SetPeers(peers)
+
+	for key := shard.Key(0); key < 100; key++ {
+		owners, err := ring.Lookup(key, 3, shard.OpReadWrite)
+		require.NoError(t, err)
+
+		hosts := make(map[string]struct{})
+		for _, owner := range owners {
+			hosts[owner.Labels["host"]] = struct{}{}
+		}
+		require.Len(t, hosts, 3, "owners of key %d share a host", key)
+	}
+
+	_, err := ring.Lookup(0, 4, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes satisfy placement constraints: need at least 4, have 3")
+
+	// Constraints must also be checked when every peer is requested.
+	_, err = ring.Lookup(0, len(peers), shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes satisfy placement constraints: need at least 6, have 3")
+}
+
+func Test_WithHashFunc(t *testing.T) {
+	fnv64a := func(data []byte) uint64 {
+		h := fnv.New64a()
+		_, _ = h.Write(data)
+		return h.Sum64()
+	}
+
+	var peers []peer.Peer
+	for i := 0; i < 5; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	var (
+		xxhashRing = shard.Ring(16)
+		fnvRing    = shard.Ring(16, shard.WithHashFunc(fnv64a))
+	)
+	xxhashRing.SetPeers(peers)
+	fnvRing.SetPeers(peers)
+
+	var differ bool
+	for key := shard.Key(0); key < 100; key++ {
+		expect, err := xxhashRing.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		actual, err := fnvRing.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		if expect[0].Name != actual[0].Name {
+			differ = true
+		}
+	}
+	require.True(t, differ, "custom hash function should change placement")
+}
+
+func Test_WithSeed(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 5; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	// moved returns the fraction of keys with a different owner in a and b.
+	moved := func(a, b shard.Sharder) float64 {
+		a.SetPeers(peers)
+		b.SetPeers(peers)
+
+		keys := shard.UniformKeys(1000)()
+		var changed int
+		for _, key := range keys {
+			expect, err := a.Lookup(key, 1, shard.OpReadWrite)
+			require.NoError(t, err)
+			actual, err := b.Lookup(key, 1, shard.OpReadWrite)
+			require.NoError(t, err)
+			if expect[0].Name != actual[0].Name {
+				changed++
+			}
+		}
+		return float64(changed) / float64(len(keys))
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  func(opts ...shard.Option) shard.Sharder
+	}{
+		{name: "ring", new: func(opts ...shard.Option) shard.Sharder { return shard.Ring(16, opts...) }},
+		{name: "multiprobe", new: shard.Multiprobe},
+		{name: "rendezvous", new: shard.Rendezvous},
+		{name: "shuffle", new: func(opts ...shard.Option) shard.Sharder {
+			return shard.Rendezvous(append(opts, shard.ShuffleShard("tenant", 2))...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Zero(t, moved(tc.new(shard.WithSeed(1)), tc.new(shard.WithSeed(1))), "same seeds should match")
+			require.Zero(t, moved(tc.new(), tc.new(shard.WithSeed(0))), "seed 0 should be the default placement")
+			require.Greater(t, moved(tc.new(shard.WithSeed(1)), tc.new(shard.WithSeed(2))), 0.5, "different seeds should differ")
+		})
+	}
+
+	src := shard.Ring(16, shard.WithSeed(1))
+	src.SetPeers(peers)
+	snapshot, err := shard.Snapshot(src)
+	require.NoError(t, err)
+	require.NoError(t, shard.Restore(shard.Ring(16, shard.WithSeed(1)), snapshot))
+	require.EqualError(t, shard.Restore(shard.Ring(16, shard.WithSeed(2)), snapshot), "snapshot was taken from a sharder with different options")
+}
+
+func Test_DebugDump(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+		{Name: "peer-c", State: peer.StateDraining},
+	}
+
+	type dump struct {
+		Ops []struct {
+			Op        string `json:"op"`
+			Estimated bool   `json:"estimated"`
+			Peers     []struct {
+				Name    string  `json:"name"`
+				Primary float64 `json:"primary"`
+				Replica float64 `json:"replica"`
+			} `json:"peers"`
+			Ranges []struct {
+				Owners []string `json:"owners"`
+			} `json:"ranges"`
+			Keys []struct {
+				Owners []string `json:"owners"`
+			} `json:"keys"`
+		} `json:"ops"`
+	}
+
+	for _, tc := range []struct {
+		name      string
+		sharder   shard.Sharder
+		estimated bool
+	}{
+		{name: "ring", sharder: shard.Ring(16)},
+		{name: "rendezvous", sharder: shard.Rendezvous(), estimated: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.sharder.SetPeers(peers)
+
+			var buf bytes.Buffer
+			err := shard.DebugDump(tc.sharder, &buf, shard.DumpOptions{
+				Format:   shard.DumpJSON,
+				Replicas: 2,
+				Keys:     []shard.Key{shard.StringKey("some-key")},
+			})
+			require.NoError(t, err)
+
+			var d dump
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+			require.Len(t, d.Ops, 2)
+
+			readWrite := d.Ops[1]
+			require.Equal(t, "ReadWrite", readWrite.Op)
+			require.Equal(t, tc.estimated, readWrite.Estimated)
+			require.Len(t, readWrite.Peers, 2)
+
+			var primary, replica float64
+			for _, p := range readWrite.Peers {
+				primary += p.Primary
+				replica += p.Replica
+			}
+			require.InDelta(t, 1, primary, 1e-6, "primary ownership should cover the keyspace")
+			require.InDelta(t, 2, replica, 1e-6, "every key should have two replicas")
+
+			if !tc.estimated {
+				require.NotEmpty(t, readWrite.Ranges)
+				for _, r := range readWrite.Ranges {
+					require.Len(t, r.Owners, 2)
+				}
+			}
+
+			expect, err := tc.sharder.Lookup(shard.StringKey("some-key"), 2, shard.OpReadWrite)
+			require.NoError(t, err)
+			require.Len(t, readWrite.Keys, 1)
+			require.Equal(t, []string{expect[0].Name, expect[1].Name}, readWrite.Keys[0].Owners)
+
+			buf.Reset()
+			require.NoError(t, shard.DebugDump(tc.sharder, &buf, shard.DumpOptions{}))
+			require.Contains(t, buf.String(), "PEER")
+			require.Contains(t, buf.String(), "peer-c")
+		})
+	}
+}
+
+func Test_OwnedRanges(t *testing.T) {
+	var peers []peer.Peer
+	for i := 0; i < 3; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	ring := shard.Ring(16)
+	ring.SetPeers(peers)
+
+	var all []shard.KeyRange
+	for _, p := range peers {
+		ranges, err := shard.OwnedRanges(ring, p.Name, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.NotEmpty(t, ranges)
+
+		for _, r := range ranges {
+			for _, key := range []shard.Key{r.Start, r.End} {
+				owners, err := ring.Lookup(key, 1, shard.OpReadWrite)
+				require.NoError(t, err)
+				require.Equal(t, p.Name, owners[0].Name)
+			}
+		}
+		all = append(all, ranges...)
+	}
+
+	// The primary ranges of all peers cover the keyspace.
+	gained, lost := shard.DiffRanges(nil, all)
+	require.Equal(t, []shard.KeyRange{{Start: 0, End: math.MaxUint64}}, gained)
+	require.Empty(t, lost)
+
+	_, err := shard.OwnedRanges(shard.Rendezvous(), "peer-0", 1, shard.OpReadWrite)
+	require.ErrorIs(t, err, shard.ErrRangesUnsupported)
+}
+
+func Test_DiffRanges(t *testing.T) {
+	gained, lost := shard.DiffRanges(
+		[]shard.KeyRange{{Start: 10, End: 20}, {Start: math.MaxUint64 - 5, End: 5}},
+		[]shard.KeyRange{{Start: 15, End: 30}, {Start: 0, End: 5}},
+	)
+	require.Equal(t, []shard.KeyRange{{Start: 21, End: 30}}, gained)
+	require.Equal(t, []shard.KeyRange{{Start: 10, End: 14}, {Start: math.MaxUint64 - 5, End: math.MaxUint64}}, lost)
+}
+
+func Test_Metrics(t *testing.T) {
+	ring := shard.Ring(16, shard.WithName("test"))
+	ring.SetPeers([]peer.Peer{
+		{Name: "local", Self: true, State: peer.StateParticipant},
+		{Name: "viewer", State: peer.StateViewer},
+	})
+
+	expect := `
+# HELP shard_local_ownership_ratio Fraction of the keyspace owned by the local node.
+# TYPE shard_local_ownership_ratio gauge
+shard_local_ownership_ratio{op="Read",sharder="test"} 1
+shard_local_ownership_ratio{op="ReadWrite",sharder="test"} 1
+# HELP shard_peer_ownership_max_ratio Largest fraction of the keyspace owned by any peer.
+# TYPE shard_peer_ownership_max_ratio gauge
+shard_peer_ownership_max_ratio{op="Read",sharder="test"} 1
+shard_peer_ownership_max_ratio{op="ReadWrite",sharder="test"} 1
+# HELP shard_peer_ownership_min_ratio Smallest fraction of the keyspace owned by any peer.
+# TYPE shard_peer_ownership_min_ratio gauge
+shard_peer_ownership_min_ratio{op="Read",sharder="test"} 1
+shard_peer_ownership_min_ratio{op="ReadWrite",sharder="test"} 1
+# HELP shard_peer_ownership_stddev_ratio Standard deviation of the fraction of the keyspace owned by each peer.
+# TYPE shard_peer_ownership_stddev_ratio gauge
+shard_peer_ownership_stddev_ratio{op="Read",sharder="test"} 0
+shard_peer_ownership_stddev_ratio{op="ReadWrite",sharder="test"} 0
+`
+	require.NoError(t, testutil.CollectAndCompare(shard.Metrics(ring), strings.NewReader(expect)))
+
+	// Ownership should be recomputed after the peers change.
+	ring.SetPeers([]peer.Peer{
+		{Name: "local", Self: true, State: peer.StateViewer},
+		{Name: "remote", State: peer.StateParticipant},
+	})
+	expect = `
+# HELP shard_local_ownership_ratio Fraction of the keyspace owned by the local node.
+# TYPE shard_local_ownership_ratio gauge
+shard_local_ownership_ratio{op="Read",sharder="test"} 0
+shard_local_ownership_ratio{op="ReadWrite",sharder="test"} 0
+`
+	require.NoError(t, testutil.CollectAndCompare(shard.Metrics(ring), strings.NewReader(expect), "shard_local_ownership_ratio"))
+}
+
+func Test_WalkOwnedRanges(t *testing.T) {
+	ring := shard.Ring(16)
+	ring.SetPeers([]peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+	})
+
+	owned, err := shard.OwnedRanges(ring, "peer-a", 1, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Greater(t, len(owned), 1)
+
+	var walked []shard.KeyRange
+	err = shard.WalkOwnedRanges(ring, "peer-a", 1, shard.OpReadWrite, func(r shard.KeyRange) bool {
+		walked = append(walked, r)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []shard.KeyRange(owned), walked)
+
+	var count int
+	err = shard.WalkOwnedRanges(ring, "peer-a", 1, shard.OpReadWrite, func(r shard.KeyRange) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, count, "walking should stop when f returns false")
+
+	for key := shard.Key(0); key < 100; key++ {
+		k := key * (math.MaxUint64 / 100)
+		owners, err := ring.Lookup(k, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, owners[0].Name == "peer-a", owned.Contains(k), "key %d", k)
+	}
+}
+
+func Test_AddPeers_RemovePeers(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func() shard.Sharder
+	}{
+		{name: "ring", new: func() shard.Sharder { return shard.Ring(16) }},
+		{name: "multiprobe", new: func() shard.Sharder { return shard.Multiprobe() }},
+		{name: "rendezvous", new: func() shard.Sharder { return shard.Rendezvous() }},
+		{name: "jump", new: func() shard.Sharder { return shard.Jump() }},
+		{name: "shuffle shard", new: func() shard.Sharder { return shard.Ring(16, shard.ShuffleShard("tenant", 3)) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var peers []peer.Peer
+			for i := 0; i < 6; i++ {
+				peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant, Weight: i%2 + 1})
+			}
+
+			incremental := tc.new()
+			incremental.SetPeers(append([]peer.Peer(nil), peers[:3]...))
+			shard.AddPeers(incremental, peers[3:]...)
+			shard.RemovePeers(incremental, "peer-1", "unknown-peer")
+
+			// Replace an existing peer with one that's only eligible for reads.
+			draining := peer.Peer{Name: "peer-4", State: peer.StateDraining}
+			shard.AddPeers(incremental, draining, peer.Peer{Name: "viewer", State: peer.StateViewer})
+
+			expect := tc.new()
+			expect.SetPeers([]peer.Peer{peers[0], peers[2], peers[3], draining, peers[5]})
+
+			expectSnapshot, err := shard.Snapshot(expect)
+			require.NoError(t, err)
+			actualSnapshot, err := shard.Snapshot(incremental)
+			require.NoError(t, err)
+			require.Equal(t, string(expectSnapshot), string(actualSnapshot))
+
+			// Viewers are ignored, but become eligible if they're replaced.
+			shard.AddPeers(incremental, peer.Peer{Name: "viewer", State: peer.StateParticipant})
+			require.Contains(t, incremental.Peers(), peer.Peer{Name: "viewer", State: peer.StateParticipant})
+		})
+	}
+}
+
+func BenchmarkRing_AddPeer(b *testing.B) {
+	var peers []peer.Peer
+	for i := 0; i < 500; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+	newPeer := peer.Peer{Name: "new-peer", State: peer.StateParticipant}
+
+	b.Run("SetPeers", func(b *testing.B) {
+		ring := shard.Ring(256)
+		ring.SetPeers(peers)
+
+		withNewPeer := append(append([]peer.Peer(nil), peers...), newPeer)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			ring.SetPeers(withNewPeer)
+		}
+	})
+
+	b.Run("AddPeers", func(b *testing.B) {
+		ring := shard.Ring(256)
+		ring.SetPeers(peers)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			shard.AddPeers(ring, newPeer)
+		}
+	})
+
+	b.Run("RemovePeers", func(b *testing.B) {
+		ring := shard.Ring(256)
+		ring.SetPeers(peers)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			shard.RemovePeers(ring, peers[0].Name)
+		}
+	})
+}
+
+func Test_WithLookupCache(t *testing.T) {
+	ring := shard.Ring(16, shard.WithLookupCache(2))
+	ring.SetPeers([]peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+	})
+
+	cacheMetrics := func(hits, misses int) string {
+		return fmt.Sprintf(`
+# HELP shard_lookup_cache_hits_total Total number of lookups served from the lookup cache.
+# TYPE shard_lookup_cache_hits_total counter
+shard_lookup_cache_hits_total %d
+# HELP shard_lookup_cache_misses_total Total number of lookups which weren't found in the lookup cache.
+# TYPE shard_lookup_cache_misses_total counter
+shard_lookup_cache_misses_total %d
+`, hits, misses)
+	}
+	requireCacheMetrics := func(hits, misses int) {
+		t.Helper()
+		err := testutil.CollectAndCompare(
+			shard.Metrics(ring), strings.NewReader(cacheMetrics(hits, misses)),
+			"shard_lookup_cache_hits_total", "shard_lookup_cache_misses_total",
+		)
+		require.NoError(t, err)
+	}
+
+	key := shard.StringKey("hot-key")
+	first, err := ring.Lookup(key, 2, shard.OpReadWrite)
+	require.NoError(t, err)
+	requireCacheMetrics(0, 1)
+
+	t.Run("cache hit", func(t *testing.T) {
+		res, err := ring.Lookup(key, 2, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, first, res)
+		requireCacheMetrics(1, 1)
+
+		// Modifying a result must not modify the cache.
+		res[0] = peer.Peer{Name: "modified"}
+		res, err = ring.Lookup(key, 2, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, first, res)
+		requireCacheMetrics(2, 1)
+	})
+
+	t.Run("results are cached per number of owners and op", func(t *testing.T) {
+		_, err := ring.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		_, err = ring.Lookup(key, 2, shard.OpRead)
+		require.NoError(t, err)
+		requireCacheMetrics(2, 3)
+	})
+
+	t.Run("least recently used results are evicted", func(t *testing.T) {
+		_, err := ring.Lookup(key, 2, shard.OpReadWrite)
+		require.NoError(t, err)
+		requireCacheMetrics(2, 4)
+	})
+
+	t.Run("lookups with options bypass the cache", func(t *testing.T) {
+		res, err := ring.Lookup(key, 1, shard.OpReadWrite, shard.WithExclude(first[0].Name))
+		require.NoError(t, err)
+		require.Equal(t, first[1:], res)
+		requireCacheMetrics(2, 4)
+	})
+
+	t.Run("cache is invalidated when peers change", func(t *testing.T) {
+		ring.SetPeers([]peer.Peer{{Name: "peer-c", State: peer.StateParticipant}})
+
+		res, err := ring.Lookup(key, 1, shard.OpReadWrite)
+		require.NoError(t, err)
+		require.Equal(t, []peer.Peer{{Name: "peer-c", State: peer.StateParticipant}}, res)
+		requireCacheMetrics(2, 5)
+
+		shard.RemovePeers(ring, "peer-c")
+		_, err = ring.Lookup(key, 1, shard.OpReadWrite)
+		require.Error(t, err)
+		requireCacheMetrics(2, 6)
+	})
+}
+
+func Test_Lookup_Concurrent(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+		{Name: "peer-c", State: peer.StateParticipant},
+	}
+	extra := peer.Peer{Name: "peer-d", State: peer.StateParticipant}
+
+	ring := shard.Ring(16)
+	ring.SetPeers(peers)
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; ; k++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Every lookup must see a consistent set of peers, which
+				// always has at least 3 peers.
+				res, err := ring.Lookup(shard.Key(i*1_000_000+k), 3, shard.OpReadWrite)
+				if !assert.NoError(t, err) || !assert.Len(t, res, 3) {
+					return
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 100; i++ {
+		shard.AddPeers(ring, extra)
+		shard.RemovePeers(ring, extra.Name)
+		ring.SetPeers(append(peers, extra))
+		ring.SetPeers(peers)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkRing_Lookup_Parallel(b *testing.B) {
+	var peers []peer.Peer
+	for i := 0; i < 100; i++ {
+		peers = append(peers, peer.Peer{Name: fmt.Sprintf("peer-%d", i), State: peer.StateParticipant})
+	}
+
+	ring := shard.Ring(256)
+	ring.SetPeers(peers)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var key shard.Key
+		for pb.Next() {
+			key++
+			_, _ = ring.Lookup(key, 1, shard.OpReadWrite)
+		}
+	})
+}
+
+func Test_DskitRing(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant, Labels: map[string]string{"tokens": shard.FormatTokens([]uint32{100, 300})}},
+		{Name: "peer-b", State: peer.StateParticipant, Labels: map[string]string{"tokens": shard.FormatTokens([]uint32{200})}},
+		{Name: "peer-c", State: peer.StateParticipant}, // No tokens
+		{Name: "peer-d", State: peer.StateParticipant, Labels: map[string]string{"tokens": "1,invalid"}},
+	}
+
+	ring := shard.DskitRing(shard.LabelTokens("tokens"))
+	ring.SetPeers(peers)
+	require.Equal(t, peers[:2], ring.Peers(), "peers without valid tokens should be ignored")
+
+	tt := []struct {
+		key    shard.Key
+		expect []string
+	}{
+		{key: 99, expect: []string{"peer-a", "peer-b"}},
+		{key: 100, expect: []string{"peer-b", "peer-a"}},
+		{key: 300, expect: []string{"peer-a", "peer-b"}},
+		{key: 1<<32 + 250, expect: []string{"peer-a", "peer-b"}},
+	}
+	for _, tc := range tt {
+		res, err := ring.Lookup(tc.key, 2, shard.OpReadWrite)
+		require.NoError(t, err)
+
+		var names []string
+		for _, p := range res {
+			names = append(names, p.Name)
+		}
+		require.Equal(t, tc.expect, names, "key %d", tc.key)
+	}
+}
+
+func Test_Ketama(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "10.0.0.1:11211", State: peer.StateParticipant},
+		{Name: "10.0.0.2:11211", State: peer.StateParticipant, Weight: 2},
+		{Name: "10.0.0.3:11211", State: peer.StateParticipant},
+	}
+
+	ring := shard.Ketama()
+	ring.SetPeers(peers)
+
+	var buf bytes.Buffer
+	require.NoError(t, shard.DebugDump(ring, &buf, shard.DumpOptions{Format: shard.DumpJSON}))
+	var dump struct {
+		Algorithm string `json:"algorithm"`
+		Ops       []struct {
+			Peers []struct {
+				Name    string  `json:"name"`
+				Primary float64 `json:"primary"`
+			} `json:"peers"`
+		} `json:"ops"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &dump))
+	require.Equal(t, "ketama", dump.Algorithm)
+	for _, p := range dump.Ops[0].Peers {
+		expect := 0.25
+		if p.Name == "10.0.0.2:11211" {
+			expect = 0.5
+		}
+		require.InDelta(t, expect, p.Primary, 0.1, "ownership of %s should be proportional to its weight", p.Name)
+	}
+
+	owners, err := ring.Lookup(shard.KetamaKey("user:1234"), 3, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Len(t, owners, 3)
+}
+
+func Test_Ketama_SmallWeight(t *testing.T) {
+	// b's share of the weight is too small to be given any points, so it
+	// can't own keys and must not be counted as a node.
+	peers := []peer.Peer{
+		{Name: "a", State: peer.StateParticipant, Weight: 1000},
+		{Name: "b", State: peer.StateParticipant, Weight: 1},
+	}
+
+	ring := shard.Ketama()
+	ring.SetPeers(peers)
+
+	owners, err := shard.Preference(ring, shard.KetamaKey("foo"), 0, shard.OpReadWrite)
+	require.NoError(t, err)
+	require.Len(t, owners, 1)
+	require.Equal(t, "a", owners[0].Name)
+
+	_, err = ring.Lookup(shard.KetamaKey("foo"), 2, shard.OpReadWrite)
+	require.EqualError(t, err, "not enough nodes: need at least 2, have 1")
+}
+
+func Test_KetamaKey(t *testing.T) {
+	// md5("foo") is acbd18db4cc2f85cedef654fccc4a4d8.
+	require.Equal(t, shard.Key(0xdb18bdac), shard.KetamaKey("foo"))
+}
+
+func Test_LabelTokens(t *testing.T) {
+	tokens := []uint32{0, 42, math.MaxUint32}
+	label := shard.FormatTokens(tokens)
+	require.Equal(t, "0,42,4294967295", label)
+
+	p := peer.Peer{Labels: map[string]string{"tokens": label}}
+	require.Equal(t, tokens, shard.LabelTokens("tokens")(p))
+	require.Nil(t, shard.LabelTokens("other")(p))
+}
+
+func Test_WithUnhealthyPolicy(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+		{Name: "peer-c", State: peer.StateParticipant},
+	}
+
+	lookup := func(t *testing.T, s shard.Sharder, numOwners int) ([]string, error) {
+		t.Helper()
+
+		res, err := s.Lookup(shard.StringKey("key"), numOwners, shard.OpReadWrite)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(res))
+		for _, p := range res {
+			names = append(names, p.Name)
+		}
+		return names, nil
+	}
+
+	for _, tc := range []struct {
+		policy shard.UnhealthyPolicy
+		skips  bool
+		strict bool
+	}{
+		{policy: shard.UnhealthyIgnore},
+		{policy: shard.UnhealthyAvoid, skips: true},
+		{policy: shard.UnhealthyExclude, skips: true, strict: true},
+	} {
+		s := shard.Ring(16, shard.WithUnhealthyPolicy(tc.policy))
+		s.SetPeers(peers)
+
+		healthy, err := lookup(t, s, 3)
+		require.NoError(t, err)
+
+		shard.SetUnhealthy(s, healthy[0])
+		res, err := lookup(t, s, 2)
+		require.NoError(t, err)
+		if tc.skips {
+			require.Equal(t, healthy[1:], res, "unhealthy peer should be skipped")
+		} else {
+			require.Equal(t, healthy[:2], res, "unhealthy peer should be ignored")
+		}
+
+		// Unhealthy peers are retained across peer changes.
+		s.SetPeers(peers)
+		res, err = lookup(t, s, 3)
+		if tc.strict {
+			require.EqualError(t, err, "not enough nodes: need at least 3, have 2")
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, healthy, res, "unhealthy peer should be used when there aren't enough healthy peers")
+		}
+
+		shard.SetUnhealthy(s)
+		res, err = lookup(t, s, 2)
+		require.NoError(t, err)
+		require.Equal(t, healthy[:2], res)
+	}
+}
+
+func Test_Preference(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant, AvailabilityZone: "zone-a"},
+		{Name: "peer-b", State: peer.StateParticipant, AvailabilityZone: "zone-a"},
+		{Name: "peer-c", State: peer.StateParticipant, AvailabilityZone: "zone-b"},
+		{Name: "peer-d", State: peer.StateParticipant, AvailabilityZone: "zone-b"},
+		{Name: "peer-e", State: peer.StateDraining, AvailabilityZone: "zone-c"},
+	}
+
+	names := func(ps []peer.Peer) []string {
+		res := make([]string, 0, len(ps))
+		for _, p := range ps {
+			res = append(res, p.Name)
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  func() shard.Sharder
+	}{
+		{name: "ring", new: func() shard.Sharder { return shard.Ring(16) }},
+		{name: "multiprobe", new: func() shard.Sharder { return shard.Multiprobe() }},
+		{name: "rendezvous", new: func() shard.Sharder { return shard.Rendezvous() }},
+		{name: "jump", new: func() shard.Sharder { return shard.Jump() }},
+		{name: "zone-aware", new: func() shard.Sharder { return shard.Ring(16, shard.WithZoneAwareness()) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.new()
+			s.SetPeers(peers)
+
+			for i := 0; i < 100; i++ {
+				key := shard.StringKey(fmt.Sprintf("key-%d", i))
+
+				pref, err := shard.Preference(s, key, 0, shard.OpRead)
+				require.NoError(t, err)
+				require.Len(t, pref, len(peers))
+
+				for numOwners := 1; numOwners <= len(peers); numOwners++ {
+					owners, err := s.Lookup(key, numOwners, shard.OpRead)
+					require.NoError(t, err)
+					require.Equal(t, owners, pref[:numOwners], "preference should start with the owners of key")
+				}
+
+				limited, err := shard.Preference(s, key, 2, shard.OpRead)
+				require.NoError(t, err)
+				require.Equal(t, pref[:2], limited)
+
+				// Draining peers aren't eligible for OpReadWrite, so there are
+				// fewer peers than requested.
+				readWrite, err := shard.Preference(s, key, 10, shard.OpReadWrite)
+				require.NoError(t, err)
+				require.Len(t, readWrite, len(peers)-1)
+			}
+		})
+	}
+
+	t.Run("exclude", func(t *testing.T) {
+		s := shard.Ring(16)
+		s.SetPeers(peers)
+
+		pref, err := shard.Preference(s, shard.StringKey("key"), 0, shard.OpRead)
+		require.NoError(t, err)
+
+		excluded, err := shard.Preference(s, shard.StringKey("key"), 0, shard.OpRead, shard.WithExclude(pref[0].Name))
+		require.NoError(t, err)
+		require.Equal(t, names(pref[1:]), names(excluded))
+	})
+
+	for _, tc := range []struct {
+		policy shard.UnhealthyPolicy
+		expect func(pref []string) []string
+	}{
+		{policy: shard.UnhealthyIgnore, expect: func(pref []string) []string { return pref }},
+		{policy: shard.UnhealthyAvoid, expect: func(pref []string) []string { return append(pref[1:], pref[0]) }},
+		{policy: shard.UnhealthyExclude, expect: func(pref []string) []string { return pref[1:] }},
+	} {
+		t.Run(fmt.Sprintf("unhealthy-%d", tc.policy), func(t *testing.T) {
+			s := shard.Ring(16, shard.WithUnhealthyPolicy(tc.policy))
+			s.SetPeers(peers)
+
+			pref, err := shard.Preference(s, shard.StringKey("key"), 0, shard.OpRead)
+			require.NoError(t, err)
+
+			shard.SetUnhealthy(s, pref[0].Name)
+			res, err := shard.Preference(s, shard.StringKey("key"), 0, shard.OpRead)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect(names(pref)), names(res))
+		})
+	}
+
+	_, err := shard.Preference(shard.Ring(16), 0, 1, shard.Op(99))
+	require.EqualError(t, err, "unknown op Op(99)")
+
+	empty, err := shard.Preference(shard.Ring(16), 0, 1, shard.OpRead)
+	require.NoError(t, err)
+	require.Empty(t, empty)
+}
+
+func Test_Fingerprint(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+	}
+
+	fingerprint := func(s shard.Sharder, ps []peer.Peer) uint64 {
+		s.SetPeers(ps)
+		fp, err := shard.Fingerprint(s)
+		require.NoError(t, err)
+		require.NotZero(t, fp)
+		return fp
+	}
+
+	// Self differs across nodes, so it must not affect the fingerprint.
+	self := []peer.Peer{peers[0], peers[1]}
+	self[1].Self = true
+
+	expect := fingerprint(shard.Ring(16), peers)
+	require.Equal(t, expect, fingerprint(shard.Ring(16), self))
+	require.NotEqual(t, expect, fingerprint(shard.Ring(16), peers[:1]), "peers should change the fingerprint")
+	require.NotEqual(t, expect, fingerprint(shard.Ring(32), peers), "params should change the fingerprint")
+	require.NotEqual(t, expect, fingerprint(shard.Ring(16, shard.WithSeed(1)), peers), "options should change the fingerprint")
+
+	// Only attributes which affect placement change the fingerprint.
+	labeled := []peer.Peer{peers[0], peers[1]}
+	labeled[0].Labels = map[string]string{"foo": "bar"}
+	labeled[0].Addr = "10.0.0.1:80"
+	require.Equal(t, expect, fingerprint(shard.Ring(16), labeled), "labels should not change the fingerprint")
+
+	weighted := []peer.Peer{peers[0], peers[1]}
+	weighted[0].Weight = 2
+	require.NotEqual(t, expect, fingerprint(shard.Ring(16), weighted), "weights should change the fingerprint")
+
+	viewer := append([]peer.Peer{}, peers...)
+	viewer = append(viewer, peer.Peer{Name: "peer-c", State: peer.StateViewer})
+	require.Equal(t, expect, fingerprint(shard.Ring(16), viewer), "ineligible peers should not change the fingerprint")
+
+	_, err := shard.Fingerprint(&lookupOnly{})
+	require.ErrorIs(t, err, shard.ErrUnsupported)
+}
+
+// lookupOnly is a Sharder which implements none of the optional interfaces.
+type lookupOnly struct{ peers []peer.Peer }
+
+func (s *lookupOnly) Lookup(key shard.Key, numOwners int, op shard.Op, opts ...shard.LookupOption) ([]peer.Peer, error) {
+	return s.peers[:numOwners], nil
+}
+
+func (s *lookupOnly) Peers() []peer.Peer      { return s.peers }
+func (s *lookupOnly) SetPeers(ps []peer.Peer) { s.peers = ps }
+
+func Test_OptionalInterfaces(t *testing.T) {
+	peers := []peer.Peer{
+		{Name: "peer-a", State: peer.StateParticipant},
+		{Name: "peer-b", State: peer.StateParticipant},
+	}
+
+	t.Run("Unsupported", func(t *testing.T) {
+		s := &lookupOnly{}
+
+		// AddPeers and RemovePeers fall back to SetPeers.
+		shard.AddPeers(s, peers...)
+		shard.AddPeers(s, peer.Peer{Name: "peer-a", State: peer.StateDraining})
+		shard.RemovePeers(s, "peer-b")
+		require.Equal(t, []peer.Peer{{Name: "peer-a", State: peer.StateDraining}}, s.Peers())
+
+		// SetUnhealthy is ignored.
+		shard.SetUnhealthy(s, "peer-a")
+
+		_, err := shard.Preference(s, 0, 1, shard.OpRead)
+		require.Equal(t, shard.ErrUnsupported, err)
+		_, err = shard.Snapshot(s)
+		require.Equal(t, shard.ErrUnsupported, err)
+		require.Equal(t, shard.ErrUnsupported, shard.Restore(s, nil))
+		require.Equal(t, shard.ErrUnsupported, shard.DebugDump(s, &bytes.Buffer{}, shard.DumpOptions{}))
+		require.Zero(t, testutil.CollectAndCount(shard.Metrics(s)))
+	})
+
+	t.Run("Wrapped", func(t *testing.T) {
+		ring := shard.Ring(16)
+		s := shard.Wrap(ring, shard.InstrumentLookups())
+
+		shard.AddPeers(s, peers...)
+		require.Len(t, ring.Peers(), 2)
+
+		expect, err := shard.Preference(ring, 0, 0, shard.OpRead)
+		require.NoError(t, err)
+		actual, err := shard.Preference(s, 0, 0, shard.OpRead)
+		require.NoError(t, err)
+		require.Equal(t, expect, actual)
+
+		_, err = shard.Snapshot(s)
+		require.NoError(t, err)
+	})
+}
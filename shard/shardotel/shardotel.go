@@ -0,0 +1,69 @@
+// Package shardotel traces shard lookups with OpenTelemetry.
+//
+// shardotel is a separate package so importers of shard don't depend on
+// OpenTelemetry.
+package shardotel
+
+import (
+	"strconv"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the Tracer used by TraceLookups.
+const instrumentationName = "github.com/rfratto/ckit/shard/shardotel"
+
+// Attribute keys of lookup spans.
+const (
+	KeyAttribute       = attribute.Key("ckit.shard.key")
+	NumOwnersAttribute = attribute.Key("ckit.shard.num_owners")
+	OpAttribute        = attribute.Key("ckit.shard.op")
+	OwnersAttribute    = attribute.Key("ckit.shard.owners")
+)
+
+// TraceLookups returns a shard.Middleware which creates a span for every
+// lookup using a Tracer from tp. The global TracerProvider is used if tp is
+// nil.
+//
+// Lookups don't take a context, so spans are parented to the context passed
+// to the lookup with shard.WithContext. Spans of lookups without a context
+// are root spans.
+func TraceLookups(tp trace.TracerProvider) shard.Middleware {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(instrumentationName)
+
+	return shard.LookupMiddleware(func(next shard.LookupFunc) shard.LookupFunc {
+		return func(key shard.Key, numOwners int, op shard.Op, opts ...shard.LookupOption) ([]peer.Peer, error) {
+			_, span := tracer.Start(shard.LookupContext(opts...), "shard.Lookup",
+				trace.WithSpanKind(trace.SpanKindInternal),
+				trace.WithAttributes(
+					KeyAttribute.String(strconv.FormatUint(uint64(key), 10)),
+					NumOwnersAttribute.Int(numOwners),
+					OpAttribute.String(op.String()),
+				),
+			)
+			defer span.End()
+
+			res, err := next(key, numOwners, op, opts...)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return res, err
+			}
+
+			owners := make([]string, len(res))
+			for i, p := range res {
+				owners[i] = p.Name
+			}
+			span.SetAttributes(OwnersAttribute.StringSlice(owners))
+			return res, nil
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package shardotel_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/rfratto/ckit/shard/shardotel"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceLookups(t *testing.T) {
+	var (
+		rec = tracetest.NewSpanRecorder()
+		tp  = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	)
+
+	s := shard.Wrap(shard.Ring(16), shardotel.TraceLookups(tp))
+	s.SetPeers([]peer.Peer{{Name: "peer-a", State: peer.StateParticipant}})
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	owners, err := s.Lookup(shard.StringKey("key"), 1, shard.OpReadWrite, shard.WithContext(ctx))
+	require.NoError(t, err)
+	parent.End()
+
+	_, err = s.Lookup(shard.StringKey("key"), 2, shard.OpReadWrite)
+	require.Error(t, err)
+
+	spans := rec.Ended()
+	require.Len(t, spans, 3)
+
+	lookup := spans[0]
+	require.Equal(t, "shard.Lookup", lookup.Name())
+	require.Equal(t, parent.SpanContext().SpanID(), lookup.Parent().SpanID())
+	require.Contains(t, lookup.Attributes(), shardotel.OwnersAttribute.StringSlice([]string{owners[0].Name}))
+	require.Contains(t, lookup.Attributes(), shardotel.NumOwnersAttribute.Int(1))
+	require.Contains(t, lookup.Attributes(), shardotel.OpAttribute.String("ReadWrite"))
+
+	failed := spans[2]
+	require.False(t, failed.Parent().IsValid(), "lookups without a context should be root spans")
+	require.Equal(t, codes.Error, failed.Status().Code)
+	for _, kv := range failed.Attributes() {
+		require.NotEqual(t, attribute.Key(shardotel.OwnersAttribute), kv.Key)
+	}
+}
@@ -0,0 +1,90 @@
+package shard
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/rfratto/ckit/peer"
+)
+
+// ShuffleShard restricts a Sharder to a subset of size peers chosen for
+// tenantID, isolating tenants from problems with peers outside of their
+// subset. Lookups only return peers within the subset.
+//
+// The subset is chosen deterministically from the eligible peers for each Op
+// using rendezvous hashing of tenantID and the peer name, so every Sharder
+// with the same peers and seed (see WithSeed) chooses the same subset for a
+// tenant. The subset is stable as the cluster changes: a peer is only
+// replaced in the subset when it stops being eligible, and new peers only
+// join the subset if they are a better match for the tenant than an existing
+// member.
+//
+// If size is greater than the number of eligible peers, every eligible peer
+// is used. ShuffleShard is ignored if size is less than 1.
+func ShuffleShard(tenantID string, size int) Option {
+	return func(o *options) {
+		o.shuffleTenant = tenantID
+		o.shuffleSize = size
+	}
+}
+
+// shuffleShard returns the subset of nodes selected for the shuffle shard
+// tenant, along with their weights. The subset retains the order of nodes.
+func (o options) shuffleShard(nodes []string, weights []int) ([]string, []int) {
+	if len(nodes) <= o.shuffleSize {
+		return nodes, weights
+	}
+
+	type candidate struct {
+		index int
+		score uint64
+	}
+	candidates := make([]candidate, len(nodes))
+
+	var seed []byte
+	if o.seed != 0 {
+		seed = make([]byte, 8)
+		binary.BigEndian.PutUint64(seed, o.seed)
+	}
+
+	dig := xxhash.New()
+	for i, node := range nodes {
+		dig.Reset()
+		_, _ = dig.Write(seed)
+		_, _ = dig.WriteString(o.shuffleTenant)
+		_, _ = dig.Write([]byte{0})
+		_, _ = dig.WriteString(node)
+		candidates[i] = candidate{index: i, score: dig.Sum64()}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+
+	candidates = candidates[:o.shuffleSize]
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].index < candidates[j].index
+	})
+
+	var (
+		subsetNodes   = make([]string, len(candidates))
+		subsetWeights = make([]int, len(candidates))
+	)
+	for i, c := range candidates {
+		subsetNodes[i] = nodes[c.index]
+		subsetWeights[i] = weights[c.index]
+	}
+	return subsetNodes, subsetWeights
+}
+
+// keepPeers returns the peers in ps which are named in any of the lists of
+// names.
+func keepPeers(ps map[string]peer.Peer, names ...[]string) map[string]peer.Peer {
+	res := make(map[string]peer.Peer, len(ps))
+	for _, list := range names {
+		for _, name := range list {
+			res[name] = ps[name]
+		}
+	}
+	return res
+}
@@ -0,0 +1,180 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/rfratto/ckit/internal/chash"
+	"github.com/rfratto/ckit/peer"
+)
+
+// snapshotVersion is the current version of the encoding used by
+// Snapshotter.Snapshot. It must be incremented whenever a change is made which
+// older versions of ckit can't safely ignore.
+const snapshotVersion = 1
+
+// sharderSnapshot is the encoded form of a Sharder snapshot. Fields may be
+// added without changing snapshotVersion as long as they're optional.
+type sharderSnapshot struct {
+	Version   int               `json:"version"`
+	Options   snapshotOptions   `json:"options"`
+	Peers     []snapshotPeer    `json:"peers"`
+	Read      chash.Description `json:"read"`
+	ReadWrite chash.Description `json:"read_write"`
+}
+
+// snapshotOptions are the options of a Sharder which affect ownership.
+// Eligibility functions, placement constraints, and hash functions can't be
+// encoded and are excluded.
+type snapshotOptions struct {
+	Roles         []string `json:"roles,omitempty"`
+	ZoneAware     bool     `json:"zone_aware,omitempty"`
+	ShuffleTenant string   `json:"shuffle_tenant,omitempty"`
+	ShuffleSize   int      `json:"shuffle_size,omitempty"`
+	Seed          uint64   `json:"seed,omitempty"`
+}
+
+type snapshotPeer struct {
+	Name             string            `json:"name"`
+	Addr             string            `json:"addr,omitempty"`
+	State            peer.State        `json:"state"`
+	StateName        string            `json:"state_name,omitempty"` // Informational only.
+	Labels           map[string]string `json:"labels,omitempty"`
+	Weight           int               `json:"weight,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	Roles            []string          `json:"roles,omitempty"`
+	Version          string            `json:"version,omitempty"`
+}
+
+func (o options) snapshotOptions() snapshotOptions {
+	so := snapshotOptions{
+		ZoneAware:     o.zoneAware,
+		ShuffleTenant: o.shuffleTenant,
+		ShuffleSize:   o.shuffleSize,
+		Seed:          o.seed,
+	}
+	if len(o.roles) > 0 {
+		so.Roles = append([]string{}, o.roles...)
+		sort.Strings(so.Roles)
+	}
+	return so
+}
+
+// Snapshotter is implemented by Sharders which can describe their state as a
+// snapshot.
+type Snapshotter interface {
+	// Snapshot returns a deterministic, encoded description of the Sharder:
+	// its algorithm and parameters, its options, its peers, and the tokens
+	// used for hashing by each Op. Sharders with the same configuration and
+	// peers produce identical snapshots, so snapshots can be compared across
+	// nodes or used to analyze ownership offline. The snapshot is encoded as
+	// versioned JSON.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the peers of the Sharder with the peers from a
+	// snapshot returned by Snapshot, as if they were passed to SetPeers. The
+	// Self field of restored peers is always false. Restore returns an error
+	// if the snapshot is invalid, was encoded by a newer version of ckit, or
+	// was taken from a Sharder with a different algorithm, parameters, or
+	// options.
+	Restore(snapshot []byte) error
+}
+
+func findSnapshotter(s Sharder) (Snapshotter, bool) {
+	ss, ok := findSharder(s, func(s Sharder) bool {
+		_, ok := s.(Snapshotter)
+		return ok
+	}).(Snapshotter)
+	return ss, ok
+}
+
+// Snapshot calls Snapshotter.Snapshot on s or the Sharder it wraps.
+// ErrUnsupported is returned if s doesn't implement Snapshotter.
+func Snapshot(s Sharder) ([]byte, error) {
+	ss, ok := findSnapshotter(s)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return ss.Snapshot()
+}
+
+// Restore calls Snapshotter.Restore on s or the Sharder it wraps.
+// ErrUnsupported is returned if s doesn't implement Snapshotter.
+func Restore(s Sharder, snapshot []byte) error {
+	ss, ok := findSnapshotter(s)
+	if !ok {
+		return ErrUnsupported
+	}
+	return ss.Restore(snapshot)
+}
+
+func (ch *chasher) Snapshot() ([]byte, error) {
+	st := ch.loadState()
+
+	snapshot := sharderSnapshot{
+		Version:   snapshotVersion,
+		Options:   ch.opts.snapshotOptions(),
+		Peers:     make([]snapshotPeer, 0, len(st.peers)),
+		Read:      st.read.Describe(),
+		ReadWrite: st.readWrite.Describe(),
+	}
+	for _, p := range st.peers {
+		snapshot.Peers = append(snapshot.Peers, snapshotPeer{
+			Name:             p.Name,
+			Addr:             p.Addr,
+			State:            p.State,
+			StateName:        p.State.String(),
+			Labels:           p.Labels,
+			Weight:           p.Weight,
+			AvailabilityZone: p.AvailabilityZone,
+			Roles:            p.Roles,
+			Version:          p.Version,
+		})
+	}
+	sort.Slice(snapshot.Peers, func(i, j int) bool {
+		return snapshot.Peers[i].Name < snapshot.Peers[j].Name
+	})
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+func (ch *chasher) Restore(snapshot []byte) error {
+	var ss sharderSnapshot
+	if err := json.Unmarshal(snapshot, &ss); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if ss.Version < 1 || ss.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", ss.Version)
+	}
+
+	var (
+		read = ch.loadState().read.Describe()
+		opts = ch.opts.snapshotOptions()
+	)
+
+	if ss.Read.Algorithm != read.Algorithm || !reflect.DeepEqual(ss.Read.Params, read.Params) {
+		return fmt.Errorf("snapshot was taken from a %s sharder with params %v, not a %s sharder with params %v",
+			ss.Read.Algorithm, ss.Read.Params, read.Algorithm, read.Params)
+	}
+	if !reflect.DeepEqual(ss.Options, opts) {
+		return fmt.Errorf("snapshot was taken from a sharder with different options")
+	}
+
+	peers := make([]peer.Peer, len(ss.Peers))
+	for i, p := range ss.Peers {
+		peers[i] = peer.Peer{
+			Name:             p.Name,
+			Addr:             p.Addr,
+			State:            p.State,
+			Labels:           p.Labels,
+			Weight:           p.Weight,
+			AvailabilityZone: p.AvailabilityZone,
+			Roles:            p.Roles,
+			Version:          p.Version,
+		}
+	}
+	ch.SetPeers(peers)
+	return nil
+}
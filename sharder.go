@@ -0,0 +1,26 @@
+package ckit
+
+import (
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+)
+
+// SyncSharder keeps the peers of s in sync with the peers of n, such as for
+// Sharders other than Config.Sharder which use different options. Peers are
+// passed to s along with their gossiped state and weight, so sharders which
+// support weights transparently assign more keys to Nodes with a higher
+// Config.Weight.
+//
+// The peers of s are set before SyncSharder returns, and are updated from an
+// Observer of n afterwards. Calling the returned unsubscribe function stops
+// updating s.
+func SyncSharder(n *Node, s shard.Sharder) (unsubscribe func()) {
+	// Observe before setting the initial peers so changes in between aren't
+	// missed.
+	unsubscribe = n.Observe(FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		s.SetPeers(peers)
+		return true
+	}))
+	s.SetPeers(n.Peers())
+	return unsubscribe
+}
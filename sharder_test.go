@@ -0,0 +1,52 @@
+package ckit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ckit/internal/testlogger"
+	"github.com/rfratto/ckit/peer"
+	"github.com/rfratto/ckit/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncSharder(t *testing.T) {
+	var (
+		l = testlogger.New(t)
+
+		a, aAddr = newTestNode(t, l, "node-a")
+		b, _     = newTestNodeWithConfig(t, l, Config{Name: "node-b", Weight: 3})
+	)
+
+	ring := shard.Ring(16)
+	unsubscribe := SyncSharder(a, ring)
+	defer unsubscribe()
+	require.Empty(t, ring.Peers(), "viewers should not be eligible")
+
+	ctx := context.Background()
+	runTestNode(t, a, nil)
+	runTestNode(t, b, []string{aAddr})
+	require.NoError(t, a.ChangeState(ctx, peer.StateParticipant))
+	require.NoError(t, b.ChangeState(ctx, peer.StateParticipant))
+
+	require.Eventually(t, func() bool {
+		peers := ring.Peers()
+		return len(peers) == 2 && peers[1].Name == "node-b" && peers[1].Weight == 3
+	}, 5*time.Second, 50*time.Millisecond, "sharder should have both peers with gossiped weights")
+
+	// node-b has 3 times the weight of node-a, so it should own roughly 75%
+	// of the keyspace.
+	owned, err := shard.OwnedRanges(ring, "node-b", 1, shard.OpReadWrite)
+	require.NoError(t, err)
+	var fraction float64
+	for _, r := range owned {
+		fraction += float64(r.End-r.Start) / float64(^uint64(0))
+	}
+	require.InDelta(t, 0.75, fraction, 0.15)
+
+	unsubscribe()
+	require.NoError(t, b.ChangeState(ctx, peer.StateTerminating))
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, ring.Peers(), 2, "sharder should not be updated after unsubscribing")
+}
@@ -0,0 +1,87 @@
+//go:build go1.21
+
+package ckit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// NewSlogLogger returns a log.Logger which writes to l, for use as
+// Config.Log or clientpool.Options.Log in applications which log with
+// log/slog. Config.Log is also used for the logs of the gossip transport.
+// ckit supports versions of Go without log/slog, so its options accept a
+// log.Logger rather than a *slog.Logger.
+//
+// Log lines keep their structured fields as slog attributes, such as the
+// "peer", "state", and "time" (lamport time) fields of state messages. The
+// "msg" field is used as the message, and the level set by the go-kit level
+// package is converted to the equivalent slog level. Log lines without a
+// level are logged at slog.LevelInfo.
+func NewSlogLogger(l *slog.Logger) log.Logger {
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (sl *slogLogger) Log(keyvals ...interface{}) error {
+	var (
+		lvl   = slog.LevelInfo
+		msg   string
+		found bool
+		attrs = make([]slog.Attr, 0, len(keyvals)/2)
+	)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var (
+			key = fmt.Sprint(keyvals[i])
+			val interface{}
+		)
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		} else {
+			val = log.ErrMissingValue
+		}
+
+		if keyvals[i] == level.Key() {
+			if l, ok := slogLevel(val); ok {
+				lvl = l
+				continue
+			}
+		}
+		if key == "msg" && !found {
+			msg, found = fmt.Sprint(val), true
+			continue
+		}
+		attrs = append(attrs, slog.Any(key, val))
+	}
+
+	ctx := context.Background()
+	if !sl.l.Enabled(ctx, lvl) {
+		return nil
+	}
+	sl.l.LogAttrs(ctx, lvl, msg, attrs...)
+	return nil
+}
+
+// slogLevel converts a go-kit level to a slog level.
+func slogLevel(v interface{}) (slog.Level, bool) {
+	switch v {
+	case level.DebugValue():
+		return slog.LevelDebug, true
+	case level.InfoValue():
+		return slog.LevelInfo, true
+	case level.WarnValue():
+		return slog.LevelWarn, true
+	case level.ErrorValue():
+		return slog.LevelError, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,41 @@
+//go:build go1.21
+
+package ckit
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/internal/messages"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && a.Value.Kind() == slog.KindTime {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	l := log.With(NewSlogLogger(slog.New(h)), "node", "node-a")
+
+	level.Debug(l).Log("msg", "filtered")
+	level.Warn(l).Log("msg", "changing node state", "peer", "node-b", "state", "participant", "time", 5)
+	l.Log("msg", "no level", "odd")
+
+	msg := messages.State{NodeName: "node-c", NewState: peer.StateDraining, Time: 7}
+	level.Info(log.With(l, stateFields(msg)...)).Log("msg", "handling state message")
+
+	require.Equal(t, `level=WARN msg="changing node state" node=node-a peer=node-b state=participant time=5
+level=INFO msg="no level" node=node-a odd=(MISSING)
+level=INFO msg="handling state message" node=node-a peer=node-c state=draining time=7
+`, buf.String())
+}
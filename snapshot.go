@@ -0,0 +1,168 @@
+package ckit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/internal/lamport"
+	"github.com/rfratto/ckit/internal/messages"
+	"github.com/rfratto/ckit/peer"
+)
+
+// snapshotVersion is the current version of the encoding used by Snapshot.
+// It must be incremented whenever a change is made which older versions of
+// ckit can't safely ignore.
+const snapshotVersion = 1
+
+// clusterSnapshot is the encoded form of a Snapshot. Fields may be added
+// without changing snapshotVersion as long as they're optional.
+type clusterSnapshot struct {
+	Version int                   `json:"version"`
+	Node    string                `json:"node"` // Name of the node which took the snapshot.
+	Time    uint64                `json:"time"` // Lamport time of the node.
+	Peers   []clusterSnapshotPeer `json:"peers"`
+}
+
+type clusterSnapshotPeer struct {
+	Name             string            `json:"name"`
+	Addr             string            `json:"addr,omitempty"`
+	State            peer.State        `json:"state"`
+	StateName        string            `json:"state_name,omitempty"` // Informational only.
+	Labels           map[string]string `json:"labels,omitempty"`
+	Weight           int               `json:"weight,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	Roles            []string          `json:"roles,omitempty"`
+	Version          string            `json:"version,omitempty"`
+
+	// Time and Incarnation of the most recent state message for the peer.
+	// Time is 0 if no state message has been received.
+	Time        uint64 `json:"state_time,omitempty"`
+	Incarnation uint64 `json:"incarnation,omitempty"`
+
+	// Time the peer became a Participant, if it is one.
+	ParticipantSince uint64 `json:"participant_since,omitempty"`
+}
+
+// Snapshot returns an encoded snapshot of the cluster state known by n,
+// including every peer, its state, and the lamport times of state changes.
+// The snapshot is encoded as versioned JSON, and can be inspected for
+// debugging or passed to Restore to seed the state of another Node.
+func (n *Node) Snapshot() ([]byte, error) {
+	n.peerMut.RLock()
+	defer n.peerMut.RUnlock()
+
+	snapshot := clusterSnapshot{
+		Version: snapshotVersion,
+		Node:    n.cfg.Name,
+		Time:    uint64(n.clock.Now()),
+		Peers:   make([]clusterSnapshotPeer, 0, len(n.peerCache)),
+	}
+	for _, p := range n.peerCache {
+		sp := clusterSnapshotPeer{
+			Name:             p.Name,
+			Addr:             p.Addr,
+			State:            p.State,
+			StateName:        p.State.String(),
+			Labels:           p.Labels,
+			Weight:           p.Weight,
+			AvailabilityZone: p.AvailabilityZone,
+			Roles:            p.Roles,
+			Version:          p.Version,
+		}
+		if msg, ok := n.peerStates[p.Name]; ok {
+			sp.Time = uint64(msg.Time)
+			sp.Incarnation = msg.Incarnation
+			sp.ParticipantSince = uint64(msg.ParticipantSince)
+		}
+		snapshot.Peers = append(snapshot.Peers, sp)
+	}
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// Restore seeds n with a snapshot returned by Snapshot, possibly from a
+// different Node or an older version of ckit. Restore is intended to be
+// called before Start to speed up convergence after a cold start:
+//
+//   - The lamport clock of n is moved forward past the time of the snapshot.
+//   - Peer states from the snapshot are applied if they're newer than the
+//     states already known by n. The state of the local Node is never
+//     restored.
+//   - Peer addresses are used as a fallback if Start fails to join the
+//     provided peers, similar to peers persisted in Config.StateDir.
+//
+// Restored states are gossiped to peers once the Node has started, so stale
+// states will be corrected by the cluster. Restore returns an error if the
+// snapshot is invalid or was encoded by a newer, incompatible version of
+// ckit.
+func (n *Node) Restore(snapshot []byte) error {
+	var cs clusterSnapshot
+	if err := json.Unmarshal(snapshot, &cs); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if cs.Version < 1 || cs.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", cs.Version)
+	}
+
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	if n.stopped {
+		return ErrStopped
+	}
+
+	n.clock.Observe(lamport.Time(cs.Time))
+
+	n.restoredPeers = nil
+	for _, p := range cs.Peers {
+		if p.Name != n.cfg.Name && p.Addr != "" && p.Addr != n.cfg.AdvertiseAddr {
+			n.restoredPeers = append(n.restoredPeers, p.Addr)
+		}
+	}
+
+	n.peerMut.Lock()
+	defer n.peerMut.Unlock()
+
+	var (
+		restored     int
+		peersChanged bool
+	)
+	for _, p := range cs.Peers {
+		if p.Name == n.cfg.Name || p.Time == 0 {
+			continue
+		}
+		if !p.State.Valid() {
+			level.Warn(n.log).Log("msg", "ignoring restored peer with unknown state", "peer", p.Name, "state", p.State)
+			continue
+		}
+
+		msg := messages.State{
+			NodeName:         p.Name,
+			NewState:         p.State,
+			Labels:           p.Labels,
+			Weight:           p.Weight,
+			AvailabilityZone: p.AvailabilityZone,
+			Roles:            p.Roles,
+			Incarnation:      p.Incarnation,
+			Time:             lamport.Time(p.Time),
+			ParticipantSince: lamport.Time(p.ParticipantSince),
+		}
+		if curr, exist := n.peerStates[msg.NodeName]; exist && !msg.Newer(curr) {
+			continue
+		}
+		n.peerStates[msg.NodeName] = msg
+		restored++
+
+		if existing, ok := n.peers[msg.NodeName]; ok {
+			n.peers[msg.NodeName] = applyStateMessage(existing, msg)
+			peersChanged = true
+		}
+	}
+	if peersChanged {
+		n.handlePeersChanged()
+	}
+
+	level.Debug(n.log).Log("msg", "restored snapshot", "node", cs.Node, "peers", len(cs.Peers), "restored_states", restored)
+	return nil
+}
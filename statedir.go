@@ -0,0 +1,220 @@
+package ckit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/rfratto/ckit/internal/lamport"
+	"github.com/rfratto/ckit/peer"
+)
+
+const (
+	// clockFile is the name of the file within Config.StateDir used to persist
+	// the lamport clock.
+	clockFile = "clock"
+
+	// incarnationFile is the name of the file within Config.StateDir used to
+	// persist the incarnation of the node.
+	incarnationFile = "incarnation"
+
+	// peersFile is the name of the file within Config.StateDir used to persist
+	// the last known set of peers.
+	peersFile = "peers.json"
+)
+
+// loadClock restores the lamport clock from the state directory. It is a
+// no-op if there is no state directory or if the clock has not been persisted
+// yet.
+func (n *Node) loadClock() error {
+	if n.cfg.StateDir == "" {
+		return nil
+	}
+
+	bb, err := os.ReadFile(filepath.Join(n.cfg.StateDir, clockFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read persisted clock: %w", err)
+	}
+
+	t, err := strconv.ParseUint(strings.TrimSpace(string(bb)), 10, 64)
+	if err != nil {
+		// A corrupt clock file shouldn't prevent the node from starting; the
+		// clock will still be synchronized with peers on join.
+		level.Warn(n.log).Log("msg", "ignoring invalid persisted clock", "err", err)
+		return nil
+	}
+
+	n.clock.Observe(lamport.Time(t))
+	level.Debug(n.log).Log("msg", "restored persisted clock", "time", n.clock.Now())
+	return nil
+}
+
+// saveClock persists the current lamport clock to the state directory. It is
+// a no-op if there is no state directory. Failures are logged and counted.
+//
+// saveClock writes to disk, so it should not be called with stateMut held;
+// use requestClockSave instead.
+func (n *Node) saveClock() {
+	if n.cfg.StateDir == "" {
+		return
+	}
+
+	// Serialize saves so an older time never overwrites a newer one.
+	n.clockSaveMut.Lock()
+	defer n.clockSaveMut.Unlock()
+
+	now := strconv.FormatUint(uint64(n.clock.Now()), 10)
+	if err := writeFileAtomic(filepath.Join(n.cfg.StateDir, clockFile), []byte(now)); err != nil {
+		level.Warn(n.log).Log("msg", "failed to persist clock", "err", err)
+		n.m.clockSaveFailuresTotal.Inc()
+	}
+}
+
+// requestClockSave asks runClockSaver to persist the clock. Requests made
+// while a save is pending are coalesced. requestClockSave never blocks, so it
+// may be called with stateMut held.
+func (n *Node) requestClockSave() {
+	if n.cfg.StateDir == "" {
+		return
+	}
+	select {
+	case n.clockSaveCh <- struct{}{}:
+	default:
+	}
+}
+
+// runClockSaver persists the clock whenever requestClockSave is called, until
+// ctx is canceled.
+func (n *Node) runClockSaver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.clockSaveCh:
+			n.saveClock()
+		}
+	}
+}
+
+// nextIncarnation determines the incarnation for a new run of the node. The
+// incarnation is derived from the current time, but is guaranteed to be
+// greater than the persisted incarnation if there is a state directory,
+// protecting against the wall clock moving backwards between restarts.
+func (n *Node) nextIncarnation() (uint64, error) {
+	next := uint64(time.Now().UnixNano())
+	if n.cfg.StateDir == "" {
+		return next, nil
+	}
+
+	path := filepath.Join(n.cfg.StateDir, incarnationFile)
+
+	bb, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// No previous incarnation.
+	case err != nil:
+		return 0, fmt.Errorf("failed to read persisted incarnation: %w", err)
+	default:
+		prev, err := strconv.ParseUint(strings.TrimSpace(string(bb)), 10, 64)
+		if err != nil {
+			level.Warn(n.log).Log("msg", "ignoring invalid persisted incarnation", "err", err)
+		} else if prev >= next {
+			next = prev + 1
+		}
+	}
+
+	if err := writeFileAtomic(path, []byte(strconv.FormatUint(next, 10))); err != nil {
+		return 0, fmt.Errorf("failed to persist incarnation: %w", err)
+	}
+	return next, nil
+}
+
+// peersSnapshot is the persisted form of the last known set of peers.
+type peersSnapshot struct {
+	Peers []snapshotPeer `json:"peers"`
+}
+
+type snapshotPeer struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// savePeers persists the addresses of remote peers to the state directory.
+// It is a no-op if there is no state directory. Failures are logged.
+func (n *Node) savePeers(peers []peer.Peer) {
+	if n.cfg.StateDir == "" {
+		return
+	}
+
+	snapshot := peersSnapshot{Peers: make([]snapshotPeer, 0, len(peers))}
+	for _, p := range peers {
+		if p.Self {
+			continue
+		}
+		snapshot.Peers = append(snapshot.Peers, snapshotPeer{Name: p.Name, Addr: p.Addr})
+	}
+
+	// Keep the old snapshot around if we've lost all of our peers; it's more
+	// useful for a future join than an empty list.
+	if len(snapshot.Peers) == 0 {
+		return
+	}
+
+	bb, err := json.Marshal(snapshot)
+	if err != nil {
+		level.Warn(n.log).Log("msg", "failed to encode peers snapshot", "err", err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(n.cfg.StateDir, peersFile), bb); err != nil {
+		level.Warn(n.log).Log("msg", "failed to persist peers snapshot", "err", err)
+	}
+}
+
+// loadPeers returns the addresses of peers from the state directory. Returns
+// nil if there is no state directory or no persisted peers.
+func (n *Node) loadPeers() []string {
+	if n.cfg.StateDir == "" {
+		return nil
+	}
+
+	bb, err := os.ReadFile(filepath.Join(n.cfg.StateDir, peersFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		level.Warn(n.log).Log("msg", "failed to read peers snapshot", "err", err)
+		return nil
+	}
+
+	var snapshot peersSnapshot
+	if err := json.Unmarshal(bb, &snapshot); err != nil {
+		level.Warn(n.log).Log("msg", "ignoring invalid peers snapshot", "err", err)
+		return nil
+	}
+
+	addrs := make([]string, 0, len(snapshot.Peers))
+	for _, p := range snapshot.Peers {
+		if p.Name == n.cfg.Name || p.Addr == n.cfg.AdvertiseAddr {
+			continue
+		}
+		addrs = append(addrs, p.Addr)
+	}
+	return addrs
+}
+
+// writeFileAtomic writes data to a temporary file and then renames it to
+// path, ensuring that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
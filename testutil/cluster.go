@@ -0,0 +1,204 @@
+// Package testutil provides utilities for testing code which uses ckit.
+package testutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+)
+
+// defaultTransitions are the state transitions permitted by a ckit.Node
+// without Config.StateTransitions.
+var defaultTransitions = map[ckit.StateTransition]struct{}{
+	{From: peer.StateViewer, To: peer.StateParticipant}:      {},
+	{From: peer.StateParticipant, To: peer.StateTerminating}: {},
+	{From: peer.StateParticipant, To: peer.StateDraining}:    {},
+}
+
+// Cluster is a fake ckit.Cluster for use in unit tests. Cluster doesn't
+// communicate over the network; the set of remote peers is controlled by the
+// test with SetPeers.
+//
+// Unlike ckit.Node, Cluster notifies observers synchronously: observers have
+// been notified about a change by the time the method which made the change
+// returns. Observers must not call methods of Cluster which change the
+// cluster.
+type Cluster struct {
+	mut       sync.Mutex
+	self      peer.Peer
+	remote    []peer.Peer
+	observers []*observer
+	joined    []string
+	started   bool
+	stopped   bool
+}
+
+type observer struct{ ckit.Observer }
+
+var _ ckit.Cluster = (*Cluster)(nil)
+
+// NewCluster returns a new Cluster for a local node with the given name. The
+// local node starts in peer.StateViewer.
+func NewCluster(name string) *Cluster {
+	return &Cluster{
+		self: peer.Peer{
+			Name:  name,
+			Addr:  name,
+			Self:  true,
+			State: peer.StateViewer,
+		},
+	}
+}
+
+// Start implements ckit.Cluster. peers are recorded and can be retrieved
+// with JoinedPeers.
+func (c *Cluster) Start(peers []string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.stopped {
+		return ckit.ErrStopped
+	}
+	c.started = true
+	c.joined = append([]string(nil), peers...)
+	return nil
+}
+
+// Stop implements ckit.Cluster. The state of the local node isn't changed.
+// Calling Stop more than once is a no-op.
+func (c *Cluster) Stop() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.stopped = true
+	return nil
+}
+
+// ChangeState implements ckit.Cluster. Only the default state transitions
+// of ckit.Node are permitted. Options are ignored.
+func (c *Cluster) ChangeState(ctx context.Context, to peer.State, _ ...ckit.ChangeStateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mut.Lock()
+	if c.stopped {
+		c.mut.Unlock()
+		return ckit.ErrStopped
+	}
+	t := ckit.StateTransition{From: c.self.State, To: to}
+	if _, valid := defaultTransitions[t]; !valid {
+		c.mut.Unlock()
+		return ckit.StateTransitionError(t)
+	}
+	c.self.State = to
+	c.mut.Unlock()
+
+	c.notify()
+	return nil
+}
+
+// Peers implements ckit.Cluster. The returned peers include the local node.
+func (c *Cluster) Peers(opts ...ckit.PeersOption) []peer.Peer {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return ckit.FilterPeers(c.peersLocked(), opts...)
+}
+
+// peersLocked returns every peer sorted by name. Must be called with c.mut
+// held.
+func (c *Cluster) peersLocked() []peer.Peer {
+	peers := make([]peer.Peer, 0, len(c.remote)+1)
+	peers = append(peers, c.remote...)
+	peers = append(peers, c.self)
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers
+}
+
+// Observe implements ckit.Cluster.
+func (c *Cluster) Observe(o ckit.Observer) (unsubscribe func()) {
+	ro := &observer{Observer: o}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.observers = append(c.observers, ro)
+
+	return func() { c.removeObserver(ro) }
+}
+
+func (c *Cluster) removeObserver(ro *observer) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for i, other := range c.observers {
+		if other == ro {
+			c.observers = append(c.observers[:i:i], c.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetPeers replaces the set of remote peers and notifies observers. The
+// Self field of each peer is ignored, and peers with the same name as the
+// local node are dropped.
+func (c *Cluster) SetPeers(peers ...peer.Peer) {
+	c.mut.Lock()
+	c.remote = make([]peer.Peer, 0, len(peers))
+	for _, p := range peers {
+		if p.Name == c.self.Name {
+			continue
+		}
+		p.Self = false
+		c.remote = append(c.remote, p)
+	}
+	c.mut.Unlock()
+
+	c.notify()
+}
+
+// CurrentState returns the state of the local node.
+func (c *Cluster) CurrentState() peer.State {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.self.State
+}
+
+// JoinedPeers returns the peers passed to the most recent call to Start.
+func (c *Cluster) JoinedPeers() []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return append([]string(nil), c.joined...)
+}
+
+// Started returns true if Start has been called.
+func (c *Cluster) Started() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.started
+}
+
+// Stopped returns true if Stop has been called.
+func (c *Cluster) Stopped() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.stopped
+}
+
+// notify invokes every observer with the current set of peers. Observers
+// which return false are removed.
+func (c *Cluster) notify() {
+	c.mut.Lock()
+	var (
+		peers     = c.peersLocked()
+		observers = append([]*observer(nil), c.observers...)
+	)
+	c.mut.Unlock()
+
+	for _, o := range observers {
+		if rereg := o.NotifyPeersChanged(peers); !rereg {
+			c.removeObserver(o)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package testutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rfratto/ckit"
+	"github.com/rfratto/ckit/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster(t *testing.T) {
+	c := NewCluster("node-a")
+	require.NoError(t, c.Start([]string{"node-b:80"}))
+	require.True(t, c.Started())
+	require.Equal(t, []string{"node-b:80"}, c.JoinedPeers())
+
+	var notified [][]peer.Peer
+	unsubscribe := c.Observe(ckit.FuncObserver(func(peers []peer.Peer) (reregister bool) {
+		notified = append(notified, peers)
+		return true
+	}))
+
+	c.SetPeers(
+		peer.Peer{Name: "node-c", State: peer.StateParticipant},
+		peer.Peer{Name: "node-b", State: peer.StateViewer},
+	)
+	require.NoError(t, c.ChangeState(context.Background(), peer.StateParticipant))
+
+	expect := []peer.Peer{
+		{Name: "node-a", Addr: "node-a", Self: true, State: peer.StateParticipant},
+		{Name: "node-b", State: peer.StateViewer},
+		{Name: "node-c", State: peer.StateParticipant},
+	}
+	require.Equal(t, expect, c.Peers())
+	require.Len(t, notified, 2)
+	require.Equal(t, expect, notified[1])
+
+	participants := c.Peers(ckit.WithStates(peer.StateParticipant))
+	require.Equal(t, []peer.Peer{expect[0], expect[2]}, participants)
+
+	err := c.ChangeState(context.Background(), peer.StateViewer)
+	require.Equal(t, ckit.StateTransitionError{From: peer.StateParticipant, To: peer.StateViewer}, err)
+
+	unsubscribe()
+	c.SetPeers()
+	require.Len(t, notified, 2, "observer should not be notified after unsubscribing")
+
+	require.NoError(t, c.Stop())
+	require.ErrorIs(t, c.ChangeState(context.Background(), peer.StateTerminating), ckit.ErrStopped)
+}
@@ -0,0 +1,204 @@
+package ckit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/memberlist"
+)
+
+// ConfigUpdate holds changes to apply to a running Node with UpdateConfig.
+// Fields left as their zero value are not changed.
+type ConfigUpdate struct {
+	// Log replaces the logger used by the Node and its transport. Replacing
+	// the logger with one that applies a different level filter can be used
+	// to change the log level of a running Node.
+	Log log.Logger
+
+	// JoinPeers replaces the set of peers passed to the most recent call to
+	// Start. Join peers are used when rejoining the cluster after losing
+	// contact with every peer (see Config.RejoinMinBackoff) and when
+	// refreshing join peers (see Config.JoinPeersRefreshInterval).
+	//
+	// If the Node has been started, any address in JoinPeers which isn't
+	// already a peer is joined immediately. Calling Start again replaces
+	// JoinPeers.
+	JoinPeers []string
+
+	// AdvertiseAddr changes the address the Node advertises to peers, for
+	// environments where the routable address of the Node changes after it
+	// is started. The Node must already be reachable at the new address.
+	//
+	// Changing the address of a started Node briefly leaves the cluster: the
+	// Node gracefully leaves, then rejoins its known peers at the new address
+	// with a new incarnation. Peers converge on the new address without the
+	// Node being restarted.
+	AdvertiseAddr string
+}
+
+// UpdateConfig applies update to a running Node without restarting it.
+//
+// Only the fields in ConfigUpdate may be changed at runtime. Other settings,
+// such as gossip intervals, are fixed when the Node is created.
+//
+// ctx is used for resolving and joining new join peers and for leaving the
+// cluster when changing the advertise address. An error is returned if new
+// join peers could not be joined, though the rest of update is still
+// applied. If the advertise address can't be changed, the Node keeps its
+// previous address unless it was already removed from the cluster.
+func (n *Node) UpdateConfig(ctx context.Context, update ConfigUpdate) error {
+	// stateMut is only held while n is being modified so that reads and state
+	// changes aren't blocked on network I/O. updateMut prevents the
+	// memberlist from being replaced or shut down concurrently instead.
+	n.updateMut.Lock()
+	defer n.updateMut.Unlock()
+
+	n.stateMut.Lock()
+	if n.stopped {
+		n.stateMut.Unlock()
+		return ErrStopped
+	}
+
+	if update.Log != nil {
+		n.log.Swap(update.Log)
+	}
+
+	var rejoin bool
+	if update.JoinPeers != nil {
+		level.Debug(n.log).Log("msg", "updating join peers", "peers", len(update.JoinPeers))
+		n.joinPeers = append([]string(nil), update.JoinPeers...)
+		rejoin = n.runCancel != nil // Only join if Start has been called
+	}
+
+	changeAddr := update.AdvertiseAddr != "" && update.AdvertiseAddr != n.cfg.AdvertiseAddr
+	n.stateMut.Unlock()
+
+	if changeAddr {
+		if err := n.changeAdvertiseAddr(ctx, update.AdvertiseAddr); err != nil {
+			return fmt.Errorf("failed to change advertise address: %w", err)
+		}
+	}
+
+	if rejoin {
+		if err := n.refreshJoinPeers(ctx); err != nil {
+			return fmt.Errorf("failed to join new join peers: %w", err)
+		}
+	}
+	return nil
+}
+
+// changeAdvertiseAddr replaces the memberlist of n with one advertising addr.
+// If n has been started, n leaves the cluster and rejoins its known peers
+// with a new incarnation. Must be called with n.updateMut held and
+// n.stateMut not held; stateMut is only locked while n is modified.
+func (n *Node) changeAdvertiseAddr(ctx context.Context, addr string) error {
+	advertiseIP, advertisePort, err := resolveAdvertiseAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	n.stateMut.RLock()
+	var (
+		started = n.runCancel != nil
+		oldAddr = n.cfg.AdvertiseAddr
+		oldML   = n.memberlist()
+	)
+
+	// Gather the peers to rejoin before leaving, since leaving will cause the
+	// peers to be removed.
+	var rejoinAddrs []string
+	if started {
+		for _, p := range n.Peers() {
+			if !p.Self {
+				rejoinAddrs = append(rejoinAddrs, p.Addr)
+			}
+		}
+		rejoinAddrs = append(rejoinAddrs, n.joinPeers...)
+	}
+	n.stateMut.RUnlock()
+
+	if started {
+		level.Info(n.log).Log("msg", "leaving cluster to change advertise address", "old", oldAddr, "new", addr)
+		if err := oldML.Leave(leaveTimeout(ctx)); err != nil {
+			level.Warn(n.log).Log("msg", "failed to broadcast leave message to cluster", "err", err)
+		}
+	}
+
+	newML, err := n.replaceMemberlist(addr, advertiseIP, advertisePort)
+	if err != nil || !started {
+		return err
+	}
+
+	if _, err := newML.Join(rejoinAddrs); err != nil {
+		return fmt.Errorf("failed to rejoin cluster: %w", err)
+	}
+
+	// updateMut prevents n from being stopped while rejoining.
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+	n.pruneMembers()
+
+	// Re-announce our state with the new incarnation.
+	_, err = n.changeState(n.localState, false, nil)
+	return err
+}
+
+// replaceMemberlist shuts down the memberlist of n and replaces it with a new
+// one advertising addr and a new incarnation. If the new memberlist can't be
+// created, n is stopped, since the old memberlist can't be reused after being
+// shut down.
+func (n *Node) replaceMemberlist(addr, advertiseIP string, advertisePort int) (*memberlist.Memberlist, error) {
+	n.stateMut.Lock()
+	defer n.stateMut.Unlock()
+
+	incarnation, err := n.nextIncarnation()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.memberlist().Shutdown(); err != nil {
+		return nil, err
+	}
+
+	newML, err := n.createMemberlist(advertiseIP, advertisePort)
+	if err != nil {
+		n.abortLocked()
+		return nil, err
+	}
+
+	n.mlMut.Lock()
+	n.ml = newML
+	n.mlMut.Unlock()
+
+	n.cfg.AdvertiseAddr = addr
+
+	n.peerMut.Lock()
+	n.incarnation = incarnation
+	n.peerMut.Unlock()
+
+	return newML, nil
+}
+
+// pruneMembers removes peers which aren't known by the memberlist of n, such
+// as peers which left while the memberlist was being replaced.
+func (n *Node) pruneMembers() {
+	members := make(map[string]struct{})
+	for _, m := range n.memberlist().Members() {
+		members[m.Name] = struct{}{}
+	}
+
+	n.peerMut.Lock()
+	defer n.peerMut.Unlock()
+
+	var changed bool
+	for name := range n.peers {
+		if _, ok := members[name]; !ok {
+			delete(n.peers, name)
+			changed = true
+		}
+	}
+	if changed {
+		n.handlePeersChanged()
+	}
+}
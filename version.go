@@ -0,0 +1,53 @@
+package ckit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxVersionSize is the maximum length of Config.Version.
+const maxVersionSize = 128
+
+// A VersionPolicy determines whether a peer running the remote version is
+// compatible with the local node running the local version. Returning an
+// error rejects the peer. Versions are empty for nodes which have not set
+// Config.Version.
+type VersionPolicy func(local, remote string) error
+
+// SameMajorVersion is a VersionPolicy which rejects peers whose major version
+// differs from the local node. Versions are expected to be in the form
+// MAJOR[.MINOR[.PATCH]], optionally prefixed with "v". Peers are rejected if
+// either version can't be parsed.
+func SameMajorVersion(local, remote string) error {
+	localMajor, err := majorVersion(local)
+	if err != nil {
+		return fmt.Errorf("invalid local version: %w", err)
+	}
+	remoteMajor, err := majorVersion(remote)
+	if err != nil {
+		return fmt.Errorf("invalid remote version: %w", err)
+	}
+
+	if localMajor != remoteMajor {
+		return fmt.Errorf("incompatible major version: local is %s, remote is %s", local, remote)
+	}
+	return nil
+}
+
+// majorVersion returns the major version component of version.
+func majorVersion(version string) (string, error) {
+	major := strings.TrimPrefix(version, "v")
+	if idx := strings.IndexByte(major, '.'); idx >= 0 {
+		major = major[:idx]
+	}
+
+	if major == "" {
+		return "", fmt.Errorf("missing major version in %q", version)
+	}
+	for _, r := range major {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("invalid major version in %q", version)
+		}
+	}
+	return major, nil
+}
@@ -0,0 +1,30 @@
+package ckit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSameMajorVersion(t *testing.T) {
+	tt := []struct {
+		local, remote string
+		expectError   string
+	}{
+		{local: "1.2.3", remote: "1.5.0"},
+		{local: "v1.2.3", remote: "1"},
+		{local: "v2.0.0", remote: "v2.0.0-rc.1"},
+		{local: "1.2.3", remote: "2.0.0", expectError: "incompatible major version: local is 1.2.3, remote is 2.0.0"},
+		{local: "1.2.3", remote: "", expectError: `invalid remote version: missing major version in ""`},
+		{local: "main", remote: "1.0.0", expectError: `invalid local version: invalid major version in "main"`},
+	}
+
+	for _, tc := range tt {
+		err := SameMajorVersion(tc.local, tc.remote)
+		if tc.expectError == "" {
+			require.NoError(t, err, "local=%q remote=%q", tc.local, tc.remote)
+		} else {
+			require.EqualError(t, err, tc.expectError, "local=%q remote=%q", tc.local, tc.remote)
+		}
+	}
+}